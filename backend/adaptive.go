@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Adaptive cooldown
+//
+// For event-style launches the cooldown can follow how busy the canvas is.
+// With ADAPTIVE_COOLDOWN_TARGET set, the user rate limiter counts the
+// placements it allows and computes the cooldown from the rate over the last
+// minute:
+//
+//	cooldown = PIXEL_COOLDOWN * rate / target
+//
+// bounded to ADAPTIVE_COOLDOWN_MIN..ADAPTIVE_COOLDOWN_MAX. At the target rate
+// users get the normal cooldown; twice as busy doubles it, and on a quiet
+// canvas it shrinks down to the minimum.
+//
+// The rate is kept in one bucket per second, like PlacementActivity, and the
+// current second isn't included yet. Everything is read through timeNow, so
+// the cooldown at a given time depends only on the placements before it.
+//
+// A user who is already waiting is checked against the current cooldown, not
+// the one at the time of their last pixel, so their wait grows or shrinks
+// along with the activity.
+
+// adaptiveWindow is how many seconds the placement rate is averaged over
+const adaptiveWindow = 60
+
+// AdaptiveCooldown configures the adaptive mode of a RateLimiter
+type AdaptiveCooldown struct {
+	Target float64       // Placements per second at which the base cooldown applies
+	Min    time.Duration // Shortest cooldown, however quiet the canvas is
+	Max    time.Duration // Longest cooldown, however busy the canvas is
+}
+
+// Validate checks that the settings make sense together
+func (a AdaptiveCooldown) Validate() error {
+	if a.Target <= 0 {
+		return fmt.Errorf("adaptive cooldown target must be positive, got %g", a.Target)
+	}
+	if a.Min < 0 || a.Max < a.Min {
+		return fmt.Errorf("adaptive cooldown bounds must satisfy 0 <= min <= max, got %s and %s", a.Min, a.Max)
+	}
+	return nil
+}
+
+// scale returns the cooldown for the given placement rate
+func (a AdaptiveCooldown) scale(base time.Duration, rate float64) time.Duration {
+	cooldown := time.Duration(float64(base) * rate / a.Target)
+	return min(max(cooldown, a.Min), a.Max)
+}
+
+// placementRate counts placements per second over adaptiveWindow
+type placementRate struct {
+	counts  [adaptiveWindow]int64 // Placements per second
+	seconds [adaptiveWindow]int64 // Unix second each bucket currently counts
+}
+
+// record counts one placement at now
+func (p *placementRate) record(now time.Time) {
+	second := now.Unix()
+	i := second % adaptiveWindow
+	if p.seconds[i] != second {
+		p.seconds[i] = second
+		p.counts[i] = 0
+	}
+	p.counts[i]++
+}
+
+// perSecond returns the placements per second over the complete seconds of
+// the window before now
+func (p *placementRate) perSecond(now time.Time) float64 {
+	current := now.Unix()
+	var total int64
+	for i, second := range p.seconds {
+		if second < current && second >= current-adaptiveWindow {
+			total += p.counts[i]
+		}
+	}
+	return float64(total) / adaptiveWindow
+}
+
+// adaptiveFromEnv reads the adaptive cooldown settings
+// Returns nil when ADAPTIVE_COOLDOWN_TARGET is not set.
+func adaptiveFromEnv(base time.Duration) (*AdaptiveCooldown, error) {
+	target := envFloat("ADAPTIVE_COOLDOWN_TARGET", 0)
+	if target == 0 {
+		return nil, nil
+	}
+
+	adaptive := &AdaptiveCooldown{
+		Target: target,
+		Min:    envDuration("ADAPTIVE_COOLDOWN_MIN", time.Second),
+		Max:    envDuration("ADAPTIVE_COOLDOWN_MAX", 12*base),
+	}
+	if err := adaptive.Validate(); err != nil {
+		return nil, err
+	}
+	return adaptive, nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// adminUserID is recorded as the owner of pixels written by admins
+const adminUserID = "admin"
+
+// requireAdmin wraps a handler so it only runs for requests that carry
+// the configured admin token as "Authorization: Bearer <token>"
+func (s *Server) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+		// Compare in constant time so the token can't be guessed byte by byte
+		if s.adminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(s.adminToken)) != 1 {
+			slog.WarnContext(r.Context(), "Rejected admin request", "path", r.URL.Path, "ip", s.clientIP(r))
+			writeError(w, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// handleClearCanvas removes every pixel from the canvas and tells all
+// WebSocket clients to reset theirs
+func (s *Server) handleClearCanvas(w http.ResponseWriter, r *http.Request) {
+	// Save the pixels still waiting in the writer first, so the clear
+	// removes them too instead of them reappearing afterwards
+	s.writer.Flush()
+
+	// Pixels numbered after seq count as placed after the clear, and are
+	// still broadcast after it
+	seq := s.db.LastSeq()
+	if err := s.persist(s.db.ClearCanvas); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to clear canvas", "err", err)
+		writeError(w, http.StatusInternalServerError, codeInternal, "Failed to clear canvas")
+		return
+	}
+
+	s.canvasCache.Clear()
+	s.hub.Clear(seq)
+	s.webhooks.CanvasCleared()
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Canvas cleared"))
+
+	slog.InfoContext(r.Context(), "Canvas cleared by admin", "ip", s.clientIP(r))
+}
+
+// handleOverlayPlace writes a single pixel to the overlay layer,
+// hiding the base pixel underneath it
+func (s *Server) handleOverlayPlace(w http.ResponseWriter, r *http.Request) {
+	var pixel PixelUpdate
+	if err := json.NewDecoder(r.Body).Decode(&pixel); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidBody, "Invalid JSON")
+		return
+	}
+
+	// Overlay pixels belong to the admin unless a specific owner is given
+	if pixel.UserID == "" {
+		pixel.UserID = adminUserID
+	}
+
+	if err := validatePixel(&pixel, s.config.Get(), s.canvas); err != nil {
+		writeError(w, http.StatusBadRequest, codeValidation, err.Error())
+		return
+	}
+
+	pixel.Timestamp = currentTimeMillis()
+	pixel.Seq = s.db.NextSeq()
+
+	// A transparent overlay pixel removes the overlay pixel instead
+	save := func() error { return s.db.SavePixelToLayer(pixel, LayerOverlay) }
+	if isTransparent(pixel.Color) {
+		save = func() error { return s.db.DeletePixelFromLayer(pixel.X, pixel.Y, LayerOverlay) }
+	}
+	if err := s.persist(save); err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "Failed to save overlay pixel")
+		return
+	}
+	if isTransparent(pixel.Color) {
+		s.canvasCache.Remove(pixel.X, pixel.Y, LayerOverlay)
+	} else {
+		s.canvasCache.Apply(HistoryEntry{X: pixel.X, Y: pixel.Y, Layer: LayerOverlay, Color: pixel.Color, UserID: pixel.UserID, PlacedAt: pixel.Timestamp, Seq: pixel.Seq})
+	}
+
+	// The overlay pixel is now the visible one, so broadcast it like any placement
+	s.broadcastVisiblePixel(pixel.X, pixel.Y)
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Overlay pixel placed"))
+
+	slog.InfoContext(r.Context(), "Overlay pixel placed", "x", pixel.X, "y", pixel.Y, "color", pixel.Color)
+}
+
+// handleOverlayRemove deletes the overlay pixel at /api/admin/overlay/{x}/{y},
+// revealing the base pixel again
+func (s *Server) handleOverlayRemove(w http.ResponseWriter, r *http.Request) {
+	x, errX := strconv.Atoi(r.PathValue("x"))
+	y, errY := strconv.Atoi(r.PathValue("y"))
+	if errX != nil || errY != nil {
+		writeError(w, http.StatusBadRequest, codeValidation, "x and y must be integers")
+		return
+	}
+
+	if err := s.persist(func() error { return s.db.DeletePixelFromLayer(x, y, LayerOverlay) }); err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "Failed to remove overlay pixel")
+		return
+	}
+	s.canvasCache.Remove(x, y, LayerOverlay)
+
+	// Whatever is underneath is visible again, so tell consumers about it
+	s.broadcastVisiblePixel(x, y)
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Overlay pixel removed"))
+
+	slog.InfoContext(r.Context(), "Overlay pixel removed", "x", x, "y", y)
+}
+
+// broadcastVisiblePixel enqueues the composited pixel at (x, y) so consumers
+// see the result of an overlay change. An empty coordinate is sent in the
+// canvas background color.
+// The cache has base pixels the background writer hasn't saved yet; without
+// it the writer is flushed first, so removing an overlay reveals a pixel
+// placed under it a moment ago rather than what the database had before.
+func (s *Server) broadcastVisiblePixel(x, y int) {
+	var pixel PixelUpdate
+	var ok bool
+	if s.canvasCache != nil {
+		pixel, ok = s.canvasCache.Pixel(x, y)
+	} else {
+		s.writer.Flush()
+		stored, found, err := s.db.GetPixel(x, y)
+		if err != nil {
+			slog.Error("Failed to read pixel for broadcast", "x", x, "y", y, "err", err)
+			return
+		}
+		if found {
+			pixel, ok = *stored, true
+		}
+	}
+	if !ok {
+		pixel = PixelUpdate{X: x, Y: y, Color: s.canvas.Background, Timestamp: currentTimeMillis()}
+	}
+
+	if err := s.queue.Enqueue(pixel); err != nil {
+		slog.Error("Failed to enqueue overlay change", "err", err)
+	}
+}
+
+// coveredByOverlay returns true if an overlay pixel hides (x, y)
+// A base-layer placement there changes nothing anyone can see, so it is
+// saved but not broadcast; broadcastVisiblePixel reveals it once the overlay
+// pixel is removed. If the database can't tell, the pixel is broadcast as
+// before.
+func (s *Server) coveredByOverlay(x, y int) bool {
+	if s.canvasCache != nil {
+		_, covered := s.canvasCache.LayerPixel(x, y, LayerOverlay)
+		return covered
+	}
+
+	covered, err := s.db.HasLayerPixel(x, y, LayerOverlay)
+	if err != nil {
+		slog.Error("Failed to look up the overlay", "x", x, "y", y, "err", err)
+		return false
+	}
+	return covered
+}
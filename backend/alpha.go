@@ -0,0 +1,174 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"image/color"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Transparent colors
+//
+// With ALPHA_COLORS=true, pixel colors may also be #RRGGBBAA, where AA is the
+// opacity (00 fully transparent, FF opaque). Colors are normalized when
+// validated, so each color has one spelling:
+//
+//	#RRGGBBFF  is stored as #RRGGBB (opaque is the same as no alpha)
+//	#RRGGBB00  is an eraser, sent as #00000000
+//	other AA   are stored as they are and drawn blended over the background
+//
+// An eraser doesn't store a transparent pixel. It removes the pixel at its
+// coordinate from canvas_state, like clearing it, so the background (or the
+// overlay pixel above) shows through. The removal is recorded in the history
+// as a tombstone and doesn't count for the leaderboard. Consumers receive the
+// eraser as a pixel with the color #00000000 and should drop the pixel there.
+//
+// Without ALPHA_COLORS only #RRGGBB is accepted, exactly as before.
+
+// transparentColor is the normalized color of an eraser
+const transparentColor = "#00000000"
+
+// alphaColorRegex matches #RRGGBB and #RRGGBBAA colors
+var alphaColorRegex = regexp.MustCompile(`^#[0-9A-Fa-f]{6}([0-9A-Fa-f]{2})?$`)
+
+// validColor returns true if color is #RRGGBB, or #RRGGBBAA when alpha is allowed
+func validColor(color string, allowAlpha bool) bool {
+	if allowAlpha {
+		return alphaColorRegex.MatchString(color)
+	}
+	return hexColorRegex.MatchString(color)
+}
+
+// normalizeColor gives a valid color its single spelling (see above)
+// #RRGGBB colors are returned unchanged.
+func normalizeColor(color string) string {
+	if len(color) != 9 {
+		return color
+	}
+	switch strings.ToUpper(color[7:]) {
+	case "FF":
+		return color[:7]
+	case "00":
+		return transparentColor
+	}
+	return color
+}
+
+// isTransparent returns true if the (normalized) color erases the pixel
+func isTransparent(color string) bool {
+	return color == transparentColor
+}
+
+// opaquePart returns the #RRGGBB part of a color, which the palette is checked against
+func opaquePart(color string) string {
+	if len(color) > 7 {
+		return color[:7]
+	}
+	return color
+}
+
+// parseHexNRGBA converts "#RRGGBB" or "#RRGGBBAA" into a color with
+// straight (not premultiplied) alpha; without AA the color is opaque
+func parseHexNRGBA(hex string) (color.NRGBA, error) {
+	if (len(hex) != 7 && len(hex) != 9) || hex[0] != '#' {
+		return color.NRGBA{}, fmt.Errorf("invalid color %q", hex)
+	}
+
+	value, err := strconv.ParseUint(hex[1:], 16, 32)
+	if err != nil {
+		return color.NRGBA{}, fmt.Errorf("invalid color %q", hex)
+	}
+	if len(hex) == 7 {
+		value = value<<8 | 0xFF
+	}
+
+	return color.NRGBA{
+		R: uint8(value >> 24),
+		G: uint8(value >> 16),
+		B: uint8(value >> 8),
+		A: uint8(value),
+	}, nil
+}
+
+// blendOver draws src over dst ("source over" compositing)
+// Both colors have premultiplied alpha, as image.RGBA stores them.
+func blendOver(dst, src color.RGBA) color.RGBA {
+	if src.A == 255 {
+		return src
+	}
+	keep := 255 - uint32(src.A)
+	return color.RGBA{
+		R: src.R + uint8((uint32(dst.R)*keep+127)/255),
+		G: src.G + uint8((uint32(dst.G)*keep+127)/255),
+		B: src.B + uint8((uint32(dst.B)*keep+127)/255),
+		A: src.A + uint8((uint32(dst.A)*keep+127)/255),
+	}
+}
+
+// erasePixelSQL removes a base-layer pixel unless something newer was
+// placed after the eraser
+const erasePixelSQL = `
+DELETE FROM canvas_state
+WHERE x = ? AND y = ? AND layer = ? AND seq <= ?
+`
+
+// erasePixelIfColor is SavePixelIfColor for an eraser: the pixel is removed
+// only if it has the expected color
+// With emptyMatches an empty coordinate matches as well, and stays empty.
+func (d *Database) erasePixelIfColor(pixel PixelUpdate, expected string, emptyMatches bool) (current string, applied bool, err error) {
+	d.maintenance.RLock()
+	defer d.maintenance.RUnlock()
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return "", false, err
+	}
+	defer tx.Rollback()
+
+	timestamp := pixel.Timestamp
+	if timestamp == 0 {
+		timestamp = time.Now().UnixNano() / int64(1000000)
+	}
+	seq := d.assignSeq(pixel.Seq)
+
+	result, err := tx.Exec(d.rebind(`
+	DELETE FROM canvas_state
+	WHERE x = ? AND y = ? AND layer = ? AND UPPER(color) = UPPER(?)
+	`), pixel.X, pixel.Y, LayerBase, expected)
+	if err != nil {
+		return "", false, err
+	}
+	changed, err := result.RowsAffected()
+	if err != nil {
+		return "", false, err
+	}
+
+	if changed == 0 {
+		err := tx.QueryRow(d.rebind(`
+		SELECT color FROM canvas_state WHERE x = ? AND y = ? AND layer = ?
+		`), pixel.X, pixel.Y, LayerBase).Scan(&current)
+		if err == sql.ErrNoRows {
+			if !emptyMatches {
+				return "", false, nil
+			}
+		} else {
+			return current, false, err
+		}
+	}
+
+	// The eraser is recorded as a tombstone, like any removal
+	_, err = tx.Exec(d.rebind(insertHistorySQL), pixel.X, pixel.Y, LayerBase, "", pixel.UserID, timestamp, seq)
+	if err != nil {
+		return "", false, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", false, err
+	}
+
+	d.version.Add(1)
+	return "", true, nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import "fmt"
+
+// AreaGuard rejects placements that would grow one user's contiguous block
+// of pixels beyond a maximum size, to stop a single user flood-filling the canvas
+// Two pixels are contiguous when they share an edge and have the same owner
+type AreaGuard struct {
+	db      *Database
+	canvas  CanvasConfig
+	maxArea int // Largest contiguous block a user may own (0 disables the guard)
+	radius  int // How far from the placement the search looks, bounding its cost
+}
+
+// NewAreaGuard creates a guard; maxArea <= 0 disables it
+func NewAreaGuard(db *Database, canvas CanvasConfig, maxArea, radius int) *AreaGuard {
+	if radius < 1 {
+		radius = 1
+	}
+	return &AreaGuard{db: db, canvas: canvas, maxArea: maxArea, radius: radius}
+}
+
+// Enabled reports whether the guard checks placements at all
+func (g *AreaGuard) Enabled() bool {
+	return g != nil && g.maxArea > 0
+}
+
+// Check returns an error if placing a pixel at (x, y) for userID would create a
+// contiguous block larger than maxArea
+// Only pixels within 'radius' of (x, y) are considered, so a block that extends
+// further is estimated from the part inside the search window
+func (g *AreaGuard) Check(userID string, x, y int) error {
+	if !g.Enabled() {
+		return nil
+	}
+
+	// Load the user's visible pixels around the target in one query
+	x0, y0 := max(x-g.radius, 0), max(y-g.radius, 0)
+	x1, y1 := min(x+g.radius, g.canvas.Width-1), min(y+g.radius, g.canvas.Height-1)
+	owned, err := g.db.UserPixelsInRegion(userID, x0, y0, x1, y1)
+	if err != nil {
+		return err
+	}
+
+	// The new pixel belongs to the user too
+	owned[[2]int{x, y}] = true
+
+	if size := blockSize(owned, x, y, g.maxArea+1); size > g.maxArea {
+		return &AreaLimitError{limit: g.maxArea}
+	}
+	return nil
+}
+
+// blockSize counts the pixels in the contiguous block containing (x, y)
+// using a breadth-first flood fill over 'owned'. Counting stops at 'limit'
+// because the caller only needs to know whether the block is too big.
+func blockSize(owned map[[2]int]bool, x, y, limit int) int {
+	start := [2]int{x, y}
+	seen := map[[2]int]bool{start: true}
+	queue := [][2]int{start}
+
+	for len(queue) > 0 && len(seen) < limit {
+		p := queue[0]
+		queue = queue[1:]
+
+		neighbors := [4][2]int{
+			{p[0] + 1, p[1]}, {p[0] - 1, p[1]},
+			{p[0], p[1] + 1}, {p[0], p[1] - 1},
+		}
+		for _, n := range neighbors {
+			if owned[n] && !seen[n] {
+				seen[n] = true
+				queue = append(queue, n)
+			}
+		}
+	}
+
+	return len(seen)
+}
+
+// AreaLimitError is returned when a placement would exceed the contiguous-area limit
+type AreaLimitError struct {
+	limit int
+}
+
+func (e *AreaLimitError) Error() string {
+	return fmt.Sprintf("placement would grow your contiguous area beyond %d pixels", e.limit)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestAreaGuardCapsFilledSquare(t *testing.T) {
+	room := newTestRoom(t, map[string]string{"MAX_CONTIGUOUS_AREA": "4", "PIXEL_COOLDOWN": "0s", "PERSISTENCE_MODE": "write-through"})
+	s := room.server
+
+	// A 2x2 square is exactly the limit
+	for _, p := range [][2]int{{0, 0}, {1, 0}, {0, 1}, {1, 1}} {
+		place(t, s, p[0], p[1], "#FF0000", "alice")
+	}
+
+	// Growing it any further is refused
+	pixel := PixelUpdate{X: 2, Y: 0, Color: "#FF0000", UserID: "alice"}
+	err := s.placePixel(&pixel, "192.0.2.1")
+	if err == nil || err.status != http.StatusForbidden || err.code != codeAreaLimit {
+		t.Fatalf("fifth pixel of the block: %+v, want 403 %s", err, codeAreaLimit)
+	}
+
+	// Scattered pixels, and another user's pixel next to the block, are fine
+	place(t, s, 3, 0, "#FF0000", "alice")
+	place(t, s, 10, 10, "#FF0000", "alice")
+	place(t, s, 2, 0, "#FF0000", "bob")
+}
+
+func TestAreaGuardRunsAfterRateLimit(t *testing.T) {
+	room := newTestRoom(t, map[string]string{"MAX_CONTIGUOUS_AREA": "1", "PIXEL_COOLDOWN": "1h", "PERSISTENCE_MODE": "write-through"})
+	s := room.server
+
+	// A user still cooling down is told so, without the area being searched
+	place(t, s, 1, 1, "#FF0000", "alice")
+	pixel := PixelUpdate{X: 2, Y: 1, Color: "#FF0000", UserID: "alice"}
+	if err := s.placePixel(&pixel, "192.0.2.1"); err == nil || err.status != http.StatusTooManyRequests {
+		t.Fatalf("placement while cooling down: %+v, want 429", err)
+	}
+
+	// A placement refused by the area guard doesn't cost a cooldown
+	s.db.SavePixel(PixelUpdate{X: 5, Y: 5, Color: "#FF0000", UserID: "bob"})
+	pixel = PixelUpdate{X: 6, Y: 5, Color: "#FF0000", UserID: "bob"}
+	if err := s.placePixel(&pixel, "192.0.2.1"); err == nil || err.status != http.StatusForbidden {
+		t.Fatalf("bob growing his block: %+v, want 403", err)
+	}
+	place(t, s, 20, 20, "#FF0000", "bob")
+}
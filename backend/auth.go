@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Signed user tokens
+//
+// Without authentication any client can claim any userId, so the rate limiter
+// and the pixel history only know what clients tell them. When AUTH_SECRET is
+// set, placements need an "Authorization: Bearer <token>" header instead, and
+// the user is taken from the token.
+//
+// Tokens are JSON Web Tokens signed with HMAC-SHA256 (HS256) using the secret.
+// Two claims are required: sub, the userId, and exp, when the token expires
+// (Unix seconds). The optional team claim assigns the user to a team (see
+// teams.go), and "role": "service" makes the user a service account (see
+// serviceaccount.go). Any JWT library can create compatible tokens, and
+// `wplace-backend -issue-token <userId>` prints one.
+
+// errInvalidToken is returned for every token that can't be trusted
+// The reason is logged but not sent to the client
+var errInvalidToken = errors.New("invalid or expired token")
+
+// tokenHeader is the only header accepted (and the one written by Issue)
+// Checking alg keeps "alg": "none" tokens from skipping the signature
+type tokenHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ,omitempty"`
+}
+
+// tokenClaims are the claims read from a token
+type tokenClaims struct {
+	Subject   string `json:"sub"`
+	ExpiresAt int64  `json:"exp"`
+	Team      string `json:"team,omitempty"`
+	Role      string `json:"role,omitempty"`
+}
+
+// TokenVerifier signs and checks user tokens with a shared secret
+type TokenVerifier struct {
+	secret []byte
+}
+
+// NewTokenVerifier creates a verifier for the secret
+// An empty secret returns nil, which disables authentication
+func NewTokenVerifier(secret string) *TokenVerifier {
+	if secret == "" {
+		return nil
+	}
+	return &TokenVerifier{secret: []byte(secret)}
+}
+
+// Issue creates a token for userID that expires after ttl
+// team may be empty for a user without a team, and role for an ordinary user.
+func (v *TokenVerifier) Issue(userID, team, role string, ttl time.Duration) (string, error) {
+	header, err := json.Marshal(tokenHeader{Alg: "HS256", Typ: "JWT"})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(tokenClaims{Subject: userID, ExpiresAt: timeNow().Add(ttl).Unix(), Team: team, Role: role})
+	if err != nil {
+		return "", err
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(v.sign(signed)), nil
+}
+
+// Verify checks the token's signature and expiry and returns its claims
+// The userId is claims.Subject.
+func (v *TokenVerifier) Verify(token string) (tokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return tokenClaims{}, errInvalidToken
+	}
+
+	// Check the signature first so nothing unsigned is ever parsed further
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(signature, v.sign(parts[0]+"."+parts[1])) {
+		return tokenClaims{}, errInvalidToken
+	}
+
+	var header tokenHeader
+	if err := decodeTokenPart(parts[0], &header); err != nil || header.Alg != "HS256" {
+		return tokenClaims{}, errInvalidToken
+	}
+
+	var claims tokenClaims
+	if err := decodeTokenPart(parts[1], &claims); err != nil {
+		return tokenClaims{}, errInvalidToken
+	}
+	if claims.Subject == "" || claims.ExpiresAt == 0 || timeNow().Unix() >= claims.ExpiresAt {
+		return tokenClaims{}, errInvalidToken
+	}
+
+	return claims, nil
+}
+
+// sign returns the HMAC-SHA256 of the header and claims
+func (v *TokenVerifier) sign(signed string) []byte {
+	mac := hmac.New(sha256.New, v.secret)
+	mac.Write([]byte(signed))
+	return mac.Sum(nil)
+}
+
+// decodeTokenPart decodes one base64url JSON part of a token
+func decodeTokenPart(part string, into interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, into)
+}
+
+// bearerToken returns the token of an "Authorization: Bearer <token>" header
+func bearerToken(r *http.Request) (string, bool) {
+	token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found || token == "" {
+		return "", false
+	}
+	return token, true
+}
+
+// tokenUser returns the user of the request's bearer token
+// ok is false when the token is missing or invalid
+func (s *Server) tokenUser(r *http.Request) (userID string, ok bool) {
+	claims, ok := s.tokenClaims(r)
+	return claims.Subject, ok
+}
+
+// tokenClaims returns the claims of the request's bearer token, for
+// placements that also need the user's team
+func (s *Server) tokenClaims(r *http.Request) (tokenClaims, bool) {
+	token, found := bearerToken(r)
+	if !found {
+		return tokenClaims{}, false
+	}
+	claims, err := s.tokens.Verify(token)
+	if err != nil {
+		slog.WarnContext(r.Context(), "Rejected invalid user token", "addr", s.clientIP(r), "path", r.URL.Path)
+		return tokenClaims{}, false
+	}
+	return claims, true
+}
+
+// writeUnauthorized answers a request without a valid token
+func writeUnauthorized(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="wplace"`)
+	writeError(w, http.StatusUnauthorized, codeUnauthorized, "A valid Authorization: Bearer token is required")
+}
@@ -0,0 +1,492 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// backupPrefix and backupSuffix frame every backup name
+// The timestamp in between sorts chronologically, so the oldest backups
+// are simply the first names in sorted order
+const (
+	backupPrefix = "canvas-"
+	backupSuffix = ".json.gz"
+)
+
+// restoreBatchSize is how many pixels restoreBackup saves per transaction
+const restoreBatchSize = 1000
+
+// backupLayers lists the layers a backup stores, bottom layer first
+var backupLayers = []int{LayerBase, LayerOverlay}
+
+// backupFile is the content of a backup
+// Every layer is stored on its own, without compositing, so a restore puts
+// overlay pixels back on the overlay instead of baking them into the base.
+type backupFile struct {
+	Layers map[int][]PixelUpdate `json:"layers"` // Pixels by layer, in sequence order
+}
+
+// BackupSink is a place canvas backups can be stored
+type BackupSink interface {
+	// Put stores a backup under the given name, replacing any existing one
+	Put(name string, data []byte) error
+
+	// List returns the names of all stored backups
+	List() ([]string, error)
+
+	// Delete removes a stored backup
+	Delete(name string) error
+}
+
+// BackupScheduler periodically uploads a snapshot of the canvas to a BackupSink
+// Backup failures are logged and counted but never affect serving requests
+type BackupScheduler struct {
+	db       *Database
+	sink     BackupSink
+	interval time.Duration // Time between backups
+	keep     int           // Number of most recent backups to retain
+	failures atomic.Int64  // Number of failed backup attempts
+}
+
+// NewBackupScheduler creates a scheduler that keeps the last 'keep' backups
+func NewBackupScheduler(db *Database, sink BackupSink, interval time.Duration, keep int) *BackupScheduler {
+	if keep < 1 {
+		keep = 1
+	}
+	return &BackupScheduler{
+		db:       db,
+		sink:     sink,
+		interval: interval,
+		keep:     keep,
+	}
+}
+
+// Run takes a backup every interval, forever
+func (b *BackupScheduler) Run() {
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := b.Backup(); err != nil {
+			failures := b.failures.Add(1)
+			slog.Error("Canvas backup failed", "failures", failures, "err", err)
+		}
+	}
+}
+
+// Failures returns how many backup attempts have failed
+func (b *BackupScheduler) Failures() int64 {
+	return b.failures.Load()
+}
+
+// Backup uploads one snapshot and prunes old ones
+func (b *BackupScheduler) Backup() error {
+	backup := backupFile{Layers: make(map[int][]PixelUpdate)}
+	total := 0
+	for _, layer := range backupLayers {
+		pixels, err := b.db.GetLayerPixels(layer)
+		if err != nil {
+			return fmt.Errorf("reading layer %d: %w", layer, err)
+		}
+		backup.Layers[layer] = pixels
+		total += len(pixels)
+	}
+
+	data, err := encodeBackup(backup)
+	if err != nil {
+		return fmt.Errorf("encoding backup: %w", err)
+	}
+
+	name := backupPrefix + timeNow().UTC().Format("20060102T150405.000Z") + backupSuffix
+	if err := b.sink.Put(name, data); err != nil {
+		return fmt.Errorf("uploading %s: %w", name, err)
+	}
+	slog.Info("Canvas backup stored", "name", name, "pixels", total, "bytes", len(data))
+
+	return b.prune()
+}
+
+// prune deletes all but the newest 'keep' backups
+func (b *BackupScheduler) prune() error {
+	names, err := b.sink.List()
+	if err != nil {
+		return fmt.Errorf("listing backups: %w", err)
+	}
+
+	// Only touch files that look like our backups
+	var backups []string
+	for _, name := range names {
+		if strings.HasPrefix(name, backupPrefix) && strings.HasSuffix(name, backupSuffix) {
+			backups = append(backups, name)
+		}
+	}
+	sort.Strings(backups)
+
+	for len(backups) > b.keep {
+		if err := b.sink.Delete(backups[0]); err != nil {
+			return fmt.Errorf("deleting %s: %w", backups[0], err)
+		}
+		slog.Info("Old canvas backup deleted", "name", backups[0])
+		backups = backups[1:]
+	}
+
+	return nil
+}
+
+// encodeBackup stores a backup as gzip-compressed JSON
+func encodeBackup(backup backupFile) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(zw).Encode(backup); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeBackup reads a backup written by encodeBackup
+// Older backups are a plain array of visible pixels (the /api/canvas format);
+// those are read as a base layer with nothing on top.
+func decodeBackup(r io.Reader) (backupFile, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return backupFile{}, err
+	}
+	defer zr.Close()
+
+	data, err := io.ReadAll(zr)
+	if err != nil {
+		return backupFile{}, err
+	}
+
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		var pixels []PixelUpdate
+		if err := json.Unmarshal(trimmed, &pixels); err != nil {
+			return backupFile{}, err
+		}
+		return backupFile{Layers: map[int][]PixelUpdate{LayerBase: pixels}}, nil
+	}
+
+	var backup backupFile
+	if err := json.Unmarshal(data, &backup); err != nil {
+		return backupFile{}, err
+	}
+	for layer := range backup.Layers {
+		if layer != LayerBase && layer != LayerOverlay {
+			return backupFile{}, fmt.Errorf("unknown layer %d", layer)
+		}
+	}
+	return backup, nil
+}
+
+// newBackupSchedulerFromEnv builds the backup scheduler from environment variables
+// Returns nil when backups are disabled (BACKUP_INTERVAL unset or zero)
+func newBackupSchedulerFromEnv(db *Database) (*BackupScheduler, error) {
+	interval := envDuration("BACKUP_INTERVAL", 0)
+	if interval <= 0 {
+		return nil, nil
+	}
+
+	var sink BackupSink
+	var err error
+	switch kind := envString("BACKUP_SINK", "local"); kind {
+	case "local":
+		sink, err = NewLocalBackupSink(envString("BACKUP_DIR", "./backups"))
+	case "s3":
+		sink, err = NewS3BackupSink(
+			os.Getenv("S3_ENDPOINT"),
+			os.Getenv("S3_REGION"),
+			os.Getenv("S3_BUCKET"),
+			os.Getenv("S3_PREFIX"),
+			os.Getenv("S3_ACCESS_KEY"),
+			os.Getenv("S3_SECRET_KEY"),
+		)
+	default:
+		err = fmt.Errorf("unknown BACKUP_SINK %q (expected \"local\" or \"s3\")", kind)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return NewBackupScheduler(db, sink, interval, envInt("BACKUP_KEEP", 24)), nil
+}
+
+// restoreBackup loads a backup file into an empty database
+// Each layer's pixels go back on that layer, restoreBatchSize per transaction.
+// Pixels keep their original owner and timestamp, but get new sequence
+// numbers (in backup order) so they come after anything already in the history.
+// Nothing is restored when a timestamp is outside timestamps (see timestamps.go).
+func restoreBackup(db *Database, path string, timestamps TimestampPolicy) error {
+	count, err := db.GetPixelCount()
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return fmt.Errorf("refusing to restore into a canvas that already has %d pixels", count)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	backup, err := decodeBackup(file)
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", path, err)
+	}
+	for _, pixels := range backup.Layers {
+		if err := timestamps.CheckPixels(pixels, timeNow()); err != nil {
+			return fmt.Errorf("reading %s: %w", path, err)
+		}
+	}
+
+	total := 0
+	for _, layer := range backupLayers {
+		pixels := backup.Layers[layer]
+		for start := 0; start < len(pixels); start += restoreBatchSize {
+			batch := make([]PixelUpdate, 0, restoreBatchSize)
+			for _, pixel := range pixels[start:min(start+restoreBatchSize, len(pixels))] {
+				pixel.Seq = 0
+				batch = append(batch, pixel)
+			}
+			if err := db.SavePixelBatchToLayer(batch, layer); err != nil {
+				return fmt.Errorf("restoring layer %d: %w", layer, err)
+			}
+		}
+		total += len(pixels)
+	}
+
+	slog.Info("Backup restored", "pixels", total, "path", path)
+	return nil
+}
+
+// LocalBackupSink stores backups as files in a directory
+type LocalBackupSink struct {
+	dir string
+}
+
+// NewLocalBackupSink creates the directory if needed and returns a sink for it
+func NewLocalBackupSink(dir string) (*LocalBackupSink, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &LocalBackupSink{dir: dir}, nil
+}
+
+// Put writes the backup to a temporary file and renames it into place,
+// so a crash never leaves a half-written backup behind
+func (l *LocalBackupSink) Put(name string, data []byte) error {
+	tmp := filepath.Join(l.dir, name+".tmp")
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(l.dir, name))
+}
+
+// List returns the names of the files in the backup directory
+func (l *LocalBackupSink) List() ([]string, error) {
+	entries, err := os.ReadDir(l.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
+
+// Delete removes a backup file
+func (l *LocalBackupSink) Delete(name string) error {
+	return os.Remove(filepath.Join(l.dir, name))
+}
+
+// S3BackupSink stores backups in an S3-compatible bucket (AWS, MinIO, R2, ...)
+// Requests use path-style URLs and are signed with AWS Signature Version 4
+type S3BackupSink struct {
+	endpoint  string // e.g. "https://s3.us-east-1.amazonaws.com"
+	region    string // e.g. "us-east-1"
+	bucket    string
+	prefix    string // Key prefix, e.g. "wplace/"
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+// NewS3BackupSink creates a sink for the given bucket
+func NewS3BackupSink(endpoint, region, bucket, prefix, accessKey, secretKey string) (*S3BackupSink, error) {
+	if endpoint == "" || bucket == "" || accessKey == "" || secretKey == "" {
+		return nil, fmt.Errorf("S3 endpoint, bucket and credentials are required")
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+	return &S3BackupSink{
+		endpoint:  strings.TrimSuffix(endpoint, "/"),
+		region:    region,
+		bucket:    bucket,
+		prefix:    prefix,
+		accessKey: accessKey,
+		secretKey: secretKey,
+		client:    &http.Client{Timeout: time.Minute},
+	}, nil
+}
+
+// Put uploads a backup object
+func (s *S3BackupSink) Put(name string, data []byte) error {
+	_, err := s.do(http.MethodPut, "/"+s.bucket+"/"+s3Escape(s.prefix+name), nil, data)
+	return err
+}
+
+// List returns the backup names stored under the prefix
+// Only the first 1000 keys are returned, which is plenty for a retention count
+func (s *S3BackupSink) List() ([]string, error) {
+	query := url.Values{}
+	query.Set("list-type", "2")
+	query.Set("prefix", s.prefix)
+
+	body, err := s.do(http.MethodGet, "/"+s.bucket, query, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var result struct {
+		Contents []struct {
+			Key string `xml:"Key"`
+		} `xml:"Contents"`
+	}
+	if err := xml.Unmarshal(body, &result); err != nil {
+		return nil, fmt.Errorf("parsing bucket listing: %w", err)
+	}
+
+	names := make([]string, 0, len(result.Contents))
+	for _, object := range result.Contents {
+		names = append(names, strings.TrimPrefix(object.Key, s.prefix))
+	}
+	return names, nil
+}
+
+// Delete removes a backup object
+func (s *S3BackupSink) Delete(name string) error {
+	_, err := s.do(http.MethodDelete, "/"+s.bucket+"/"+s3Escape(s.prefix+name), nil, nil)
+	return err
+}
+
+// do sends a signed request and returns the response body
+func (s *S3BackupSink) do(method, path string, query url.Values, payload []byte) ([]byte, error) {
+	rawQuery := s3CanonicalQuery(query)
+	target := s.endpoint + path
+	if rawQuery != "" {
+		target += "?" + rawQuery
+	}
+
+	req, err := http.NewRequest(method, target, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	s.sign(req, path, rawQuery, payload, timeNow().UTC())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("S3 %s %s: %s", method, path, resp.Status)
+	}
+	return body, nil
+}
+
+// sign adds AWS Signature Version 4 headers to the request
+func (s *S3BackupSink) sign(req *http.Request, path, rawQuery string, payload []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(payload)
+
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	// The canonical request lists exactly what the signature covers
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := "host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:" + payloadHash + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+	canonicalRequest := strings.Join([]string{
+		req.Method, path, rawQuery, canonicalHeaders, signedHeaders, payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	// Derive the signing key from the secret, scoped to the date/region/service
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature))
+}
+
+// s3Escape URI-encodes an object key the way SigV4 expects:
+// everything except unreserved characters and '/' is percent-encoded
+func s3Escape(key string) string {
+	var b strings.Builder
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3CanonicalQuery encodes query parameters sorted by key, with spaces as %20
+func s3CanonicalQuery(query url.Values) string {
+	return strings.ReplaceAll(query.Encode(), "+", "%20")
+}
+
+// sha256Hex returns the hex-encoded SHA-256 of data
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// hmacSHA256 returns HMAC-SHA256(key, data)
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
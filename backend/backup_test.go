@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memorySink is a BackupSink that keeps backups in a map
+type memorySink struct {
+	mu      sync.Mutex
+	backups map[string][]byte
+}
+
+func newMemorySink() *memorySink {
+	return &memorySink{backups: make(map[string][]byte)}
+}
+
+func (m *memorySink) Put(name string, data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.backups[name] = data
+	return nil
+}
+
+func (m *memorySink) List() ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	names := make([]string, 0, len(m.backups))
+	for name := range m.backups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (m *memorySink) Delete(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.backups, name)
+	return nil
+}
+
+func TestBackupRetention(t *testing.T) {
+	clock := useFakeClock(t)
+	db := newTestDatabase(t)
+	sink := newMemorySink()
+	// Files that aren't backups are never pruned
+	sink.Put("notes.txt", []byte("keep me"))
+
+	scheduler := NewBackupScheduler(db, sink, time.Hour, 3)
+	var taken []string
+	for i := 0; i < 5; i++ {
+		if err := scheduler.Backup(); err != nil {
+			t.Fatalf("backup %d: %v", i, err)
+		}
+		taken = append(taken, backupPrefix+clock.Now().UTC().Format("20060102T150405.000Z")+backupSuffix)
+		clock.Advance(time.Hour)
+	}
+
+	names, _ := sink.List()
+	want := append(append([]string{}, taken[2:]...), "notes.txt")
+	if len(names) != len(want) {
+		t.Fatalf("kept %v, want %v", names, want)
+	}
+	for i := range want {
+		if names[i] != want[i] {
+			t.Fatalf("kept %v, want %v", names, want)
+		}
+	}
+}
+
+func TestBackupRoundTrip(t *testing.T) {
+	src := newTestDatabase(t)
+
+	// More pixels than one restore batch, and an overlay pixel on top of one
+	var pixels []PixelUpdate
+	for i := 0; i < restoreBatchSize+500; i++ {
+		pixels = append(pixels, PixelUpdate{X: i % 1000, Y: i / 1000, Color: "#FF0000", UserID: "alice"})
+	}
+	src.SavePixelBatch(pixels)
+	src.SavePixelToLayer(PixelUpdate{X: 0, Y: 0, Color: "#FFFFFF", UserID: adminUserID}, LayerOverlay)
+
+	dir := t.TempDir()
+	sink, err := NewLocalBackupSink(dir)
+	if err != nil {
+		t.Fatalf("sink: %v", err)
+	}
+	if err := NewBackupScheduler(src, sink, time.Hour, 1).Backup(); err != nil {
+		t.Fatalf("backup: %v", err)
+	}
+	names, _ := sink.List()
+	if len(names) != 1 {
+		t.Fatalf("backups %v, want one", names)
+	}
+
+	dst := newTestDatabase(t)
+	if err := restoreBackup(dst, filepath.Join(dir, names[0]), defaultTimestampPolicy); err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+
+	if got, want := checksum(t, dst), checksum(t, src); got != want {
+		t.Fatalf("restored checksum %s, original %s", got, want)
+	}
+	// The overlay pixel is back on the overlay, with alice's pixel below it
+	overlay, _ := dst.GetLayerPixels(LayerOverlay)
+	base, _ := dst.GetLayerPixels(LayerBase)
+	if len(overlay) != 1 || len(base) != len(pixels) {
+		t.Fatalf("restored %d overlay and %d base pixels, want 1 and %d", len(overlay), len(base), len(pixels))
+	}
+	if err := dst.DeletePixelFromLayer(0, 0, LayerOverlay); err != nil {
+		t.Fatalf("delete overlay pixel: %v", err)
+	}
+	if pixel, ok, _ := dst.GetPixel(0, 0); !ok || pixel.UserID != "alice" {
+		t.Fatalf("(0,0) without the overlay = %+v, %v; want alice's pixel", pixel, ok)
+	}
+
+	// A restore only goes into an empty canvas
+	if err := restoreBackup(dst, filepath.Join(dir, names[0]), defaultTimestampPolicy); err == nil {
+		t.Fatal("restore into a non-empty canvas succeeded")
+	}
+}
+
+func TestRestoreOldBackupFormat(t *testing.T) {
+	// Older backups are a gzip-compressed list of visible pixels
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	json.NewEncoder(zw).Encode([]PixelUpdate{{X: 1, Y: 1, Color: "#00FF00", UserID: "bob", Timestamp: currentTimeMillis()}})
+	zw.Close()
+
+	path := filepath.Join(t.TempDir(), "old.json.gz")
+	if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		t.Fatalf("writing backup: %v", err)
+	}
+
+	db := newTestDatabase(t)
+	if err := restoreBackup(db, path, defaultTimestampPolicy); err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	base, _ := db.GetLayerPixels(LayerBase)
+	if len(base) != 1 || base[0].Color != "#00FF00" {
+		t.Fatalf("base layer %+v, want bob's pixel", base)
+	}
+}
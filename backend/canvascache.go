@@ -0,0 +1,208 @@
+package main
+
+import (
+	"log/slog"
+	"sort"
+	"sync"
+)
+
+// In-memory canvas
+//
+// GET /api/canvas used to read the whole canvas_state table on every call,
+// which is slow on a full canvas and competes with the background writer for
+// the database. The CanvasCache keeps every stored pixel in memory instead:
+// it is loaded from the database once at startup and updated whenever a
+// change is accepted, so reading the canvas never touches the database.
+//
+// The database is still the durable copy, written in the background as
+// before. The cache follows the same rules as canvas_state, so the two hold
+// the same pixels once the writer has caught up:
+//
+//   - one map per layer; the visible pixel is the one on the highest layer
+//   - a pixel only replaces a stored one with a lower or equal sequence number
+//   - a removal (eraser, undo to an empty pixel) only removes an older pixel
+//
+// The cache is never saved. Every start loads it from the database again
+// (after the queue log has been replayed), so it can't carry anything across
+// a restart that the database doesn't have. While the database is degraded
+// the cache has the pixels whose writes were skipped, like the WebSocket
+// clients that received them, until the next restart.
+//
+// With CANVAS_CACHE=false there is no cache and /api/canvas reads the
+// database as before, which saves the memory: about 170 bytes per stored
+// pixel, or 170 MB for a full 1000x1000 canvas.
+
+// coord is a canvas coordinate, used as a map key
+type coord [2]int
+
+// cachedPixel is a stored pixel without its coordinate (the map key), to
+// keep the cache small
+type cachedPixel struct {
+	color     string
+	userID    string
+	timestamp int64
+	seq       int64
+}
+
+// pixelAt turns a cached pixel back into a PixelUpdate
+func (p cachedPixel) pixelAt(key coord) PixelUpdate {
+	return PixelUpdate{X: key[0], Y: key[1], Color: p.color, UserID: p.userID, Timestamp: p.timestamp, Seq: p.seq}
+}
+
+// CanvasCache holds the stored pixels of every layer in memory
+// A nil cache (CANVAS_CACHE=false) ignores updates.
+type CanvasCache struct {
+	mu     sync.RWMutex
+	layers [LayerOverlay + 1]map[coord]cachedPixel
+
+	// version counts the changes and seq is the highest sequence number
+	// applied, so the checksum is only computed again after a change
+	// (see checksum.go)
+	version uint64
+	seq     int64
+
+	// sumMu guards sum and makes concurrent checksum requests wait for one
+	// computation instead of each hashing the canvas
+	sumMu sync.Mutex
+	sum   cachedChecksum
+}
+
+// NewCanvasCache loads the stored pixels of every layer from the database
+func NewCanvasCache(db *Database) (*CanvasCache, error) {
+	c := &CanvasCache{seq: db.LastSeq()}
+	for layer := range c.layers {
+		pixels, err := db.GetLayerPixels(layer)
+		if err != nil {
+			return nil, err
+		}
+		c.layers[layer] = make(map[coord]cachedPixel, len(pixels))
+		for _, pixel := range pixels {
+			c.layers[layer][coord{pixel.X, pixel.Y}] = cachedPixel{pixel.Color, pixel.UserID, pixel.Timestamp, pixel.Seq}
+		}
+	}
+
+	slog.Info("Canvas cache loaded", "base", len(c.layers[LayerBase]), "overlay", len(c.layers[LayerOverlay]))
+	return c, nil
+}
+
+// Place applies an accepted base-layer placement
+// An eraser (see alpha.go) removes the pixel instead.
+func (c *CanvasCache) Place(pixel PixelUpdate) {
+	entry := HistoryEntry{X: pixel.X, Y: pixel.Y, Layer: LayerBase, Color: pixel.Color, UserID: pixel.UserID, PlacedAt: pixel.Timestamp, Seq: pixel.Seq}
+	if isTransparent(pixel.Color) {
+		entry.Color = ""
+	}
+	c.Apply(entry)
+}
+
+// Apply applies a history entry that was written to the database
+// Like in canvas_state, nothing changes if the stored pixel is newer.
+func (c *CanvasCache) Apply(entry HistoryEntry) {
+	if c == nil || entry.Layer < 0 || entry.Layer >= len(c.layers) {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	layer := c.layers[entry.Layer]
+	key := coord{entry.X, entry.Y}
+	if stored, ok := layer[key]; ok && stored.seq > entry.Seq {
+		return
+	}
+	c.version++
+	c.seq = max(c.seq, entry.Seq)
+	if entry.IsTombstone() {
+		delete(layer, key)
+		return
+	}
+	layer[key] = cachedPixel{entry.Color, entry.UserID, entry.PlacedAt, entry.Seq}
+}
+
+// Remove deletes the pixel at (x, y) from a layer, whatever its sequence number
+// Used for overlay removals, which only admins make.
+func (c *CanvasCache) Remove(x, y, layer int) {
+	if c == nil || layer < 0 || layer >= len(c.layers) {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.layers[layer], coord{x, y})
+	c.version++
+}
+
+// Clear removes every pixel from every layer
+func (c *CanvasCache) Clear() {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for layer := range c.layers {
+		c.layers[layer] = make(map[coord]cachedPixel)
+	}
+	c.version++
+}
+
+// Pixel returns the visible pixel at (x, y), like Database.GetPixel
+// The boolean result is false when no layer has a pixel there.
+func (c *CanvasCache) Pixel(x, y int) (PixelUpdate, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	key := coord{x, y}
+	for layer := len(c.layers) - 1; layer >= 0; layer-- {
+		if pixel, ok := c.layers[layer][key]; ok {
+			return pixel.pixelAt(key), true
+		}
+	}
+	return PixelUpdate{}, false
+}
+
+// LayerPixel returns the pixel stored at (x, y) on one layer, without
+// compositing; the boolean result is false when that layer has none there
+func (c *CanvasCache) LayerPixel(x, y, layer int) (PixelUpdate, bool) {
+	if layer < 0 || layer >= len(c.layers) {
+		return PixelUpdate{}, false
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	key := coord{x, y}
+	pixel, ok := c.layers[layer][key]
+	if !ok {
+		return PixelUpdate{}, false
+	}
+	return pixel.pixelAt(key), true
+}
+
+// Pixels returns the visible canvas in placement order, like
+// Database.GetAllPixels
+// The lock is only held while copying, so sorting doesn't block placements.
+func (c *CanvasCache) Pixels() []PixelUpdate {
+	c.mu.RLock()
+	pixels := c.visible()
+	c.mu.RUnlock()
+
+	sort.Slice(pixels, func(i, j int) bool { return pixels[i].Seq < pixels[j].Seq })
+	return pixels
+}
+
+// visible copies the visible canvas, in no particular order
+// The caller must hold c.mu (read or write)
+func (c *CanvasCache) visible() []PixelUpdate {
+	base, overlay := c.layers[LayerBase], c.layers[LayerOverlay]
+	pixels := make([]PixelUpdate, 0, len(base)+len(overlay))
+	for key, pixel := range base {
+		if _, covered := overlay[key]; !covered {
+			pixels = append(pixels, pixel.pixelAt(key))
+		}
+	}
+	for key, pixel := range overlay {
+		pixels = append(pixels, pixel.pixelAt(key))
+	}
+	return pixels
+}
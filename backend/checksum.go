@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Canvas checksums
+//
+// A client that builds its canvas from a snapshot and the live updates can't
+// tell when it missed one. GET /api/canvas/checksum returns a SHA-256 hash of
+// the visible canvas, so the client can hash its own copy the same way and
+// load the canvas again (or resume, see resume.go) when they differ.
+//
+// The hash must not depend on how the canvas was built, only on what it
+// shows, so it covers one line per visible pixel, in coordinate order (x,
+// then y) rather than placement order:
+//
+//	x,y,COLOR\n
+//
+// with the color in upper case, exactly as in /api/canvas otherwise. Empty
+// coordinates are left out, and so is everything but the color (who placed a
+// pixel and when doesn't change what the canvas looks like).
+//
+// The response also has the cursor the checksum is for: the highest
+// placement sequence number it includes (see resume.go). A client whose own
+// cursor is lower hasn't received everything yet and should compare again
+// after it has; one whose cursor is the same but whose hash differs has
+// missed an update.
+//
+// Hashing a full canvas takes a moment, so the checksum is computed from the
+// canvas cache and kept until the next change, when it is computed again on
+// the next request. Without the cache (CANVAS_CACHE=false) it is computed
+// from the database on every request, like /api/canvas, and has no cursor:
+// the database lags behind the live updates by up to a writer batch.
+
+// checksumAlgorithm names the hash in the response, so it can change later
+const checksumAlgorithm = "sha256"
+
+// canvasChecksum is the response of GET /api/canvas/checksum
+type canvasChecksum struct {
+	Algorithm string `json:"algorithm"`
+	Checksum  string `json:"checksum"`
+	Pixels    int    `json:"pixels"`           // Visible pixels hashed
+	Cursor    int64  `json:"cursor,omitempty"` // Highest sequence number included (only with the cache)
+}
+
+// cachedChecksum is the checksum of the cache at one version
+type cachedChecksum struct {
+	canvasChecksum
+	version uint64
+	valid   bool
+}
+
+// checksumPixels hashes the visible pixels as described above
+// The pixels are sorted in place.
+func checksumPixels(pixels []PixelUpdate) string {
+	sort.Slice(pixels, func(i, j int) bool {
+		if pixels[i].X != pixels[j].X {
+			return pixels[i].X < pixels[j].X
+		}
+		return pixels[i].Y < pixels[j].Y
+	})
+
+	hash := sha256.New()
+	for _, pixel := range pixels {
+		fmt.Fprintf(hash, "%d,%d,%s\n", pixel.X, pixel.Y, strings.ToUpper(pixel.Color))
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// Checksum returns the checksum of the visible canvas
+// It is only computed again when the canvas changed since the last call.
+func (c *CanvasCache) Checksum() canvasChecksum {
+	c.sumMu.Lock()
+	defer c.sumMu.Unlock()
+
+	c.mu.RLock()
+	if c.sum.valid && c.sum.version == c.version {
+		c.mu.RUnlock()
+		return c.sum.canvasChecksum
+	}
+	version, seq := c.version, c.seq
+	pixels := c.visible()
+	c.mu.RUnlock()
+
+	// Placements go on while the copy is hashed; the next call sees the new
+	// version and hashes again
+	c.sum = cachedChecksum{
+		canvasChecksum: canvasChecksum{
+			Algorithm: checksumAlgorithm,
+			Checksum:  checksumPixels(pixels),
+			Pixels:    len(pixels),
+			Cursor:    seq,
+		},
+		version: version,
+		valid:   true,
+	}
+	return c.sum.canvasChecksum
+}
+
+// handleCanvasChecksum returns the checksum of the current canvas
+func (s *Server) handleCanvasChecksum(w http.ResponseWriter, r *http.Request) {
+	s.writeCORS(w, r, "GET, OPTIONS")
+
+	var sum canvasChecksum
+	if s.canvasCache != nil {
+		sum = s.canvasCache.Checksum()
+	} else {
+		pixels, err := s.db.GetAllPixels()
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Failed to retrieve canvas state", "err", err)
+			writeError(w, http.StatusInternalServerError, codeInternal, "Failed to retrieve canvas state")
+			return
+		}
+		sum = canvasChecksum{Algorithm: checksumAlgorithm, Checksum: checksumPixels(pixels), Pixels: len(pixels)}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(sum); err != nil {
+		slog.WarnContext(r.Context(), "Failed to encode canvas checksum", "err", err)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+)
+
+// Chunked canvas addressing
+//
+// A very large canvas is split into square tiles ("chunks") of ChunkSize x
+// ChunkSize pixels. Chunk (cx, cy) covers x from cx*ChunkSize to
+// (cx+1)*ChunkSize-1, and the same for y; chunks on the right and bottom edge
+// may be cut short by the canvas. Clients fetch only the chunks they show with
+// GET /api/chunk/{cx}/{cy} and subscribe to the same chunks over the WebSocket.
+
+// defaultChunkSize is the side of a chunk when CHUNK_SIZE is not set
+const defaultChunkSize = 256
+
+// ChunkCoord identifies a chunk as [cx, cy]
+type ChunkCoord [2]int
+
+// chunkOf returns the chunk that contains (x, y)
+func chunkOf(x, y, chunkSize int) ChunkCoord {
+	return ChunkCoord{x / chunkSize, y / chunkSize}
+}
+
+// Chunks returns how many chunks the canvas has across and down
+func (c CanvasConfig) Chunks() (cols, rows int) {
+	return (c.Width + c.ChunkSize - 1) / c.ChunkSize, (c.Height + c.ChunkSize - 1) / c.ChunkSize
+}
+
+// HasChunk returns true if the chunk overlaps the canvas
+func (c CanvasConfig) HasChunk(chunk ChunkCoord) bool {
+	cols, rows := c.Chunks()
+	return chunk[0] >= 0 && chunk[0] < cols && chunk[1] >= 0 && chunk[1] < rows
+}
+
+// handleGetChunk returns the visible pixels of one chunk
+// Path parameters: cx and cy, the chunk coordinates
+func (s *Server) handleGetChunk(w http.ResponseWriter, r *http.Request) {
+	s.writeCORS(w, r, "GET, OPTIONS")
+
+	cx, errX := strconv.Atoi(r.PathValue("cx"))
+	cy, errY := strconv.Atoi(r.PathValue("cy"))
+	if errX != nil || errY != nil {
+		writeError(w, http.StatusBadRequest, codeValidation, "cx and cy must be integers")
+		return
+	}
+
+	if !s.canvas.HasChunk(ChunkCoord{cx, cy}) {
+		cols, rows := s.canvas.Chunks()
+		writeError(w, http.StatusNotFound, codeNotFound, fmt.Sprintf("chunk must be between (0, 0) and (%d, %d)", cols-1, rows-1))
+		return
+	}
+
+	pixels, err := s.db.GetChunk(cx, cy, s.canvas.ChunkSize)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to retrieve chunk", "cx", cx, "cy", cy, "err", err)
+		writeError(w, http.StatusInternalServerError, codeInternal, "Failed to retrieve chunk")
+		return
+	}
+
+	// If no pixels exist in the chunk, return an empty array
+	if pixels == nil {
+		pixels = []PixelUpdate{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(pixels); err != nil {
+		slog.WarnContext(r.Context(), "Failed to encode chunk", "err", err)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// errCircuitOpen is returned when a call is skipped because the breaker is open
+var errCircuitOpen = errors.New("circuit breaker is open")
+
+// Circuit breaker states
+const (
+	// breakerClosed lets every call through (normal operation)
+	breakerClosed = "closed"
+
+	// breakerOpen skips every call until the cooldown has passed
+	breakerOpen = "open"
+
+	// breakerHalfOpen lets a single probe call through to test recovery
+	breakerHalfOpen = "half-open"
+)
+
+// CircuitBreaker stops calling a failing dependency for a while
+// After 'threshold' consecutive failures it opens and fails fast for 'cooldown'.
+// Then it half-opens: one probe call is allowed, and its result decides whether
+// the breaker closes again (success) or re-opens for another cooldown (failure).
+type CircuitBreaker struct {
+	mu        sync.Mutex
+	state     string        // One of breakerClosed, breakerOpen, breakerHalfOpen
+	failures  int           // Consecutive failures seen while closed
+	threshold int           // Failures needed to open the breaker
+	cooldown  time.Duration // How long the breaker stays open
+	openedAt  time.Time     // When the breaker last opened
+	probing   bool          // True while the half-open probe call is in flight
+}
+
+// NewCircuitBreaker creates a closed circuit breaker
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	if threshold < 1 {
+		threshold = 1
+	}
+	return &CircuitBreaker{
+		state:     breakerClosed,
+		threshold: threshold,
+		cooldown:  cooldown,
+	}
+}
+
+// Call runs fn if the breaker allows it and records the outcome
+// Returns errCircuitOpen without calling fn when the breaker is open
+func (cb *CircuitBreaker) Call(fn func() error) error {
+	if !cb.allow() {
+		return errCircuitOpen
+	}
+
+	err := fn()
+	cb.record(err)
+	return err
+}
+
+// allow reports whether a call may go through right now
+func (cb *CircuitBreaker) allow() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.state {
+	case breakerOpen:
+		// Stay open until the cooldown has passed, then let one probe through
+		if timeNow().Sub(cb.openedAt) < cb.cooldown {
+			return false
+		}
+		cb.state = breakerHalfOpen
+		cb.probing = true
+		return true
+
+	case breakerHalfOpen:
+		// Only one probe at a time; everyone else keeps failing fast
+		if cb.probing {
+			return false
+		}
+		cb.probing = true
+		return true
+	}
+
+	return true
+}
+
+// record updates the breaker state with the result of a call
+func (cb *CircuitBreaker) record(err error) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if err == nil {
+		// Any success (including a half-open probe) closes the breaker
+		cb.state = breakerClosed
+		cb.failures = 0
+		cb.probing = false
+		return
+	}
+
+	if cb.state == breakerHalfOpen {
+		// The probe failed - the dependency is still broken
+		cb.open()
+		return
+	}
+
+	cb.failures++
+	if cb.failures >= cb.threshold {
+		cb.open()
+	}
+}
+
+// open moves the breaker to the open state (caller must hold the lock)
+func (cb *CircuitBreaker) open() {
+	cb.state = breakerOpen
+	cb.openedAt = timeNow()
+	cb.failures = 0
+	cb.probing = false
+}
+
+// State returns the current breaker state
+func (cb *CircuitBreaker) State() string {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.state
+}
+
+// Degraded returns true when the breaker is not fully closed
+func (cb *CircuitBreaker) Degraded() bool {
+	return cb.State() != breakerClosed
+}
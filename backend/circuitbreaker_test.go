@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+var errWriteFailed = errors.New("disk full")
+
+func failing() error    { return errWriteFailed }
+func succeeding() error { return nil }
+
+func TestCircuitBreakerOpensAfterThreshold(t *testing.T) {
+	useFakeClock(t)
+	cb := NewCircuitBreaker(3, 30*time.Second)
+
+	// Failures below the threshold keep it closed
+	for i := 0; i < 2; i++ {
+		if err := cb.Call(failing); err != errWriteFailed {
+			t.Fatalf("call %d: got %v, want the write's error", i, err)
+		}
+	}
+	if state := cb.State(); state != breakerClosed {
+		t.Fatalf("after 2 failures: state %q, want %q", state, breakerClosed)
+	}
+
+	// The third one opens it, and further calls fail fast without running
+	cb.Call(failing)
+	if state := cb.State(); state != breakerOpen {
+		t.Fatalf("after 3 failures: state %q, want %q", state, breakerOpen)
+	}
+	called := false
+	if err := cb.Call(func() error { called = true; return nil }); err != errCircuitOpen {
+		t.Fatalf("open breaker: got %v, want errCircuitOpen", err)
+	}
+	if called {
+		t.Fatal("open breaker ran the call")
+	}
+	if !cb.Degraded() {
+		t.Fatal("open breaker is not degraded")
+	}
+}
+
+func TestCircuitBreakerSuccessResetsFailures(t *testing.T) {
+	useFakeClock(t)
+	cb := NewCircuitBreaker(2, 30*time.Second)
+
+	// Only consecutive failures count
+	cb.Call(failing)
+	cb.Call(succeeding)
+	cb.Call(failing)
+	if state := cb.State(); state != breakerClosed {
+		t.Fatalf("state %q, want %q", state, breakerClosed)
+	}
+}
+
+func TestCircuitBreakerHalfOpenProbe(t *testing.T) {
+	clock := useFakeClock(t)
+	cb := NewCircuitBreaker(1, 30*time.Second)
+	cb.Call(failing)
+
+	// Still open just before the cooldown is over
+	clock.Advance(29 * time.Second)
+	if err := cb.Call(succeeding); err != errCircuitOpen {
+		t.Fatalf("before the cooldown: got %v, want errCircuitOpen", err)
+	}
+
+	// After it, exactly one probe goes through while it runs
+	clock.Advance(time.Second)
+	var during error
+	err := cb.Call(func() error {
+		if state := cb.State(); state != breakerHalfOpen {
+			t.Errorf("during the probe: state %q, want %q", state, breakerHalfOpen)
+		}
+		during = cb.Call(succeeding)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("probe: got %v, want nil", err)
+	}
+	if during != errCircuitOpen {
+		t.Fatalf("second call during the probe: got %v, want errCircuitOpen", during)
+	}
+
+	// The successful probe closed it
+	if state := cb.State(); state != breakerClosed {
+		t.Fatalf("after the probe: state %q, want %q", state, breakerClosed)
+	}
+}
+
+func TestCircuitBreakerFailedProbeReopens(t *testing.T) {
+	clock := useFakeClock(t)
+	cb := NewCircuitBreaker(1, 30*time.Second)
+	cb.Call(failing)
+
+	clock.Advance(30 * time.Second)
+	if err := cb.Call(failing); err != errWriteFailed {
+		t.Fatalf("probe: got %v, want the write's error", err)
+	}
+	if state := cb.State(); state != breakerOpen {
+		t.Fatalf("after a failed probe: state %q, want %q", state, breakerOpen)
+	}
+
+	// A new cooldown started with the failed probe
+	clock.Advance(29 * time.Second)
+	if err := cb.Call(succeeding); err != errCircuitOpen {
+		t.Fatalf("during the new cooldown: got %v, want errCircuitOpen", err)
+	}
+}
+
+// openBreaker trips the room's database circuit breaker
+func openBreaker(t *testing.T, room *Room) {
+	t.Helper()
+	breaker := room.server.dbBreaker
+	for breaker.State() != breakerOpen {
+		breaker.Call(failing)
+	}
+}
+
+func TestPlacementBroadcastWhileBreakerOpen(t *testing.T) {
+	room := newTestRoom(t, map[string]string{"DB_BREAKER_THRESHOLD": "1"})
+	ts := startTestServer(t, room)
+	conn := dialWS(t, ts, "/ws/queue?snapshot=false")
+	openBreaker(t, room)
+
+	// The write is skipped, but the pixel is still accepted and broadcast
+	status, body := postPixel(t, ts, `{"x":1,"y":2,"color":"#FF0000","userId":"alice"}`)
+	if status != http.StatusOK {
+		t.Fatalf("status %d (%v), want 200", status, body)
+	}
+	batch := readBatch(t, conn, 2*time.Second)
+	if len(batch) != 1 || batch[0].X != 1 || batch[0].Y != 2 || batch[0].UserID != "alice" {
+		t.Fatalf("broadcast %+v, want alice's pixel at (1,2)", batch)
+	}
+}
+
+func TestPlacementShedWhileBreakerOpen(t *testing.T) {
+	room := newTestRoom(t, map[string]string{"DB_BREAKER_THRESHOLD": "1", "DB_BREAKER_SHED": "true"})
+	ts := startTestServer(t, room)
+	openBreaker(t, room)
+
+	status, body := postPixel(t, ts, `{"x":1,"y":2,"color":"#FF0000","userId":"alice"}`)
+	if status != http.StatusServiceUnavailable || errorCode(body) != codeUnavailable {
+		t.Fatalf("got %d %v, want 503 %s", status, body, codeUnavailable)
+	}
+}
@@ -2,33 +2,103 @@ package main
 
 import (
 	"encoding/json"
-	"log"
+	"fmt"
+	"log/slog"
 	"net/http"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
 )
 
+// Default connection timeouts (WS_WRITE_WAIT, WS_PONG_WAIT, WS_PING_PERIOD)
 const (
 	// Time allowed to write a message to the peer
-	writeWait = 10 * time.Second
+	defaultWriteWait = 10 * time.Second
 
 	// Time allowed to read the next pong message from the peer
-	pongWait = 60 * time.Second
+	defaultPongWait = 60 * time.Second
+)
+
+// defaultPingPeriod is the ping period for a pong wait: 9/10 of it, so the
+// next ping goes out before the previous deadline runs out
+func defaultPingPeriod(pongWait time.Duration) time.Duration {
+	return (pongWait * 9) / 10
+}
 
-	// Send pings to peer with this period (must be less than pongWait)
-	pingPeriod = (pongWait * 9) / 10
+const (
+	// Smallest default limit on the size of a message from the peer; acks
+	// and subscribe rectangles fit easily
+	minMessageSize = 4096
+
+	// Room for one chunk in a subscribe message ("[cx,cy]," with
+	// four-digit coordinates and some whitespace)
+	subscribeChunkBytes = 16
 
-	// Maximum message size allowed from peer
-	maxMessageSize = 512
+	// Messages at least this large are compressed when the client negotiated
+	// permessage-deflate; smaller ones (acks, tiny batches) aren't worth it
+	compressThreshold = 256
 )
 
+// ClientConfig holds the timeouts of WebSocket connections
+// Clients on flaky mobile networks may need a longer PongWait than the
+// default minute before they are considered gone.
+type ClientConfig struct {
+	// WriteWait is the time allowed to write one message to the peer
+	WriteWait time.Duration
+
+	// PongWait is how long the connection may stay silent (no pong or other
+	// message) before it is closed
+	PongWait time.Duration
+
+	// PingPeriod is how often the peer is pinged; it must be shorter than
+	// PongWait so a healthy client always answers in time
+	PingPeriod time.Duration
+
+	// MaxMessageSize is the largest message accepted from the peer, in
+	// bytes; a larger one closes the connection
+	MaxMessageSize int64
+}
+
+// DefaultClientConfig returns the timeouts used unless configured otherwise
+func DefaultClientConfig() ClientConfig {
+	return ClientConfig{
+		WriteWait:      defaultWriteWait,
+		PongWait:       defaultPongWait,
+		PingPeriod:     defaultPingPeriod(defaultPongWait),
+		MaxMessageSize: minMessageSize,
+	}
+}
+
+// defaultMaxMessageSize returns a message size limit that fits the largest
+// valid inbound message: a placeBatch as large as a batch request body, or
+// a subscribe to every chunk of the canvas
+func defaultMaxMessageSize(canvas CanvasConfig, maxBatchBodyBytes int) int64 {
+	cols, rows := canvas.Chunks()
+	return int64(max(minMessageSize, maxBatchBodyBytes, cols*rows*subscribeChunkBytes))
+}
+
+// Validate checks that the timeouts are positive and pings come more often
+// than the pong wait
+func (c ClientConfig) Validate() error {
+	if c.WriteWait <= 0 || c.PongWait <= 0 || c.PingPeriod <= 0 {
+		return fmt.Errorf("WebSocket timeouts must be positive (write wait %s, pong wait %s, ping period %s)", c.WriteWait, c.PongWait, c.PingPeriod)
+	}
+	if c.MaxMessageSize < 1 {
+		return fmt.Errorf("WebSocket message size limit must be positive, got %d", c.MaxMessageSize)
+	}
+	if c.PingPeriod >= c.PongWait {
+		return fmt.Errorf("the ping period (%s) must be shorter than the pong wait (%s)", c.PingPeriod, c.PongWait)
+	}
+	return nil
+}
+
 // upgrader is used to upgrade HTTP connections to WebSocket connections
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
-	// Allow connections from any origin (for development)
-	// In production, you should restrict this to your frontend domain
+	// Allow connections from any origin; handleWebSocket replaces this with
+	// Server.checkOrigin so the CORS allowlist applies to WebSockets too
 	CheckOrigin: func(r *http.Request) bool {
 		return true
 	},
@@ -36,9 +106,120 @@ var upgrader = websocket.Upgrader{
 
 // Client represents a single WebSocket connection to a consumer
 type Client struct {
-	hub  *Hub              // Reference to the hub
-	conn *websocket.Conn   // The WebSocket connection
-	send chan []PixelUpdate // Channel for outbound pixel batches
+	hub  *Hub                 // Reference to the hub
+	conn *websocket.Conn      // The WebSocket connection
+	send chan outboundMessage // Channel for outbound batches and snapshots
+
+	// removed is set when the hub takes the client out and closes send, so
+	// send is closed exactly once however the client leaves (only touched by
+	// the hub goroutine, see Hub.remove)
+	removed bool
+
+	// Credit-based flow control (only used when paced is true)
+	// These fields are only touched by the hub goroutine
+	paced    bool          // Client opted in to acknowledging batches
+	sentSeq  int64         // Number of batches handed to the send channel
+	ackedSeq int64         // Number of batches the client has acknowledged
+	held     []PixelUpdate // Pixels waiting for the client to have credit again
+
+	// Send buffer backpressure (only touched by the hub goroutine)
+	// While stalls > 0 the send buffer was full and held has the pixels
+	// that didn't fit (see Hub.send)
+	stalls       int       // Failed send attempts in a row
+	stalledSince time.Time // When the first of them happened
+
+	// Initial snapshot handling (only touched by the hub goroutine)
+	wantsSnapshot bool                   // Client asked for a snapshot on connect
+	pending       map[[2]int]PixelUpdate // Snapshot pixels that may still be broadcast
+	pendingUntil  time.Time              // When pending stops being checked
+
+	// Part of the canvas the client subscribed to (only touched by the hub
+	// goroutine): a rectangle, or a set of chunks. When both are nil the
+	// client receives the whole canvas, which is where every client starts.
+	region *Region
+	chunks map[ChunkCoord]bool
+
+	// When the last pong (or the connection itself) arrived, in Unix nanoseconds
+	// Written by readPump and read by the hub's reaper, so it is atomic
+	lastPong atomic.Int64
+
+	// Control messages (such as placement results) waiting to be written
+	// Only writePump writes to the connection, so replies go through here
+	control chan []byte
+
+	// binary sends batches in the binary format of wire.go (?format=binary)
+	binary bool
+
+	// Where and when the client connected, for GET /api/admin/clients
+	addr        string
+	connectedAt time.Time
+
+	// Pixel placement over the WebSocket (placeBatch is nil when disabled)
+	userID     string // Identity given when connecting (?userId=)
+	team       string // Team given when connecting (?team=), see teams.go
+	placeBatch func(userID, team string, pixels []PixelUpdate) ([]placementResult, *placementError)
+}
+
+// Types of the pixel messages sent to clients
+const (
+	// messageSnapshot carries every visible pixel, sent once right after connecting
+	messageSnapshot = "snapshot"
+
+	// messageBatch carries pixels placed since the previous message
+	messageBatch = "batch"
+
+	// messageClear tells the client the canvas was cleared (pixels is empty)
+	messageClear = "clear"
+
+	// messageCursor gives a client connecting without a snapshot the cursor
+	// to resume from (pixels is empty), and messageResume carries what
+	// changed after a resuming client's cursor (see resume.go)
+	messageCursor = "cursor"
+	messageResume = "resume"
+)
+
+// outboundMessage is a pixel message sent to a client:
+// {"type":"snapshot"|"batch"|"clear"|"cursor"|"resume","pixels":[...]}
+// Snapshots, cursor and resume messages also carry "cursor".
+type outboundMessage struct {
+	Type   string        `json:"type"`
+	Pixels []PixelUpdate `json:"pixels"`
+	Cursor *int64        `json:"cursor,omitempty"`
+}
+
+// inboundMessage is a control message sent by a client
+// {"type":"ack","upTo":N} acknowledges the first N batches the client received
+// {"type":"placeBatch","id":"..","pixels":[...]} places pixels as the client's user
+// {"type":"subscribe","x":..,"y":..,"w":..,"h":..} receives only pixels inside that rectangle
+// {"type":"subscribe","chunks":[[cx,cy],...]} receives only pixels in those chunks
+// {"type":"subscribe"} (no rectangle or chunks) goes back to the whole canvas
+// {"type":"resume","cursor":N} asks for what changed after N (see resume.go)
+type inboundMessage struct {
+	Type   string        `json:"type"`
+	UpTo   int64         `json:"upTo"`
+	Cursor int64         `json:"cursor"`
+	ID     string        `json:"id,omitempty"`
+	Pixels []PixelUpdate `json:"pixels"`
+	Chunks []ChunkCoord  `json:"chunks"`
+
+	// Subscription rectangle: top-left corner and size
+	X int `json:"x"`
+	Y int `json:"y"`
+	W int `json:"w"`
+	H int `json:"h"`
+}
+
+// placeBatchResult is the reply to a placeBatch message
+// Results has one entry per submitted pixel, keyed by its index in the batch.
+// When the whole batch is rejected Results is empty and Status/Code/Error say
+// why.
+type placeBatchResult struct {
+	Type    string            `json:"type"`
+	ID      string            `json:"id,omitempty"`
+	Results []placementResult `json:"results"`
+	Status  int               `json:"status,omitempty"`
+	Code    string            `json:"code,omitempty"`
+	Error   string            `json:"error,omitempty"`
 }
 
 // readPump reads messages from the WebSocket connection
@@ -47,45 +228,194 @@ type Client struct {
 func (c *Client) readPump() {
 	defer func() {
 		// When this function exits, unregister the client and close connection
-		c.hub.unregister <- c
+		// (once the hub has stopped there's nobody left to unregister from)
+		select {
+		case c.hub.unregister <- c:
+		case <-c.hub.stop:
+		}
 		c.conn.Close()
 	}()
 
 	// Configure the connection
+	// A message over the size limit makes ReadMessage fail, which closes the
+	// connection with 1009 (message too big) below
+	c.conn.SetReadLimit(c.hub.clientConfig.MaxMessageSize)
+	pongWait := c.hub.clientConfig.PongWait
 	c.conn.SetReadDeadline(time.Now().Add(pongWait))
 	c.conn.SetPongHandler(func(string) error {
-		// When we receive a pong, extend the read deadline
+		// When we receive a pong, extend the read deadline and tell the reaper
 		c.conn.SetReadDeadline(time.Now().Add(pongWait))
+		c.lastPong.Store(timeNow().UnixNano())
 		return nil
 	})
 
 	// Read messages in a loop
-	// We discard any messages since consumers shouldn't send us data
+	// Control messages are handled; anything else is discarded
 	for {
-		_, _, err := c.conn.ReadMessage()
+		_, data, err := c.conn.ReadMessage()
 		if err != nil {
 			// Connection closed or error occurred
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Printf("WebSocket error: %v", err)
+				slog.Warn("WebSocket error", "err", err)
 			}
 			break
 		}
+
+		c.handleInbound(data)
+	}
+}
+
+// handleInbound processes a single message received from the client
+func (c *Client) handleInbound(data []byte) {
+	var msg inboundMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		// Not a control message - ignore it
+		return
+	}
+
+	switch msg.Type {
+	case "ack":
+		// Hand the acknowledgement to the hub, which owns the credit counters
+		select {
+		case c.hub.acks <- clientAck{client: c, upTo: msg.UpTo}:
+		case <-c.hub.stop:
+		}
+
+	case "placeBatch":
+		c.handlePlaceBatch(msg)
+
+	case "subscribe":
+		c.handleSubscribe(msg)
+
+	case "resume":
+		c.handleResume(msg)
+	}
+}
+
+// handleSubscribe hands a subscription to the hub, which filters the broadcasts
+// A rectangle takes precedence over chunks; one with w or h below 1 is ignored
+func (c *Client) handleSubscribe(msg inboundMessage) {
+	sub := clientSubscription{client: c, chunks: msg.Chunks}
+	if msg.W != 0 || msg.H != 0 {
+		if msg.W < 1 || msg.H < 1 {
+			slog.Debug("Ignoring subscription with an empty rectangle", "w", msg.W, "h", msg.H)
+			return
+		}
+		sub.region = &Region{X0: msg.X, Y0: msg.Y, X1: msg.X + msg.W - 1, Y1: msg.Y + msg.H - 1}
+		sub.chunks = nil
+	}
+
+	select {
+	case c.hub.subscriptions <- sub:
+	case <-c.hub.stop:
+	}
+}
+
+// subscribe replaces the client's subscription (called from the hub)
+// A nil chunk list goes back to the whole canvas; an empty one receives nothing
+func (c *Client) subscribe(sub clientSubscription) {
+	c.region = sub.region
+	c.chunks = nil
+	if sub.chunks == nil {
+		return
+	}
+
+	c.chunks = make(map[ChunkCoord]bool, len(sub.chunks))
+	for _, chunk := range sub.chunks {
+		c.chunks[chunk] = true
+	}
+}
+
+// subscribed returns the pixels of the batch that are inside the client's
+// subscription (called from the hub)
+func (c *Client) subscribed(batch []PixelUpdate) []PixelUpdate {
+	if c.region == nil && c.chunks == nil {
+		return batch
+	}
+
+	var subscribed []PixelUpdate
+	for _, pixel := range batch {
+		if c.region != nil && c.region.Contains(pixel.X, pixel.Y) ||
+			c.chunks != nil && c.chunks[chunkOf(pixel.X, pixel.Y, c.hub.chunkSize)] {
+			subscribed = append(subscribed, pixel)
+		}
+	}
+	return subscribed
+}
+
+// handlePlaceBatch places the pixels of a placeBatch message and replies
+// with the result for each pixel
+func (c *Client) handlePlaceBatch(msg inboundMessage) {
+	reply := placeBatchResult{Type: "placeBatchResult", ID: msg.ID, Results: []placementResult{}}
+
+	switch {
+	case c.placeBatch == nil:
+		reply.Status, reply.Code = http.StatusForbidden, codeForbidden
+		reply.Error = "pixel placement over WebSocket is disabled"
+	case c.userID == "":
+		reply.Status, reply.Code = http.StatusUnauthorized, codeUnauthorized
+		reply.Error = "connect with ?userId= (or ?token= when tokens are required) to place pixels"
+	default:
+		results, err := c.placeBatch(c.userID, c.team, msg.Pixels)
+		if err != nil {
+			reply.Status, reply.Code = err.status, err.code
+			reply.Error = err.message
+		} else {
+			reply.Results = results
+		}
+	}
+
+	data, err := json.Marshal(reply)
+	if err != nil {
+		slog.Error("Failed to marshal placement result", "err", err)
+		return
+	}
+	c.sendControl(data)
+}
+
+// sendControl queues a control message for writePump
+// A client that doesn't read its replies is disconnected rather than
+// letting the read loop block
+func (c *Client) sendControl(data []byte) {
+	select {
+	case c.control <- data:
+	default:
+		slog.Warn("Control buffer full, closing WebSocket connection")
+		c.conn.Close()
+	}
+}
+
+// encode turns a pixel message into the WebSocket message to send
+// Batches for binary clients become binary messages (see wire.go); everything
+// else, and any batch the binary format can't hold, is sent as JSON text.
+func (c *Client) encode(msg outboundMessage) (int, []byte, error) {
+	if c.binary && msg.Type == messageBatch {
+		data, err := encodeBatchBinary(msg.Pixels)
+		if err == nil {
+			return websocket.BinaryMessage, data, nil
+		}
+		slog.Warn("Sending batch as JSON instead of binary", "pixels", len(msg.Pixels), "err", err)
 	}
+
+	data, err := json.Marshal(msg)
+	return websocket.TextMessage, data, err
 }
 
-// writePump sends pixel batches to the WebSocket connection
+// writePump sends pixel messages to the WebSocket connection
 // It also sends periodic ping messages to keep the connection alive
 func (c *Client) writePump() {
 	// Create a ticker for sending ping messages
-	ticker := time.NewTicker(pingPeriod)
+	ticker := time.NewTicker(c.hub.pingInterval())
+	writeWait := c.hub.clientConfig.WriteWait
 	defer func() {
 		ticker.Stop()
 		c.conn.Close()
+		c.hub.pumps.Done()
 	}()
 
 	for {
 		select {
-		case batch, ok := <-c.send:
+		case msg, ok := <-c.send:
 			// Set write deadline
 			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
 
@@ -95,20 +425,31 @@ func (c *Client) writePump() {
 				return
 			}
 
-			// Convert the pixel batch to JSON
-			data, err := json.Marshal(batch)
+			// Convert the message to JSON, or a batch to the binary format
+			messageType, data, err := c.encode(msg)
 			if err != nil {
-				log.Printf("Failed to marshal batch: %v", err)
+				slog.Error("Failed to marshal message", "type", msg.Type, "err", err)
 				continue
 			}
 
-			// Send the JSON message
-			if err := c.conn.WriteMessage(websocket.TextMessage, data); err != nil {
-				log.Printf("Failed to write message: %v", err)
+			// Send the message, compressed if it is large enough
+			// This has no effect on clients that didn't negotiate compression
+			c.conn.EnableWriteCompression(len(data) >= compressThreshold)
+			if err := c.conn.WriteMessage(messageType, data); err != nil {
+				slog.Warn("Failed to write message", "err", err)
 				return
 			}
 
-			log.Printf("Sent batch of %d pixels to consumer", len(batch))
+			slog.Debug("Sent message to consumer", "type", msg.Type, "pixels", len(msg.Pixels))
+
+		case data := <-c.control:
+			// Send a control message such as a placement result
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			c.conn.EnableWriteCompression(len(data) >= compressThreshold)
+			if err := c.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+				slog.Warn("Failed to write message", "err", err)
+				return
+			}
 
 		case <-ticker.C:
 			// Send a ping message to keep the connection alive
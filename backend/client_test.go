@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// readPlaceBatchResult skips pixel messages until the reply to a placeBatch arrives
+func readPlaceBatchResult(t *testing.T, conn *websocket.Conn) placeBatchResult {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		conn.SetReadDeadline(deadline)
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("reading WebSocket message: %v", err)
+		}
+		var reply placeBatchResult
+		if err := json.Unmarshal(data, &reply); err == nil && reply.Type == "placeBatchResult" {
+			return reply
+		}
+	}
+}
+
+func TestWebSocketPlaceBatchPartialSuccess(t *testing.T) {
+	room := newTestRoom(t, map[string]string{"WS_PLACEMENT": "true", "MAX_BATCH_SIZE": "3", "PIXEL_COOLDOWN": "1h"})
+	ts := startTestServer(t, room)
+	conn := dialWS(t, ts, "/ws/queue?userId=alice&snapshot=false")
+
+	// The first pixel is placed, the second is invalid and the third is
+	// refused because the first one started alice's cooldown
+	conn.WriteJSON(map[string]interface{}{
+		"type": "placeBatch",
+		"id":   "b1",
+		"pixels": []map[string]interface{}{
+			{"x": 1, "y": 1, "color": "#FF0000"},
+			{"x": 2, "y": 1, "color": "red"},
+			{"x": 3, "y": 1, "color": "#FF0000"},
+		},
+	})
+
+	reply := readPlaceBatchResult(t, conn)
+	if reply.ID != "b1" || reply.Status != 0 || len(reply.Results) != 3 {
+		t.Fatalf("reply %+v, want three results for b1", reply)
+	}
+	want := []struct {
+		ok     bool
+		status int
+	}{{true, 0}, {false, http.StatusBadRequest}, {false, http.StatusTooManyRequests}}
+	for i, result := range reply.Results {
+		if result.Index != i || result.OK != want[i].ok || result.Status != want[i].status {
+			t.Errorf("result %d = %+v, want ok %v status %d", i, result, want[i].ok, want[i].status)
+		}
+	}
+
+	// The placed pixel belongs to the connection's user
+	batch := readBatch(t, conn, 2*time.Second)
+	if len(batch) != 1 || batch[0].X != 1 || batch[0].UserID != "alice" {
+		t.Fatalf("broadcast %+v, want alice's pixel at (1,1)", batch)
+	}
+}
+
+func TestWebSocketPlaceBatchTooLarge(t *testing.T) {
+	room := newTestRoom(t, map[string]string{"WS_PLACEMENT": "true", "MAX_BATCH_SIZE": "2", "PIXEL_COOLDOWN": "0s"})
+	ts := startTestServer(t, room)
+	conn := dialWS(t, ts, "/ws/queue?userId=alice&snapshot=false")
+
+	pixels := []map[string]interface{}{
+		{"x": 1, "y": 1, "color": "#FF0000"},
+		{"x": 2, "y": 1, "color": "#FF0000"},
+		{"x": 3, "y": 1, "color": "#FF0000"},
+	}
+	conn.WriteJSON(map[string]interface{}{"type": "placeBatch", "id": "big", "pixels": pixels})
+
+	reply := readPlaceBatchResult(t, conn)
+	if reply.ID != "big" || reply.Status != http.StatusRequestEntityTooLarge || reply.Code != codePayloadTooLarge || len(reply.Results) != 0 {
+		t.Fatalf("reply %+v, want the whole batch rejected with 413 %s", reply, codePayloadTooLarge)
+	}
+	// Nothing from the rejected batch was placed
+	if _, ok, _ := room.server.db.GetPixel(1, 1); ok || room.server.writer.Pending() != 0 {
+		t.Fatal("a pixel from the rejected batch was placed")
+	}
+}
+
+func TestWebSocketPlaceBatchNeedsUser(t *testing.T) {
+	ts := startTestServer(t, newTestRoom(t, map[string]string{"WS_PLACEMENT": "true"}))
+	conn := dialWS(t, ts, "/ws/queue?snapshot=false")
+
+	conn.WriteJSON(map[string]interface{}{"type": "placeBatch", "pixels": []map[string]interface{}{{"x": 1, "y": 1, "color": "#FF0000"}}})
+	if reply := readPlaceBatchResult(t, conn); reply.Status != http.StatusUnauthorized {
+		t.Fatalf("reply %+v, want 401", reply)
+	}
+}
+
+func TestOversizedFrameClosesConnection(t *testing.T) {
+	room := newTestRoom(t, map[string]string{"WS_MAX_MESSAGE_BYTES": "256"})
+	ts := startTestServer(t, room)
+	conn := dialWS(t, ts, "/ws/queue?snapshot=false")
+	readMessage(t, conn, time.Second) // The cursor
+	hub := room.server.hub
+	waitFor(t, time.Second, "the client to register", func() bool { return hub.ClientCount() == 1 })
+
+	// A message within the limit is fine
+	if err := conn.WriteJSON(map[string]interface{}{"type": "ack", "upTo": 0}); err != nil {
+		t.Fatalf("sending a small message: %v", err)
+	}
+
+	oversized := `{"type":"subscribe","chunks":["` + strings.Repeat("0", 1024) + `"]}`
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(oversized)); err != nil {
+		t.Fatalf("sending the oversized frame: %v", err)
+	}
+
+	// The server closes the connection. It says "message too big" first, but
+	// may hang up before that arrives, so any error but the timeout will do.
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		_, _, err := conn.ReadMessage()
+		if err == nil {
+			continue
+		}
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			t.Fatal("connection still open after the oversized frame")
+		}
+		break
+	}
+	waitFor(t, time.Second, "the client to be removed", func() bool { return hub.ClientCount() == 0 })
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Listing clients
+//
+// h.clients belongs to the hub goroutine: Run is the only code that reads or
+// writes it, which is why it needs no lock. An HTTP handler ranging over it
+// would race with registrations. Two ways of looking at the clients are safe
+// from other goroutines:
+//
+//   - Hub.ClientCount reads an atomic counter and never waits, for metrics
+//     and health checks
+//   - Hub.Clients asks Run for a list over the clientQueries channel, like
+//     the health probes do. Run builds the list between two events, so it is
+//     consistent, but a busy hub answers late. Callers give a timeout.
+//
+// GET /api/admin/clients uses Hub.Clients to show who is connected.
+
+// clientQueryTimeout is how long GET /api/admin/clients waits for the hub
+const clientQueryTimeout = 2 * time.Second
+
+// errHubBusy is returned by Hub.Clients when the hub doesn't answer in time
+var errHubBusy = errors.New("the hub didn't answer in time")
+
+// ClientInfo describes one connected WebSocket client
+type ClientInfo struct {
+	Addr        string    `json:"addr"`
+	UserID      string    `json:"userId,omitempty"`
+	Team        string    `json:"team,omitempty"`
+	ConnectedAt time.Time `json:"connectedAt"`
+	Format      string    `json:"format"`        // "json" or "binary"
+	Paced       bool      `json:"paced"`         // Acknowledges batches (?ack=true)
+	InFlight    int64     `json:"inFlight"`      // Batches sent but not acknowledged yet (paced clients)
+	Buffered    int       `json:"buffered"`      // Messages waiting in the send channel
+	Held        int       `json:"held"`          // Pixels held back for lack of credit or buffer space
+	Stalls      int       `json:"stalls"`        // Failed sends in a row because the buffer was full
+	Subscribed  string    `json:"subscribed"`    // "canvas", "region" or "chunks"
+	LastPongMs  int64     `json:"lastPongMsAgo"` // Time since the last pong
+}
+
+// clientsReport is the response of GET /api/admin/clients
+type clientsReport struct {
+	Count      int          `json:"count"`
+	MaxClients int          `json:"maxClients"` // 0 = no limit
+	Clients    []ClientInfo `json:"clients"`    // Oldest connection first
+}
+
+// Clients returns a description of every registered client
+// Safe to call from any goroutine. It fails with errHubBusy when Run doesn't
+// answer within timeout (or has stopped).
+func (h *Hub) Clients(timeout time.Duration) ([]ClientInfo, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	// The reply has room for the answer, so Run never waits for a caller
+	// that gave up
+	reply := make(chan []ClientInfo, 1)
+	select {
+	case h.clientQueries <- reply:
+	case <-timer.C:
+		return nil, errHubBusy
+	}
+
+	select {
+	case infos := <-reply:
+		return infos, nil
+	case <-timer.C:
+		return nil, errHubBusy
+	}
+}
+
+// clientInfos describes the registered clients (must be called from Run)
+func (h *Hub) clientInfos() []ClientInfo {
+	now := timeNow()
+	infos := make([]ClientInfo, 0, len(h.clients))
+	for client := range h.clients {
+		info := ClientInfo{
+			Addr:        client.addr,
+			UserID:      client.userID,
+			Team:        client.team,
+			ConnectedAt: client.connectedAt,
+			Format:      "json",
+			Paced:       client.paced,
+			Buffered:    len(client.send),
+			Held:        len(client.held),
+			Stalls:      client.stalls,
+			Subscribed:  "canvas",
+			LastPongMs:  now.Sub(time.Unix(0, client.lastPong.Load())).Milliseconds(),
+		}
+		if client.binary {
+			info.Format = "binary"
+		}
+		if client.paced {
+			info.InFlight = client.sentSeq - client.ackedSeq
+		}
+		if client.region != nil {
+			info.Subscribed = "region"
+		} else if client.chunks != nil {
+			info.Subscribed = "chunks"
+		}
+		infos = append(infos, info)
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ConnectedAt.Before(infos[j].ConnectedAt)
+	})
+	return infos
+}
+
+// handleAdminClients lists the connected WebSocket clients
+func (s *Server) handleAdminClients(w http.ResponseWriter, r *http.Request) {
+	clients, err := s.hub.Clients(clientQueryTimeout)
+	if err != nil {
+		slog.WarnContext(r.Context(), "Failed to list clients", "err", err)
+		writeError(w, http.StatusServiceUnavailable, codeUnavailable, "The hub is busy, try again")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(clientsReport{
+		Count:      len(clients),
+		MaxClients: s.hub.MaxClients(),
+		Clients:    clients,
+	})
+}
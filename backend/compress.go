@@ -0,0 +1,149 @@
+package main
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Response compression
+//
+// The full canvas as JSON is several megabytes, but very repetitive (the
+// same keys and a handful of colors over and over), so it compresses to a
+// small fraction of that. Endpoints wrapped with withCompression compress
+// their response with gzip or deflate when the client's Accept-Encoding
+// allows it; other clients get the plain response as before.
+//
+// Compressors keep large internal buffers, so they are reused through
+// sync.Pools instead of being allocated for every response.
+
+// Content codings withCompression can produce, in order of preference
+const (
+	encodingGzip    = "gzip"
+	encodingDeflate = "deflate" // zlib-wrapped deflate, as HTTP defines it
+)
+
+var (
+	gzipWriters = sync.Pool{New: func() interface{} { return gzip.NewWriter(io.Discard) }}
+	zlibWriters = sync.Pool{New: func() interface{} { return zlib.NewWriter(io.Discard) }}
+)
+
+// compressor is the common part of gzip.Writer and zlib.Writer
+type compressor interface {
+	io.WriteCloser
+	Reset(w io.Writer)
+}
+
+// withCompression compresses the handler's response if the client accepts it
+func withCompression(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Caches must keep compressed and plain responses apart
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		if encoding == "" || r.Method == http.MethodHead {
+			next(w, r)
+			return
+		}
+
+		pool := &gzipWriters
+		if encoding == encodingDeflate {
+			pool = &zlibWriters
+		}
+		zw := pool.Get().(compressor)
+		zw.Reset(w)
+		defer pool.Put(zw)
+
+		cw := &compressedResponse{ResponseWriter: w, compressor: zw, encoding: encoding}
+		next(cw, r)
+		cw.Close()
+	}
+}
+
+// negotiateEncoding picks gzip or deflate from an Accept-Encoding header,
+// or "" if the client accepts neither
+// A coding with q=0 is refused; "*" stands for any coding not listed.
+func negotiateEncoding(header string) string {
+	accepted := make(map[string]bool)
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding == "" {
+			continue
+		}
+		accepted[coding] = acceptQuality(params) > 0
+	}
+
+	for _, encoding := range []string{encodingGzip, encodingDeflate} {
+		if ok, listed := accepted[encoding]; listed {
+			if ok {
+				return encoding
+			}
+			continue
+		}
+		if accepted["*"] {
+			return encoding
+		}
+	}
+	return ""
+}
+
+// acceptQuality returns the q value of a coding's parameters (1 if absent)
+func acceptQuality(params string) float64 {
+	for _, param := range strings.Split(params, ";") {
+		name, value, found := strings.Cut(strings.TrimSpace(param), "=")
+		if !found || strings.ToLower(strings.TrimSpace(name)) != "q" {
+			continue
+		}
+		q, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil {
+			return 0
+		}
+		return q
+	}
+	return 1
+}
+
+// compressedResponse sends everything the handler writes through the
+// compressor
+type compressedResponse struct {
+	http.ResponseWriter
+	compressor  compressor
+	encoding    string
+	wroteHeader bool
+}
+
+// WriteHeader marks the body as compressed before the headers go out
+// The handler's Content-Length (if any) is for the uncompressed body, so it
+// is dropped.
+func (c *compressedResponse) WriteHeader(status int) {
+	if c.wroteHeader {
+		return
+	}
+	c.wroteHeader = true
+
+	header := c.Header()
+	header.Set("Content-Encoding", c.encoding)
+	header.Del("Content-Length")
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *compressedResponse) Write(data []byte) (int, error) {
+	if !c.wroteHeader {
+		c.WriteHeader(http.StatusOK)
+	}
+	return c.compressor.Write(data)
+}
+
+// Close finishes the compressed stream
+// A handler that wrote nothing still gets a valid (empty) compressed body
+func (c *compressedResponse) Close() error {
+	if !c.wroteHeader {
+		c.WriteHeader(http.StatusOK)
+	}
+	return c.compressor.Close()
+}
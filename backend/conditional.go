@@ -0,0 +1,221 @@
+package main
+
+import (
+	"database/sql"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Conditional placements
+//
+// A pixel with an expectedColor is only placed if the pixel at its coordinate
+// currently has that color, like a compare-and-swap. Bots and collaborative
+// tools use it to avoid painting over a change they haven't seen yet: if the
+// color differs, the placement is refused with 409 Conflict and the current
+// color, so the client can decide again.
+//
+// The comparison is against the base layer (the layer placements go to) and
+// ignores case. An empty coordinate has the canvas background color.
+//
+// Normal placements are saved by the background writer in batches, so the
+// database may be behind the canvas clients see. A conditional placement is
+// therefore saved on its own, right away: the writer is flushed first, and a
+// single conditional UPDATE (or an INSERT for an empty coordinate) both checks
+// the color and writes the pixel, so nothing can change it in between.
+//
+// The color is checked once before the rate limiter so a placement that is
+// already stale costs no cooldown. If someone changes the pixel between that
+// check and the write, the placement is still refused, but the cooldown has
+// been used.
+
+// errColorMismatch is the message of a refused conditional placement
+const errColorMismatch = "The pixel is no longer the expected color"
+
+// checkExpectedColor refuses a conditional placement whose expected color
+// doesn't match the pixel's current color
+// Pixels still waiting for the background writer count, newest first, so
+// this doesn't need to wait for a flush.
+func (s *Server) checkExpectedColor(pixel *PixelUpdate) *placementError {
+	current, err := s.currentColor(pixel.X, pixel.Y)
+	if err != nil {
+		slog.Error("Failed to read pixel for conditional placement", "x", pixel.X, "y", pixel.Y, "err", err)
+		pixelsRejected.WithLabelValues(rejectUnavailable).Inc()
+		return &placementError{status: http.StatusServiceUnavailable, code: codeUnavailable, message: "Database unavailable. Please try again later."}
+	}
+	if !strings.EqualFold(current, pixel.ExpectedColor) {
+		return colorMismatch(current)
+	}
+	return nil
+}
+
+// currentColor returns the base-layer color at (x, y), including pixels
+// not saved yet, or the background color if the coordinate is empty
+func (s *Server) currentColor(x, y int) (string, error) {
+	var newest *PixelUpdate
+	unsaved := s.writer.Unsaved()
+	for i := range unsaved {
+		if unsaved[i].X == x && unsaved[i].Y == y && (newest == nil || unsaved[i].Seq > newest.Seq) {
+			newest = &unsaved[i]
+		}
+	}
+	if newest != nil && isTransparent(newest.Color) {
+		return s.canvas.Background, nil
+	}
+	if newest != nil {
+		return newest.Color, nil
+	}
+
+	color, ok, err := s.db.GetBaseColor(x, y)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return s.canvas.Background, nil
+	}
+	return color, nil
+}
+
+// saveIfExpectedColor saves a conditional placement if the stored pixel
+// still has the expected color, and clears ExpectedColor for the broadcast
+func (s *Server) saveIfExpectedColor(pixel *PixelUpdate) *placementError {
+	// Earlier placements must be in the database before comparing with it
+	s.writer.Flush()
+
+	emptyMatches := strings.EqualFold(pixel.ExpectedColor, s.canvas.Background)
+
+	// A mismatch isn't a database failure, so it is reported outside persist
+	var current string
+	var applied bool
+	err := s.persist(func() (err error) {
+		current, applied, err = s.db.SavePixelIfColor(*pixel, pixel.ExpectedColor, emptyMatches)
+		return err
+	})
+	if err != nil {
+		slog.Error("Failed to save conditional placement", "x", pixel.X, "y", pixel.Y, "err", err)
+		pixelsRejected.WithLabelValues(rejectUnavailable).Inc()
+		return &placementError{status: http.StatusServiceUnavailable, code: codeUnavailable, message: "Database unavailable. Please try again later."}
+	}
+	if !applied {
+		if current == "" {
+			current = s.canvas.Background
+		}
+		return colorMismatch(current)
+	}
+
+	pixel.ExpectedColor = ""
+	return nil
+}
+
+// colorMismatch builds the 409 error of a refused conditional placement
+func colorMismatch(current string) *placementError {
+	pixelsRejected.WithLabelValues(rejectConflict).Inc()
+	return &placementError{status: http.StatusConflict, code: codeColorMismatch, message: errColorMismatch, currentColor: current}
+}
+
+// GetBaseColor returns the color of the base-layer pixel at (x, y)
+// The boolean result is false when the coordinate is empty
+func (d *Database) GetBaseColor(x, y int) (string, bool, error) {
+	var color string
+	err := d.db.QueryRow(d.rebind(`
+	SELECT color FROM canvas_state WHERE x = ? AND y = ? AND layer = ?
+	`), x, y, LayerBase).Scan(&color)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return color, true, nil
+}
+
+// SavePixelIfColor saves a base-layer pixel only if the stored pixel at its
+// coordinate has the expected color (ignoring case)
+// With emptyMatches an empty coordinate matches as well. The check and the
+// write are one statement, and the history entry and leaderboard count are
+// added in the same transaction. When nothing is saved, applied is false and
+// current is the stored color ("" for an empty coordinate).
+func (d *Database) SavePixelIfColor(pixel PixelUpdate, expected string, emptyMatches bool) (current string, applied bool, err error) {
+	err = d.serialize(func() (err error) {
+		if isTransparent(pixel.Color) {
+			current, applied, err = d.erasePixelIfColor(pixel, expected, emptyMatches)
+		} else {
+			current, applied, err = d.savePixelIfColor(pixel, expected, emptyMatches)
+		}
+		return err
+	})
+	return current, applied, err
+}
+
+// savePixelIfColor is SavePixelIfColor on the writer goroutine
+func (d *Database) savePixelIfColor(pixel PixelUpdate, expected string, emptyMatches bool) (current string, applied bool, err error) {
+	d.maintenance.RLock()
+	defer d.maintenance.RUnlock()
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return "", false, err
+	}
+	defer tx.Rollback()
+
+	timestamp := pixel.Timestamp
+	if timestamp == 0 {
+		timestamp = time.Now().UnixNano() / int64(1000000)
+	}
+	seq := d.assignSeq(pixel.Seq)
+
+	result, err := tx.Exec(d.rebind(`
+	UPDATE canvas_state SET color = ?, user_id = ?, updated_at = ?, seq = ?
+	WHERE x = ? AND y = ? AND layer = ? AND UPPER(color) = UPPER(?)
+	`), pixel.Color, pixel.UserID, timestamp, seq, pixel.X, pixel.Y, LayerBase, expected)
+	if err != nil {
+		return "", false, err
+	}
+	changed, err := result.RowsAffected()
+	if err != nil {
+		return "", false, err
+	}
+
+	// Nothing stored there yet: insert, unless someone else just did
+	if changed == 0 && emptyMatches {
+		result, err = tx.Exec(d.rebind(`
+		INSERT INTO canvas_state (x, y, layer, color, user_id, updated_at, seq)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (x, y, layer) DO NOTHING
+		`), pixel.X, pixel.Y, LayerBase, pixel.Color, pixel.UserID, timestamp, seq)
+		if err != nil {
+			return "", false, err
+		}
+		if changed, err = result.RowsAffected(); err != nil {
+			return "", false, err
+		}
+	}
+
+	if changed == 0 {
+		err := tx.QueryRow(d.rebind(`
+		SELECT color FROM canvas_state WHERE x = ? AND y = ? AND layer = ?
+		`), pixel.X, pixel.Y, LayerBase).Scan(&current)
+		if err == sql.ErrNoRows {
+			return "", false, nil
+		}
+		return current, false, err
+	}
+
+	_, err = tx.Exec(d.rebind(insertHistorySQL), pixel.X, pixel.Y, LayerBase, pixel.Color, pixel.UserID, timestamp, seq)
+	if err != nil {
+		return "", false, err
+	}
+	if pixel.UserID != "" {
+		if err := d.incrementUserCount(tx, pixel.UserID, timestamp); err != nil {
+			return "", false, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", false, err
+	}
+
+	d.version.Add(1)
+	return pixel.Color, true, nil
+}
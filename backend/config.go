@@ -0,0 +1,594 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Config holds the settings that can be loaded from a JSON config file
+// Palette, AllowedOrigins, Cooldown, ColorCooldowns, MaxUserIDLength, Zones and Teams can be changed at runtime
+// by editing the file and sending SIGHUP. ListenAddr, DBPath, Canvas and Batch are only read at startup.
+//
+// Every setting starts from a built-in default (DefaultConfig), is replaced
+// by the file's value when the file has one, and by the environment
+// variable's when that is set (applyEnv). The file can describe a whole
+// deployment, and the environment still adjusts one instance of it.
+type Config struct {
+	// Palette lists the allowed #RRGGBB colors (empty allows every color)
+	Palette []string `json:"palette"`
+
+	// AllowedOrigins lists the origins allowed by CORS (empty allows any origin)
+	AllowedOrigins []string `json:"allowedOrigins"`
+
+	// Cooldown is the time users must wait between pixels, e.g. "5s"
+	Cooldown Duration `json:"cooldown"`
+
+	// ColorCooldowns makes some colors cost more than one cooldown, e.g.
+	// {"#FFD700": 3} for a rare gold; colors not listed cost one
+	ColorCooldowns map[string]float64 `json:"colorCooldowns"`
+
+	// MaxUserIDLength is the longest userId accepted, in characters
+	MaxUserIDLength int `json:"maxUserIdLength"`
+
+	// Zones are areas of the canvas with their own placement rules (see zones.go)
+	Zones []Zone `json:"zones"`
+
+	// Teams restrict each user to their team's color (see teams.go)
+	Teams []Team `json:"teams"`
+
+	// ListenAddr is the address the HTTP server binds to (startup only)
+	ListenAddr string `json:"listenAddr"`
+
+	// DBPath is the SQLite database file (startup only, DATABASE_URL overrides it)
+	DBPath string `json:"dbPath"`
+
+	// Canvas is the size and look of the canvas (startup only)
+	Canvas CanvasConfig `json:"canvas"`
+
+	// Batch holds the broadcast and database batching settings (startup only)
+	Batch BatchConfig `json:"batch"`
+
+	// paletteSet is Palette in upper case, for O(1) lookups during validation
+	paletteSet map[string]bool
+
+	// colorCosts is ColorCooldowns with the colors in upper case
+	colorCosts map[string]float64
+
+	// zones is Zones indexed for lookups by coordinate
+	zones *Zones
+
+	// teams is Teams by name
+	teams map[string]*Team
+}
+
+// CanvasConfig holds the size of the canvas
+// Valid coordinates are 0 to Width-1 and 0 to Height-1
+type CanvasConfig struct {
+	Width  int `json:"width"`
+	Height int `json:"height"`
+
+	// Background is the #RRGGBB color of coordinates without a pixel
+	Background string `json:"background"`
+
+	// AlphaColors also accepts #RRGGBBAA pixel colors, where a fully
+	// transparent color erases the pixel (see alpha.go)
+	AlphaColors bool `json:"alphaColors"`
+
+	// ChunkSize is the side of the square tiles the canvas is split into
+	// for /api/chunk and WebSocket subscriptions (see chunk.go)
+	ChunkSize int `json:"chunkSize"`
+}
+
+// BatchConfig holds how pixels are grouped for broadcasting and saving
+// Larger batches or longer intervals mean fewer, bigger WebSocket messages
+// and transactions (more throughput) at the cost of latency.
+type BatchConfig struct {
+	Size     int      `json:"size"`     // Most pixels in a broadcast batch (BATCH_SIZE)
+	Interval Duration `json:"interval"` // Longest wait before a partial batch is broadcast (BATCH_INTERVAL)
+
+	DBSize          int      `json:"dbSize"`          // Most pixels saved per transaction (DB_BATCH_SIZE)
+	DBFlushInterval Duration `json:"dbFlushInterval"` // Longest wait before a partial batch is saved (DB_FLUSH_INTERVAL)
+}
+
+// Validate rejects batches that could never be sent or saved
+func (b BatchConfig) Validate() error {
+	if err := validateBatching(b.Size, time.Duration(b.Interval)); err != nil {
+		return err
+	}
+	if b.DBSize < 1 {
+		return fmt.Errorf("database batch size must be at least 1, got %d", b.DBSize)
+	}
+	if b.DBFlushInterval <= 0 {
+		return fmt.Errorf("database flush interval must be positive, got %s", time.Duration(b.DBFlushInterval))
+	}
+	return nil
+}
+
+// maxCanvasSize bounds each canvas dimension
+// Coordinates are sent as uint16 in the binary batch format
+const maxCanvasSize = 65535
+
+// maxCanvasArea bounds the number of pixels on a canvas
+// The PNG export, thumbnails, timelapses and seeding render the whole canvas
+// into one image of 4 bytes per pixel, so this keeps a render at 64 MB.
+// 65535x65535 would need about 17 GB.
+const maxCanvasArea = 4096 * 4096
+
+// Validate rejects sizes that can't hold any pixel or are too large
+func (c CanvasConfig) Validate() error {
+	if c.Width < 1 || c.Width > maxCanvasSize || c.Height < 1 || c.Height > maxCanvasSize {
+		return fmt.Errorf("canvas width and height must be between 1 and %d (got %dx%d)",
+			maxCanvasSize, c.Width, c.Height)
+	}
+	if c.Width*c.Height > maxCanvasArea {
+		return fmt.Errorf("canvas must not have more than %d pixels (got %dx%d = %d)",
+			maxCanvasArea, c.Width, c.Height, c.Width*c.Height)
+	}
+	if !hexColorRegex.MatchString(c.Background) {
+		return fmt.Errorf("canvas background %q is not in #RRGGBB format", c.Background)
+	}
+	if c.ChunkSize < 1 || c.ChunkSize > maxCanvasSize {
+		return fmt.Errorf("chunk size must be between 1 and %d (got %d)", maxCanvasSize, c.ChunkSize)
+	}
+	return nil
+}
+
+// Contains returns true if (x, y) is on the canvas
+func (c CanvasConfig) Contains(x, y int) bool {
+	return x >= 0 && x < c.Width && y >= 0 && y < c.Height
+}
+
+// Region returns the region covering the whole canvas
+func (c CanvasConfig) Region() Region {
+	return Region{X0: 0, Y0: 0, X1: c.Width - 1, Y1: c.Height - 1}
+}
+
+// Duration is a time.Duration that is written as a string like "5s" in JSON
+type Duration time.Duration
+
+// UnmarshalJSON parses a duration string such as "5s" or "1m30s"
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(parsed)
+	return nil
+}
+
+// MarshalJSON writes the duration as a string such as "5s"
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// DefaultConfig returns the built-in settings, used for everything neither
+// the config file nor the environment sets: a 5s cooldown, any color from
+// any origin, a 1000x1000 white canvas, ...
+func DefaultConfig() *Config {
+	cfg := &Config{
+		Cooldown:        Duration(5 * time.Second),
+		MaxUserIDLength: 64,
+		ListenAddr:      "0.0.0.0:8080",
+		DBPath:          "./canvas.db",
+		Canvas: CanvasConfig{
+			Width:      1000,
+			Height:     1000,
+			Background: "#FFFFFF",
+			ChunkSize:  defaultChunkSize,
+		},
+		Batch: BatchConfig{
+			Size:            defaultBatchSize,
+			Interval:        Duration(defaultBatchInterval),
+			DBSize:          100,
+			DBFlushInterval: Duration(100 * time.Millisecond),
+		},
+	}
+	cfg.prepare()
+	return cfg
+}
+
+// applyEnv replaces the settings whose environment variable is set
+// A variable that is set but invalid is logged and ignored.
+func (c *Config) applyEnv() {
+	if palette := envList("PALETTE"); palette != nil {
+		c.Palette = palette
+	}
+	if origins := envList("ALLOWED_ORIGINS"); origins != nil {
+		c.AllowedOrigins = origins
+	}
+	c.Cooldown = Duration(envDuration("PIXEL_COOLDOWN", time.Duration(c.Cooldown)))
+	c.MaxUserIDLength = envInt("USER_ID_MAX_LENGTH", c.MaxUserIDLength)
+	c.ListenAddr = envString("LISTEN_ADDR", c.ListenAddr)
+	c.DBPath = envString("DB_PATH", c.DBPath)
+
+	// Coordinates are 0 to size-1, and empty ones are drawn in the
+	// background color. CHUNK_SIZE is the side of the tiles served by
+	// /api/chunk, and ALPHA_COLORS allows translucent #RRGGBBAA colors and
+	// erasers.
+	c.Canvas.Width = envInt("CANVAS_WIDTH", c.Canvas.Width)
+	c.Canvas.Height = envInt("CANVAS_HEIGHT", c.Canvas.Height)
+	c.Canvas.Background = envString("CANVAS_BACKGROUND", c.Canvas.Background)
+	c.Canvas.ChunkSize = envInt("CHUNK_SIZE", c.Canvas.ChunkSize)
+	c.Canvas.AlphaColors = envBool("ALPHA_COLORS", c.Canvas.AlphaColors)
+
+	c.Batch.Size = envInt("BATCH_SIZE", c.Batch.Size)
+	c.Batch.Interval = Duration(envDuration("BATCH_INTERVAL", time.Duration(c.Batch.Interval)))
+	c.Batch.DBSize = envInt("DB_BATCH_SIZE", c.Batch.DBSize)
+	c.Batch.DBFlushInterval = Duration(envDuration("DB_FLUSH_INTERVAL", time.Duration(c.Batch.DBFlushInterval)))
+}
+
+// LoadConfig reads a JSON config file over the defaults, then applies the
+// environment variables that are set
+// With an empty path only the defaults and the environment are used.
+func LoadConfig(path string) (*Config, error) {
+	cfg := DefaultConfig()
+	source := "environment settings"
+	if path != "" {
+		source = "config " + path
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := decodeConfig(data, cfg); err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", path, err)
+		}
+	}
+
+	cfg.applyEnv()
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", source, err)
+	}
+
+	cfg.prepare()
+	return cfg, nil
+}
+
+// decodeConfig parses a config file into cfg
+// Unknown fields are rejected, so a misspelt setting isn't silently ignored,
+// and syntax errors name the line and column.
+func decodeConfig(data []byte, cfg *Config) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+
+	err := decoder.Decode(cfg)
+	if err == nil && decoder.More() {
+		err = errors.New("unexpected data after the top-level object")
+	}
+
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		line, column := lineAndColumn(data, syntaxErr.Offset)
+		return fmt.Errorf("line %d, column %d: %w", line, column, err)
+	case errors.As(err, &typeErr):
+		line, column := lineAndColumn(data, typeErr.Offset)
+		return fmt.Errorf("line %d, column %d: %s has the wrong type: expected %s, got %s", line, column, typeErr.Field, typeErr.Type, typeErr.Value)
+	}
+	return err
+}
+
+// lineAndColumn converts a byte offset in data into a 1-based line and column
+func lineAndColumn(data []byte, offset int64) (int, int) {
+	offset = min(offset, int64(len(data)))
+	before := data[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	column := int(offset) - bytes.LastIndexByte(before, '\n')
+	return line, column
+}
+
+// validate checks that the loaded values make sense
+func (c *Config) validate() error {
+	if err := c.Canvas.Validate(); err != nil {
+		return err
+	}
+	if err := c.Batch.Validate(); err != nil {
+		return err
+	}
+
+	if time.Duration(c.Cooldown) < 0 {
+		return fmt.Errorf("cooldown must not be negative")
+	}
+
+	if err := validateListenAddr(c.ListenAddr); err != nil {
+		return err
+	}
+
+	if c.MaxUserIDLength < 1 {
+		return fmt.Errorf("maxUserIdLength must be at least 1")
+	}
+
+	for i := range c.Zones {
+		if err := c.Zones[i].validate(); err != nil {
+			return err
+		}
+	}
+
+	for _, color := range c.Palette {
+		if !hexColorRegex.MatchString(color) {
+			return fmt.Errorf("palette color %q is not in #RRGGBB format", color)
+		}
+	}
+
+	if err := validateColorCooldowns(c.ColorCooldowns, c.Palette); err != nil {
+		return err
+	}
+
+	return validateTeams(c.Teams, c.Palette)
+}
+
+// validateColorCooldowns checks that every color is a #RRGGBB color (from the
+// palette, if there is one) with a positive multiplier
+func validateColorCooldowns(multipliers map[string]float64, palette []string) error {
+	for color, multiplier := range multipliers {
+		if !hexColorRegex.MatchString(color) {
+			return fmt.Errorf("colorCooldowns color %q is not in #RRGGBB format", color)
+		}
+		if len(palette) > 0 && !slices.ContainsFunc(palette, func(p string) bool { return strings.EqualFold(p, color) }) {
+			return fmt.Errorf("colorCooldowns color %q is not in the palette", color)
+		}
+		if multiplier <= 0 {
+			return fmt.Errorf("colorCooldowns multiplier for %q must be positive", color)
+		}
+	}
+	return nil
+}
+
+// validateListenAddr checks that addr is a host:port the server can bind to
+// The host may be empty (all interfaces); the port must be a number, so a
+// typo fails at startup instead of when the server starts listening
+func validateListenAddr(addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("listen address %q must be host:port, e.g. 0.0.0.0:8080: %w", addr, err)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		return fmt.Errorf("listen address %q has an invalid port %q", addr, port)
+	}
+	return nil
+}
+
+// prepare builds the lookup structures derived from the raw settings
+// Palette colors are normalized to upper case (and duplicates removed) so
+// "#ffffff" and "#FFFFFF" are the same color everywhere, including /api/palette
+func (c *Config) prepare() {
+	c.paletteSet = make(map[string]bool, len(c.Palette))
+	palette := make([]string, 0, len(c.Palette))
+	for _, color := range c.Palette {
+		color = strings.ToUpper(color)
+		if !c.paletteSet[color] {
+			c.paletteSet[color] = true
+			palette = append(palette, color)
+		}
+	}
+	c.Palette = palette
+
+	c.colorCosts = make(map[string]float64, len(c.ColorCooldowns))
+	for color, multiplier := range c.ColorCooldowns {
+		c.colorCosts[strings.ToUpper(color)] = multiplier
+	}
+
+	c.zones = NewZones(c.Zones)
+
+	c.teams = make(map[string]*Team, len(c.Teams))
+	for i := range c.Teams {
+		c.teams[c.Teams[i].Name] = &c.Teams[i]
+	}
+}
+
+// AllowsColor returns true if the color is in the palette (or there is no palette)
+func (c *Config) AllowsColor(color string) bool {
+	if len(c.paletteSet) == 0 {
+		return true
+	}
+	return c.paletteSet[strings.ToUpper(color)]
+}
+
+// ColorCost returns how many cooldowns a pixel of this color costs
+// A translucent color costs the same as its opaque color, and an eraser one.
+func (c *Config) ColorCost(color string) float64 {
+	if multiplier, ok := c.colorCosts[strings.ToUpper(opaquePart(color))]; ok && !isTransparent(color) {
+		return multiplier
+	}
+	return 1
+}
+
+// AllowsOrigin returns true if CORS requests from the origin are allowed
+func (c *Config) AllowsOrigin(origin string) bool {
+	if len(c.AllowedOrigins) == 0 {
+		return true
+	}
+	for _, allowed := range c.AllowedOrigins {
+		if allowed == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// LiveConfig holds the active Config and swaps it atomically on reload
+// Request handlers call Get on every request, so a reload takes effect
+// immediately without locks on the hot path
+type LiveConfig struct {
+	current atomic.Pointer[Config]
+	path    string // File the config was loaded from ("" when using defaults)
+}
+
+// NewLiveConfig loads the config file and wraps it for atomic access
+func NewLiveConfig(path string) (*LiveConfig, error) {
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+
+	lc := &LiveConfig{path: path}
+	lc.current.Store(cfg)
+	return lc, nil
+}
+
+// Get returns the active config
+// The returned value must be treated as read-only
+func (lc *LiveConfig) Get() *Config {
+	return lc.current.Load()
+}
+
+// Reload re-reads the config file and swaps it in
+// On error the previous config stays active. Startup-only settings that
+// changed in the file are logged and ignored.
+func (lc *LiveConfig) Reload() (*Config, error) {
+	next, err := LoadConfig(lc.path)
+	if err != nil {
+		return nil, err
+	}
+
+	prev := lc.Get()
+	if next.ListenAddr != prev.ListenAddr {
+		slog.Warn("Config reload: ignoring listenAddr change, restart required", "from", prev.ListenAddr, "to", next.ListenAddr)
+		next.ListenAddr = prev.ListenAddr
+	}
+	if next.DBPath != prev.DBPath {
+		slog.Warn("Config reload: ignoring dbPath change, restart required", "from", prev.DBPath, "to", next.DBPath)
+		next.DBPath = prev.DBPath
+	}
+	if next.Canvas != prev.Canvas {
+		slog.Warn("Config reload: ignoring canvas change, restart required")
+		next.Canvas = prev.Canvas
+	}
+	if next.Batch != prev.Batch {
+		slog.Warn("Config reload: ignoring batch change, restart required")
+		next.Batch = prev.Batch
+	}
+
+	lc.current.Store(next)
+	return next, nil
+}
+
+// watchReload reloads the config whenever the process receives SIGHUP
+// The new cooldown is handed to setCooldown, which passes it on to the rate
+// limiters; everything else is read from the LiveConfig by the handlers on
+// their next request
+func watchReload(lc *LiveConfig, setCooldown func(time.Duration)) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	for range signals {
+		if lc.path == "" {
+			slog.Info("Received SIGHUP but no config file is in use, nothing to reload")
+			continue
+		}
+
+		cfg, err := lc.Reload()
+		if err != nil {
+			slog.Error("Config reload failed, keeping previous config", "err", err)
+			continue
+		}
+
+		setCooldown(time.Duration(cfg.Cooldown))
+		slog.Info("Config reloaded", "path", lc.path, "paletteColors", len(cfg.Palette),
+			"origins", len(cfg.AllowedOrigins), "cooldown", time.Duration(cfg.Cooldown))
+	}
+}
+
+// envList reads a comma-separated environment variable
+// Entries are trimmed and empty ones skipped; an unset variable gives nil
+func envList(name string) []string {
+	var list []string
+	for _, item := range strings.Split(os.Getenv(name), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// envString reads a string environment variable
+// Falls back to the default when the variable is unset
+func envString(name string, def string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return def
+}
+
+// envInt reads an integer environment variable
+// Falls back to the default when the variable is unset or not a valid integer
+func envInt(name string, def int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		slog.Warn("Invalid environment variable, using default", "name", name, "value", value, "default", def)
+		return def
+	}
+	return n
+}
+
+// envDuration reads a duration environment variable such as "5s" or "250ms"
+// Falls back to the default when the variable is unset or not a valid duration
+func envDuration(name string, def time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		slog.Warn("Invalid environment variable, using default", "name", name, "value", value, "default", def)
+		return def
+	}
+	return d
+}
+
+// envFloat reads a decimal environment variable such as "2.5"
+// Falls back to the default when the variable is unset or not a valid number
+func envFloat(name string, def float64) float64 {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		slog.Warn("Invalid environment variable, using default", "name", name, "value", value, "default", def)
+		return def
+	}
+	return f
+}
+
+// envBool reads a boolean environment variable ("true", "1", "false", "0", ...)
+// Falls back to the default when the variable is unset or not a valid boolean
+func envBool(name string, def bool) bool {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		slog.Warn("Invalid environment variable, using default", "name", name, "value", value, "default", def)
+		return def
+	}
+	return b
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeConfig writes a config file for LiveConfig to load
+func writeConfig(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("writing config: %v", err)
+	}
+}
+
+func TestReloadRemovesPaletteColor(t *testing.T) {
+	room := newTestRoom(t, nil)
+	ts := startTestServer(t, room)
+
+	// Point the room's config at a file, like -config does
+	path := filepath.Join(t.TempDir(), "config.json")
+	writeConfig(t, path, `{"palette": ["#FF0000", "#00FF00"]}`)
+	live := room.server.config
+	live.path = path
+	if _, err := live.Reload(); err != nil {
+		t.Fatalf("first load: %v", err)
+	}
+
+	if status, body := postPixel(t, ts, `{"x":1,"y":1,"color":"#00FF00","userId":"alice"}`); status != http.StatusOK {
+		t.Fatalf("green before the reload: %d %v, want 200", status, body)
+	}
+
+	// Green leaves the palette; the next request sees the new one
+	writeConfig(t, path, `{"palette": ["#FF0000"]}`)
+	if _, err := live.Reload(); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	status, body := postPixel(t, ts, `{"x":2,"y":1,"color":"#00FF00","userId":"bob"}`)
+	if status != http.StatusBadRequest || errorCode(body) != codeValidation {
+		t.Fatalf("green after the reload: %d %v, want 400 %s", status, body, codeValidation)
+	}
+	if status, body := postPixel(t, ts, `{"x":3,"y":1,"color":"#FF0000","userId":"carol"}`); status != http.StatusOK {
+		t.Fatalf("red after the reload: %d %v, want 200", status, body)
+	}
+}
+
+func TestReloadKeepsStartupSettings(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	writeConfig(t, path, `{"listenAddr": "127.0.0.1:8080", "cooldown": "5s"}`)
+	live, err := NewLiveConfig(path)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+
+	writeConfig(t, path, `{"listenAddr": "127.0.0.1:9090", "cooldown": "2s", "canvas": {"width": 10, "height": 10, "background": "#FFFFFF", "chunkSize": 5}}`)
+	cfg, err := live.Reload()
+	if err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if cfg.ListenAddr != "127.0.0.1:8080" || cfg.Canvas.Width != 1000 {
+		t.Fatalf("startup-only settings changed: listenAddr %s, width %d", cfg.ListenAddr, cfg.Canvas.Width)
+	}
+	if time.Duration(cfg.Cooldown) != 2*time.Second {
+		t.Fatalf("cooldown %s, want the reloaded 2s", time.Duration(cfg.Cooldown))
+	}
+}
+
+func TestReloadKeepsPreviousConfigOnError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	writeConfig(t, path, `{"palette": ["#FF0000"]}`)
+	live, err := NewLiveConfig(path)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+
+	writeConfig(t, path, `{"palette": ["red"]}`)
+	if _, err := live.Reload(); err == nil {
+		t.Fatal("reload of an invalid palette succeeded")
+	}
+	if !live.Get().AllowsColor("#FF0000") || live.Get().AllowsColor("#00FF00") {
+		t.Fatal("the previous palette is no longer active")
+	}
+}
+
+func TestCanvasConfigValidate(t *testing.T) {
+	tests := []struct {
+		width, height int
+		valid         bool
+	}{
+		{1000, 1000, true},
+		{1, 1, true},
+		{4096, 4096, true},
+		{65535, 256, true}, // Wide but within the area limit
+		{0, 1000, false},
+		{1000, -1, false},
+		{65536, 1, false},
+		{4097, 4096, false},
+		{65535, 65535, false}, // Would render into a 17 GB image
+	}
+
+	for _, test := range tests {
+		canvas := CanvasConfig{Width: test.width, Height: test.height, Background: "#FFFFFF", ChunkSize: 256}
+		if err := canvas.Validate(); (err == nil) != test.valid {
+			t.Errorf("%dx%d: error %v, want valid %v", test.width, test.height, err, test.valid)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// CORS preflight
+//
+// Before a cross-origin request with a JSON body or an Authorization header,
+// browsers send an OPTIONS request to the same path and only go on if the
+// answer allows the method and headers. Every route used to register an
+// OPTIONS handler of its own with a hand-written method list, so a route
+// could be missing one (the admin and health endpoints were) or list the
+// wrong methods.
+//
+// withPreflight answers OPTIONS for every route of a mux instead. The
+// methods come from the mux itself: it asks the router which methods it has
+// a handler for at the request's path, so the answer always matches the
+// routes, including path patterns like /api/chunk/{cx}/{cy} and routes that
+// only exist when a feature is on. The response is 204 No Content with the
+// CORS headers (see writeCORS) and the same methods in Allow. A path nothing
+// is registered for still gets the router's 404.
+//
+// A route that has to add headers of its own to the preflight (Accept-Post
+// on /api/pixel) can still register an OPTIONS handler; it is called after
+// the common headers are set and writes the status itself.
+
+// preflightMethods are the methods a preflight response can list
+// GET routes also answer HEAD, like the router's own 405 Allow header says.
+var preflightMethods = []string{
+	http.MethodGet,
+	http.MethodHead,
+	http.MethodPost,
+	http.MethodPut,
+	http.MethodPatch,
+	http.MethodDelete,
+}
+
+// withPreflight answers CORS preflight (OPTIONS) requests for every route of
+// mux and passes everything else on
+func (s *Server) withPreflight(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodOptions {
+			mux.ServeHTTP(w, r)
+			return
+		}
+
+		methods := allowedMethods(mux, r)
+		if len(methods) == 0 {
+			mux.ServeHTTP(w, r)
+			return
+		}
+		allow := strings.Join(append(methods, http.MethodOptions), ", ")
+		w.Header().Set("Allow", allow)
+		s.writeCORS(w, r, allow)
+
+		// A route's own OPTIONS handler adds to the answer
+		if _, pattern := mux.Handler(r); pattern != "" {
+			mux.ServeHTTP(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// allowedMethods returns the methods mux has a handler for at the path of r
+func allowedMethods(mux *http.ServeMux, r *http.Request) []string {
+	var methods []string
+	for _, method := range preflightMethods {
+		probe := r.Clone(r.Context())
+		probe.Method = method
+		if _, pattern := mux.Handler(probe); pattern != "" {
+			methods = append(methods, method)
+		}
+	}
+	return methods
+}
@@ -1,23 +1,145 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
 	"database/sql"
-	"log"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"math"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
-// Database manages the SQLite connection and canvas state persistence
+// Canvas layers, from bottom to top
+// When several layers have a pixel at the same coordinate, the highest layer wins.
+// Removing a pixel from an upper layer reveals whatever is underneath it.
+const (
+	// LayerBase holds the pixels placed by regular users
+	LayerBase = 0
+
+	// LayerOverlay holds admin-controlled pixels drawn on top of the base layer
+	LayerOverlay = 1
+)
+
+// visibleLayerFilter is a SQL condition on canvas_state aliased as "c" that
+// keeps only the row on the highest layer of each coordinate, i.e. the pixel
+// that is actually visible after compositing
+const visibleLayerFilter = `c.layer = (
+		SELECT MAX(layer) FROM canvas_state WHERE x = c.x AND y = c.y
+	)`
+
+// ColorCount is the number of visible pixels of a single color
+type ColorCount struct {
+	Color string `json:"color"`
+	Count int    `json:"count"`
+}
+
+// UserStat is the number of visible pixels owned by a single user
+type UserStat struct {
+	UserID string `json:"userId"`
+	Count  int    `json:"count"`
+}
+
+// HistoryEntry is one append-only record in the pixel history
+// An entry with an empty Color is a tombstone: it records that the pixel
+// was removed from its layer rather than painted
+type HistoryEntry struct {
+	ID       int64  // Order in which the entry was written
+	X        int    // X coordinate
+	Y        int    // Y coordinate
+	Layer    int    // Canvas layer the entry applies to
+	Color    string // Hex color, or "" for a tombstone
+	UserID   string // User who made the change
+	PlacedAt int64  // Unix timestamp in milliseconds
+	Seq      int64  // Sequence number deciding the order of placements (see sequence.go)
+}
+
+// IsTombstone returns true if the entry removes a pixel instead of placing one
+func (e HistoryEntry) IsTombstone() bool {
+	return e.Color == ""
+}
+
+// Database manages the database connection and canvas state persistence
+// The same queries run on SQLite and PostgreSQL; dialect says which one
+// this is (see OpenDatabase)
 type Database struct {
-	db *sql.DB
+	db      *sql.DB
+	dialect string
+
+	// version increases on every write so caches can tell when the canvas changed
+	version atomic.Int64
+
+	// seq is the last sequence number handed out (see sequence.go)
+	seq atomic.Int64
+
+	// maintenance is held for reading by write transactions and for writing
+	// by Vacuum, so a vacuum never runs in the middle of a write
+	maintenance sync.RWMutex
+
+	// retries says how writes are retried after transient errors
+	retries RetryPolicy
+
+	// writes feeds the single writer goroutine of a SQLite database
+	// (see serialize.go); nil on PostgreSQL
+	writes *writeQueue
+}
+
+// SQLite journal and sync settings (SQLITE_JOURNAL_MODE, SQLITE_SYNCHRONOUS)
+// WAL lets readers keep reading while a batch is written, and NORMAL only
+// syncs at checkpoints instead of on every commit. A crash can't corrupt the
+// database either way, but with NORMAL the last commits before a power loss
+// may be lost; FULL syncs every commit for deployments that can't accept that.
+var (
+	sqliteJournalModes = []string{"DELETE", "TRUNCATE", "PERSIST", "MEMORY", "WAL", "OFF"}
+	sqliteSyncModes    = []string{"OFF", "NORMAL", "FULL", "EXTRA"}
+)
+
+// sqliteDSN adds the journal mode and synchronous setting to a SQLite path
+// They are passed to the driver rather than run as PRAGMAs because
+// synchronous only applies to the connection it is run on, and database/sql
+// opens several connections.
+func sqliteDSN(dbPath, journalMode, synchronous string) (string, error) {
+	journalMode, synchronous = strings.ToUpper(journalMode), strings.ToUpper(synchronous)
+	if !containsString(sqliteJournalModes, journalMode) {
+		return "", fmt.Errorf("unknown SQLite journal mode %q (use one of %s)", journalMode, strings.Join(sqliteJournalModes, ", "))
+	}
+	if !containsString(sqliteSyncModes, synchronous) {
+		return "", fmt.Errorf("unknown SQLite synchronous setting %q (use one of %s)", synchronous, strings.Join(sqliteSyncModes, ", "))
+	}
+
+	separator := "?"
+	if strings.Contains(dbPath, "?") {
+		separator = "&"
+	}
+	return dbPath + separator + "_journal_mode=" + journalMode + "&_synchronous=" + synchronous, nil
+}
+
+// containsString returns true if list has the given value
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
 }
 
 // NewDatabase creates a new database connection and initializes the schema
 func NewDatabase(dbPath string) (*Database, error) {
+	dsn, err := sqliteDSN(dbPath, envString("SQLITE_JOURNAL_MODE", "WAL"), envString("SQLITE_SYNCHRONOUS", "NORMAL"))
+	if err != nil {
+		return nil, err
+	}
+
 	// Open SQLite database file
 	// If the file doesn't exist, it will be created
-	db, err := sql.Open("sqlite3", dbPath)
+	db, err := sql.Open("sqlite3", dsn)
 	if err != nil {
 		return nil, err
 	}
@@ -27,74 +149,625 @@ func NewDatabase(dbPath string) (*Database, error) {
 		return nil, err
 	}
 
-	database := &Database{db: db}
+	database := &Database{db: db, dialect: dialectSQLite, retries: defaultRetryPolicy}
 
 	// Initialize the schema
 	if err := database.initSchema(); err != nil {
 		return nil, err
 	}
 
-	log.Printf("Database initialized at %s", dbPath)
+	// From now on every write goes through one goroutine
+	database.startWriter()
+
+	slog.Info("Database initialized", "path", dbPath)
 	return database, nil
 }
 
-// initSchema creates the canvas_state table if it doesn't exist
+// initSchema creates the SQLite tables if they don't exist
+// PostgreSQL has its own version in postgres.go
 func (d *Database) initSchema() error {
 	schema := `
 	CREATE TABLE IF NOT EXISTS canvas_state (
 		x INTEGER NOT NULL,
 		y INTEGER NOT NULL,
+		layer INTEGER NOT NULL DEFAULT 0,
 		color TEXT NOT NULL,
 		user_id TEXT,
 		updated_at INTEGER NOT NULL,
-		PRIMARY KEY (x, y)
+		seq INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (x, y, layer)
 	);
+	`
+
+	_, err := d.db.Exec(schema)
+	if err != nil {
+		return err
+	}
+
+	// Databases created before layers existed need their table rebuilt
+	if err := d.migrateLayers(); err != nil {
+		return err
+	}
 
+	indexesAndHistory := `
 	CREATE INDEX IF NOT EXISTS idx_updated_at ON canvas_state(updated_at);
+
+	CREATE TABLE IF NOT EXISTS pixel_history (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		x INTEGER NOT NULL,
+		y INTEGER NOT NULL,
+		layer INTEGER NOT NULL DEFAULT 0,
+		color TEXT NOT NULL,
+		user_id TEXT,
+		placed_at INTEGER NOT NULL,
+		seq INTEGER NOT NULL DEFAULT 0
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_history_placed_at ON pixel_history(placed_at);
+	CREATE INDEX IF NOT EXISTS idx_history_xy ON pixel_history(x, y, placed_at);
 	`
 
-	_, err := d.db.Exec(schema)
+	_, err = d.db.Exec(indexesAndHistory)
 	if err != nil {
 		return err
 	}
 
-	log.Println("Database schema initialized")
+	if err := d.initSequence(); err != nil {
+		return err
+	}
+
+	if err := d.initLeaderboard(); err != nil {
+		return err
+	}
+
+	if err := d.initShadowBans(); err != nil {
+		return err
+	}
+
+	slog.Info("Database schema initialized")
 	return nil
 }
 
-// SavePixel saves or updates a pixel in the database
-// Uses REPLACE to handle both INSERT and UPDATE cases
-func (d *Database) SavePixel(pixel PixelUpdate) error {
-	query := `
-	REPLACE INTO canvas_state (x, y, color, user_id, updated_at)
-	VALUES (?, ?, ?, ?, ?)
+// migrateLayers upgrades a canvas_state table without a layer column
+// SQLite can't change a primary key in place, so the table is copied into a new one
+// Existing pixels all end up on the base layer
+func (d *Database) migrateLayers() error {
+	var count int
+	err := d.db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('canvas_state') WHERE name = 'layer'`).Scan(&count)
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		// Already has the layer column - nothing to do
+		return nil
+	}
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	migration := `
+	ALTER TABLE canvas_state RENAME TO canvas_state_old;
+
+	CREATE TABLE canvas_state (
+		x INTEGER NOT NULL,
+		y INTEGER NOT NULL,
+		layer INTEGER NOT NULL DEFAULT 0,
+		color TEXT NOT NULL,
+		user_id TEXT,
+		updated_at INTEGER NOT NULL,
+		PRIMARY KEY (x, y, layer)
+	);
+
+	INSERT INTO canvas_state (x, y, layer, color, user_id, updated_at)
+	SELECT x, y, 0, color, user_id, updated_at FROM canvas_state_old;
+
+	DROP TABLE canvas_state_old;
 	`
 
+	if _, err := tx.Exec(migration); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	slog.Info("Migrated canvas_state to layered schema")
+	return nil
+}
+
+// SavePixel saves or updates a pixel on the base layer
+func (d *Database) SavePixel(pixel PixelUpdate) error {
+	return d.SavePixelToLayer(pixel, LayerBase)
+}
+
+// SavePixelToLayer saves or updates a pixel on the given layer
+// The placement is also appended to the pixel history. A nonzero timestamp is
+// stored as it is: callers pass the server's clock or a timestamp checked
+// against a TimestampPolicy (see timestamps.go).
+func (d *Database) SavePixelToLayer(pixel PixelUpdate, layer int) error {
 	// Use provided timestamp or current time
 	timestamp := pixel.Timestamp
 	if timestamp == 0 {
 		timestamp = time.Now().UnixNano() / int64(1000000)
 	}
 
-	_, err := d.db.Exec(query, pixel.X, pixel.Y, pixel.Color, pixel.UserID, timestamp)
+	entry := HistoryEntry{
+		X:        pixel.X,
+		Y:        pixel.Y,
+		Layer:    layer,
+		Color:    pixel.Color,
+		UserID:   pixel.UserID,
+		PlacedAt: timestamp,
+		Seq:      pixel.Seq,
+	}
+
+	if err := d.ApplyHistoryEntry(entry); err != nil {
+		slog.Error("Failed to save pixel", "x", pixel.X, "y", pixel.Y, "layer", layer, "err", err)
+		return err
+	}
+
+	return nil
+}
+
+// DeletePixelFromLayer removes a pixel from a single layer
+// Any pixel on a lower layer at the same coordinate becomes visible again.
+// The removal is recorded in the history as a tombstone.
+func (d *Database) DeletePixelFromLayer(x, y, layer int) error {
+	entry := HistoryEntry{
+		X:        x,
+		Y:        y,
+		Layer:    layer,
+		PlacedAt: time.Now().UnixNano() / int64(1000000),
+	}
+
+	return d.ApplyHistoryEntry(entry)
+}
+
+// SQL shared by single and batched writes
+const (
+	// insertHistorySQL appends one entry to the pixel history
+	insertHistorySQL = `
+	INSERT INTO pixel_history (x, y, layer, color, user_id, placed_at, seq)
+	VALUES (?, ?, ?, ?, ?, ?, ?)
+	`
+
+	// upsertPixelSQL inserts a pixel, or overwrites the stored one only when
+	// this placement comes after it in sequence order
+	upsertPixelSQL = `
+	INSERT INTO canvas_state (x, y, layer, color, user_id, updated_at, seq)
+	VALUES (?, ?, ?, ?, ?, ?, ?)
+	ON CONFLICT (x, y, layer) DO UPDATE SET
+		color = excluded.color,
+		user_id = excluded.user_id,
+		updated_at = excluded.updated_at,
+		seq = excluded.seq
+	WHERE excluded.seq >= canvas_state.seq
+	`
+)
+
+// SavePixelBatch saves many base-layer pixels in a single transaction
+// Each pixel is appended to the history and applied to canvas_state with
+// prepared statements, in slice order. Together with the "not before the
+// stored sequence number" rule this means the latest color for a coordinate
+// wins. Pixels without a sequence number get one here.
+// Each pixel also counts towards its user's leaderboard total.
+// A transient error (the database is busy) is retried (see retry.go).
+func (d *Database) SavePixelBatch(pixels []PixelUpdate) error {
+	return d.SavePixelBatchToLayer(pixels, LayerBase)
+}
+
+// SavePixelBatchToLayer is SavePixelBatch for any layer
+// Only base-layer pixels count towards the leaderboard (see countsForLeaderboard).
+func (d *Database) SavePixelBatchToLayer(pixels []PixelUpdate, layer int) error {
+	if len(pixels) == 0 {
+		return nil
+	}
+
+	// Numbers are assigned once, so a retried batch keeps them
+	seqs := make([]int64, len(pixels))
+	for i, pixel := range pixels {
+		seqs[i] = d.assignSeq(pixel.Seq)
+	}
+
+	return d.withRetry(func() error { return d.savePixelBatch(pixels, seqs, layer) })
+}
+
+// savePixelBatch is one attempt of SavePixelBatchToLayer
+func (d *Database) savePixelBatch(pixels []PixelUpdate, seqs []int64, layer int) error {
+	d.maintenance.RLock()
+	defer d.maintenance.RUnlock()
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	insertHistory, err := tx.Prepare(d.rebind(insertHistorySQL))
+	if err != nil {
+		return err
+	}
+	defer insertHistory.Close()
+
+	upsertPixel, err := tx.Prepare(d.rebind(upsertPixelSQL))
+	if err != nil {
+		return err
+	}
+	defer upsertPixel.Close()
+
+	incrementCount, err := tx.Prepare(d.rebind(incrementUserCountSQL))
 	if err != nil {
-		log.Printf("Failed to save pixel (%d, %d): %v", pixel.X, pixel.Y, err)
+		return err
+	}
+	defer incrementCount.Close()
+
+	for i, pixel := range pixels {
+		timestamp := pixel.Timestamp
+		if timestamp == 0 {
+			timestamp = time.Now().UnixNano() / int64(1000000)
+		}
+
+		seq := seqs[i]
+
+		// An eraser removes the pixel and is recorded as a tombstone (see alpha.go)
+		if isTransparent(pixel.Color) {
+			if _, err := insertHistory.Exec(pixel.X, pixel.Y, layer, "", pixel.UserID, timestamp, seq); err != nil {
+				return err
+			}
+			if _, err := tx.Exec(d.rebind(erasePixelSQL), pixel.X, pixel.Y, layer, seq); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if _, err := insertHistory.Exec(pixel.X, pixel.Y, layer, pixel.Color, pixel.UserID, timestamp, seq); err != nil {
+			return err
+		}
+		if _, err := upsertPixel.Exec(pixel.X, pixel.Y, layer, pixel.Color, pixel.UserID, timestamp, seq); err != nil {
+			return err
+		}
+		if layer == LayerBase && pixel.UserID != "" {
+			if _, err := incrementCount.Exec(pixel.UserID, timestamp); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
 		return err
 	}
 
+	d.version.Add(1)
 	return nil
 }
 
-// GetAllPixels retrieves all pixels from the database
-// Returns a slice of PixelUpdate representing the current canvas state
+// ApplyHistoryEntry appends an entry to the history and applies it to canvas_state
+// Both writes, and the user's leaderboard count, happen in one transaction.
+// The canvas is only changed when the entry's sequence number is at least the
+// stored one, so applying entries in sequence order always ends with the
+// latest placement winning. An entry without a sequence number gets one here.
+// A transient error (the database is busy) is retried (see retry.go).
+func (d *Database) ApplyHistoryEntry(entry HistoryEntry) error {
+	entry.Seq = d.assignSeq(entry.Seq)
+
+	return d.withRetry(func() error { return d.applyHistoryEntry(entry) })
+}
+
+// applyHistoryEntry is one attempt of ApplyHistoryEntry
+func (d *Database) applyHistoryEntry(entry HistoryEntry) error {
+	d.maintenance.RLock()
+	defer d.maintenance.RUnlock()
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(d.rebind(insertHistorySQL), entry.X, entry.Y, entry.Layer, entry.Color, entry.UserID, entry.PlacedAt, entry.Seq)
+	if err != nil {
+		return err
+	}
+
+	if entry.IsTombstone() {
+		// Remove the pixel unless something newer was placed after the removal
+		_, err = tx.Exec(d.rebind(`
+		DELETE FROM canvas_state
+		WHERE x = ? AND y = ? AND layer = ? AND seq <= ?
+		`), entry.X, entry.Y, entry.Layer, entry.Seq)
+	} else {
+		// Insert, or overwrite only when this placement comes after the stored one
+		_, err = tx.Exec(d.rebind(upsertPixelSQL), entry.X, entry.Y, entry.Layer, entry.Color, entry.UserID, entry.PlacedAt, entry.Seq)
+	}
+	if err != nil {
+		return err
+	}
+
+	if countsForLeaderboard(entry) {
+		if err := d.incrementUserCount(tx, entry.UserID, entry.PlacedAt); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	d.version.Add(1)
+	return nil
+}
+
+// Version returns a number that changes every time the canvas is written
+func (d *Database) Version() int64 {
+	return d.version.Load()
+}
+
+// ForEachHistoryEntry calls fn for every history entry in sequence order
+// Entries sharing a sequence number (the tombstones of one clear) are
+// returned in the order they were written
+func (d *Database) ForEachHistoryEntry(fn func(HistoryEntry) error) error {
+	rows, err := d.db.Query(d.rebind(`
+	SELECT id, x, y, layer, color, user_id, placed_at, seq
+	FROM pixel_history
+	ORDER BY seq ASC, id ASC
+	`))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var entry HistoryEntry
+		var userID sql.NullString
+		if err := rows.Scan(&entry.ID, &entry.X, &entry.Y, &entry.Layer, &entry.Color, &userID, &entry.PlacedAt, &entry.Seq); err != nil {
+			return err
+		}
+		entry.UserID = userID.String
+
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// GetPixelHistory returns the most recent base-layer history entries for one
+// coordinate, at most limit of them, oldest first
+// Tombstones (the pixel being cleared) are included with an empty color
+func (d *Database) GetPixelHistory(x, y int, limit int) ([]HistoryEntry, error) {
+	// Take the newest entries, then reverse them into chronological order
+	entries, err := d.queryHistory(`
+	SELECT id, x, y, layer, color, user_id, placed_at, seq
+	FROM pixel_history
+	WHERE x = ? AND y = ? AND layer = ?
+	ORDER BY seq DESC, id DESC
+	LIMIT ?
+	`, x, y, LayerBase, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	return entries, nil
+}
+
+// GetHistoryPage returns up to limit history entries placed at or before
+// until, in placement order, starting right after the entry identified by
+// (afterPlacedAt, afterID)
+// Reading the history one page at a time keeps each read short, so long
+// readers like the timelapse don't hold up the writer. Start with (-1, 0).
+// Pages follow the clock rather than sequence numbers because the timelapse
+// cuts its frames by time.
+func (d *Database) GetHistoryPage(afterPlacedAt, afterID, until int64, limit int) ([]HistoryEntry, error) {
+	return d.queryHistory(`
+	SELECT id, x, y, layer, color, user_id, placed_at, seq
+	FROM pixel_history
+	WHERE (placed_at > ? OR (placed_at = ? AND id > ?)) AND placed_at <= ?
+	ORDER BY placed_at ASC, id ASC
+	LIMIT ?
+	`, afterPlacedAt, afterPlacedAt, afterID, until, limit)
+}
+
+// queryHistory runs a query that selects whole history rows
+// (id, x, y, layer, color, user_id, placed_at, seq) and collects them
+func (d *Database) queryHistory(query string, args ...interface{}) ([]HistoryEntry, error) {
+	rows, err := d.db.Query(d.rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []HistoryEntry
+	for rows.Next() {
+		var entry HistoryEntry
+		var userID sql.NullString
+		if err := rows.Scan(&entry.ID, &entry.X, &entry.Y, &entry.Layer, &entry.Color, &userID, &entry.PlacedAt, &entry.Seq); err != nil {
+			return nil, err
+		}
+		entry.UserID = userID.String
+		entries = append(entries, entry)
+	}
+
+	return entries, rows.Err()
+}
+
+// CountHistoryBetween returns the number of history entries placed after
+// from and at or before to
+func (d *Database) CountHistoryBetween(from, to int64) (int, error) {
+	var count int
+	err := d.db.QueryRow(d.rebind(`
+	SELECT COUNT(*) FROM pixel_history WHERE placed_at > ? AND placed_at <= ?
+	`), from, to).Scan(&count)
+	return count, err
+}
+
+// GetHistoryCount returns the number of entries in the pixel history
+func (d *Database) GetHistoryCount() (int, error) {
+	var count int
+	err := d.db.QueryRow(`SELECT COUNT(*) FROM pixel_history`).Scan(&count)
+	return count, err
+}
+
+// Checksum returns a SHA-256 hash of the visible canvas
+// Pixels are hashed in coordinate order, so two canvases with the same
+// pixels always produce the same checksum regardless of how they were built
+func (d *Database) Checksum() (string, error) {
+	return d.RegionChecksum(0, 0, math.MaxInt32, math.MaxInt32)
+}
+
+// RegionChecksum returns a SHA-256 hash of the visible pixels inside
+// the rectangle from (x0, y0) to (x1, y1), inclusive
+func (d *Database) RegionChecksum(x0, y0, x1, y1 int) (string, error) {
+	query := `
+	SELECT c.x, c.y, c.color, c.user_id, c.updated_at, c.seq
+	FROM canvas_state c
+	WHERE c.x BETWEEN ? AND ? AND c.y BETWEEN ? AND ?
+	AND ` + visibleLayerFilter + `
+	ORDER BY c.x ASC, c.y ASC
+	`
+
+	pixels, err := d.queryPixels(query, x0, x1, y0, y1)
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.New()
+	for _, p := range pixels {
+		fmt.Fprintf(hash, "%d,%d,%s,%s\n", p.X, p.Y, p.Color, p.UserID)
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// GetAllPixels retrieves the composited canvas from the database
+// For each coordinate only the pixel on the highest layer is returned, in
+// the order the pixels were placed
 func (d *Database) GetAllPixels() ([]PixelUpdate, error) {
 	query := `
-	SELECT x, y, color, user_id, updated_at
+	SELECT c.x, c.y, c.color, c.user_id, c.updated_at, c.seq
+	FROM canvas_state c
+	WHERE ` + visibleLayerFilter + `
+	ORDER BY c.seq ASC
+	`
+
+	pixels, err := d.queryPixels(query)
+	if err != nil {
+		return nil, err
+	}
+
+	slog.Debug("Retrieved pixels from database", "pixels", len(pixels))
+	return pixels, nil
+}
+
+// GetPixelsAt rebuilds the visible canvas as it was at time ts (Unix
+// milliseconds) from the pixel history
+// For every coordinate and layer the last entry placed at or before ts
+// (in sequence order) is taken; tombstones mean the layer was empty, and
+// the highest remaining layer is the visible pixel. Both steps are window
+// functions, so the history is read once. Before the first placement the
+// result is empty; after the last it matches GetAllPixels.
+func (d *Database) GetPixelsAt(ts int64) ([]PixelUpdate, error) {
+	query := `
+	WITH latest AS (
+		SELECT x, y, layer, color, user_id, placed_at, seq,
+			ROW_NUMBER() OVER (PARTITION BY x, y, layer ORDER BY seq DESC, id DESC) AS n
+		FROM pixel_history
+		WHERE placed_at <= ?
+	), visible AS (
+		SELECT x, y, color, user_id, placed_at, seq,
+			ROW_NUMBER() OVER (PARTITION BY x, y ORDER BY layer DESC) AS n
+		FROM latest
+		WHERE n = 1 AND color <> ''
+	)
+	SELECT x, y, color, user_id, placed_at, seq
+	FROM visible
+	WHERE n = 1
+	ORDER BY seq ASC
+	`
+
+	return d.queryPixels(query, ts)
+}
+
+// GetPixelsInRegion retrieves the visible pixels inside the w x h rectangle
+// whose top-left corner is (x, y)
+// The range condition on x and y is answered from the primary key index
+func (d *Database) GetPixelsInRegion(x, y, w, h int) ([]PixelUpdate, error) {
+	query := `
+	SELECT c.x, c.y, c.color, c.user_id, c.updated_at, c.seq
+	FROM canvas_state c
+	WHERE c.x BETWEEN ? AND ? AND c.y BETWEEN ? AND ?
+	AND ` + visibleLayerFilter + `
+	ORDER BY c.seq ASC
+	`
+
+	return d.queryPixels(query, x, x+w-1, y, y+h-1)
+}
+
+// GetChunk retrieves the visible pixels of chunk (cx, cy), the chunkSize x
+// chunkSize tile whose top-left corner is (cx*chunkSize, cy*chunkSize)
+func (d *Database) GetChunk(cx, cy, chunkSize int) ([]PixelUpdate, error) {
+	return d.GetPixelsInRegion(cx*chunkSize, cy*chunkSize, chunkSize, chunkSize)
+}
+
+// GetLayerPixels retrieves the pixels stored on a single layer, without compositing
+func (d *Database) GetLayerPixels(layer int) ([]PixelUpdate, error) {
+	query := `
+	SELECT x, y, color, user_id, updated_at, seq
 	FROM canvas_state
-	ORDER BY updated_at ASC
+	WHERE layer = ?
+	ORDER BY seq ASC
 	`
 
-	rows, err := d.db.Query(query)
+	return d.queryPixels(query, layer)
+}
+
+// GetPixel returns the visible (composited) pixel at a coordinate
+// The boolean result is false when no layer has a pixel there
+func (d *Database) GetPixel(x, y int) (*PixelUpdate, bool, error) {
+	query := `
+	SELECT x, y, color, user_id, updated_at, seq
+	FROM canvas_state
+	WHERE x = ? AND y = ?
+	ORDER BY layer DESC
+	LIMIT 1
+	`
+
+	var pixel PixelUpdate
+	var userID sql.NullString
+	err := d.db.QueryRow(d.rebind(query), x, y).Scan(&pixel.X, &pixel.Y, &pixel.Color, &userID, &pixel.Timestamp, &pixel.Seq)
+	if err == sql.ErrNoRows {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	pixel.UserID = userID.String
+
+	return &pixel, true, nil
+}
+
+// HasLayerPixel returns true if a layer has a pixel stored at a coordinate
+func (d *Database) HasLayerPixel(x, y, layer int) (bool, error) {
+	query := `SELECT COUNT(*) FROM canvas_state WHERE x = ? AND y = ? AND layer = ?`
+
+	var count int
+	if err := d.db.QueryRow(d.rebind(query), x, y, layer).Scan(&count); err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// queryPixels runs a query that selects (x, y, color, user_id, updated_at, seq)
+// and collects the rows into a slice of PixelUpdate
+func (d *Database) queryPixels(query string, args ...interface{}) ([]PixelUpdate, error) {
+	rows, err := d.db.Query(d.rebind(query), args...)
 	if err != nil {
 		return nil, err
 	}
@@ -105,11 +778,13 @@ func (d *Database) GetAllPixels() ([]PixelUpdate, error) {
 	// Iterate through all rows
 	for rows.Next() {
 		var pixel PixelUpdate
-		err := rows.Scan(&pixel.X, &pixel.Y, &pixel.Color, &pixel.UserID, &pixel.Timestamp)
+		var userID sql.NullString
+		err := rows.Scan(&pixel.X, &pixel.Y, &pixel.Color, &userID, &pixel.Timestamp, &pixel.Seq)
 		if err != nil {
-			log.Printf("Failed to scan pixel row: %v", err)
+			slog.Error("Failed to scan pixel row", "err", err)
 			continue
 		}
+		pixel.UserID = userID.String
 		pixels = append(pixels, pixel)
 	}
 
@@ -118,14 +793,173 @@ func (d *Database) GetAllPixels() ([]PixelUpdate, error) {
 		return nil, err
 	}
 
-	log.Printf("Retrieved %d pixels from database", len(pixels))
 	return pixels, nil
 }
 
-// GetPixelCount returns the total number of pixels in the canvas
+// ColorCounts returns how many visible pixels each color has inside the
+// rectangle from (x0, y0) to (x1, y1), inclusive, most used color first
+func (d *Database) ColorCounts(x0, y0, x1, y1 int) ([]ColorCount, error) {
+	query := `
+	SELECT c.color, COUNT(*) AS count
+	FROM canvas_state c
+	WHERE c.x BETWEEN ? AND ? AND c.y BETWEEN ? AND ?
+	AND ` + visibleLayerFilter + `
+	GROUP BY c.color
+	ORDER BY count DESC, c.color ASC
+	`
+
+	rows, err := d.db.Query(d.rebind(query), x0, x1, y0, y1)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := []ColorCount{}
+	for rows.Next() {
+		var cc ColorCount
+		if err := rows.Scan(&cc.Color, &cc.Count); err != nil {
+			return nil, err
+		}
+		counts = append(counts, cc)
+	}
+
+	return counts, rows.Err()
+}
+
+// RegionOwners returns how many visible pixels each user owns inside the
+// rectangle from (x0, y0) to (x1, y1), inclusive, biggest owner first
+func (d *Database) RegionOwners(x0, y0, x1, y1 int) ([]UserStat, error) {
+	query := `
+	SELECT c.user_id, COUNT(*) AS count
+	FROM canvas_state c
+	WHERE c.x BETWEEN ? AND ? AND c.y BETWEEN ? AND ?
+	AND c.user_id IS NOT NULL
+	AND ` + visibleLayerFilter + `
+	GROUP BY c.user_id
+	ORDER BY count DESC, c.user_id ASC
+	`
+
+	rows, err := d.db.Query(d.rebind(query), x0, x1, y0, y1)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	owners := []UserStat{}
+	for rows.Next() {
+		var us UserStat
+		if err := rows.Scan(&us.UserID, &us.Count); err != nil {
+			return nil, err
+		}
+		owners = append(owners, us)
+	}
+
+	return owners, rows.Err()
+}
+
+// UserPixelsInRegion returns the coordinates of the visible pixels owned by
+// userID inside the rectangle from (x0, y0) to (x1, y1), inclusive
+func (d *Database) UserPixelsInRegion(userID string, x0, y0, x1, y1 int) (map[[2]int]bool, error) {
+	query := `
+	SELECT c.x, c.y
+	FROM canvas_state c
+	WHERE c.x BETWEEN ? AND ? AND c.y BETWEEN ? AND ?
+	AND c.user_id = ?
+	AND ` + visibleLayerFilter
+
+	rows, err := d.db.Query(d.rebind(query), x0, x1, y0, y1, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	owned := make(map[[2]int]bool)
+	for rows.Next() {
+		var x, y int
+		if err := rows.Scan(&x, &y); err != nil {
+			return nil, err
+		}
+		owned[[2]int{x, y}] = true
+	}
+
+	return owned, rows.Err()
+}
+
+// CanvasStats are the aggregates shown on the stats dashboard
+type CanvasStats struct {
+	// TotalPlaced is the number of pixels ever placed by users (base layer history)
+	TotalPlaced int `json:"totalPlaced"`
+
+	// UniqueUsers is the number of different users who placed them
+	UniqueUsers int `json:"uniqueUsers"`
+
+	// VisiblePixels is the number of coordinates with a pixel right now
+	VisiblePixels int `json:"visiblePixels"`
+
+	// MostUsedColor is the color with the most visible pixels (nil on an empty canvas)
+	MostUsedColor *ColorCount `json:"mostUsedColor"`
+
+	// PlacedLastHour is the number of pixels placed in the last hour
+	PlacedLastHour int `json:"placedLastHour"`
+
+	// ChangedLastHour is the number of coordinates whose current pixel was
+	// placed in the last hour
+	ChangedLastHour int `json:"changedLastHour"`
+}
+
+// GetStats computes the dashboard aggregates
+// Placements come from pixel_history (tombstones and overlay pixels are not
+// placements by users). The time windows are range conditions on
+// placed_at and updated_at, answered by idx_history_placed_at and idx_updated_at.
+func (d *Database) GetStats(now time.Time) (CanvasStats, error) {
+	var stats CanvasStats
+	hourAgo := now.Add(-time.Hour).UnixMilli()
+
+	err := d.db.QueryRow(d.rebind(`
+	SELECT COUNT(*), COUNT(DISTINCT user_id)
+	FROM pixel_history
+	WHERE layer = ? AND color <> ''
+	`), LayerBase).Scan(&stats.TotalPlaced, &stats.UniqueUsers)
+	if err != nil {
+		return stats, err
+	}
+
+	err = d.db.QueryRow(d.rebind(`
+	SELECT COUNT(*) FROM pixel_history
+	WHERE placed_at >= ? AND layer = ? AND color <> ''
+	`), hourAgo, LayerBase).Scan(&stats.PlacedLastHour)
+	if err != nil {
+		return stats, err
+	}
+
+	err = d.db.QueryRow(d.rebind(`
+	SELECT COUNT(*) FROM canvas_state c
+	WHERE c.updated_at >= ? AND `+visibleLayerFilter), hourAgo).Scan(&stats.ChangedLastHour)
+	if err != nil {
+		return stats, err
+	}
+
+	if stats.VisiblePixels, err = d.GetPixelCount(); err != nil {
+		return stats, err
+	}
+
+	// The color counts are sorted, so the first one is the most used
+	counts, err := d.ColorCounts(0, 0, math.MaxInt32, math.MaxInt32)
+	if err != nil {
+		return stats, err
+	}
+	if len(counts) > 0 {
+		stats.MostUsedColor = &counts[0]
+	}
+
+	return stats, nil
+}
+
+// GetPixelCount returns the total number of visible pixels in the canvas
+// A coordinate covered by several layers is only counted once
 func (d *Database) GetPixelCount() (int, error) {
 	var count int
-	query := `SELECT COUNT(*) FROM canvas_state`
+	query := `SELECT COUNT(*) FROM (SELECT DISTINCT x, y FROM canvas_state) AS coordinates`
 
 	err := d.db.QueryRow(query).Scan(&count)
 	if err != nil {
@@ -135,21 +969,60 @@ func (d *Database) GetPixelCount() (int, error) {
 	return count, nil
 }
 
-// ClearCanvas removes all pixels from the database
-// This is useful for testing or resetting the canvas
+// ClearCanvas removes all pixels from every layer of the database
+// This is useful for testing or resetting the canvas.
+// A tombstone is written to the history for every removed pixel so that
+// replaying the history still ends with an empty canvas. The tombstones all
+// share one sequence number, as the clear happens at a single moment.
 func (d *Database) ClearCanvas() error {
-	query := `DELETE FROM canvas_state`
-	_, err := d.db.Exec(query)
+	return d.serialize(d.clearCanvas)
+}
+
+// clearCanvas is ClearCanvas on the writer goroutine
+func (d *Database) clearCanvas() error {
+	d.maintenance.RLock()
+	defer d.maintenance.RUnlock()
+
+	tx, err := d.db.Begin()
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
 
-	log.Println("Canvas cleared")
+	// The casts give the parameters a type, which PostgreSQL needs in a SELECT list
+	_, err = tx.Exec(d.rebind(`
+	INSERT INTO pixel_history (x, y, layer, color, user_id, placed_at, seq)
+	SELECT x, y, layer, '', CAST(? AS TEXT), CAST(? AS BIGINT), CAST(? AS BIGINT) FROM canvas_state
+	`), adminUserID, time.Now().UnixNano()/int64(1000000), d.NextSeq())
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`DELETE FROM canvas_state`); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	d.version.Add(1)
+
+	slog.Info("Canvas cleared")
 	return nil
 }
 
+// Ping checks that the database can still be reached
+// A trivial query is run rather than just PingContext, which the SQLite
+// driver answers without touching the file
+func (d *Database) Ping(ctx context.Context) error {
+	var one int
+	return d.db.QueryRowContext(ctx, `SELECT 1`).Scan(&one)
+}
+
 // Close closes the database connection
+// Writes made afterwards fail with errDatabaseClosed.
 func (d *Database) Close() error {
+	d.stopWriter()
 	if d.db != nil {
 		return d.db.Close()
 	}
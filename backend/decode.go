@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Body formats accepted by the pixel endpoint
+const (
+	formatJSON     = "json"
+	formatForm     = "form"
+	formatProtobuf = "protobuf"
+)
+
+// formatContentType is the main Content-Type of each body format
+var formatContentType = map[string]string{
+	formatJSON:     "application/json",
+	formatForm:     "application/x-www-form-urlencoded",
+	formatProtobuf: "application/protobuf",
+}
+
+// maxProtobufBody bounds how much of a protobuf body is read
+// A PixelUpdate message is only a few dozen bytes
+const maxProtobufBody = 4096
+
+// defaultMaxBodyBytes is the default limit on a single pixel's request body
+// (MAX_BODY_BYTES). A pixel is about 100 bytes in any format, so this leaves
+// plenty of room while a client streaming a huge body is cut off early.
+const defaultMaxBodyBytes = 4096
+
+// errUnsupportedFormat is returned when the Content-Type is not an accepted format
+var errUnsupportedFormat = errors.New("unsupported content type")
+
+// errBodyTooLarge is returned when a body is longer than the endpoint's limit
+var errBodyTooLarge = errors.New("request body too large")
+
+// limitBody cuts the request body off after limit bytes
+// Reading past the limit fails with an *http.MaxBytesError (turned into
+// errBodyTooLarge by the decoders), and the server closes the connection
+// instead of reading the rest of the body.
+func limitBody(w http.ResponseWriter, r *http.Request, limit int64) {
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+}
+
+// readError returns errBodyTooLarge if err came from hitting the body
+// limit, or otherwise an error with the given message
+func readError(err error, message string) error {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return errBodyTooLarge
+	}
+	return errors.New(message)
+}
+
+// decodeJSONBody decodes a single JSON value from body into v
+// Anything but whitespace after the value is rejected, and with strict also
+// fields v doesn't have (STRICT_JSON), so typos like "colour" aren't silently
+// ignored.
+func decodeJSONBody(body io.Reader, v interface{}, strict bool) error {
+	decoder := json.NewDecoder(body)
+	if strict {
+		decoder.DisallowUnknownFields()
+	}
+	if err := decoder.Decode(v); err != nil {
+		return err
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		if err == nil {
+			err = errors.New("unexpected data after the JSON value")
+		}
+		return err
+	}
+	return nil
+}
+
+// bodyFormat maps a Content-Type header to one of the format constants
+// A missing Content-Type is treated as JSON, which is what clients sent before
+// content negotiation existed
+func bodyFormat(contentType string) string {
+	if contentType == "" {
+		return formatJSON
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+
+	switch mediaType {
+	case "application/json", "text/json":
+		return formatJSON
+	case "application/x-www-form-urlencoded":
+		return formatForm
+	case "application/protobuf", "application/x-protobuf":
+		return formatProtobuf
+	}
+	return ""
+}
+
+// parseBodyFormats turns a comma-separated list such as "json,form" into a set
+func parseBodyFormats(list string) map[string]bool {
+	formats := make(map[string]bool)
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(strings.ToLower(name))
+		if name != "" {
+			formats[name] = true
+		}
+	}
+	return formats
+}
+
+// decodePixel parses a pixel update from the request body
+// The body format is chosen from the Content-Type header; formats not enabled
+// on the server are rejected with errUnsupportedFormat
+func (s *Server) decodePixel(r *http.Request) (PixelUpdate, error) {
+	format := bodyFormat(r.Header.Get("Content-Type"))
+	if format == "" || !s.bodyFormats[format] {
+		return PixelUpdate{}, errUnsupportedFormat
+	}
+
+	switch format {
+	case formatForm:
+		return decodePixelForm(r)
+	case formatProtobuf:
+		return decodePixelProtobuf(r.Body)
+	default:
+		return decodePixelJSON(r.Body, s.strictJSON)
+	}
+}
+
+// decodePixelJSON parses {"x":..,"y":..,"color":..,"userId":..}
+// With strict, unknown fields are rejected
+func decodePixelJSON(body io.Reader, strict bool) (PixelUpdate, error) {
+	var pixel PixelUpdate
+	if err := decodeJSONBody(body, &pixel, strict); err != nil {
+		return PixelUpdate{}, readError(err, "invalid JSON")
+	}
+	return pixel, nil
+}
+
+// decodePixelForm parses x=..&y=..&color=..&userId=..(&expectedColor=..&team=..)
+func decodePixelForm(r *http.Request) (PixelUpdate, error) {
+	if err := r.ParseForm(); err != nil {
+		return PixelUpdate{}, readError(err, "invalid form body")
+	}
+
+	x, err := strconv.Atoi(r.PostForm.Get("x"))
+	if err != nil {
+		return PixelUpdate{}, errors.New("x must be an integer")
+	}
+
+	y, err := strconv.Atoi(r.PostForm.Get("y"))
+	if err != nil {
+		return PixelUpdate{}, errors.New("y must be an integer")
+	}
+
+	return PixelUpdate{
+		X:      x,
+		Y:      y,
+		Color:  r.PostForm.Get("color"),
+		UserID: r.PostForm.Get("userId"),
+
+		ExpectedColor: r.PostForm.Get("expectedColor"),
+		Team:          r.PostForm.Get("team"),
+	}, nil
+}
+
+// decodePixelProtobuf parses a PixelUpdate message as defined in pixel.proto:
+//
+//	message PixelUpdate {
+//	  int32  x       = 1;
+//	  int32  y       = 2;
+//	  string color   = 3;
+//	  string user_id = 4;
+//	  string expected_color = 5;
+//	  string team    = 6;
+//	}
+//
+// Unknown fields are skipped so newer clients can add fields
+func decodePixelProtobuf(body io.Reader) (PixelUpdate, error) {
+	data, err := io.ReadAll(io.LimitReader(body, maxProtobufBody+1))
+	if err != nil {
+		return PixelUpdate{}, readError(err, "failed to read body")
+	}
+	if len(data) > maxProtobufBody {
+		return PixelUpdate{}, errors.New("protobuf body too large")
+	}
+
+	var pixel PixelUpdate
+	for len(data) > 0 {
+		// Each field starts with a tag holding its number and wire type
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return PixelUpdate{}, errors.New("invalid protobuf tag")
+		}
+		data = data[n:]
+
+		switch {
+		case (num == 1 || num == 2) && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(data)
+			if n < 0 {
+				return PixelUpdate{}, fmt.Errorf("invalid protobuf field %d", num)
+			}
+			data = data[n:]
+			if num == 1 {
+				pixel.X = int(int32(v))
+			} else {
+				pixel.Y = int(int32(v))
+			}
+
+		case num >= 3 && num <= 6 && typ == protowire.BytesType:
+			v, n := protowire.ConsumeString(data)
+			if n < 0 {
+				return PixelUpdate{}, fmt.Errorf("invalid protobuf field %d", num)
+			}
+			data = data[n:]
+			switch num {
+			case 3:
+				pixel.Color = v
+			case 4:
+				pixel.UserID = v
+			case 5:
+				pixel.ExpectedColor = v
+			default:
+				pixel.Team = v
+			}
+
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, data)
+			if n < 0 {
+				return PixelUpdate{}, fmt.Errorf("invalid protobuf field %d", num)
+			}
+			data = data[n:]
+		}
+	}
+
+	return pixel, nil
+}
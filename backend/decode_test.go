@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// protobufPixel encodes a PixelUpdate message as defined in pixel.proto
+func protobufPixel(x, y int32, color, userID string) []byte {
+	var data []byte
+	data = protowire.AppendTag(data, 1, protowire.VarintType)
+	data = protowire.AppendVarint(data, uint64(x))
+	data = protowire.AppendTag(data, 2, protowire.VarintType)
+	data = protowire.AppendVarint(data, uint64(y))
+	data = protowire.AppendTag(data, 3, protowire.BytesType)
+	data = protowire.AppendString(data, color)
+	data = protowire.AppendTag(data, 4, protowire.BytesType)
+	data = protowire.AppendString(data, userID)
+	return data
+}
+
+func TestDecodePixel(t *testing.T) {
+	s := &Server{serverOptions: serverOptions{bodyFormats: parseBodyFormats("json,form,protobuf")}}
+	want := PixelUpdate{X: 3, Y: 4, Color: "#FF0000", UserID: "alice"}
+
+	// A field the decoder doesn't know (99) must be skipped
+	withUnknown := protowire.AppendTag(protobufPixel(3, 4, "#FF0000", "alice"), 99, protowire.VarintType)
+	withUnknown = protowire.AppendVarint(withUnknown, 7)
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		wantErr     bool
+	}{
+		{"json", "application/json", `{"x":3,"y":4,"color":"#FF0000","userId":"alice"}`, false},
+		{"json with charset", "application/json; charset=utf-8", `{"x":3,"y":4,"color":"#FF0000","userId":"alice"}`, false},
+		{"no content type is json", "", `{"x":3,"y":4,"color":"#FF0000","userId":"alice"}`, false},
+		{"form", "application/x-www-form-urlencoded", "x=3&y=4&color=%23FF0000&userId=alice", false},
+		{"protobuf", "application/protobuf", string(protobufPixel(3, 4, "#FF0000", "alice")), false},
+		{"protobuf with unknown field", "application/x-protobuf", string(withUnknown), false},
+
+		{"malformed json", "application/json", `{"x":3,`, true},
+		{"json with trailing data", "application/json", `{"x":3,"y":4} {"x":5}`, true},
+		{"json with wrong type", "application/json", `{"x":"three"}`, true},
+		{"form without x", "application/x-www-form-urlencoded", "y=4&color=%23FF0000", true},
+		{"form with non-numeric y", "application/x-www-form-urlencoded", "x=3&y=four", true},
+		{"truncated protobuf", "application/protobuf", string(protobufPixel(3, 4, "#FF0000", "alice")[:7]), true},
+		{"protobuf with a bad tag", "application/protobuf", "\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/api/pixel", strings.NewReader(test.body))
+			if test.contentType != "" {
+				r.Header.Set("Content-Type", test.contentType)
+			}
+
+			pixel, err := s.decodePixel(r)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("decoded %+v, want an error", pixel)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("error %v", err)
+			}
+			if pixel != want {
+				t.Fatalf("decoded %+v, want %+v", pixel, want)
+			}
+		})
+	}
+}
+
+func TestDecodePixelFormats(t *testing.T) {
+	// Only enabled formats are accepted, and unknown types never are
+	s := &Server{serverOptions: serverOptions{bodyFormats: parseBodyFormats("json")}}
+	for _, contentType := range []string{"application/x-www-form-urlencoded", "application/protobuf", "text/plain", "not a type;;"} {
+		r := httptest.NewRequest(http.MethodPost, "/api/pixel", strings.NewReader("x=1"))
+		r.Header.Set("Content-Type", contentType)
+		if _, err := s.decodePixel(r); err != errUnsupportedFormat {
+			t.Errorf("%s: got %v, want errUnsupportedFormat", contentType, err)
+		}
+	}
+}
+
+func TestDecodePixelStrictJSON(t *testing.T) {
+	s := &Server{serverOptions: serverOptions{bodyFormats: parseBodyFormats("json"), strictJSON: true}}
+	r := httptest.NewRequest(http.MethodPost, "/api/pixel", strings.NewReader(`{"x":1,"y":1,"colour":"#FF0000"}`))
+	if _, err := s.decodePixel(r); err == nil {
+		t.Fatal("strict JSON accepted an unknown field")
+	}
+}
+
+func TestPlacePixelBodyFormats(t *testing.T) {
+	// Every format goes through the same placement path
+	room := newTestRoom(t, map[string]string{"PIXEL_BODY_FORMATS": "json,form"})
+	ts := startTestServer(t, room)
+
+	resp, err := http.Post(ts.URL+"/api/pixel", "application/x-www-form-urlencoded", strings.NewReader("x=3&y=4&color=%23FF0000&userId=alice"))
+	if err != nil {
+		t.Fatalf("POST: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("form placement: status %d, want 200", resp.StatusCode)
+	}
+
+	resp, err = http.Post(ts.URL+"/api/pixel", "application/x-www-form-urlencoded", strings.NewReader("x=5&y=4&color=red&userId=bob"))
+	if err != nil {
+		t.Fatalf("POST: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("invalid form color: status %d, want 400", resp.StatusCode)
+	}
+
+	resp, err = http.Post(ts.URL+"/api/pixel", "application/protobuf", strings.NewReader(string(protobufPixel(6, 4, "#FF0000", "carol"))))
+	if err != nil {
+		t.Fatalf("POST: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Fatalf("protobuf while disabled: status %d, want 415", resp.StatusCode)
+	}
+}
+
+// endlessBody is a request body that never ends: a JSON object whose userId
+// string goes on forever. read counts the bytes taken from it.
+type endlessBody struct {
+	prefix []byte
+	read   int64
+}
+
+func (b *endlessBody) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		if int(b.read) < len(b.prefix) {
+			p[n] = b.prefix[b.read]
+		} else {
+			p[n] = 'a'
+		}
+		n++
+		b.read++
+	}
+	return n, nil
+}
+
+func TestOversizedBodyIsRejected(t *testing.T) {
+	room := newTestRoom(t, map[string]string{
+		"MAX_BODY_BYTES":       "1024",
+		"BATCH_PLACEMENT":      "true",
+		"MAX_BATCH_BODY_BYTES": "4096",
+	})
+
+	for path, limit := range map[string]int64{"/api/pixel": 1024, "/api/pixels/batch": 4096} {
+		body := &endlessBody{prefix: []byte(`{"x":1,"y":1,"color":"#FF0000","userId":"`)}
+		if path == "/api/pixels/batch" {
+			body.prefix = []byte(`{"userId":"`)
+		}
+		r := httptest.NewRequest(http.MethodPost, path, body)
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		room.server.ServeHTTP(w, r)
+
+		if w.Code != http.StatusRequestEntityTooLarge {
+			t.Fatalf("%s: status %d, want 413", path, w.Code)
+		}
+		var resp map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		if code := errorCode(resp); code != codePayloadTooLarge {
+			t.Errorf("%s: code %q, want %s", path, code, codePayloadTooLarge)
+		}
+		// Reading stops at the limit; the decoder may have asked for one
+		// buffer more than that, but never much more
+		if body.read > limit+4096 {
+			t.Errorf("%s: read %d bytes of the body, limit %d", path, body.read, limit)
+		}
+	}
+
+	// A normal pixel still goes through
+	if status, resp := postPixel(t, startTestServer(t, room), `{"x":1,"y":1,"color":"#FF0000","userId":"alice"}`); status != http.StatusOK {
+		t.Fatalf("small body: status %d (%v)", status, resp)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+)
+
+// Canvas diffs
+//
+// A client that reconnects after a short break doesn't need the whole canvas
+// again, only what changed while it was gone. GET /api/canvas/diff?since=T
+// returns the coordinates changed after T (a timestamp from an earlier
+// response) with their current pixel, plus an "until" timestamp to pass as
+// the next since.
+//
+// The changed coordinates come from three places:
+//
+//   - canvas_state rows updated after since (the idx_updated_at index)
+//   - tombstones in the history after since, because an eraser, an undo to
+//     an empty pixel or a clear deletes the canvas_state row instead of
+//     updating it
+//   - pixels still waiting for the background writer
+//
+// Each of them is then reported as it looks now: in "pixels" if something is
+// visible there, or in "removed" if the coordinate is empty again.
+//
+// Timestamps have millisecond resolution and come from the wall clock, so a
+// pixel accepted during the request can carry the same timestamp as the
+// newest pixel in the response. until is therefore held back to a second
+// before the request while changes are that recent. The next diff may repeat
+// a few pixels, which clients can apply again safely, but doesn't miss one
+// that was saved (or handed to the writer) within a second of being accepted.
+//
+// More than maxDiffPixels changes answer with "resync": true and no pixels;
+// the client should then load /api/canvas again, which is cheaper.
+
+// maxDiffPixels bounds the coordinates one diff reports
+const maxDiffPixels = 10000
+
+// diffSettleMillis is how far before the request until stays, so pixels
+// accepted while it runs are included in the next diff
+const diffSettleMillis = 1000
+
+// canvasDiff is the response of GET /api/canvas/diff
+type canvasDiff struct {
+	Since   int64         `json:"since"`
+	Until   int64         `json:"until"`   // Pass as since to get the next diff
+	Pixels  []PixelUpdate `json:"pixels"`  // Visible pixels at changed coordinates
+	Removed [][2]int      `json:"removed"` // Changed coordinates that are empty now, as [x, y]
+	Resync  bool          `json:"resync,omitempty"`
+}
+
+// ChangedSince returns the coordinates changed after since (Unix
+// milliseconds) with their visible pixel, at most limit of them, and the
+// time of the newest change among them
+// Coordinates that are empty now have an empty Color.
+func (d *Database) ChangedSince(since int64, limit int) ([]PixelUpdate, int64, error) {
+	query := `
+	WITH changed AS (
+		SELECT x, y, updated_at AS changed_at FROM canvas_state WHERE updated_at > ?
+		UNION ALL
+		SELECT x, y, placed_at FROM pixel_history WHERE placed_at > ? AND color = ''
+	), latest AS (
+		SELECT x, y, MAX(changed_at) AS changed_at FROM changed GROUP BY x, y
+	)
+	SELECT l.x, l.y, l.changed_at, c.color, c.user_id, c.updated_at, c.seq
+	FROM latest l
+	LEFT JOIN canvas_state c ON c.x = l.x AND c.y = l.y AND ` + visibleLayerFilter + `
+	LIMIT ?
+	`
+
+	rows, err := d.db.Query(d.rebind(query), since, since, limit)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var pixels []PixelUpdate
+	newest := since
+	for rows.Next() {
+		var pixel PixelUpdate
+		var changedAt int64
+		var color, userID sql.NullString
+		var timestamp, seq sql.NullInt64
+		if err := rows.Scan(&pixel.X, &pixel.Y, &changedAt, &color, &userID, &timestamp, &seq); err != nil {
+			return nil, 0, err
+		}
+		pixel.Color, pixel.UserID = color.String, userID.String
+		pixel.Timestamp, pixel.Seq = timestamp.Int64, seq.Int64
+		pixels = append(pixels, pixel)
+		newest = max(newest, changedAt)
+	}
+	return pixels, newest, rows.Err()
+}
+
+// handleCanvasDiff returns the pixels changed after a timestamp
+// Query parameter: since (Unix milliseconds, usually the until of the
+// previous diff or the newest timestamp of the snapshot). A since in the
+// future gets an empty diff.
+func (s *Server) handleCanvasDiff(w http.ResponseWriter, r *http.Request) {
+	s.writeCORS(w, r, "GET, OPTIONS")
+
+	since, err := strconv.ParseInt(r.URL.Query().Get("since"), 10, 64)
+	if err != nil || since < 0 {
+		writeError(w, http.StatusBadRequest, codeValidation, "since must be a Unix timestamp in milliseconds")
+		return
+	}
+
+	// Unsaved pixels are read before the database, like withUnsaved does,
+	// so a pixel saved in between is seen twice rather than not at all
+	started := currentTimeMillis()
+	unsaved := s.writer.Unsaved()
+	stored, newest, err := s.db.ChangedSince(since, maxDiffPixels+1)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to retrieve canvas diff", "since", since, "err", err)
+		writeError(w, http.StatusInternalServerError, codeInternal, "Failed to retrieve canvas diff")
+		return
+	}
+
+	// The latest state of every changed coordinate; unsaved pixels are newer
+	// than anything stored
+	changed := make(map[coord]PixelUpdate, len(stored))
+	var order []coord
+	for _, pixel := range stored {
+		key := coord{pixel.X, pixel.Y}
+		order = append(order, key)
+		changed[key] = pixel
+	}
+	for _, pixel := range unsaved {
+		if pixel.Timestamp <= since {
+			continue
+		}
+		key := coord{pixel.X, pixel.Y}
+		if _, seen := changed[key]; !seen {
+			order = append(order, key)
+		}
+		changed[key] = pixel
+		newest = max(newest, pixel.Timestamp)
+	}
+
+	diff := canvasDiff{Since: since, Until: since, Pixels: []PixelUpdate{}, Removed: [][2]int{}}
+	if len(changed) > maxDiffPixels {
+		diff.Resync = true
+	} else {
+		for _, key := range order {
+			// The cache knows the visible pixel including overlays and
+			// unsaved erasers; without it the newest change decides
+			pixel, visible := changed[key], changed[key].Color != "" && !isTransparent(changed[key].Color)
+			if s.canvasCache != nil {
+				pixel, visible = s.canvasCache.Pixel(key[0], key[1])
+			}
+			if visible {
+				diff.Pixels = append(diff.Pixels, pixel)
+			} else {
+				diff.Removed = append(diff.Removed, [2]int(key))
+			}
+		}
+		diff.Until = max(since, min(newest, started-diffSettleMillis))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(diff); err != nil {
+		slog.WarnContext(r.Context(), "Failed to encode canvas diff", "err", err)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Drain mode
+//
+// For a rolling deploy behind a load balancer, an instance should stop
+// getting new traffic, let its clients move over and only then be stopped.
+// POST /api/admin/drain starts that:
+//
+//  1. GET /ready (and /health) answer 503 with "drain": "draining", so the
+//     load balancer stops sending new requests here. GET /live is
+//     unaffected, so the instance isn't restarted meanwhile.
+//  2. New WebSocket connections (/ws/queue and /ws/stats, on every canvas)
+//     are refused with 503.
+//  3. The writers save every pixel accepted so far.
+//  4. Existing connections keep working for DRAIN_GRACE, so clients can
+//     finish and reconnect elsewhere on their own. Pixels they place are
+//     still accepted and saved.
+//  5. The WebSocket clients left are disconnected, the writers save once
+//     more and the drain is complete.
+//
+// GET /api/admin/drain reports the progress; once it says "complete" the
+// process can be stopped (SIGTERM), and the graceful shutdown saves anything
+// that arrived after the last flush. A drain can't be called off: the
+// instance is meant to be replaced.
+//
+// Every room checks the same Drain, so one request drains all canvases.
+
+// Drain tracks whether the server is draining
+// A nil *Drain never drains.
+type Drain struct {
+	grace time.Duration // How long existing connections are kept
+
+	draining  atomic.Bool
+	complete  atomic.Bool
+	startedAt atomic.Int64 // Unix milliseconds
+	start     sync.Once
+
+	// servers are the main canvas and every room opened so far
+	mu      sync.Mutex
+	servers []*Server
+}
+
+// NewDrain creates a drain that keeps connections for grace once started
+func NewDrain(grace time.Duration) *Drain {
+	return &Drain{grace: grace}
+}
+
+// DrainStatus is the response of the drain endpoints
+type DrainStatus struct {
+	Draining      bool  `json:"draining"`
+	Complete      bool  `json:"complete"`              // Safe to stop the process
+	StartedAt     int64 `json:"startedAt,omitempty"`   // Unix milliseconds
+	GraceEndsAt   int64 `json:"graceEndsAt,omitempty"` // When the WebSocket clients left are disconnected
+	WSClients     int64 `json:"wsClients"`             // Connected WebSocket clients, all canvases
+	QueueLength   int   `json:"queueLength"`           // Pixels waiting to be broadcast, all canvases
+	PendingWrites int   `json:"pendingWrites"`         // Pixels not saved yet, all canvases
+}
+
+// track adds a server to the ones drained (called by newRoom)
+func (d *Drain) track(s *Server) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.servers = append(d.servers, s)
+}
+
+// tracked returns a copy of the servers drained
+func (d *Drain) tracked() []*Server {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]*Server(nil), d.servers...)
+}
+
+// Draining returns true once a drain was started
+// Safe to call from any goroutine.
+func (d *Drain) Draining() bool {
+	return d != nil && d.draining.Load()
+}
+
+// Start begins draining; starting an ongoing or finished drain does nothing
+func (d *Drain) Start() {
+	d.start.Do(func() {
+		d.startedAt.Store(timeNow().UnixMilli())
+		d.draining.Store(true)
+		safeGo("drain", d.run)
+	})
+}
+
+// run saves the accepted pixels, waits for the grace period and disconnects
+// the WebSocket clients left
+func (d *Drain) run() {
+	slog.Warn("Draining: refusing new connections", "graceMs", d.grace.Milliseconds())
+	d.flush()
+
+	time.Sleep(d.grace)
+
+	var clients int64
+	for _, s := range d.tracked() {
+		clients += s.hub.ClientCount()
+		s.hub.DisconnectAll()
+		s.statsStream.Stop()
+	}
+	d.flush()
+
+	d.complete.Store(true)
+	slog.Info("Drain complete, safe to stop", "disconnected", clients)
+}
+
+// flush waits until every writer has saved the pixels accepted so far
+func (d *Drain) flush() {
+	for _, s := range d.tracked() {
+		s.writer.Flush()
+	}
+}
+
+// Status reports the progress of the drain
+func (d *Drain) Status() DrainStatus {
+	status := DrainStatus{Draining: d.Draining(), Complete: d.complete.Load()}
+	if status.Draining {
+		status.StartedAt = d.startedAt.Load()
+		status.GraceEndsAt = status.StartedAt + d.grace.Milliseconds()
+	}
+	for _, s := range d.tracked() {
+		status.WSClients += s.hub.ClientCount()
+		status.QueueLength += s.queue.Len()
+		status.PendingWrites += s.writer.Pending()
+	}
+	return status
+}
+
+// handleDrain starts draining and reports the progress
+// Calling it again while draining only reports the progress.
+func (s *Server) handleDrain(w http.ResponseWriter, r *http.Request) {
+	s.drain.Start()
+	writeDrainStatus(w, http.StatusAccepted, s.drain.Status())
+}
+
+// handleDrainStatus reports the progress of the drain
+func (s *Server) handleDrainStatus(w http.ResponseWriter, r *http.Request) {
+	writeDrainStatus(w, http.StatusOK, s.drain.Status())
+}
+
+// writeDrainStatus sends status as JSON
+func writeDrainStatus(w http.ResponseWriter, code int, status DrainStatus) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(status)
+}
+
+// refuseWhileDraining answers 503 and returns true when the server is draining
+// New connections should go to another instance.
+func (s *Server) refuseWhileDraining(w http.ResponseWriter) bool {
+	if !s.drain.Draining() {
+		return false
+	}
+	writeError(w, http.StatusServiceUnavailable, codeUnavailable, "This server is draining, connect to another one")
+	return true
+}
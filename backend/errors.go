@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+)
+
+// Error responses
+//
+// Every error the API sends is a JSON envelope with a stable,
+// machine-readable code next to the human-readable message:
+//
+//	{"error": {"code": "RATE_LIMITED", "message": "Rate limit exceeded. ...", "retryAfterMs": 3120, "reason": "user"}}
+//
+// Clients should branch on the code; the message is meant for people and may
+// change. Some errors carry extra fields inside the envelope (retryAfterMs and
+// reason for RATE_LIMITED, GLOBAL_RATE_LIMITED and QUOTA_EXCEEDED, resetAt
+// for QUOTA_EXCEEDED, currentColor for COLOR_MISMATCH). The HTTP status codes are the same as before the envelope
+// was introduced.
+
+// Error codes sent in the "code" field of an error response
+const (
+	codeInvalidBody          = "INVALID_BODY"           // The body couldn't be decoded (400)
+	codeValidation           = "VALIDATION_FAILED"      // A field or parameter has a bad value (400)
+	codeUnauthorized         = "UNAUTHORIZED"           // A valid user or admin token is required (401)
+	codeForbidden            = "FORBIDDEN"              // The action is turned off on this server (403)
+	codeAreaLimit            = "AREA_LIMIT_EXCEEDED"    // The pixel would grow the user's area past the limit (403)
+	codeZoneLocked           = "ZONE_LOCKED"            // The pixel is in a locked zone (403)
+	codeNotFound             = "NOT_FOUND"              // Nothing exists at the requested place (404)
+	codeConflict             = "CONFLICT"               // The request no longer applies to the current state (409)
+	codeColorMismatch        = "COLOR_MISMATCH"         // A conditional placement's expectedColor didn't match (409)
+	codePayloadTooLarge      = "PAYLOAD_TOO_LARGE"      // The body or batch is over the limit (413)
+	codeUnsupportedMediaType = "UNSUPPORTED_MEDIA_TYPE" // The Content-Type isn't accepted (415)
+	codeRateLimited          = "RATE_LIMITED"           // A cooldown is still running (429)
+	codeGlobalRateLimited    = "GLOBAL_RATE_LIMITED"    // The whole server is at GLOBAL_RATE_LIMIT (429)
+	codeQuotaExceeded        = "QUOTA_EXCEEDED"         // The user placed PLACEMENT_QUOTA pixels within the window (429)
+	codeQueueFull            = "QUEUE_FULL"             // The broadcast queue has no room (503)
+	codeUnavailable          = "UNAVAILABLE"            // A dependency or capacity limit refuses the request for now (503)
+	codeInternal             = "INTERNAL_ERROR"         // The server failed (500)
+)
+
+// apiError is the body of the "error" envelope
+type apiError struct {
+	Code         string `json:"code"`
+	Message      string `json:"message"`
+	RetryAfterMs int64  `json:"retryAfterMs,omitempty"`
+	Reason       string `json:"reason,omitempty"`
+	ResetAt      int64  `json:"resetAt,omitempty"` // Unix milliseconds
+	CurrentColor string `json:"currentColor,omitempty"`
+}
+
+// writeError sends an error response with the given status, code and message
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	writeAPIError(w, status, apiError{Code: code, Message: message})
+}
+
+// writeAPIError sends an error response with extra fields
+func writeAPIError(w http.ResponseWriter, status int, body apiError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(map[string]apiError{"error": body}); err != nil {
+		slog.Warn("Failed to encode error response", "err", err)
+	}
+}
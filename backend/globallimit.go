@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// Global rate limit
+//
+// The per-user and per-IP limiters can't stop a coordinated flood of many
+// users each placing within their own cooldown. GLOBAL_RATE_LIMIT caps the
+// placements per second of the whole server, with bursts of up to
+// GLOBAL_RATE_BURST, and refuses the rest with 429 GLOBAL_RATE_LIMITED.
+//
+// The limit is checked on every placement, so it must not become the lock
+// everybody waits for. It is a token bucket written as GCRA (the generic cell
+// rate algorithm): instead of a token count and a refill time, it keeps a
+// single "theoretical arrival time" (tat), the moment the bucket would be
+// full again. Each placement pushes tat one interval (1s / rate) further; a
+// placement is refused when that would put tat more than the burst ahead of
+// now. One int64 is the whole state, so it is updated with compare-and-swap
+// instead of a mutex.
+
+// GlobalLimiter caps the placements per second across all users
+// A nil *GlobalLimiter allows everything.
+type GlobalLimiter struct {
+	interval  int64 // Nanoseconds between placements at the sustained rate
+	tolerance int64 // How far tat may run ahead of now (burst - 1 intervals)
+
+	tat atomic.Int64 // Theoretical arrival time, in Unix nanoseconds
+}
+
+// NewGlobalLimiter allows rate placements per second, in bursts of up to burst
+func NewGlobalLimiter(rate float64, burst int) (*GlobalLimiter, error) {
+	if rate <= 0 || burst < 1 {
+		return nil, fmt.Errorf("global rate limit needs a positive rate and a burst of at least 1 (got %g and %d)", rate, burst)
+	}
+
+	interval := max(int64(float64(time.Second)/rate), 1)
+	return &GlobalLimiter{
+		interval:  interval,
+		tolerance: interval * int64(burst-1),
+	}, nil
+}
+
+// Allow takes one placement from the bucket
+// When the bucket is empty it returns false and how long until a placement
+// would be allowed.
+func (g *GlobalLimiter) Allow() (bool, time.Duration) {
+	if g == nil {
+		return true, 0
+	}
+
+	now := timeNow().UnixNano()
+	for {
+		tat := g.tat.Load()
+		next := max(tat, now) + g.interval
+		if wait := next - g.interval - g.tolerance - now; wait > 0 {
+			return false, time.Duration(wait)
+		}
+		if g.tat.CompareAndSwap(tat, next) {
+			return true, 0
+		}
+		// Another placement got there first; try again with its tat
+	}
+}
+
+// Refund gives back a placement taken by Allow that was refused afterwards
+// (by the user's or the IP's cooldown, say), so it doesn't count towards the
+// server's rate. tat moves back one interval; if it falls behind now in the
+// meantime that is the same as a full bucket, since Allow starts from now.
+func (g *GlobalLimiter) Refund() {
+	if g == nil {
+		return
+	}
+	g.tat.Add(-g.interval)
+}
+
+// Utilization returns how much of the burst is in use, from 0 (idle) to 1
+// (placements are being refused)
+func (g *GlobalLimiter) Utilization() float64 {
+	if g == nil {
+		return 0
+	}
+
+	ahead := g.tat.Load() - timeNow().UnixNano()
+	return min(max(float64(ahead)/float64(g.tolerance+g.interval), 0), 1)
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRefusedPlacementGivesBackGlobalToken(t *testing.T) {
+	clock := useFakeClock(t)
+	room := newTestRoom(t, map[string]string{"GLOBAL_RATE_LIMIT": "1", "GLOBAL_RATE_BURST": "1", "IP_COOLDOWN": "1h"})
+	s := room.server
+
+	pixel := PixelUpdate{X: 1, Y: 1, Color: "#FF0000", UserID: "alice"}
+	if err := s.placePixel(&pixel, "192.0.2.1"); err != nil {
+		t.Fatalf("first placement: %d %s", err.status, err.message)
+	}
+	clock.Advance(time.Second)
+
+	// bob places from alice's address, which is still cooling down
+	pixel = PixelUpdate{X: 2, Y: 1, Color: "#FF0000", UserID: "bob"}
+	if err := s.placePixel(&pixel, "192.0.2.1"); err == nil || err.reason != rateLimitIP {
+		t.Fatalf("bob from alice's address: %+v, want refused for the IP", err)
+	}
+
+	// That refusal didn't use up the one placement the second allows
+	pixel = PixelUpdate{X: 3, Y: 1, Color: "#FF0000", UserID: "carol"}
+	if err := s.placePixel(&pixel, "192.0.2.2"); err != nil {
+		t.Fatalf("carol after bob's refused placement: %d %s", err.status, err.message)
+	}
+	pixel = PixelUpdate{X: 4, Y: 1, Color: "#FF0000", UserID: "dave"}
+	if err := s.placePixel(&pixel, "192.0.2.3"); err == nil || err.status != http.StatusTooManyRequests || err.reason != rateLimitGlobal {
+		t.Fatalf("dave in the same second: %+v, want the global limit", err)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// Health checks
+//
+// Three endpoints, following the usual liveness/readiness split:
+//
+//   - GET /live answers 200 while the hub's main loop is responsive. A
+//     failing liveness check means restarting the process would help.
+//   - GET /ready also pings the database. A failing readiness check means
+//     the instance should get no traffic for now (a restart won't fix a
+//     database that is down).
+//   - GET /health runs the readiness checks and adds the operational numbers
+//     (queue length, clients, panics, ...) for dashboards and humans.
+//
+// All three answer 503 with the failing checks in the body when unhealthy.
+// While draining (see drain.go) /ready and /health fail with "drain":
+// "draining" so the load balancer moves traffic away; /live still passes.
+// Each check is bounded by healthCheckTimeout, so they are cheap enough to be
+// polled every few seconds.
+
+// healthCheckTimeout bounds each individual check
+const healthCheckTimeout = time.Second
+
+// Results of a single check
+const (
+	checkOK     = "ok"
+	checkFailed = "failed"
+)
+
+// healthChecks runs the checks; database (and the drain) is skipped for liveness
+// It returns the result of each check and whether all of them passed
+func (s *Server) healthChecks(ctx context.Context, database bool) (map[string]string, bool) {
+	checks := map[string]string{"hub": checkOK}
+	healthy := true
+
+	if !s.hub.Alive(healthCheckTimeout) {
+		slog.Warn("Health check: hub main loop not responding")
+		checks["hub"] = checkFailed
+		healthy = false
+	}
+
+	if database {
+		ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+		defer cancel()
+
+		checks["database"] = checkOK
+		if err := s.db.Ping(ctx); err != nil {
+			// The error can name hosts, so it is logged rather than returned
+			slog.Warn("Health check: database unreachable", "err", err)
+			checks["database"] = checkFailed
+			healthy = false
+		}
+	}
+
+	// A draining server is healthy but shouldn't get traffic (see drain.go)
+	if database && s.drain.Draining() {
+		checks["drain"] = "draining"
+		healthy = false
+	}
+
+	return checks, healthy
+}
+
+// writeHealth sends a health report with 200, or 503 when unhealthy
+func writeHealth(w http.ResponseWriter, report map[string]interface{}, healthy bool) {
+	status := http.StatusOK
+	report["status"] = "ok"
+	if !healthy {
+		status = http.StatusServiceUnavailable
+		report["status"] = "unhealthy"
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(report)
+}
+
+// handleLive is the liveness check: is the hub's main loop responsive
+func (s *Server) handleLive(w http.ResponseWriter, r *http.Request) {
+	checks, healthy := s.healthChecks(r.Context(), false)
+	writeHealth(w, map[string]interface{}{"checks": checks}, healthy)
+}
+
+// handleReady is the readiness check: hub responsive and database reachable
+func (s *Server) handleReady(w http.ResponseWriter, r *http.Request) {
+	checks, healthy := s.healthChecks(r.Context(), true)
+	writeHealth(w, map[string]interface{}{"checks": checks}, healthy)
+}
+
+// handleHealth runs the readiness checks and reports the operational state:
+// whether the database is degraded, the queue length, recovered panics, ...
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	checks, healthy := s.healthChecks(r.Context(), true)
+
+	health := map[string]interface{}{
+		"checks":           checks,
+		"databaseDegraded": s.dbBreaker.Degraded(),
+		"queueLength":      s.queue.Len(),
+		"goroutinePanics":  goroutinePanics.Load(),
+		"droppedBatches":   s.hub.DroppedBatches(),
+		"wsClients":        s.hub.ClientCount(),
+		"wsMaxClients":     s.hub.MaxClients(),
+	}
+	if s.backups != nil {
+		health["backupFailures"] = s.backups.Failures()
+	}
+
+	writeHealth(w, health, healthy)
+}
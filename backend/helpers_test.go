@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// fakeClock replaces timeNow for a test, so cooldowns and timeouts can be
+// stepped through without sleeping
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+// useFakeClock makes timeNow return the fake clock's time until the test ends
+// Only use it in tests without a running hub or writer, which read the clock
+// on goroutines of their own.
+func useFakeClock(t *testing.T) *fakeClock {
+	t.Helper()
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+	previous := timeNow
+	timeNow = clock.Now
+	t.Cleanup(func() { timeNow = previous })
+	return clock
+}
+
+// Now returns the fake time
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Advance moves the fake time forward
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// newTestDatabase opens a fresh SQLite database in a temporary directory
+// It is closed when the test ends.
+func newTestDatabase(t *testing.T) *Database {
+	t.Helper()
+	db, err := NewDatabase(filepath.Join(t.TempDir(), "canvas.db"))
+	if err != nil {
+		t.Fatalf("opening database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// newTestRoom builds a canvas the way main does, on a fresh SQLite database,
+// with the given environment variables set for the duration of the test
+// The room is stopped when the test ends.
+func newTestRoom(t *testing.T, env map[string]string) *Room {
+	t.Helper()
+	for name, value := range env {
+		t.Setenv(name, value)
+	}
+
+	liveConfig, err := NewLiveConfig("")
+	if err != nil {
+		t.Fatalf("loading config: %v", err)
+	}
+	db, err := NewDatabase(filepath.Join(t.TempDir(), "canvas.db"))
+	if err != nil {
+		t.Fatalf("opening database: %v", err)
+	}
+
+	room, err := newRoom("", db, liveConfig.Get().Canvas, roomOptions{
+		liveConfig: liveConfig,
+		tokens:     NewTokenVerifier(os.Getenv("AUTH_SECRET")),
+		drain:      NewDrain(time.Second),
+	})
+	if err != nil {
+		db.Close()
+		t.Fatalf("building room: %v", err)
+	}
+	t.Cleanup(func() { stopTestRoom(room) })
+	return room
+}
+
+// stoppedRooms holds the rooms stopTestRoom has stopped
+var stoppedRooms sync.Map
+
+// stopTestRoom stops a room built by newTestRoom, unless it was already
+// stopped, so a test can shut its room down before the cleanup runs
+func stopTestRoom(room *Room) {
+	if _, stopped := stoppedRooms.LoadOrStore(room, true); stopped {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	room.Stop(ctx)
+}
+
+// startTestServer serves a room's routes on a local HTTP server until the
+// test ends
+func startTestServer(t *testing.T, room *Room) *httptest.Server {
+	t.Helper()
+	ts := httptest.NewServer(room.server)
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// postPixel sends a JSON pixel to /api/pixel and returns the response status
+// and decoded body
+func postPixel(t *testing.T, ts *httptest.Server, pixel string) (int, map[string]interface{}) {
+	t.Helper()
+	resp, err := http.Post(ts.URL+"/api/pixel", "application/json", strings.NewReader(pixel))
+	if err != nil {
+		t.Fatalf("POST /api/pixel: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var body map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+	return resp.StatusCode, body
+}
+
+// errorCode returns the code of an error response body ("" if there is none)
+func errorCode(body map[string]interface{}) string {
+	envelope, _ := body["error"].(map[string]interface{})
+	code, _ := envelope["code"].(string)
+	return code
+}
+
+// dialWS opens a WebSocket connection to path (with its query) on ts
+// The connection is closed when the test ends.
+func dialWS(t *testing.T, ts *httptest.Server, path string) *websocket.Conn {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+path, nil)
+	if err != nil {
+		t.Fatalf("dialing %s: %v", path, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// readMessage reads the next pixel message from a JSON WebSocket client
+func readMessage(t *testing.T, conn *websocket.Conn, timeout time.Duration) outboundMessage {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	var msg outboundMessage
+	if err := conn.ReadJSON(&msg); err != nil {
+		t.Fatalf("reading WebSocket message: %v", err)
+	}
+	return msg
+}
+
+// readBatch skips messages until a batch arrives and returns its pixels
+func readBatch(t *testing.T, conn *websocket.Conn, timeout time.Duration) []PixelUpdate {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for {
+		msg := readMessage(t, conn, time.Until(deadline))
+		if msg.Type == messageBatch {
+			return msg.Pixels
+		}
+	}
+}
+
+// place runs a pixel through the whole placement path of the server, as
+// POST /api/pixel would, and fails the test if it is rejected
+func place(t *testing.T, s *Server, x, y int, color, userID string) {
+	t.Helper()
+	pixel := PixelUpdate{X: x, Y: y, Color: color, UserID: userID}
+	if err := s.placePixel(&pixel, "192.0.2.1"); err != nil {
+		t.Fatalf("placing (%d,%d) for %s: %d %s", x, y, userID, err.status, err.message)
+	}
+}
+
+// waitFor polls cond until it returns true, failing the test after timeout
+func waitFor(t *testing.T, timeout time.Duration, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// onlyClient returns the hub's single registered client
+func onlyClient(t *testing.T, hub *Hub) ClientInfo {
+	t.Helper()
+	clients, err := hub.Clients(time.Second)
+	if err != nil || len(clients) != 1 {
+		t.Fatalf("clients: %v, %v; want exactly one", clients, err)
+	}
+	return clients[0]
+}
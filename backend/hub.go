@@ -1,10 +1,88 @@
 package main
 
 import (
-	"log"
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// BroadcastPolicy decides what happens when the broadcast channel is full
+type BroadcastPolicy string
+
+const (
+	// broadcastBlock waits for room in the channel (the queue processor stalls)
+	broadcastBlock BroadcastPolicy = "block"
+
+	// broadcastDropOldest discards the oldest waiting batch to make room
+	broadcastDropOldest BroadcastPolicy = "drop-oldest"
+)
+
+// ParseBroadcastPolicy checks a BROADCAST_POLICY value
+func ParseBroadcastPolicy(value string) (BroadcastPolicy, error) {
+	switch policy := BroadcastPolicy(value); policy {
+	case broadcastBlock, broadcastDropOldest:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown broadcast policy %q (expected %q or %q)", value, broadcastBlock, broadcastDropOldest)
+	}
+}
+
+// HubConfig holds the tunable settings of a Hub
+type HubConfig struct {
+	// AckWindow is the maximum number of unacknowledged batches a paced
+	// client may have in flight
+	AckWindow int
+
+	// BroadcastBuffer is the capacity of the broadcast channel
+	BroadcastBuffer int
+
+	// BroadcastPolicy is broadcastBlock (the default) or broadcastDropOldest
+	BroadcastPolicy BroadcastPolicy
+
+	// ReapAfter closes clients that haven't answered a ping for this long
+	// (0 disables the reaper and leaves it to the read deadline)
+	ReapAfter time.Duration
+
+	// Snapshot reads the visible canvas for new clients (nil disables snapshots)
+	Snapshot func() ([]PixelUpdate, error)
+
+	// Cursor returns the newest placement sequence number, sent to clients
+	// so they can resume later; Resume lists what changed after one, or
+	// returns false when the client needs a snapshot (see resume.go). Either
+	// may be nil.
+	Cursor func() int64
+	Resume func(cursor int64) ([]PixelUpdate, bool, error)
+
+	// Coalesce keeps only the latest update per coordinate in each batch
+	Coalesce bool
+
+	// MaxClients is the most WebSocket clients connected at once (0 = no limit)
+	MaxClients int
+
+	// ChunkSize is the side of the chunks broadcast pixels are tagged with
+	ChunkSize int
+
+	// SendBuffer is how many messages each client's send channel holds
+	SendBuffer int
+
+	// A batch is broadcast once it holds BatchSize pixels or its first pixel
+	// has waited BatchInterval (see validateBatching)
+	BatchSize     int
+	BatchInterval time.Duration
+
+	// A client whose send buffer is full keeps its pixels held and is only
+	// dropped once the buffer has been full for SlowGrace and SlowStrikes
+	// send attempts in a row (a zero grace and one strike drop it right away)
+	SlowGrace   time.Duration
+	SlowStrikes int
+
+	// Client holds the connection timeouts (zero fields take the defaults)
+	Client ClientConfig
+}
+
 // Hub manages all WebSocket connections (consumers) and broadcasts pixel updates
 // It acts as a central coordinator between the queue and all connected consumers
 type Hub struct {
@@ -21,105 +99,979 @@ type Hub struct {
 	// Channel to unregister disconnected clients
 	unregister chan *Client
 
+	// Channel for batch acknowledgements sent by paced clients
+	acks chan clientAck
+
+	// Channel for chunk subscriptions sent by clients
+	subscriptions chan clientSubscription
+
+	// Channel for resume requests sent by clients (see resume.go)
+	resumes chan clientResume
+
+	// Channel to tell all clients the canvas was cleared, with the newest
+	// sequence number the clear removed
+	clear chan int64
+
+	// Channel to disconnect every client at the end of a drain (see drain.go)
+	disconnects chan struct{}
+
+	// Channel for health checks: Run closes each channel it receives
+	probes chan chan struct{}
+
+	// Channel for client listings: Run sends the clients on each channel it
+	// receives (see clients.go)
+	clientQueries chan chan []ClientInfo
+
 	// Reference to the pixel queue
 	queue *PixelQueue
+
+	// Maximum number of unacknowledged batches a paced client may have in flight
+	ackWindow int
+
+	// What publish does when the broadcast channel is full
+	broadcastPolicy BroadcastPolicy
+
+	// Number of batches discarded by the drop-oldest policy
+	droppedBatches atomic.Int64
+
+	// Number of registered clients, readable outside the hub goroutine
+	// It also counts clients that reserved a slot and are still registering
+	clientCount atomic.Int64
+
+	// Most clients connected at once (0 = no limit)
+	maxClients int
+
+	// Clients whose last pong is older than this are closed (0 disables)
+	reapAfter time.Duration
+
+	// Timeouts of every client connection
+	clientConfig ClientConfig
+
+	// Reads the canvas for the snapshot sent to new clients (may be nil)
+	snapshot func() ([]PixelUpdate, error)
+
+	// Read the cursor and the changes after one for resuming clients (may be nil)
+	currentSeq func() int64
+	resume     func(cursor int64) ([]PixelUpdate, bool, error)
+
+	// Drop overwritten pixels from each batch before broadcasting it
+	coalesce bool
+
+	// Side of the chunks pixels are tagged with and subscriptions refer to
+	chunkSize int
+
+	// Capacity of each client's send channel, and how long and how many
+	// attempts in a row it may stay full before the client is dropped
+	sendBuffer  int
+	slowGrace   time.Duration
+	slowStrikes int
+
+	// Most pixels in a broadcast batch, and longest wait before a partial
+	// batch is sent
+	batchSize     int
+	batchInterval time.Duration
+
+	// stop is closed by Stop to shut the hub down; done is closed by Run
+	// once every client has been closed
+	stop chan struct{}
+	done chan struct{}
+
+	// queueDone is closed by processQueue when it stops reading the queue;
+	// unpublished holds the pixels it had taken out but not published
+	queueDone   chan struct{}
+	unpublished []PixelUpdate
+
+	// pumps counts running client writePumps so Stop can wait for them
+	// to send their last batches
+	// A WaitGroup must not be added to while Wait may be running, so pumps
+	// are only added through addPump, which refuses once stopping is set
+	// (both guarded by pumpsMu)
+	pumps    sync.WaitGroup
+	pumpsMu  sync.Mutex
+	stopping bool
 }
 
+// addPump counts a client's writePump before the client is registered
+// It returns false once Stop has begun, and the client must then be refused.
+func (h *Hub) addPump() bool {
+	h.pumpsMu.Lock()
+	defer h.pumpsMu.Unlock()
+	if h.stopping {
+		return false
+	}
+	h.pumps.Add(1)
+	return true
+}
+
+// clientAck is an acknowledgement received from a client's readPump
+type clientAck struct {
+	client *Client
+	upTo   int64 // Number of batches the client has processed
+}
+
+// clientSubscription is a subscription received from a client's readPump
+// It limits the client to a rectangle (region) or a set of chunks. With
+// neither, the client is subscribed to the whole canvas again.
+type clientSubscription struct {
+	client *Client
+	region *Region
+	chunks []ChunkCoord
+}
+
+// defaultSendBuffer is the capacity of a client's send channel when
+// WS_SEND_BUFFER is not set
+const defaultSendBuffer = 256
+
+// slowRetryInterval is how often the pixels held for a client with a full
+// send buffer are offered to it again
+const slowRetryInterval = 50 * time.Millisecond
+
+// maxHeldPixels bounds how many pixels are held for a paced client that has
+// run out of credit. A client that falls this far behind is treated as dead.
+const maxHeldPixels = 10000
+
 // NewHub creates a new Hub instance
-func NewHub(queue *PixelQueue) *Hub {
+func NewHub(queue *PixelQueue, config HubConfig) *Hub {
+	if config.BroadcastBuffer < 1 {
+		config.BroadcastBuffer = 1
+	}
+	if config.BroadcastPolicy == "" {
+		config.BroadcastPolicy = broadcastBlock
+	}
+	if config.ChunkSize < 1 {
+		config.ChunkSize = defaultChunkSize
+	}
+	if config.SendBuffer < 1 {
+		config.SendBuffer = defaultSendBuffer
+	}
+	if config.SlowStrikes < 1 {
+		config.SlowStrikes = 1
+	}
+	if config.BatchSize < 1 {
+		config.BatchSize = defaultBatchSize
+	}
+	if config.BatchInterval <= 0 {
+		config.BatchInterval = defaultBatchInterval
+	}
+	defaults := DefaultClientConfig()
+	if config.Client.WriteWait <= 0 {
+		config.Client.WriteWait = defaults.WriteWait
+	}
+	if config.Client.PongWait <= 0 {
+		config.Client.PongWait = defaults.PongWait
+	}
+	if config.Client.PingPeriod <= 0 {
+		config.Client.PingPeriod = defaultPingPeriod(config.Client.PongWait)
+	}
+	if config.Client.MaxMessageSize <= 0 {
+		config.Client.MaxMessageSize = defaults.MaxMessageSize
+	}
+
 	return &Hub{
-		clients:    make(map[*Client]bool),
-		broadcast:  make(chan []PixelUpdate, 256),
-		register:   make(chan *Client),
-		unregister: make(chan *Client),
-		queue:      queue,
+		clients:         make(map[*Client]bool),
+		broadcast:       make(chan []PixelUpdate, config.BroadcastBuffer),
+		register:        make(chan *Client),
+		unregister:      make(chan *Client),
+		acks:            make(chan clientAck, 256),
+		subscriptions:   make(chan clientSubscription, 256),
+		resumes:         make(chan clientResume, 256),
+		clear:           make(chan int64),
+		disconnects:     make(chan struct{}),
+		probes:          make(chan chan struct{}),
+		clientQueries:   make(chan chan []ClientInfo),
+		queue:           queue,
+		ackWindow:       config.AckWindow,
+		broadcastPolicy: config.BroadcastPolicy,
+		reapAfter:       config.ReapAfter,
+		clientConfig:    config.Client,
+		snapshot:        config.Snapshot,
+		currentSeq:      config.Cursor,
+		resume:          config.Resume,
+		coalesce:        config.Coalesce,
+		maxClients:      config.MaxClients,
+		chunkSize:       config.ChunkSize,
+		sendBuffer:      config.SendBuffer,
+		slowGrace:       config.SlowGrace,
+		slowStrikes:     config.SlowStrikes,
+		batchSize:       config.BatchSize,
+		batchInterval:   config.BatchInterval,
+		stop:            make(chan struct{}),
+		done:            make(chan struct{}),
+		queueDone:       make(chan struct{}),
+	}
+}
+
+// pingInterval is how often clients are pinged
+// With the reaper enabled clients are pinged often enough that a healthy
+// connection always answers well within the reap threshold
+func (h *Hub) pingInterval() time.Duration {
+	if h.reapAfter > 0 && h.reapAfter/2 < h.clientConfig.PingPeriod {
+		return h.reapAfter / 2
 	}
+	return h.clientConfig.PingPeriod
 }
 
-// Run starts the hub's main event loop
+// publish hands a batch to the main loop for broadcasting
+// With the drop-oldest policy a full channel never blocks the caller:
+// the oldest waiting batch is discarded instead and counted.
+// It returns false, without publishing, if the hub stops while it waits.
+func (h *Hub) publish(batch []PixelUpdate) bool {
+	if h.broadcastPolicy == broadcastBlock {
+		select {
+		case h.broadcast <- batch:
+			return true
+		case <-h.stop:
+			return false
+		}
+	}
+
+	for {
+		select {
+		case h.broadcast <- batch:
+			return true
+		default:
+			// Channel is full - throw away the oldest batch and try again
+			select {
+			case <-h.broadcast:
+				dropped := h.droppedBatches.Add(1)
+				slog.Warn("Broadcast channel full, dropped oldest batch", "totalDropped", dropped)
+			default:
+				// The main loop emptied a slot in the meantime
+			}
+		}
+	}
+}
+
+// ClientCount returns the number of connected clients
+// Safe to call from any goroutine
+func (h *Hub) ClientCount() int64 {
+	return h.clientCount.Load()
+}
+
+// MaxClients returns the client limit (0 = no limit)
+func (h *Hub) MaxClients() int {
+	return h.maxClients
+}
+
+// reserveClient takes a client slot before a WebSocket upgrade
+// It returns false when the hub is full. The check and the increment are one
+// compare-and-swap, so two handlers can't both take the last slot.
+// A reserved slot is given back with releaseClient if the client never
+// registers, and by Run when a registered client leaves.
+func (h *Hub) reserveClient() bool {
+	for {
+		count := h.clientCount.Load()
+		if h.maxClients > 0 && count >= int64(h.maxClients) {
+			return false
+		}
+		if h.clientCount.CompareAndSwap(count, count+1) {
+			return true
+		}
+	}
+}
+
+// releaseClient gives back a slot taken by reserveClient for a client that
+// never reached the register channel
+func (h *Hub) releaseClient() {
+	h.clientCount.Add(-1)
+}
+
+// Alive returns true if the main loop answers within timeout
+// A loop that is stuck (or has stopped) can't take the probe, so this
+// detects a wedged hub even though its goroutine still exists
+func (h *Hub) Alive(timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	probe := make(chan struct{})
+	select {
+	case h.probes <- probe:
+	case <-timer.C:
+		return false
+	}
+
+	select {
+	case <-probe:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// DroppedBatches returns how many batches the drop-oldest policy has discarded
+func (h *Hub) DroppedBatches() int64 {
+	return h.droppedBatches.Load()
+}
+
+// BroadcastBacklog returns how many batches are waiting in the broadcast channel
+// A value stuck at the channel's capacity means the main loop can't keep up:
+// with the block policy the queue processor is stalled, with drop-oldest
+// batches are being discarded.
+func (h *Hub) BroadcastBacklog() int {
+	return len(h.broadcast)
+}
+
+// Start launches the hub's goroutines
+// Both are supervised, so a panic in either one is logged and the loop restarts
+func (h *Hub) Start() {
+	// The main event loop handling clients and broadcasts
+	superviseGo("hub", h.Run)
+
+	// The queue processor continuously reads from the queue and sends batches
+	superviseGo("processQueue", h.processQueue)
+}
+
+// Run is the hub's main event loop
 // This function runs in its own goroutine and handles:
 // 1. Registering new clients
 // 2. Unregistering disconnected clients
 // 3. Broadcasting batches of pixels to all clients
-// 4. Reading from the queue and broadcasting
+// 4. Handling acknowledgements from paced clients
+// 5. Reaping clients that stopped answering pings (when enabled)
+// 6. Answering health probes and client listings from other goroutines
+// It returns once Stop is called and every client has been closed.
 func (h *Hub) Run() {
-	// Start the queue processor in a separate goroutine
-	// This goroutine continuously reads from the queue and sends batches
-	go h.processQueue()
+	// The reaper checks pong times a few times per threshold so a dead
+	// client is closed soon after it crosses it (a nil channel never fires)
+	var reap <-chan time.Time
+	if h.reapAfter > 0 {
+		ticker := time.NewTicker(h.reapAfter / 4)
+		defer ticker.Stop()
+		reap = ticker.C
+	}
+
+	// Clients with a full send buffer are retried while they are in their
+	// grace period (without one they are dropped on the first failure)
+	var retry <-chan time.Time
+	if h.slowGrace > 0 || h.slowStrikes > 1 {
+		ticker := time.NewTicker(slowRetryInterval)
+		defer ticker.Stop()
+		retry = ticker.C
+	}
 
 	// Main event loop - runs forever
 	for {
 		select {
 		case client := <-h.register:
 			// New client connected - add to the map
+			// Connecting counts as a pong so the client isn't reaped right away
+			client.lastPong.Store(timeNow().UnixNano())
 			h.clients[client] = true
-			log.Printf("Client registered. Total clients: %d", len(h.clients))
+			// The client was counted when its handler reserved a slot, so
+			// registering can never take the hub past maxClients
+			slog.Info("Client registered", "clients", len(h.clients))
+
+			// Send the current canvas before any batch reaches the client,
+			// or at least the cursor to resume from later
+			if client.wantsSnapshot {
+				h.sendSnapshot(client)
+			} else {
+				h.sendCursor(client)
+			}
 
 		case client := <-h.unregister:
 			// Client disconnected - remove from map and close channel
-			if _, ok := h.clients[client]; ok {
-				delete(h.clients, client)
-				close(client.send)
-				log.Printf("Client unregistered. Total clients: %d", len(h.clients))
+			// A client the hub already dropped (a slow consumer, a dead
+			// connection) still unregisters when its readPump ends; remove
+			// ignores it then
+			if h.remove(client) {
+				slog.Info("Client unregistered", "clients", len(h.clients))
 			}
 
 		case batch := <-h.broadcast:
+			broadcastBatchSize.Observe(float64(len(batch)))
+			if slog.Default().Enabled(context.Background(), slog.LevelDebug) {
+				slog.Debug("Batch broadcast", "pixels", len(batch), "clients", len(h.clients), "requestIds", requestIDs(batch))
+			}
+
 			// Broadcast a batch of pixels to all connected clients
 			// Iterate over all clients and send the batch
 			for client := range h.clients {
-				select {
-				case client.send <- batch:
-					// Successfully sent batch to client
-				default:
-					// Client's send buffer is full - disconnect them
-					// This prevents a slow client from blocking the hub
-					close(client.send)
-					delete(h.clients, client)
-					log.Printf("Client removed due to slow consumption")
-				}
+				h.deliver(client, batch)
+			}
+
+		case seq := <-h.clear:
+			h.clearCanvas(seq)
+
+		case <-h.disconnects:
+			// The server is draining: close every connection so the clients
+			// reconnect to another instance
+			for client := range h.clients {
+				h.remove(client)
+			}
+			slog.Info("Disconnected all clients")
+
+		case probe := <-h.probes:
+			// A health check - answering proves the loop isn't stuck
+			close(probe)
+
+		case reply := <-h.clientQueries:
+			// Somebody outside the hub wants to see the clients
+			reply <- h.clientInfos()
+
+		case ack := <-h.acks:
+			// A paced client processed some batches - give it more credit
+			if _, ok := h.clients[ack.client]; ok {
+				h.handleAck(ack)
+			}
+
+		case sub := <-h.subscriptions:
+			// A client chose which part of the canvas it wants to receive
+			if _, ok := h.clients[sub.client]; ok {
+				sub.client.subscribe(sub)
+			}
+
+		case req := <-h.resumes:
+			// A reconnected client wants what it missed
+			if _, ok := h.clients[req.client]; ok {
+				h.sendResume(req.client, req.cursor)
+			}
+
+		case <-reap:
+			h.reapDeadClients()
+
+		case <-retry:
+			h.retryStalled()
+
+		case <-h.stop:
+			h.shutdown()
+			return
+		}
+	}
+}
+
+// Stop shuts the hub down for a graceful exit
+// The queue processor stops, pixels still waiting in the queue are sent to
+// every client as a final batch, and all client connections are closed.
+// Stop waits until the clients' writers have finished or ctx expires.
+func (h *Hub) Stop(ctx context.Context) error {
+	// No writePump is counted from here on, so the wait below is safe
+	h.pumpsMu.Lock()
+	h.stopping = true
+	h.pumpsMu.Unlock()
+
+	close(h.stop)
+
+	select {
+	case <-h.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	// Wait for the writePumps to flush their send channels
+	flushed := make(chan struct{})
+	go func() {
+		h.pumps.Wait()
+		close(flushed)
+	}()
+
+	select {
+	case <-flushed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// shutdown sends everything still waiting to be broadcast as one final batch
+// and then closes every client (must be called from Run)
+func (h *Hub) shutdown() {
+	var final []PixelUpdate
+
+	// Wait until processQueue has stopped so nothing is added to the
+	// broadcast channel or taken from the queue while they are drained
+	<-h.queueDone
+
+	// Batches already handed to the broadcast channel
+	for pending := true; pending; {
+		select {
+		case batch := <-h.broadcast:
+			final = append(final, batch...)
+		default:
+			pending = false
+		}
+	}
+
+	// Pixels processQueue had taken from the queue but not published,
+	// then the ones still in the queue
+	final = append(final, h.unpublished...)
+	if remaining := h.queue.Len(); remaining > 0 {
+		final = append(final, h.queue.DequeueBatch(remaining)...)
+	}
+	if len(final) > 0 {
+		slog.Info("Flushing pending pixels to consumers before shutdown", "pixels", len(final))
+	}
+	h.tagChunks(final)
+
+	for client := range h.clients {
+		// Nothing will be sent after this, so paced clients get their held
+		// pixels too, regardless of credit
+		batch := client.skipSnapshotted(coalescePixels(append(append([]PixelUpdate{}, client.held...), client.subscribed(final)...)))
+		if len(batch) > 0 {
+			select {
+			case client.send <- outboundMessage{Type: messageBatch, Pixels: batch}:
+			default:
+				slog.Warn("Client send buffer full, final batch not delivered")
 			}
 		}
+
+		// Closing the send channel makes the writePump send a close message
+		h.remove(client)
+	}
+	close(h.done)
+}
+
+// snapshotOverlap is how far back snapshot pixels are remembered as possibly
+// still on their way through the queue. Pixels are queued right after they are
+// accepted, so anything older has long been broadcast.
+const snapshotOverlap = 10 * time.Second
+
+// sendSnapshot sends the visible canvas to a newly registered client
+// (must be called from Run)
+// Because it runs on the hub goroutine, no batch can be broadcast between
+// reading the snapshot and queueing it, so the client can't miss an update.
+// Pixels that were accepted but not broadcast yet are in the snapshot too; they
+// are remembered so deliver doesn't send them to this client a second time.
+func (h *Hub) sendSnapshot(client *Client) {
+	if h.snapshot == nil {
+		return
+	}
+
+	// The cursor is read first, so it never covers a placement the
+	// snapshot is missing
+	cursor := h.cursor()
+	pixels, err := h.snapshot()
+	if err != nil {
+		slog.Error("Failed to read canvas snapshot for new client", "err", err)
+		return
+	}
+	if pixels == nil {
+		pixels = []PixelUpdate{}
+	}
+	h.rememberPending(client, pixels)
+
+	// The send channel is empty for a new client, so this doesn't block
+	// The snapshot doesn't count towards the paced client's ack sequence
+	select {
+	case client.send <- outboundMessage{Type: messageSnapshot, Pixels: pixels, Cursor: &cursor}:
+	default:
+		h.drop(client, "snapshot could not be queued")
+	}
+}
+
+// rememberPending records the recent pixels of a snapshot (or resume) sent
+// to the client, so skipSnapshotted can leave them out of later batches
+func (h *Hub) rememberPending(client *Client, pixels []PixelUpdate) {
+	cutoff := timeNow().Add(-snapshotOverlap).UnixMilli()
+	client.pending = make(map[[2]int]PixelUpdate)
+	for _, pixel := range pixels {
+		if pixel.Timestamp >= cutoff {
+			client.pending[[2]int{pixel.X, pixel.Y}] = pixel
+		}
+	}
+	client.pendingUntil = timeNow().Add(snapshotOverlap)
+}
+
+// cursor returns the newest placement sequence number (0 without a Cursor)
+func (h *Hub) cursor() int64 {
+	if h.currentSeq == nil {
+		return 0
+	}
+	return h.currentSeq()
+}
+
+// sendCursor tells a client that didn't ask for a snapshot the cursor to
+// resume from (must be called from Run)
+func (h *Hub) sendCursor(client *Client) {
+	if h.currentSeq == nil {
+		return
+	}
+
+	cursor := h.cursor()
+	select {
+	case client.send <- outboundMessage{Type: messageCursor, Pixels: []PixelUpdate{}, Cursor: &cursor}:
+	default:
+		h.drop(client, "cursor could not be queued")
+	}
+}
+
+// skipSnapshotted removes pixels the client already received in its snapshot
+// A batch pixel identical to the snapshot's pixel at the same coordinate is
+// the same placement arriving late, so sending it again would apply it twice.
+// An older pixel at that coordinate would overwrite the newer snapshot pixel,
+// so it is skipped as well.
+func (c *Client) skipSnapshotted(batch []PixelUpdate) []PixelUpdate {
+	if c.pending == nil {
+		return batch
+	}
+	if timeNow().After(c.pendingUntil) {
+		c.pending = nil
+		return batch
+	}
+
+	kept := make([]PixelUpdate, 0, len(batch))
+	for _, pixel := range batch {
+		key := [2]int{pixel.X, pixel.Y}
+		if seen, ok := c.pending[key]; ok {
+			// The request ID is only for the logs, and the canvas cache the
+			// snapshot comes from doesn't keep it
+			seen.RequestID = pixel.RequestID
+			if pixel == seen {
+				delete(c.pending, key)
+				continue
+			}
+			if pixel.Seq < seen.Seq {
+				continue
+			}
+			// A newer placement - the snapshot pixel no longer matters
+			delete(c.pending, key)
+		}
+		kept = append(kept, pixel)
+	}
+	return kept
+}
+
+// reapDeadClients closes every client whose last pong is older than the
+// reap threshold (must be called from Run)
+// This catches half-open connections sooner than the read deadline would
+func (h *Hub) reapDeadClients() {
+	cutoff := timeNow().Add(-h.reapAfter).UnixNano()
+	for client := range h.clients {
+		if client.lastPong.Load() < cutoff {
+			h.drop(client, "no pong received")
+			// Closing the connection unblocks readPump and writePump right away
+			// instead of waiting for a write to a dead peer to time out
+			client.conn.Close()
+		}
+	}
+}
+
+// deliver sends a batch to a single client (must be called from Run)
+// Paced clients that are out of credit get the batch held instead,
+// and it is sent once they acknowledge what they already have
+func (h *Hub) deliver(client *Client, batch []PixelUpdate) {
+	// Only the part of the canvas the client subscribed to is sent (or held) at all
+	batch = client.subscribed(batch)
+	if len(batch) == 0 {
+		return
+	}
+
+	if client.paced && client.sentSeq-client.ackedSeq >= int64(h.ackWindow) {
+		// Out of credit - hold the pixels until the client catches up
+		client.held = append(client.held, batch...)
+		if len(client.held) > maxHeldPixels {
+			h.drop(client, "too many unacknowledged pixels")
+		}
+		return
+	}
+
+	// Skip pixels the client already got in its snapshot
+	batch = client.skipSnapshotted(batch)
+	if len(batch) == 0 {
+		return
+	}
+
+	h.send(client, batch)
+}
+
+// send hands a batch to the client's writePump (must be called from Run)
+// The hub never waits for a single client, since that would hold up every
+// other one. When the send buffer is full the pixels are held instead and
+// offered again with the next batch or by retryStalled. The client is only
+// dropped once the buffer has stayed full for slowGrace and slowStrikes
+// attempts in a row, so a brief network hiccup doesn't disconnect it; once
+// it recovers it gets the latest color of every pixel it missed.
+func (h *Hub) send(client *Client, batch []PixelUpdate) {
+	if client.stalls > 0 {
+		// held may share its array with other clients' batches, so it is
+		// copied rather than appended to
+		batch = coalescePixels(append(append([]PixelUpdate(nil), client.held...), batch...))
+		client.held = nil
+	}
+	if len(batch) == 0 {
+		client.stalls = 0
+		return
+	}
+
+	select {
+	case client.send <- outboundMessage{Type: messageBatch, Pixels: batch}:
+		// Successfully sent batch to client
+		client.sentSeq++
+		if client.stalls > 0 {
+			slog.Info("Slow client caught up", "failedSends", client.stalls, "stalledFor", timeNow().Sub(client.stalledSince))
+			client.stalls = 0
+		}
+
+	default:
+		// Client's send buffer is full - hold the pixels and count the failure
+		now := timeNow()
+		if client.stalls == 0 {
+			client.stalledSince = now
+		}
+		client.stalls++
+		client.held = batch
+
+		switch {
+		case client.stalls >= h.slowStrikes && now.Sub(client.stalledSince) >= h.slowGrace:
+			h.drop(client, "slow consumption")
+		case len(client.held) > maxHeldPixels:
+			h.drop(client, "too many undelivered pixels")
+		}
+	}
+}
+
+// retryStalled offers the held pixels again to every client whose send
+// buffer was full (must be called from Run)
+// Paced clients out of credit are left to their next acknowledgement.
+func (h *Hub) retryStalled() {
+	for client := range h.clients {
+		if client.stalls == 0 || (client.paced && client.sentSeq-client.ackedSeq >= int64(h.ackWindow)) {
+			continue
+		}
+		h.send(client, nil)
+	}
+}
+
+// handleAck records an acknowledgement and flushes held pixels if the
+// client has credit again (must be called from Run)
+func (h *Hub) handleAck(ack clientAck) {
+	client := ack.client
+
+	// Ignore acks that go backwards or acknowledge batches never sent
+	if ack.upTo <= client.ackedSeq || ack.upTo > client.sentSeq {
+		return
+	}
+	client.ackedSeq = ack.upTo
+
+	if len(client.held) == 0 {
+		return
 	}
+
+	// Send everything held so far as one batch, keeping only the
+	// latest pixel for each coordinate since that's all that gets rendered
+	held := coalescePixels(client.held)
+	client.held = nil
+	h.deliver(client, held)
+}
+
+// drop disconnects a client from the hub (must be called from Run)
+func (h *Hub) drop(client *Client, reason string) {
+	if h.remove(client) {
+		slog.Warn("Client removed", "reason", reason)
+	}
+}
+
+// remove takes a client out of the hub and closes its send channel, which
+// makes its writePump send a close message and end (must be called from Run)
+// It is the only place send is closed. A client can be removed several ways
+// (dropped while broadcasting, reaped, unregistered by its readPump, shut
+// down) and often more than one of them happens; closing a channel twice
+// panics, so only the first one does anything. It returns whether it did.
+func (h *Hub) remove(client *Client) bool {
+	if client.removed {
+		return false
+	}
+	client.removed = true
+	delete(h.clients, client)
+	h.clientCount.Add(-1)
+	close(client.send)
+	return true
+}
+
+// coalescePixels keeps only the latest update for each coordinate
+// The surviving pixels keep the order of their last update
+func coalescePixels(pixels []PixelUpdate) []PixelUpdate {
+	latest := make(map[[2]int]int, len(pixels))
+	for i, pixel := range pixels {
+		latest[[2]int{pixel.X, pixel.Y}] = i
+	}
+
+	result := make([]PixelUpdate, 0, len(latest))
+	for i, pixel := range pixels {
+		if latest[[2]int{pixel.X, pixel.Y}] == i {
+			result = append(result, pixel)
+		}
+	}
+	return result
+}
+
+// Clear tells every connected client to reset its canvas
+// Call it after the canvas has been cleared in the database; seq is the
+// newest sequence number handed out before the clear (Database.LastSeq).
+func (h *Hub) Clear(seq int64) {
+	select {
+	case h.clear <- seq:
+	case <-h.stop:
+	}
+}
+
+// DisconnectAll closes every client connection
+// Clients receive a close message and are expected to reconnect.
+func (h *Hub) DisconnectAll() {
+	select {
+	case h.disconnects <- struct{}{}:
+	case <-h.stop:
+	}
+}
+
+// clearCanvas sends the clear message to every client (must be called from Run)
+// Pixels in the batches still waiting in the broadcast channel and in the
+// held pixels with a sequence number up to seq were removed by the clear, so
+// they are discarded first, along with the snapshot bookkeeping. Pixels
+// placed after the clear are kept and sent after the clear message.
+// Pixels that processQueue has already taken from the queue can still arrive
+// after the clear; they were placed at about the same moment.
+func (h *Hub) clearCanvas(seq int64) {
+	var kept []PixelUpdate
+	for pending := true; pending; {
+		select {
+		case batch := <-h.broadcast:
+			kept = append(kept, placedAfter(batch, seq)...)
+		default:
+			pending = false
+		}
+	}
+
+	for client := range h.clients {
+		client.held = placedAfter(client.held, seq)
+		if client.held == nil {
+			client.stalls = 0
+		}
+		client.pending = nil
+
+		// Like the snapshot, the clear doesn't count towards the ack sequence
+		select {
+		case client.send <- outboundMessage{Type: messageClear, Pixels: []PixelUpdate{}}:
+		default:
+			h.drop(client, "slow consumption")
+		}
+	}
+	slog.Info("Sent canvas clear", "clients", len(h.clients), "keptPixels", len(kept))
+
+	if len(kept) > 0 {
+		for client := range h.clients {
+			h.deliver(client, kept)
+		}
+	}
+}
+
+// placedAfter returns the pixels of batch with a sequence number above seq
+// (nil if there are none), in a new slice: batches are shared between clients
+func placedAfter(batch []PixelUpdate, seq int64) []PixelUpdate {
+	var result []PixelUpdate
+	for _, pixel := range batch {
+		if pixel.Seq > seq {
+			result = append(result, pixel)
+		}
+	}
+	return result
+}
+
+// Batching limits for processQueue when BATCH_SIZE and BATCH_INTERVAL are
+// not set: a batch is broadcast once it holds defaultBatchSize pixels or its
+// first pixel has waited defaultBatchInterval
+const (
+	defaultBatchSize     = 50
+	defaultBatchInterval = 100 * time.Millisecond
+
+	// queuePollInterval is how often processQueue checks the queue for pixels
+	queuePollInterval = 10 * time.Millisecond
+)
+
+// validateBatching checks the BATCH_SIZE and BATCH_INTERVAL settings
+// A batch larger than maxHeldPixels would get a client whose send buffer is
+// momentarily full dropped at once instead of held, so that is the limit.
+func validateBatching(size int, interval time.Duration) error {
+	if size < 1 || size > maxHeldPixels {
+		return fmt.Errorf("batch size must be between 1 and %d pixels, got %d", maxHeldPixels, size)
+	}
+	if interval <= 0 {
+		return fmt.Errorf("batch interval must be positive, got %s", interval)
+	}
+	return nil
 }
 
 // processQueue continuously reads from the pixel queue and broadcasts batches
-// It implements the batching logic: send every 100ms or 50 pixels, whichever comes first
+// It implements the batching logic: send every batchInterval or batchSize
+// pixels, whichever comes first
+// Everything happens on this one goroutine, so every pixel is published
+// exactly once and in the order it was queued.
 func (h *Hub) processQueue() {
-	// Ticker fires every 100 milliseconds
-	ticker := time.NewTicker(100 * time.Millisecond)
-	defer ticker.Stop()
+	// The queue can't wake us up without blocking, so it is polled
+	poll := time.NewTicker(queuePollInterval)
+	defer poll.Stop()
 
 	// Buffer to accumulate pixels before broadcasting
+	// deadline is when the buffered pixels must be sent (unset while empty)
 	var buffer []PixelUpdate
+	var deadline time.Time
 
 	for {
 		select {
-		case <-ticker.C:
-			// Timer fired - check if we have pixels to broadcast
-			if len(buffer) > 0 {
-				// Broadcast the accumulated pixels
-				h.broadcast <- buffer
-				log.Printf("Broadcasting batch of %d pixels (time-based)", len(buffer))
-
-				// Create a new buffer for the next batch
-				buffer = make([]PixelUpdate, 0, 50)
+		case <-h.stop:
+			// The hub is shutting down; Run flushes what's left
+			h.stopProcessing(buffer)
+			return
+
+		case <-poll.C:
+		}
+
+		// Move pixels from the queue into the buffer, sending full batches
+		// DequeueBatch blocks on an empty queue, so check first; this is the
+		// only goroutine taking pixels out while the hub runs
+		for !h.queue.IsEmpty() {
+			if len(buffer) == 0 {
+				deadline = timeNow().Add(h.batchInterval)
 			}
+			buffer = append(buffer, h.queue.DequeueBatch(h.batchSize-len(buffer))...)
 
-			// Try to get more pixels from the queue (non-blocking)
-			// We dequeue in a separate goroutine to avoid blocking the ticker
-			go func() {
-				if !h.queue.IsEmpty() {
-					// Get up to 50 pixels from the queue
-					batch := h.queue.DequeueBatch(50)
-					if len(batch) > 0 {
-						// Add to buffer
-						// Note: In a production system, you'd need proper synchronization
-						// For simplicity, we're broadcasting directly here
-						h.broadcast <- batch
-						log.Printf("Broadcasting batch of %d pixels (size-based)", len(batch))
-					}
+			if len(buffer) == h.batchSize {
+				batch := h.outgoing(buffer)
+				slog.Debug("Broadcasting batch", "pixels", len(batch), "trigger", "size")
+				if !h.publish(batch) {
+					h.stopProcessing(buffer)
+					return
 				}
-			}()
+				buffer = nil
+			}
+		}
+
+		// Send a partial batch once its first pixel has waited long enough
+		if len(buffer) > 0 && !timeNow().Before(deadline) {
+			batch := h.outgoing(buffer)
+			slog.Debug("Broadcasting batch", "pixels", len(batch), "trigger", "time")
+			if !h.publish(batch) {
+				h.stopProcessing(buffer)
+				return
+			}
+			buffer = nil
 		}
 	}
 }
+
+// outgoing returns the batch to publish for the buffered pixels
+// With coalescing on, only the latest update for each coordinate is kept;
+// it keeps its own timestamp. Every pixel is tagged with its chunk.
+func (h *Hub) outgoing(buffer []PixelUpdate) []PixelUpdate {
+	batch := buffer
+	if h.coalesce {
+		batch = coalescePixels(buffer)
+	}
+	h.tagChunks(batch)
+	return batch
+}
+
+// tagChunks sets the chunk of every pixel in the batch
+func (h *Hub) tagChunks(batch []PixelUpdate) {
+	for i := range batch {
+		chunk := chunkOf(batch[i].X, batch[i].Y, h.chunkSize)
+		batch[i].Chunk = &chunk
+	}
+}
+
+// stopProcessing hands the pixels processQueue had not published yet to
+// shutdown and tells it the queue is no longer being read
+func (h *Hub) stopProcessing(buffer []PixelUpdate) {
+	h.unpublished = buffer
+	close(h.queueDone)
+}
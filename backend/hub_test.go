@@ -0,0 +1,586 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestPacedClientIsHeldNotDropped(t *testing.T) {
+	room := newTestRoom(t, map[string]string{"WS_ACK_WINDOW": "2", "BATCH_INTERVAL": "5ms"})
+	ts := startTestServer(t, room)
+	s := room.server
+	conn := dialWS(t, ts, "/ws/queue?ack=true&snapshot=false")
+	if msg := readMessage(t, conn, time.Second); msg.Type != messageCursor {
+		t.Fatalf("first message %q, want the cursor", msg.Type)
+	}
+
+	// Two batches use up the credit window
+	place(t, s, 0, 0, "#FF0000", "user0")
+	readBatch(t, conn, time.Second)
+	place(t, s, 1, 0, "#FF0000", "user1")
+	readBatch(t, conn, time.Second)
+
+	// Further pixels are held for the client instead of being sent, and the
+	// client stays connected however long it takes to acknowledge
+	place(t, s, 2, 0, "#00FF00", "user2")
+	place(t, s, 3, 0, "#0000FF", "user3")
+	waitFor(t, time.Second, "the pixels to be held", func() bool {
+		return onlyClient(t, s.hub).Held == 2
+	})
+	if info := onlyClient(t, s.hub); info.InFlight != 2 {
+		t.Fatalf("in flight %d, want 2", info.InFlight)
+	}
+
+	// Acknowledging gives credit back and the held pixels arrive together
+	if err := conn.WriteJSON(map[string]interface{}{"type": "ack", "upTo": 2}); err != nil {
+		t.Fatalf("sending ack: %v", err)
+	}
+	batch := readBatch(t, conn, time.Second)
+	if len(batch) != 2 || batch[0].X != 2 || batch[1].X != 3 {
+		t.Fatalf("batch after the ack %+v, want the two held pixels", batch)
+	}
+	if info := onlyClient(t, s.hub); info.Held != 0 {
+		t.Fatalf("still holding %d pixels after the ack", info.Held)
+	}
+}
+
+func TestParseBroadcastPolicy(t *testing.T) {
+	for _, value := range []string{"block", "drop-oldest"} {
+		if policy, err := ParseBroadcastPolicy(value); err != nil || string(policy) != value {
+			t.Errorf("%q: %q, %v", value, policy, err)
+		}
+	}
+	for _, value := range []string{"", "drop", "DROP-OLDEST"} {
+		if _, err := ParseBroadcastPolicy(value); err == nil {
+			t.Errorf("%q accepted", value)
+		}
+	}
+}
+
+func TestUnknownBroadcastPolicyStopsStartup(t *testing.T) {
+	t.Setenv("BROADCAST_POLICY", "drop")
+	liveConfig, err := NewLiveConfig("")
+	if err != nil {
+		t.Fatalf("loading config: %v", err)
+	}
+	db := newTestDatabase(t)
+
+	if _, err := newRoom("", db, liveConfig.Get().Canvas, roomOptions{liveConfig: liveConfig, drain: NewDrain(0)}); err == nil {
+		t.Fatal("room built with an unknown broadcast policy")
+	}
+}
+
+func TestBroadcastDropOldestWhenFanOutStalls(t *testing.T) {
+	// The hub is never started, so nothing drains the broadcast channel -
+	// the same as a main loop stuck in a large fan-out
+	hub := NewHub(newTestQueue(t, 10), HubConfig{BroadcastBuffer: 2, BroadcastPolicy: broadcastDropOldest})
+
+	for i := 0; i < 5; i++ {
+		if !hub.publish([]PixelUpdate{{X: i}}) {
+			t.Fatalf("publish %d failed", i)
+		}
+	}
+
+	if got := hub.DroppedBatches(); got != 3 {
+		t.Fatalf("%d batches dropped, want 3", got)
+	}
+	// The newest batches are the ones kept
+	for _, want := range []int{3, 4} {
+		if batch := <-hub.broadcast; batch[0].X != want {
+			t.Fatalf("kept batch %d, want %d", batch[0].X, want)
+		}
+	}
+}
+
+func TestBroadcastBlockWhenFanOutStalls(t *testing.T) {
+	hub := NewHub(newTestQueue(t, 10), HubConfig{BroadcastBuffer: 1})
+	hub.publish([]PixelUpdate{{X: 0}})
+
+	published := make(chan bool)
+	go func() { published <- hub.publish([]PixelUpdate{{X: 1}}) }()
+
+	select {
+	case <-published:
+		t.Fatal("publish returned while the channel was full")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Stopping the hub releases the blocked publisher without publishing
+	close(hub.stop)
+	if <-published {
+		t.Fatal("publish reported success after the hub stopped")
+	}
+	if got := hub.DroppedBatches(); got != 0 {
+		t.Fatalf("%d batches dropped by the block policy", got)
+	}
+}
+
+func TestReaperClosesClientThatStopsPonging(t *testing.T) {
+	room := newTestRoom(t, map[string]string{"WS_REAP_AFTER": "200ms"})
+	ts := startTestServer(t, room)
+	hub := room.server.hub
+
+	// gorilla answers pings while the connection is being read, so a
+	// client that reads keeps ponging and one that never reads stops
+	healthy := dialWS(t, ts, "/ws/queue?snapshot=false")
+	go func() {
+		for {
+			if _, _, err := healthy.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	dialWS(t, ts, "/ws/queue?snapshot=false")
+	waitFor(t, time.Second, "both clients to register", func() bool { return hub.ClientCount() == 2 })
+
+	// The pong wait (the read deadline) is a minute, so only the reaper can
+	// close the silent client this quickly
+	waitFor(t, time.Second, "the silent client to be reaped", func() bool { return hub.ClientCount() == 1 })
+
+	// The healthy client outlives several reap windows
+	time.Sleep(600 * time.Millisecond)
+	if got := hub.ClientCount(); got != 1 {
+		t.Fatalf("%d clients after the reap windows, want the healthy one", got)
+	}
+}
+
+// pumpsIdle reports whether no writePump is counted within timeout
+func pumpsIdle(hub *Hub, timeout time.Duration) bool {
+	idle := make(chan struct{})
+	go func() {
+		hub.pumps.Wait()
+		close(idle)
+	}()
+	select {
+	case <-idle:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func TestConnectWhileHubStops(t *testing.T) {
+	room := newTestRoom(t, nil)
+	ts := startTestServer(t, room)
+	hub := room.server.hub
+
+	// Clients keep connecting while the hub shuts down; every pump counted
+	// must be waited for by Stop or given back when registering fails
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/ws/queue?snapshot=false", nil)
+			if err == nil {
+				conn.Close()
+			}
+		}
+	}()
+
+	time.Sleep(5 * time.Millisecond)
+	stopped := make(chan struct{})
+	go func() {
+		stopTestRoom(room)
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the room didn't stop")
+	}
+	<-done
+
+	// Connections refused after the stop don't leave a pump counted
+	if !pumpsIdle(hub, time.Second) {
+		t.Fatal("a writePump is still counted after the hub stopped")
+	}
+}
+
+func TestEveryQueuedPixelIsBroadcastOnce(t *testing.T) {
+	room := newTestRoom(t, map[string]string{"BATCH_SIZE": "50", "BATCH_INTERVAL": "100ms"})
+	ts := startTestServer(t, room)
+	conn := dialWS(t, ts, "/ws/queue?snapshot=false")
+	readMessage(t, conn, time.Second) // The cursor
+	waitFor(t, time.Second, "the client to register", func() bool { return room.server.hub.ClientCount() == 1 })
+
+	const total = 120
+	now := currentTimeMillis()
+	for i := 0; i < total; i++ {
+		if err := room.server.queue.Enqueue(PixelUpdate{X: i, Y: 0, Color: "#FF0000", UserID: "alice", Timestamp: now, Seq: int64(i + 1)}); err != nil {
+			t.Fatalf("enqueue %d: %v", i, err)
+		}
+	}
+
+	seen := make(map[int]int)
+	batches := 0
+	for len(seen) < total {
+		for _, pixel := range readBatch(t, conn, 2*time.Second) {
+			seen[pixel.X]++
+		}
+		batches++
+	}
+
+	// Nothing else arrives after the last batch
+	conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	var extra outboundMessage
+	if err := conn.ReadJSON(&extra); err == nil {
+		t.Fatalf("unexpected message after all pixels arrived: %+v", extra)
+	}
+
+	for x := 0; x < total; x++ {
+		if seen[x] != 1 {
+			t.Errorf("pixel %d broadcast %d times", x, seen[x])
+		}
+	}
+	// 50 + 50 + 20, or more batches if the processor ran ahead of the enqueueing
+	if batches < 3 {
+		t.Errorf("%d batches, want at least 3 with BATCH_SIZE=50", batches)
+	}
+}
+
+func TestFloodNeverDeadlocksTheHub(t *testing.T) {
+	for _, policy := range []BroadcastPolicy{broadcastBlock, broadcastDropOldest} {
+		t.Run(string(policy), func(t *testing.T) {
+			// One-pixel batches into a two-batch broadcast channel, so the
+			// processor runs into a full channel over and over
+			room := newTestRoom(t, map[string]string{
+				"BROADCAST_POLICY":    string(policy),
+				"BROADCAST_BUFFER":    "2",
+				"BATCH_SIZE":          "1",
+				"BATCH_INTERVAL":      "1ms",
+				"QUEUE_OVERFLOW":      "block",
+				"QUEUE_BLOCK_TIMEOUT": "10s",
+			})
+			ts := startTestServer(t, room)
+			hub := room.server.hub
+
+			// A client that reads everything and one that never reads
+			reader := dialWS(t, ts, "/ws/queue?snapshot=false")
+			go func() {
+				for {
+					if _, _, err := reader.ReadMessage(); err != nil {
+						return
+					}
+				}
+			}()
+			dialWS(t, ts, "/ws/queue?snapshot=false")
+			waitFor(t, time.Second, "the clients to register", func() bool { return hub.ClientCount() == 2 })
+
+			const producers, perProducer = 8, 500
+			flooded := make(chan struct{})
+			go func() {
+				defer close(flooded)
+				done := make(chan struct{}, producers)
+				for p := 0; p < producers; p++ {
+					go func(p int) {
+						defer func() { done <- struct{}{} }()
+						for i := 0; i < perProducer; i++ {
+							room.server.queue.Enqueue(PixelUpdate{X: i, Y: p, Color: "#FF0000", UserID: "alice", Timestamp: currentTimeMillis()})
+						}
+					}(p)
+				}
+				for p := 0; p < producers; p++ {
+					<-done
+				}
+			}()
+
+			select {
+			case <-flooded:
+			case <-time.After(10 * time.Second):
+				t.Fatal("producers still blocked after 10s")
+			}
+			waitFor(t, 5*time.Second, "the queue to drain", func() bool { return room.server.queue.Len() == 0 })
+
+			// The main loop still answers, and the room shuts down in time
+			if !hub.Alive(time.Second) {
+				t.Fatal("the hub's main loop is stuck")
+			}
+			stopped := make(chan struct{})
+			go func() {
+				stopTestRoom(room)
+				close(stopped)
+			}()
+			select {
+			case <-stopped:
+			case <-time.After(5 * time.Second):
+				t.Fatal("the room didn't stop after the flood")
+			}
+		})
+	}
+}
+
+// stalledClient registers a client whose one-slot send buffer is already
+// full with a hub that is never started, so its sends can be driven by hand
+func stalledClient(hub *Hub) *Client {
+	client := &Client{hub: hub, send: make(chan outboundMessage, 1)}
+	client.send <- outboundMessage{Type: messageCursor}
+	hub.clients[client] = true
+	hub.clientCount.Add(1)
+	return client
+}
+
+func TestSlowReaderThatRecoversIsKept(t *testing.T) {
+	clock := useFakeClock(t)
+	hub := NewHub(newTestQueue(t, 10), HubConfig{SlowGrace: 2 * time.Second, SlowStrikes: 3})
+	client := stalledClient(hub)
+
+	// The buffer stays full for more strikes than allowed, but for less
+	// than the grace period
+	for i := 0; i < 5; i++ {
+		hub.deliver(client, []PixelUpdate{{X: 1, Y: 1, Color: "#FF0000"}, {X: i, Y: 0, Color: "#00FF00"}})
+		clock.Advance(300 * time.Millisecond)
+	}
+	if !hub.clients[client] || client.removed {
+		t.Fatal("client dropped within its grace period")
+	}
+
+	// The reader catches up; the next retry sends the latest color of every
+	// pixel it missed as one batch
+	<-client.send
+	hub.retryStalled()
+	if client.stalls != 0 || len(client.held) != 0 {
+		t.Fatalf("still stalled (%d stalls, %d held) after catching up", client.stalls, len(client.held))
+	}
+	msg := <-client.send
+	if len(msg.Pixels) != 6 {
+		t.Fatalf("catch-up batch has %d pixels, want 6 (one per coordinate)", len(msg.Pixels))
+	}
+
+	// Catching up resets the count: a new hiccup gets a full grace period,
+	// even though the first one started more than the grace period ago
+	client.send <- outboundMessage{Type: messageCursor}
+	for i := 0; i < 3; i++ {
+		hub.deliver(client, []PixelUpdate{{X: 2, Y: 2}})
+		clock.Advance(500 * time.Millisecond)
+	}
+	if client.removed {
+		t.Fatal("earlier stalls counted against the client after it recovered")
+	}
+}
+
+func TestSlowReaderIsDroppedAfterGrace(t *testing.T) {
+	clock := useFakeClock(t)
+	hub := NewHub(newTestQueue(t, 10), HubConfig{SlowGrace: 2 * time.Second, SlowStrikes: 3})
+	client := stalledClient(hub)
+
+	for i := 0; i < 3; i++ {
+		hub.deliver(client, []PixelUpdate{{X: i}})
+		clock.Advance(time.Second)
+	}
+	if !client.removed || hub.clients[client] {
+		t.Fatal("client still connected after staying full past its grace period")
+	}
+}
+
+func TestSizeFlushHappensBeforeTheTimer(t *testing.T) {
+	// The interval is far longer than the test, so any batch that arrives
+	// was sent because it was full
+	room := newTestRoom(t, map[string]string{"BATCH_SIZE": "5", "BATCH_INTERVAL": "1m"})
+	ts := startTestServer(t, room)
+	conn := dialWS(t, ts, "/ws/queue?snapshot=false")
+	readMessage(t, conn, time.Second) // The cursor
+	waitFor(t, time.Second, "the client to register", func() bool { return room.server.hub.ClientCount() == 1 })
+
+	now := currentTimeMillis()
+	for i := 0; i < 12; i++ {
+		if err := room.server.queue.Enqueue(PixelUpdate{X: i, Y: 0, Color: "#FF0000", UserID: "alice", Timestamp: now, Seq: int64(i + 1)}); err != nil {
+			t.Fatalf("enqueue %d: %v", i, err)
+		}
+	}
+
+	for want := 0; want < 10; want += 5 {
+		batch := readBatch(t, conn, time.Second)
+		if len(batch) != 5 || batch[0].X != want {
+			t.Fatalf("batch %+v, want 5 pixels from x=%d", batch, want)
+		}
+	}
+
+	// The two left over wait for the timer
+	conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	var extra outboundMessage
+	if err := conn.ReadJSON(&extra); err == nil {
+		t.Fatalf("partial batch sent before the interval: %+v", extra)
+	}
+}
+
+func TestValidateBatching(t *testing.T) {
+	tests := []struct {
+		size     int
+		interval time.Duration
+		valid    bool
+	}{
+		{50, 100 * time.Millisecond, true},
+		{1, time.Millisecond, true},
+		{maxHeldPixels, time.Second, true},
+		{0, 100 * time.Millisecond, false},
+		{maxHeldPixels + 1, 100 * time.Millisecond, false},
+		{50, 0, false},
+		{50, -time.Second, false},
+	}
+
+	for _, test := range tests {
+		if err := validateBatching(test.size, test.interval); (err == nil) != test.valid {
+			t.Errorf("size %d, interval %s: error %v, want valid %v", test.size, test.interval, err, test.valid)
+		}
+	}
+}
+
+func TestEvictedClientCanStillUnregister(t *testing.T) {
+	captureLogs(t)
+	panics := goroutinePanics.Load()
+
+	// Dropped on the first full send buffer
+	hub := NewHub(newTestQueue(t, 10), HubConfig{SlowStrikes: 1})
+	client := stalledClient(hub)
+	hub.Start()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		hub.Stop(ctx)
+	})
+
+	// The broadcast finds the buffer full and evicts the client, closing send
+	hub.publish([]PixelUpdate{{X: 1, Y: 1, Color: "#FF0000"}})
+	waitFor(t, time.Second, "the slow client to be evicted", func() bool { return hub.ClientCount() == 0 })
+
+	// Its readPump then notices the closed connection and unregisters it as
+	// on any disconnect; the second close of send must not happen
+	hub.unregister <- client
+	hub.unregister <- client
+	if !hub.Alive(time.Second) {
+		t.Fatal("the hub's main loop stopped answering")
+	}
+	if got := goroutinePanics.Load(); got != panics {
+		t.Fatalf("%d panics in the hub", got-panics)
+	}
+	if got := hub.ClientCount(); got != 0 {
+		t.Fatalf("client count %d after the unregister, want 0", got)
+	}
+
+	// send was closed exactly once, after the message that filled it
+	<-client.send
+	if _, ok := <-client.send; ok {
+		t.Fatal("send channel still open")
+	}
+}
+
+func TestClientCountWhileClientsChurn(t *testing.T) {
+	// Run with -race: the count and the client list are read from other
+	// goroutines while the hub adds and removes clients
+	room := newTestRoom(t, map[string]string{"ADMIN_TOKEN": "test-admin"})
+	ts := startTestServer(t, room)
+	hub := room.server.hub
+
+	const workers, rounds = 8, 20
+	churned := make(chan struct{})
+	go func() {
+		defer close(churned)
+		done := make(chan struct{}, workers)
+		for w := 0; w < workers; w++ {
+			go func() {
+				defer func() { done <- struct{}{} }()
+				for i := 0; i < rounds; i++ {
+					conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/ws/queue?snapshot=false", nil)
+					if err == nil {
+						conn.Close()
+					}
+				}
+			}()
+		}
+		for w := 0; w < workers; w++ {
+			<-done
+		}
+	}()
+
+	for polling := true; polling; {
+		select {
+		case <-churned:
+			polling = false
+		default:
+		}
+		// A closed client is counted until its readPump unregisters it, so
+		// more than one per worker may be counted at once
+		if n := hub.ClientCount(); n < 0 || n > workers*rounds {
+			t.Fatalf("client count %d, want 0 to %d", n, workers*rounds)
+		}
+		if clients, err := hub.Clients(time.Second); err != nil || len(clients) > workers*rounds {
+			t.Fatalf("client list of %d, %v", len(clients), err)
+		}
+		if status, _ := adminRequest(t, ts, http.MethodGet, "/api/admin/clients", ""); status != http.StatusOK {
+			t.Fatalf("GET /api/admin/clients: status %d", status)
+		}
+	}
+
+	// Every client unregisters once its readPump notices the close
+	waitFor(t, 2*time.Second, "every client to unregister", func() bool { return hub.ClientCount() == 0 })
+	if clients, _ := hub.Clients(time.Second); len(clients) != 0 {
+		t.Fatalf("%d clients listed after all disconnected", len(clients))
+	}
+}
+
+func TestSnapshotShowsTheOverlay(t *testing.T) {
+	for _, cache := range []string{"true", "false"} {
+		t.Run("cache="+cache, func(t *testing.T) {
+			// Write-behind with a long flush interval, so the placements below
+			// are still unsaved when the client connects
+			room := newTestRoom(t, map[string]string{"ADMIN_TOKEN": "test-admin", "CANVAS_CACHE": cache, "DB_FLUSH_INTERVAL": "1h"})
+			ts := startTestServer(t, room)
+			s := room.server
+
+			if status, body := adminRequest(t, ts, http.MethodPost, "/api/admin/overlay", `{"x":3,"y":3,"color":"#000000"}`); status != http.StatusOK {
+				t.Fatalf("placing overlay: %d %s", status, body)
+			}
+			place(t, s, 3, 3, "#FF0000", "alice") // Under the overlay
+			place(t, s, 4, 3, "#00FF00", "bob")
+			if s.writer.Pending() != 2 {
+				t.Fatalf("%d pixels unsaved, want both placements", s.writer.Pending())
+			}
+
+			conn := dialWS(t, ts, "/ws/queue")
+			msg := readMessage(t, conn, time.Second)
+			if msg.Type != messageSnapshot {
+				t.Fatalf("first message %q, want the snapshot", msg.Type)
+			}
+			colors := make(map[[2]int]string)
+			for _, pixel := range msg.Pixels {
+				colors[[2]int{pixel.X, pixel.Y}] = pixel.Color
+			}
+			if len(colors) != 2 || colors[[2]int{3, 3}] != "#000000" || colors[[2]int{4, 3}] != "#00FF00" {
+				t.Fatalf("snapshot %+v, want the overlay at (3,3) and bob's pixel at (4,3)", msg.Pixels)
+			}
+		})
+	}
+}
+
+func TestClearKeepsPixelsPlacedAfterIt(t *testing.T) {
+	hub := NewHub(newTestQueue(t, 10), HubConfig{BroadcastBuffer: 2})
+	client := &Client{hub: hub, send: make(chan outboundMessage, 4)}
+	hub.clients[client] = true
+	hub.clientCount.Add(1)
+
+	// Two batches are still waiting when the canvas is cleared at seq 2
+	hub.broadcast <- []PixelUpdate{{X: 1, Y: 1, Color: "#FF0000", Seq: 1}, {X: 2, Y: 1, Color: "#FF0000", Seq: 2}}
+	hub.broadcast <- []PixelUpdate{{X: 3, Y: 1, Color: "#00FF00", Seq: 3}}
+	hub.clearCanvas(2)
+
+	if msg := <-client.send; msg.Type != messageClear {
+		t.Fatalf("first message %q, want the clear", msg.Type)
+	}
+	// Only the pixel placed after the clear is sent, after it
+	select {
+	case msg := <-client.send:
+		if len(msg.Pixels) != 1 || msg.Pixels[0].Seq != 3 {
+			t.Fatalf("sent %+v after the clear, want only seq 3", msg.Pixels)
+		}
+	default:
+		t.Fatal("the pixel placed after the clear was dropped")
+	}
+	if len(hub.broadcast) != 0 || len(client.send) != 0 {
+		t.Fatal("pixels from before the clear are still on their way")
+	}
+}
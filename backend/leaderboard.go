@@ -0,0 +1,161 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+)
+
+// Leaderboard
+//
+// Counting every user's placements in pixel_history on each request would
+// scan the whole history, so each user's total is kept in user_pixel_counts
+// instead. The row is incremented in the same transaction that records the
+// placement, so the counts always match the history. reached_at is when the
+// user reached their current count; between users with the same count the
+// one who got there first ranks higher.
+//
+// Only user placements on the base layer are counted: admin overlay pixels
+// and removals (tombstones) are not.
+
+// Limits for /api/leaderboard
+const (
+	defaultLeaderboardLimit = 10
+	maxLeaderboardLimit     = 100
+)
+
+// leaderboardSchema creates the counts table
+// BIGINT is a 64-bit integer in both SQLite and PostgreSQL
+const leaderboardSchema = `
+CREATE TABLE IF NOT EXISTS user_pixel_counts (
+	user_id TEXT PRIMARY KEY,
+	count BIGINT NOT NULL,
+	reached_at BIGINT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_user_pixel_counts_rank ON user_pixel_counts(count DESC, reached_at ASC);
+`
+
+// incrementUserCountSQL adds one placement to a user's total
+const incrementUserCountSQL = `
+INSERT INTO user_pixel_counts (user_id, count, reached_at)
+VALUES (?, 1, ?)
+ON CONFLICT (user_id) DO UPDATE SET
+	count = user_pixel_counts.count + 1,
+	reached_at = excluded.reached_at
+`
+
+// initLeaderboard creates the counts table and, the first time, fills it
+// from the existing history so databases from before the leaderboard rank
+// their users correctly
+func (d *Database) initLeaderboard() error {
+	if _, err := d.db.Exec(leaderboardSchema); err != nil {
+		return err
+	}
+
+	var rows int
+	if err := d.db.QueryRow(`SELECT COUNT(*) FROM user_pixel_counts`).Scan(&rows); err != nil {
+		return err
+	}
+	if rows > 0 {
+		return nil
+	}
+
+	result, err := d.db.Exec(d.rebind(`
+	INSERT INTO user_pixel_counts (user_id, count, reached_at)
+	SELECT user_id, COUNT(*), MAX(placed_at)
+	FROM pixel_history
+	WHERE layer = ? AND color <> '' AND user_id IS NOT NULL AND user_id <> ''
+	GROUP BY user_id
+	`), LayerBase)
+	if err != nil {
+		return err
+	}
+
+	if users, _ := result.RowsAffected(); users > 0 {
+		slog.Info("Leaderboard counts built from history", "users", users)
+	}
+	return nil
+}
+
+// countsForLeaderboard returns true if the entry adds to its user's total
+func countsForLeaderboard(entry HistoryEntry) bool {
+	return entry.Layer == LayerBase && !entry.IsTombstone() && entry.UserID != ""
+}
+
+// incrementUserCount adds one placement to a user's total within tx
+func (d *Database) incrementUserCount(tx *sql.Tx, userID string, placedAt int64) error {
+	_, err := tx.Exec(d.rebind(incrementUserCountSQL), userID, placedAt)
+	return err
+}
+
+// GetLeaderboard returns the users with the most placements, most first
+// Ties go to the user who reached the count first
+func (d *Database) GetLeaderboard(limit int) ([]UserStat, error) {
+	rows, err := d.db.Query(d.rebind(`
+	SELECT user_id, count
+	FROM user_pixel_counts
+	WHERE count > 0
+	ORDER BY count DESC, reached_at ASC, user_id ASC
+	LIMIT ?
+	`), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	leaders := []UserStat{}
+	for rows.Next() {
+		var us UserStat
+		if err := rows.Scan(&us.UserID, &us.Count); err != nil {
+			return nil, err
+		}
+		leaders = append(leaders, us)
+	}
+
+	return leaders, rows.Err()
+}
+
+// GetUserPixelCount returns a user's leaderboard total (0 for unknown users)
+func (d *Database) GetUserPixelCount(userID string) (int64, error) {
+	var count int64
+	err := d.db.QueryRow(d.rebind(`
+	SELECT count FROM user_pixel_counts WHERE user_id = ?
+	`), userID).Scan(&count)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return count, err
+}
+
+// handleLeaderboard returns the top users by pixels placed
+// Query parameter: limit (default 10, at most 100)
+func (s *Server) handleLeaderboard(w http.ResponseWriter, r *http.Request) {
+	s.writeCORS(w, r, "GET, OPTIONS")
+
+	limit := defaultLeaderboardLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > maxLeaderboardLimit {
+			writeError(w, http.StatusBadRequest, codeValidation, fmt.Sprintf("limit must be between 1 and %d", maxLeaderboardLimit))
+			return
+		}
+		limit = parsed
+	}
+
+	leaders, err := s.db.GetLeaderboard(limit)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to retrieve leaderboard", "err", err)
+		writeError(w, http.StatusInternalServerError, codeInternal, "Failed to retrieve leaderboard")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(leaders); err != nil {
+		slog.WarnContext(r.Context(), "Failed to encode leaderboard", "err", err)
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Live stats
+//
+// GET /ws/stats is a WebSocket that pushes a small stats message every
+// STATS_STREAM_INTERVAL (1s by default) so dashboards update live:
+//
+//	{"type":"stats","pixelsPerSecond":4.2,"activeUsers":17,"queueLength":0,"clients":31,"timestamp":1699032145234}
+//
+// It is deliberately kept apart from the pixel Hub. The stats are computed
+// once per tick by a single goroutine, encoded once, and handed to each
+// stats client without waiting: a client that hasn't written the previous
+// message yet simply gets the newer one instead. Stats clients therefore
+// never hold up the hub or each other.
+
+// Windows the live numbers are computed over
+const (
+	// activityRateWindow is how many seconds pixelsPerSecond is averaged over
+	activityRateWindow = 10
+
+	// activeUserWindow is how recently a user must have placed to count as active
+	activeUserWindow = time.Minute
+)
+
+// messageStats is the type of the messages on /ws/stats
+const messageStats = "stats"
+
+// LiveStats is one message of the stats stream
+type LiveStats struct {
+	Type            string  `json:"type"`
+	PixelsPerSecond float64 `json:"pixelsPerSecond"` // Accepted placements per second, averaged over the last 10s
+	ActiveUsers     int     `json:"activeUsers"`     // Users who placed in the last minute
+	QueueLength     int     `json:"queueLength"`     // Pixels waiting to be broadcast
+	Clients         int64   `json:"clients"`         // Connected /ws/queue consumers
+	Timestamp       int64   `json:"timestamp"`       // When the stats were taken, in Unix milliseconds
+}
+
+// PlacementActivity keeps rolling counts of recent placements
+// Placements are counted in one bucket per second, in a ring covering the
+// rate window, so recording one is a single increment.
+type PlacementActivity struct {
+	mu        sync.Mutex
+	counts    [activityRateWindow]int64 // Placements per second
+	seconds   [activityRateWindow]int64 // Unix second each bucket currently counts
+	users     map[string]time.Time      // When each user last placed
+	lastPrune time.Time
+}
+
+// NewPlacementActivity creates an empty activity counter
+func NewPlacementActivity() *PlacementActivity {
+	return &PlacementActivity{users: make(map[string]time.Time), lastPrune: timeNow()}
+}
+
+// Record counts an accepted placement by userID
+func (a *PlacementActivity) Record(userID string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := timeNow()
+	second := now.Unix()
+	i := second % activityRateWindow
+	if a.seconds[i] != second {
+		// The bucket still holds an older second; start it over
+		a.seconds[i] = second
+		a.counts[i] = 0
+	}
+	a.counts[i]++
+	a.users[userID] = now
+
+	// Forget inactive users at most once per window, so the map stays small
+	// even when nobody is watching the stats
+	if now.Sub(a.lastPrune) >= activeUserWindow {
+		a.pruneUsers(now)
+	}
+}
+
+// Rate returns the accepted placements per second over the rate window
+// The current, still incomplete second is not included.
+func (a *PlacementActivity) Rate() float64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	current := timeNow().Unix()
+	var total int64
+	for i, second := range a.seconds {
+		if second < current && second >= current-activityRateWindow {
+			total += a.counts[i]
+		}
+	}
+	return float64(total) / activityRateWindow
+}
+
+// ActiveUsers returns how many users placed within activeUserWindow
+func (a *PlacementActivity) ActiveUsers() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.pruneUsers(timeNow())
+	return len(a.users)
+}
+
+// pruneUsers removes users who haven't placed within activeUserWindow
+// The caller must hold a.mu
+func (a *PlacementActivity) pruneUsers(now time.Time) {
+	for userID, placedAt := range a.users {
+		if now.Sub(placedAt) > activeUserWindow {
+			delete(a.users, userID)
+		}
+	}
+	a.lastPrune = now
+}
+
+// statsClient is one /ws/stats connection
+// send holds at most the latest encoded stats message
+type statsClient struct {
+	conn     *websocket.Conn
+	send     chan []byte
+	timeouts ClientConfig
+}
+
+// StatsStream pushes LiveStats to every connected /ws/stats client
+type StatsStream struct {
+	mu         sync.Mutex
+	clients    map[*statsClient]bool
+	maxClients int
+	interval   time.Duration
+	stopped    bool
+
+	// collect takes the current stats
+	collect func() LiveStats
+}
+
+// NewStatsStream creates a stream that sends collect's result every interval
+// to at most maxClients clients (0 = no limit)
+func NewStatsStream(collect func() LiveStats, interval time.Duration, maxClients int) *StatsStream {
+	return &StatsStream{
+		clients:    make(map[*statsClient]bool),
+		maxClients: maxClients,
+		interval:   interval,
+		collect:    collect,
+	}
+}
+
+// Run sends the stats to all clients every interval, forever
+// Nothing is collected while nobody is connected.
+func (st *StatsStream) Run() {
+	ticker := time.NewTicker(st.interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if st.ClientCount() == 0 {
+			continue
+		}
+		data, err := st.encode()
+		if err != nil {
+			slog.Error("Failed to encode live stats", "err", err)
+			continue
+		}
+
+		st.mu.Lock()
+		for client := range st.clients {
+			offerLatest(client.send, data)
+		}
+		st.mu.Unlock()
+	}
+}
+
+// encode collects the current stats as a JSON message
+func (st *StatsStream) encode() ([]byte, error) {
+	stats := st.collect()
+	stats.Type = messageStats
+	return json.Marshal(stats)
+}
+
+// offerLatest puts data in a one-slot channel without blocking, replacing
+// a message the client hasn't picked up yet
+func offerLatest(send chan []byte, data []byte) {
+	for {
+		select {
+		case send <- data:
+			return
+		default:
+		}
+		select {
+		case <-send:
+		default:
+		}
+	}
+}
+
+// ClientCount returns the number of connected stats clients
+func (st *StatsStream) ClientCount() int {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return len(st.clients)
+}
+
+// add registers a client, or returns false if the stream is full or stopped
+func (st *StatsStream) add(client *statsClient) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.stopped || (st.maxClients > 0 && len(st.clients) >= st.maxClients) {
+		return false
+	}
+	st.clients[client] = true
+	return true
+}
+
+// remove unregisters a client and closes its send channel, which ends its
+// write loop. Removing a client twice is harmless.
+func (st *StatsStream) remove(client *statsClient) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.clients[client] {
+		delete(st.clients, client)
+		close(client.send)
+	}
+}
+
+// Stop disconnects every client and refuses new ones (used on shutdown)
+func (st *StatsStream) Stop() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.stopped = true
+	for client := range st.clients {
+		delete(st.clients, client)
+		close(client.send)
+	}
+}
+
+// handleStatsWebSocket upgrades a connection to the live stats stream
+func (s *Server) handleStatsWebSocket(w http.ResponseWriter, r *http.Request) {
+	s.writeCORS(w, r, "GET")
+
+	if s.refuseWhileDraining(w) {
+		return
+	}
+
+	if s.statsStream.maxClients > 0 && s.statsStream.ClientCount() >= s.statsStream.maxClients {
+		writeError(w, http.StatusServiceUnavailable, codeUnavailable, "Too many stats clients")
+		return
+	}
+
+	wsUpgrader := upgrader
+	wsUpgrader.CheckOrigin = s.checkOrigin
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		slog.WarnContext(r.Context(), "WebSocket upgrade failed", "err", err)
+		return
+	}
+
+	client := &statsClient{conn: conn, send: make(chan []byte, 1), timeouts: s.hub.clientConfig}
+	if !s.statsStream.add(client) {
+		conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "too many stats clients"))
+		conn.Close()
+		return
+	}
+
+	// Dashboards get the current numbers right away instead of after a tick
+	if data, err := s.statsStream.encode(); err == nil {
+		offerLatest(client.send, data)
+	}
+
+	safeGo("statsWritePump", func() { client.writePump() })
+	safeGo("statsReadPump", func() { client.readPump(s.statsStream) })
+
+	slog.InfoContext(r.Context(), "Live stats client connected", "addr", s.clientIP(r))
+}
+
+// readPump discards anything the client sends and keeps the read deadline
+// going with pongs. When the connection ends the client is removed.
+func (c *statsClient) readPump(stream *StatsStream) {
+	defer func() {
+		stream.remove(c)
+		c.conn.Close()
+	}()
+
+	c.conn.SetReadLimit(c.timeouts.MaxMessageSize)
+	c.conn.SetReadDeadline(time.Now().Add(c.timeouts.PongWait))
+	c.conn.SetPongHandler(func(string) error {
+		c.conn.SetReadDeadline(time.Now().Add(c.timeouts.PongWait))
+		return nil
+	})
+
+	for {
+		if _, _, err := c.conn.ReadMessage(); err != nil {
+			return
+		}
+	}
+}
+
+// writePump writes the stats messages and pings until send is closed
+func (c *statsClient) writePump() {
+	ticker := time.NewTicker(c.timeouts.PingPeriod)
+	writeWait := c.timeouts.WriteWait
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+	}()
+
+	for {
+		select {
+		case data, ok := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if !ok {
+				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+			if err := c.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+				return
+			}
+
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// liveStats collects the numbers for the stats stream
+// Everything comes from memory, so taking them never touches the database.
+func (s *Server) liveStats() LiveStats {
+	return LiveStats{
+		PixelsPerSecond: s.activity.Rate(),
+		ActiveUsers:     s.activity.ActiveUsers(),
+		QueueLength:     s.queue.Len(),
+		Clients:         s.hub.ClientCount(),
+		Timestamp:       currentTimeMillis(),
+	}
+}
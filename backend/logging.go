@@ -0,0 +1,37 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// setupLogging installs the default structured logger
+// LOG_LEVEL is debug, info (default), warn or error. LOG_FORMAT is json
+// (default, one object per line for log aggregators) or text (key=value
+// pairs, easier to read during local development).
+// Messages from the standard log package go through the same handler, and
+// lines logged with a request's context get its ID (see requestid.go).
+func setupLogging() {
+	var level slog.Level
+	levelErr := level.UnmarshalText([]byte(envString("LOG_LEVEL", "info")))
+
+	options := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	if strings.EqualFold(envString("LOG_FORMAT", "json"), "text") {
+		handler = slog.NewTextHandler(os.Stderr, options)
+	} else {
+		handler = slog.NewJSONHandler(os.Stderr, options)
+	}
+	slog.SetDefault(slog.New(contextLogHandler{handler}))
+
+	if levelErr != nil {
+		slog.Warn("Invalid LOG_LEVEL, using info", "value", os.Getenv("LOG_LEVEL"))
+	}
+}
+
+// fatal logs an error with its attributes and exits, like log.Fatal
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
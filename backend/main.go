@@ -1,60 +1,301 @@
 package main
 
 import (
-	"log"
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 func main() {
-	// Initialize SQLite database for canvas persistence
-	db, err := NewDatabase("./canvas.db")
+	// Structured logging (LOG_LEVEL, LOG_FORMAT) is set up before anything logs
+	setupLogging()
+
+	// Command-line flags for one-off maintenance operations
+	replayFrom := flag.String("replay-from", "", "replay the pixel history of this database (file path or URL) and exit")
+	replayTo := flag.String("replay-to", "", "fresh database (file path or URL) to replay the history into (used with -replay-from)")
+	configPath := flag.String("config", "", "JSON config file (reloaded on SIGHUP)")
+	restorePath := flag.String("restore-backup", "", "load a canvas backup into an empty database before starting")
+	issueToken := flag.String("issue-token", "", "print a signed token for this userId (needs AUTH_SECRET) and exit")
+	tokenTTL := flag.Duration("token-ttl", 24*time.Hour, "how long a token from -issue-token is valid")
+	tokenTeam := flag.String("token-team", "", "team to put in the token from -issue-token (see teams.go)")
+	tokenRole := flag.String("token-role", "", `role to put in the token from -issue-token ("service" for a service account)`)
+	flag.Parse()
+
+	// Signed user tokens (see auth.go); without AUTH_SECRET any userId is trusted
+	tokens := NewTokenVerifier(os.Getenv("AUTH_SECRET"))
+
+	// Token mode: print a token for a user instead of starting the server
+	if *issueToken != "" {
+		if tokens == nil {
+			fatal("AUTH_SECRET is required with -issue-token")
+		}
+		token, err := tokens.Issue(*issueToken, *tokenTeam, *tokenRole, *tokenTTL)
+		if err != nil {
+			fatal("Failed to issue token", "err", err)
+		}
+		fmt.Println(token)
+		return
+	}
+
+	// Timestamps read back from backups, the queue log and replayed history
+	// must be within TIMESTAMP_MAX_FUTURE and TIMESTAMP_MAX_AGE of the clock
+	// (clients never set timestamps; see timestamps.go)
+	timestamps, err := timestampPolicyFromEnv()
+	if err != nil {
+		fatal("Invalid timestamp settings", "err", err)
+	}
+
+	// Replay mode: rebuild a canvas from history instead of starting the server
+	if *replayFrom != "" {
+		if *replayTo == "" {
+			fatal("-replay-to is required with -replay-from")
+		}
+		if err := runReplay(*replayFrom, *replayTo, timestamps); err != nil {
+			fatal("Replay failed", "err", err)
+		}
+		return
+	}
+
+	// Load the settings: the defaults, then the config file (if given), then
+	// the environment variables that are set. Anything invalid stops here.
+	liveConfig, err := NewLiveConfig(*configPath)
+	if err != nil {
+		fatal("Failed to load config", "err", err)
+	}
+	cfg := liveConfig.Get()
+
+	// Canvas size (1000x1000 by default), background, chunk size and colors
+	canvas := cfg.Canvas
+
+	// Initialize the database for canvas persistence
+	// DATABASE_URL selects PostgreSQL (postgres://...) or a SQLite file
+	// (sqlite://path); without it the SQLite file at dbPath is used
+	db, err := OpenDatabase(envString("DATABASE_URL", cfg.DBPath))
 	if err != nil {
-		log.Fatal("Failed to initialize database:", err)
+		fatal("Failed to initialize database", "err", err)
 	}
 	defer db.Close()
 
+	// Writes failing because the database is busy are retried with
+	// exponential backoff (see retry.go)
+	retries := RetryPolicy{
+		Attempts:   envInt("DB_RETRY_ATTEMPTS", defaultRetryPolicy.Attempts),
+		BaseDelay:  envDuration("DB_RETRY_BASE_DELAY", defaultRetryPolicy.BaseDelay),
+		MaxElapsed: envDuration("DB_RETRY_MAX_ELAPSED", defaultRetryPolicy.MaxElapsed),
+	}
+	if err := retries.Validate(); err != nil {
+		fatal("Invalid database retry settings", "err", err)
+	}
+	db.SetRetryPolicy(retries)
+
+	// Optionally restore a backup into the (empty) database
+	if *restorePath != "" {
+		if err := restoreBackup(db, *restorePath, timestamps); err != nil {
+			fatal("Failed to restore backup", "err", err)
+		}
+	}
+
+	// Draw SEED_IMAGE onto the canvas if it is still empty (see seed.go)
+	if path := envString("SEED_IMAGE", ""); path != "" {
+		fit := envString("SEED_IMAGE_FIT", seedFitClip)
+		if err := seedCanvas(db, canvas, path, fit, envString("SEED_USER_ID", "seed")); err != nil {
+			fatal("Failed to seed the canvas", "path", path, "err", err)
+		}
+	}
+
+	// Start periodic canvas backups when BACKUP_INTERVAL is set
+	backups, err := newBackupSchedulerFromEnv(db)
+	if err != nil {
+		fatal("Failed to configure backups", "err", err)
+	}
+	if backups != nil {
+		superviseGo("backups", backups.Run)
+	}
+
+	// Reclaim the space left behind by overwritten pixels every
+	// VACUUM_INTERVAL (off by default; see vacuum.go)
+	if interval := envDuration("VACUUM_INTERVAL", 0); interval > 0 {
+		superviseGo("vacuum", func() { runVacuums(db, interval) })
+	}
+
 	// Initialize the pixel queue with a maximum capacity of 10,000 items
-	queue := NewPixelQueue(10000)
+	// With QUEUE_LOG set, enqueued pixels are also written to that file so
+	// the ones not saved yet survive a crash; they're recovered here
+	queue, err := NewPixelQueue(10000)
+	if err != nil {
+		fatal("Failed to create pixel queue", "err", err)
+	}
+	var queueLog *QueueLog
+	var recovered []PixelUpdate
+	if path := envString("QUEUE_LOG", ""); path != "" {
+		queueLog, recovered, err = OpenQueueLog(path)
+		if err != nil {
+			fatal("Failed to open queue log", "err", err)
+		}
+		defer queueLog.Close()
+		recovered = timestamps.FilterPixels(recovered, timeNow())
+		queue, err = NewLoggedPixelQueue(10000, queueLog, recovered)
+		if err != nil {
+			fatal("Failed to create pixel queue", "err", err)
+		}
+	}
+
+	// POST notable events to WEBHOOK_URL when it is set
+	webhooks, err := newWebhookNotifierFromEnv(db)
+	if err != nil {
+		fatal("Failed to configure webhooks", "err", err)
+	}
+	if webhooks != nil {
+		superviseGo("webhooks", webhooks.Run)
+	}
+
+	// POST /api/admin/drain stops new connections before a deploy and
+	// disconnects the rest after DRAIN_GRACE (see drain.go)
+	drain := NewDrain(envDuration("DRAIN_GRACE", 30*time.Second))
+
+	// Build the server for the main canvas: rate limiters, background
+	// writer, canvas cache, WebSocket hub and the rest (see rooms.go)
+	room, err := newRoom("", db, canvas, roomOptions{
+		liveConfig: liveConfig,
+		tokens:     tokens,
+		drain:      drain,
+		queue:      queue,
+		recovered:  recovered,
+		webhooks:   webhooks,
+		backups:    backups,
+	})
+	if err != nil {
+		fatal("Failed to start the canvas", "err", err)
+	}
+	server := room.server
+
+	// Checkpoint the queue log every QUEUE_LOG_CHECKPOINT
+	if queueLog != nil {
+		interval := envDuration("QUEUE_LOG_CHECKPOINT", 5*time.Second)
+		superviseGo("queueLog", func() { queueLog.Run(server.writer, interval) })
+	}
+
+	// Expose the queue, hub and database state on /metrics
+	registerStateMetrics(queue, server.hub, server.dbBreaker, server.rateLimiter, server.writer, server.globalLimit)
 
-	// Initialize the rate limiter (1 pixel per user per 5 seconds)
-	rateLimiter := NewRateLimiter(5 * time.Second)
+	// The canvas endpoints (see routes.go) are on the server's own mux; the
+	// main canvas serves a few more
+	mux, endpoints := server.mux, server.endpoints
 
-	// Initialize the WebSocket hub that manages all consumer connections
-	hub := NewHub(queue)
+	// Health checks: liveness, readiness, and the full report (see health.go)
+	mux.HandleFunc("GET /live", server.handleLive)
+	mux.HandleFunc("GET /ready", server.handleReady)
+	mux.HandleFunc("GET /health", server.handleHealth)
 
-	// Start the hub in a separate goroutine (concurrent execution)
-	// This allows the hub to handle broadcasting while the server handles requests
-	go hub.Run()
+	// Prometheus metrics
+	mux.Handle("GET /metrics", promhttp.Handler())
 
-	// Create HTTP server with our handlers
-	server := &Server{
-		queue:       queue,
-		rateLimiter: rateLimiter,
-		hub:         hub,
-		db:          db,
+	endpoints = append(endpoints, [][3]string{
+		{"GET", "/live", "Liveness check (hub responsive)"},
+		{"GET", "/ready", "Readiness check (hub and database)"},
+		{"GET", "/health", "Health report with the readiness checks"},
+		{"GET", "/metrics", "Prometheus metrics"},
+	}...)
+
+	// Draining covers every canvas, so it is only on the main canvas's paths
+	if server.adminToken != "" {
+		mux.HandleFunc("POST /api/admin/drain", server.requireAdmin(server.handleDrain))
+		mux.HandleFunc("GET /api/admin/drain", server.requireAdmin(server.handleDrainStatus))
+		endpoints = append(endpoints, [][3]string{
+			{"POST", "/api/admin/drain", "Stop taking new connections before a shutdown (admin)"},
+			{"GET", "/api/admin/drain", "Progress of the drain (admin)"},
+		}...)
 	}
 
-	// Register HTTP endpoints
-	http.HandleFunc("/api/pixel", server.handlePixelUpdate)
-	http.HandleFunc("/api/canvas", server.handleGetCanvas)
-	http.HandleFunc("/ws/queue", server.handleWebSocket)
+	// The canvases listed in CANVASES are served under /api/<name>/ and
+	// /ws/<name>/, each by a room of its own (see rooms.go). A name can't be
+	// the first path segment of an endpoint, or /api/<name>/... would be
+	// ambiguous.
+	reserved := make(map[string]bool)
+	for _, endpoint := range endpoints {
+		for _, prefix := range []string{"/api/", "/ws/"} {
+			if rest, ok := strings.CutPrefix(endpoint[1], prefix); ok {
+				first, _, _ := strings.Cut(rest, "/")
+				reserved[first] = true
+			}
+		}
+	}
+	canvases, err := NewCanvasManager(envList("CANVASES"), envString("DATABASE_URL", cfg.DBPath), canvas, retries,
+		roomOptions{liveConfig: liveConfig, tokens: tokens, drain: drain}, server, reserved)
+	if err != nil {
+		fatal("Invalid canvases", "err", err)
+	}
 
-	// Add a simple health check endpoint
-	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("OK"))
+	// Reload the palette, allowed origins and cooldown on SIGHUP
+	superviseGo("watchReload", func() {
+		watchReload(liveConfig, func(cooldown time.Duration) {
+			server.rateLimiter.SetCooldown(cooldown)
+			canvases.SetCooldown(cooldown)
+		})
 	})
 
-	// Start the HTTP server on port 8080 (accessible from all network interfaces)
-	log.Println("Server starting on 0.0.0.0:8080")
-	log.Println("Endpoints:")
-	log.Println("  POST   /api/pixel  - Submit pixel updates")
-	log.Println("  GET    /api/canvas - Get full canvas state")
-	log.Println("  WS     /ws/queue   - WebSocket for consumers")
-	log.Println("  GET    /health     - Health check")
+	// Start the HTTP server (port 8080 on all network interfaces by default)
+	slog.Info("Server starting", "addr", cfg.ListenAddr, "dbPath", cfg.DBPath, "width", canvas.Width, "height", canvas.Height, "userTokens", tokens != nil, "canvases", canvases.Names())
+	// Log the available endpoints (method, path, description)
+	for _, endpoint := range endpoints {
+		slog.Info("Endpoint", "method", endpoint[0], "path", endpoint[1], "description", endpoint[2])
+	}
+
+	// Run the HTTP server until SIGINT or SIGTERM arrives
+	// Every request gets an X-Request-ID for the logs (see requestid.go)
+	httpServer := &http.Server{Addr: cfg.ListenAddr, Handler: withRequestID(canvases)}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- httpServer.ListenAndServe()
+	}()
 
-	if err := http.ListenAndServe("0.0.0.0:8080", nil); err != nil {
-		log.Fatal("Server failed to start:", err)
+	select {
+	case err := <-serverErr:
+		fatal("Server failed to start", "err", err)
+	case <-ctx.Done():
+	}
+
+	// Graceful shutdown: stop accepting requests and let in-flight ones finish,
+	// then flush pending pixels to the WebSocket consumers and close them.
+	// Once no more pixels can arrive, the writer saves its last batch; the
+	// deferred db.Close runs after that.
+	slog.Info("Shutting down...")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), envDuration("SHUTDOWN_TIMEOUT", 10*time.Second))
+	defer cancel()
+
+	if err := httpServer.Shutdown(shutdownCtx); err != nil {
+		slog.Warn("HTTP server shutdown", "err", err)
+	}
+	canvases.Stop(shutdownCtx)
+	if err := server.hub.Stop(shutdownCtx); err != nil {
+		slog.Warn("WebSocket hub shutdown", "err", err)
+	}
+	server.statsStream.Stop()
+	if err := webhooks.Stop(shutdownCtx); err != nil {
+		slog.Warn("Webhook shutdown", "err", err)
+	}
+	if queueLog != nil {
+		queueLog.Stop()
+	}
+	if err := server.writer.Stop(shutdownCtx); err != nil {
+		slog.Warn("Pixel writer shutdown", "err", err)
+	} else if queueLog != nil {
+		// Everything was saved, so the log can be emptied
+		if err := queueLog.Checkpoint(server.writer); err != nil {
+			slog.Warn("Queue log checkpoint", "err", err)
+		}
 	}
+	slog.Info("Server stopped")
 }
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Reasons a placement is rejected, used as the "reason" label of pixelsRejected
+const (
+	rejectValidation  = "validation"
+	rejectRateLimit   = "rate_limit"
+	rejectGlobalLimit = "global_rate_limit"
+	rejectQuota       = "quota"
+	rejectAreaLimit   = "area_limit"
+	rejectZone        = "zone"
+	rejectUnavailable = "unavailable"
+	rejectConflict    = "conflict"
+)
+
+// How a WebSocket resume was answered, the "result" label of wsResumes
+const (
+	resumeResumed  = "resumed"
+	resumeSnapshot = "snapshot"
+)
+
+// Metrics exposed on /metrics
+// Counters and histograms are lock-free atomics inside client_golang, so
+// updating them on the placement path doesn't add contention
+var (
+	pixelsAccepted = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "wplace_pixels_accepted_total",
+		Help: "Pixel placements accepted and queued for broadcast.",
+	})
+
+	pixelsRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "wplace_pixels_rejected_total",
+		Help: "Pixel placements rejected, by reason.",
+	}, []string{"reason"})
+
+	serviceAccountPixels = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "wplace_service_account_pixels_total",
+		Help: "Placements accepted from service accounts, which skip the public cooldowns.",
+	})
+
+	pixelsQuarantined = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "wplace_pixels_quarantined_total",
+		Help: "Placements of shadow-banned users, answered as accepted but only saved to the quarantine table.",
+	})
+
+	dbWriteRetries = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "wplace_db_write_retries_total",
+		Help: "Database writes retried after a transient error (such as SQLITE_BUSY).",
+	})
+
+	webhookDeliveries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "wplace_webhook_deliveries_total",
+		Help: "Webhook events delivered or given up after the retries, by result (ok or failed).",
+	}, []string{"result"})
+
+	webhooksDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "wplace_webhook_dropped_total",
+		Help: "Webhook events dropped because the delivery buffer was full.",
+	})
+
+	historyPruned = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "wplace_history_pruned_total",
+		Help: "History entries deleted by the retention policy or POST /api/admin/prune.",
+	})
+
+	rateLimiterEvictions = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "wplace_rate_limiter_evictions_total",
+		Help: "Users forgotten by a rate limiter before their TTL because it was full.",
+	})
+
+	wsResumes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "wplace_websocket_resumes_total",
+		Help: "WebSocket resume requests, by result (resumed, or snapshot when the cursor couldn't be resumed from).",
+	}, []string{"result"})
+
+	broadcastBatchSize = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "wplace_broadcast_batch_size",
+		Help:    "Number of pixels in each batch broadcast to WebSocket clients.",
+		Buckets: []float64{1, 5, 10, 25, 50, 100, 250, 500, 1000},
+	})
+)
+
+// registerStateMetrics exposes values owned by other components as gauges
+// They are read when /metrics is scraped instead of being pushed on every change
+func registerStateMetrics(queue *PixelQueue, hub *Hub, dbBreaker *CircuitBreaker, rateLimiter *RateLimiter, writer *PixelWriter, globalLimit *GlobalLimiter) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "wplace_queue_length",
+		Help: "Pixels waiting in the queue to be broadcast.",
+	}, func() float64 { return float64(queue.Len()) })
+
+	promauto.NewCounterFunc(prometheus.CounterOpts{
+		Name: "wplace_queue_dropped_total",
+		Help: "Queued pixels discarded by the drop-oldest queue overflow policy.",
+	}, func() float64 { return float64(queue.Dropped()) })
+
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "wplace_websocket_clients",
+		Help: "Connected WebSocket clients.",
+	}, func() float64 { return float64(hub.ClientCount()) })
+
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "wplace_websocket_clients_max",
+		Help: "Most WebSocket clients allowed at once (0 = no limit).",
+	}, func() float64 { return float64(hub.MaxClients()) })
+
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "wplace_broadcast_backlog",
+		Help: "Batches waiting in the broadcast channel for the hub's main loop.",
+	}, func() float64 { return float64(hub.BroadcastBacklog()) })
+
+	promauto.NewCounterFunc(prometheus.CounterOpts{
+		Name: "wplace_broadcast_batches_dropped_total",
+		Help: "Batches discarded by the drop-oldest broadcast policy.",
+	}, func() float64 { return float64(hub.DroppedBatches()) })
+
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "wplace_db_unsaved_pixels",
+		Help: "Accepted pixels waiting for the background writer to save them.",
+	}, func() float64 { return float64(writer.Pending()) })
+
+	promauto.NewCounterFunc(prometheus.CounterOpts{
+		Name: "wplace_db_lost_pixels_total",
+		Help: "Accepted pixels the background writer gave up on: too many piled up unsaved, or their batch failed with an error that is not retried.",
+	}, func() float64 { return float64(writer.Lost()) })
+
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "wplace_global_rate_utilization",
+		Help: "Share of the GLOBAL_RATE_LIMIT burst in use, from 0 to 1 (1 = placements are refused).",
+	}, globalLimit.Utilization)
+
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "wplace_rate_limiter_users",
+		Help: "Users tracked by the per-user rate limiter.",
+	}, func() float64 { return float64(rateLimiter.Len()) })
+
+	promauto.NewCounterFunc(prometheus.CounterOpts{
+		Name: "wplace_goroutine_panics_total",
+		Help: "Panics recovered in background goroutines.",
+	}, func() float64 { return float64(goroutinePanics.Load()) })
+
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "wplace_database_degraded",
+		Help: "1 while database writes are skipped by the circuit breaker.",
+	}, func() float64 {
+		if dbBreaker.Degraded() {
+			return 1
+		}
+		return 0
+	})
+}
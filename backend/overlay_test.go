@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// canvasPixel returns the pixel GET /api/canvas shows at (x, y)
+func canvasPixel(t *testing.T, url string, x, y int) (PixelUpdate, bool) {
+	t.Helper()
+	resp, err := http.Get(url + "/api/canvas")
+	if err != nil {
+		t.Fatalf("GET /api/canvas: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var pixels []PixelUpdate
+	if err := json.NewDecoder(resp.Body).Decode(&pixels); err != nil {
+		t.Fatalf("decoding canvas: %v", err)
+	}
+	for _, pixel := range pixels {
+		if pixel.X == x && pixel.Y == y {
+			return pixel, true
+		}
+	}
+	return PixelUpdate{}, false
+}
+
+func TestOverlayHidesAndRevealsBasePixel(t *testing.T) {
+	for _, cache := range []string{"true", "false"} {
+		t.Run("cache="+cache, func(t *testing.T) {
+			room := newTestRoom(t, map[string]string{"ADMIN_TOKEN": "test-admin", "CANVAS_CACHE": cache, "BATCH_INTERVAL": "5ms"})
+			ts := startTestServer(t, room)
+			s := room.server
+
+			conn := dialWS(t, ts, "/ws/queue?snapshot=false")
+			readMessage(t, conn, time.Second) // The cursor
+			waitFor(t, time.Second, "the client to register", func() bool { return s.hub.ClientCount() == 1 })
+
+			if status, body := adminRequest(t, ts, http.MethodPost, "/api/admin/overlay", `{"x":3,"y":3,"color":"#000000"}`); status != http.StatusOK {
+				t.Fatalf("placing overlay: %d %s", status, body)
+			}
+			if batch := readBatch(t, conn, time.Second); len(batch) != 1 || batch[0].Color != "#000000" {
+				t.Fatalf("broadcast %+v, want the overlay pixel", batch)
+			}
+
+			// A placement under the overlay is accepted but not broadcast; the
+			// placement next to it shows the batches are flowing
+			place(t, s, 3, 3, "#FF0000", "alice")
+			place(t, s, 4, 3, "#00FF00", "bob")
+			batch := readBatch(t, conn, time.Second)
+			if len(batch) != 1 || batch[0].X != 4 {
+				t.Fatalf("broadcast %+v, want only bob's pixel", batch)
+			}
+			if pixel, _ := canvasPixel(t, ts.URL, 3, 3); pixel.Color != "#000000" {
+				t.Fatalf("/api/canvas shows %q under the overlay, want #000000", pixel.Color)
+			}
+
+			// Removing the overlay reveals alice's pixel, to live clients and readers
+			if status, body := adminRequest(t, ts, http.MethodDelete, "/api/admin/overlay/3/3", ""); status != http.StatusOK {
+				t.Fatalf("removing overlay: %d %s", status, body)
+			}
+			batch = readBatch(t, conn, time.Second)
+			if len(batch) != 1 || batch[0].X != 3 || batch[0].Color != "#FF0000" || batch[0].UserID != "alice" {
+				t.Fatalf("broadcast after the removal %+v, want alice's pixel", batch)
+			}
+			if pixel, ok := canvasPixel(t, ts.URL, 3, 3); !ok || pixel.Color != "#FF0000" {
+				t.Fatalf("/api/canvas shows %+v after the removal, want alice's pixel", pixel)
+			}
+		})
+	}
+}
@@ -0,0 +1,470 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// placementError is a rejected placement together with the HTTP status
+// that describes it (400 invalid, 403 area limit, 429 rate limited, ...)
+// and the error code sent with it (see errors.go)
+type placementError struct {
+	status  int
+	code    string
+	message string
+
+	// retryAfter is how long a rate-limited user must wait (0 otherwise)
+	// reason says which limit was hit: rateLimitUser, rateLimitIP, ...
+	// resetAt is when a used-up quota gives a pixel back (Unix milliseconds)
+	retryAfter time.Duration
+	reason     string
+	resetAt    int64
+
+	// currentColor is the pixel's actual color when a conditional placement
+	// is refused with 409 because it didn't match expectedColor
+	currentColor string
+}
+
+// Which rate limit rejected a placement (the "reason" of a 429 response)
+const (
+	rateLimitUser   = "user"
+	rateLimitIP     = "ip"
+	rateLimitGlobal = "global"
+	rateLimitQuota  = "quota"
+)
+
+func (e *placementError) Error() string {
+	return e.message
+}
+
+// placementResult reports the outcome of one pixel in a batch
+// Index is the position of the pixel in the submitted batch
+type placementResult struct {
+	Index        int    `json:"index"`
+	OK           bool   `json:"ok"`
+	Status       int    `json:"status,omitempty"`
+	Code         string `json:"code,omitempty"`
+	Error        string `json:"error,omitempty"`
+	RetryAfterMs int64  `json:"retryAfterMs,omitempty"`
+	Reason       string `json:"reason,omitempty"`
+	ResetAt      int64  `json:"resetAt,omitempty"`
+	CurrentColor string `json:"currentColor,omitempty"`
+}
+
+// placePixel runs a decoded pixel through the whole placement path:
+// validation, the rate limiter, the contiguous area guard, the background
+// database writer and finally the queue. It is shared by every way of placing pixels so they
+// all enforce the same rules. ip is the client's address for the per-IP limit.
+func (s *Server) placePixel(pixel *PixelUpdate, ip string) *placementError {
+	// The timestamp, sequence number and chunk are the server's to assign
+	// (see timestamps.go); whatever the client sent is dropped before
+	// anything looks at the pixel
+	pixel.Timestamp, pixel.Seq, pixel.Chunk = 0, 0, nil
+
+	// Validate the pixel data
+	if err := validatePixel(pixel, s.config.Get(), s.canvas); err != nil {
+		pixelsRejected.WithLabelValues(rejectValidation).Inc()
+		return &placementError{status: http.StatusBadRequest, code: codeValidation, message: err.Error()}
+	}
+
+	// In team mode the color must be the user's team color
+	if err := checkTeam(s.config.Get(), pixel); err != nil {
+		return err
+	}
+
+	// Apply the rule of the zone the pixel is in: locked zones refuse it,
+	// others may make it cost more than one cooldown
+	cost, zoneErr := checkZone(s.config.Get().zones, pixel)
+	if zoneErr != nil {
+		return zoneErr
+	}
+
+	// Rare colors may cost more too (colorCooldowns); the two multiply
+	cost *= s.config.Get().ColorCost(pixel.Color)
+
+	// A conditional placement whose expected color is already wrong is
+	// refused before it costs a cooldown, so the client can simply retry
+	if pixel.ExpectedColor != "" {
+		if err := s.checkExpectedColor(pixel); err != nil {
+			return err
+		}
+	}
+
+	// Check if the user or their IP address is rate limited
+	// The user's cooldown is checked before the IP's is used up, so a user
+	// still cooling down doesn't block other users on the same address.
+	// Service accounts have a cooldown of their own instead of the user's,
+	// the IP's and the quota (see serviceaccount.go).
+	if pixel.ServiceAccount {
+		if err := s.checkServiceCooldown(pixel); err != nil {
+			return err
+		}
+	} else if s.rateLimiter.TimeUntilAllowed(pixel.UserID) > 0 {
+		return s.rateLimited(s.rateLimiter, pixel.UserID, rateLimitUser)
+	} else if wait := s.quota.TimeUntilAllowed(pixel.UserID); wait > 0 {
+		// So is the user's quota (PLACEMENT_QUOTA, see quota.go)
+		return s.quota.exceeded(wait)
+	}
+
+	// Check the pixel doesn't grow the user's contiguous area past the limit
+	// The search is a database query, so it only runs once the cooldown and
+	// quota checks above have passed: a rate-limited client can't make the
+	// server search for every refused request. Nothing has been used up yet,
+	// so a placement refused here doesn't cost a cooldown.
+	if err := s.areaGuard.Check(pixel.UserID, pixel.X, pixel.Y); err != nil {
+		if _, ok := err.(*AreaLimitError); ok {
+			pixelsRejected.WithLabelValues(rejectAreaLimit).Inc()
+			return &placementError{status: http.StatusForbidden, code: codeAreaLimit, message: err.Error()}
+		}
+		slog.Error("Contiguous area check failed", "requestId", pixel.RequestID, "err", err)
+		// Don't block placements just because the check itself failed
+	}
+
+	// The server-wide limit comes before the IP's cooldown is used up, so a
+	// placement refused by it doesn't cost one. It applies to service
+	// accounts too. A placement the cooldowns or the quota refuse after all
+	// gives its share of the server-wide limit back.
+	if ok, wait := s.globalLimit.Allow(); !ok {
+		pixelsRejected.WithLabelValues(rejectGlobalLimit).Inc()
+		return &placementError{
+			status:     http.StatusTooManyRequests,
+			code:       codeGlobalRateLimited,
+			message:    "The canvas is too busy right now. Please try again shortly.",
+			retryAfter: wait,
+			reason:     rateLimitGlobal,
+		}
+	}
+	if err := s.takeLimits(pixel, ip, cost); err != nil {
+		s.globalLimit.Refund()
+		return err
+	}
+
+	// Add timestamp to the pixel update (in milliseconds) and the sequence
+	// number that decides its order, even if the clock goes backwards
+	// The chunk is assigned by the hub when the pixel is broadcast
+	pixel.Timestamp = currentTimeMillis()
+	pixel.Seq = s.db.NextSeq()
+
+	// Refuse the placement while database writes are being skipped, if configured to
+	if s.shedWhenDegraded && s.dbBreaker.Degraded() {
+		pixelsRejected.WithLabelValues(rejectUnavailable).Inc()
+		return &placementError{status: http.StatusServiceUnavailable, code: codeUnavailable, message: "Database unavailable. Please try again later."}
+	}
+
+	// A shadow-banned user's placement is answered like any other, but it is
+	// only saved to the quarantine table (see shadowban.go)
+	if s.shadowBans.Banned(pixel.UserID) {
+		s.quarantine(pixel)
+		return nil
+	}
+
+	conditional := pixel.ExpectedColor != ""
+	if conditional {
+		// A conditional placement is saved right away, in the same statement
+		// that checks the color, so nobody can change the pixel in between
+		if err := s.saveIfExpectedColor(pixel); err != nil {
+			return err
+		}
+	} else if s.persistence == WriteThrough {
+		// Save the pixel before answering, so an accepted pixel is durable
+		if err := s.saveThrough(pixel); err != nil {
+			return err
+		}
+	} else {
+		// Hand the pixel to the background writer, which saves it with the next batch
+		// A failed write is only logged - database failure shouldn't block real-time updates
+		s.writer.Write(*pixel)
+	}
+	s.canvasCache.Place(*pixel)
+
+	// Try to add the pixel to the queue, unless an overlay pixel hides it:
+	// live clients would paint it over the overlay that /api/canvas still
+	// shows (see coveredByOverlay). It is still logged for crash recovery.
+	if s.coveredByOverlay(pixel.X, pixel.Y) {
+		s.queue.Record(*pixel)
+	} else if err := s.queue.Enqueue(*pixel); err != nil {
+		slog.Warn("Failed to enqueue pixel", "requestId", pixel.RequestID, "err", err)
+		pixelsRejected.WithLabelValues(rejectUnavailable).Inc()
+		return &placementError{status: http.StatusServiceUnavailable, code: codeQueueFull, message: "Queue is full. Please try again."}
+	}
+
+	s.undos.Record(*pixel)
+	s.activity.Record(pixel.UserID)
+	s.webhooks.PixelPlaced(*pixel, conditional)
+
+	if pixel.ServiceAccount {
+		auditServicePlacement(pixel)
+	}
+	pixelsAccepted.Inc()
+	slog.Info("Pixel accepted", "requestId", pixel.RequestID, "user", pixel.UserID, "x", pixel.X, "y", pixel.Y, "color", pixel.Color, "seq", pixel.Seq)
+	return nil
+}
+
+// saveThrough saves a placement in write-through mode
+// It goes through the circuit breaker like the writer's batches, but a failure
+// refuses the placement instead of being logged. The sequence number keeps a
+// later placement winning even if its save commits first.
+func (s *Server) saveThrough(pixel *PixelUpdate) *placementError {
+	err := s.persist(func() error { return s.db.SavePixelBatch([]PixelUpdate{*pixel}) })
+	if err != nil {
+		slog.Error("Failed to save placement", "requestId", pixel.RequestID, "x", pixel.X, "y", pixel.Y, "err", err)
+		pixelsRejected.WithLabelValues(rejectUnavailable).Inc()
+		return &placementError{status: http.StatusServiceUnavailable, code: codeUnavailable, message: "Database unavailable. Please try again later."}
+	}
+	return nil
+}
+
+// takeLimits uses up the cooldowns and quota of a placement: the service
+// account's cooldown, or the IP's and the user's cooldowns and the user's
+// quota. The checks before it have let the placement through, so one of
+// these only refuses it when a placement racing this one got there first.
+func (s *Server) takeLimits(pixel *PixelUpdate, ip string, cost float64) *placementError {
+	if pixel.ServiceAccount {
+		return s.takeServiceCooldown(pixel)
+	}
+
+	if s.ipLimiter != nil && !s.ipLimiter.Allow(ip) {
+		return s.rateLimited(s.ipLimiter, ip, rateLimitIP)
+	}
+	// Returns true if the user is allowed to place a pixel, and uses up
+	// the zone's cost
+	if !s.rateLimiter.AllowN(pixel.UserID, cost) {
+		return s.rateLimited(s.rateLimiter, pixel.UserID, rateLimitUser)
+	}
+	// Count the pixel against the quota; it can only be used up since the
+	// check above by a placement of the same user racing this one
+	if ok, wait := s.quota.Take(pixel.UserID); !ok {
+		return s.quota.exceeded(wait)
+	}
+	return nil
+}
+
+// rateLimited builds the 429 error for a key that hit the given limiter
+func (s *Server) rateLimited(limiter *RateLimiter, key, reason string) *placementError {
+	pixelsRejected.WithLabelValues(rejectRateLimit).Inc()
+	return &placementError{
+		status:     http.StatusTooManyRequests,
+		code:       codeRateLimited,
+		message:    "Rate limit exceeded. Please wait before placing another pixel.",
+		retryAfter: limiter.TimeUntilAllowed(key),
+		reason:     reason,
+	}
+}
+
+// cooldownStatus is the response of GET /api/cooldown
+type cooldownStatus struct {
+	ReadyInMs  int64  `json:"readyInMs"`
+	CanPlace   bool   `json:"canPlace"`
+	Reason     string `json:"reason,omitempty"` // The limit still cooling down: rateLimitUser, rateLimitIP or rateLimitQuota
+	CooldownMs int64  `json:"cooldownMs"`       // The user cooldown right now (it follows the activity in adaptive mode)
+
+	// Quota is the user's PLACEMENT_QUOTA (nil when there is none)
+	Quota *quotaStatus `json:"quota,omitempty"`
+
+	// ServiceAccount is true for a service account, whose cooldownMs is
+	// SERVICE_ACCOUNT_COOLDOWN (see serviceaccount.go)
+	ServiceAccount bool `json:"serviceAccount,omitempty"`
+}
+
+// handleCooldown reports how long a user must wait before placing a pixel
+// Query parameter: userId (with AUTH_SECRET the user comes from the bearer
+// token instead). The limiters are only peeked at with TimeUntilAllowed, so
+// polling this never uses up or restarts a cooldown.
+func (s *Server) handleCooldown(w http.ResponseWriter, r *http.Request) {
+	s.writeCORS(w, r, "GET, OPTIONS")
+
+	userID := r.URL.Query().Get("userId")
+	service := false
+	if s.tokens != nil {
+		claims, ok := s.tokenClaims(r)
+		if !ok {
+			writeUnauthorized(w)
+			return
+		}
+		userID, service = claims.Subject, s.serviceAccounts.Match(claims)
+	}
+	if userID == "" {
+		writeError(w, http.StatusBadRequest, codeValidation, "userId is required")
+		return
+	}
+
+	// A service account only has its own cooldown (see serviceaccount.go)
+	if service {
+		wait := s.serviceAccounts.TimeUntilAllowed(userID)
+		status := cooldownStatus{
+			ReadyInMs:      wait.Milliseconds(),
+			CanPlace:       wait == 0,
+			CooldownMs:     s.serviceAccounts.Cooldown().Milliseconds(),
+			ServiceAccount: true,
+		}
+		if !status.CanPlace {
+			status.Reason = rateLimitUser
+		}
+		writeCooldownStatus(w, r, status)
+		return
+	}
+
+	// The longer of the user's and the address's cooldown decides, the same
+	// as for a real placement
+	wait, reason := s.rateLimiter.TimeUntilAllowed(userID), rateLimitUser
+	if s.ipLimiter != nil {
+		if ipWait := s.ipLimiter.TimeUntilAllowed(s.clientIP(r)); ipWait > wait {
+			wait, reason = ipWait, rateLimitIP
+		}
+	}
+	if quotaWait := s.quota.TimeUntilAllowed(userID); quotaWait > wait {
+		wait, reason = quotaWait, rateLimitQuota
+	}
+
+	status := cooldownStatus{
+		ReadyInMs:  wait.Milliseconds(),
+		CanPlace:   wait == 0,
+		CooldownMs: s.rateLimiter.Cooldown().Milliseconds(),
+		Quota:      s.quota.status(userID),
+	}
+	if !status.CanPlace {
+		status.Reason = reason
+	}
+	writeCooldownStatus(w, r, status)
+}
+
+// writeCooldownStatus sends the response of GET /api/cooldown
+func writeCooldownStatus(w http.ResponseWriter, r *http.Request, status cooldownStatus) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		slog.WarnContext(r.Context(), "Failed to encode cooldown", "err", err)
+	}
+}
+
+// placeBatch places several pixels for one user, one at a time, and reports
+// a result for every pixel so callers can tell which ones were accepted.
+// Any userId and team in the pixels are replaced with the given ones, and
+// every pixel is tagged with requestID for the logs. service is true for a
+// service account (see serviceaccount.go).
+func (s *Server) placeBatch(userID, team string, service bool, ip, requestID string, pixels []PixelUpdate) ([]placementResult, *placementError) {
+	if len(pixels) > s.maxBatchSize {
+		return nil, &placementError{
+			status:  http.StatusRequestEntityTooLarge,
+			code:    codePayloadTooLarge,
+			message: fmt.Sprintf("batch of %d pixels exceeds the limit of %d", len(pixels), s.maxBatchSize),
+		}
+	}
+
+	results := make([]placementResult, len(pixels))
+	for i := range pixels {
+		pixel := pixels[i]
+		pixel.UserID, pixel.Team = userID, team
+		pixel.RequestID, pixel.ServiceAccount = requestID, service
+
+		results[i] = placementResult{Index: i, OK: true}
+		if err := s.placePixel(&pixel, ip); err != nil {
+			results[i] = placementResult{
+				Index:        i,
+				Status:       err.status,
+				Code:         err.code,
+				Error:        err.message,
+				RetryAfterMs: err.retryAfter.Milliseconds(),
+				Reason:       err.reason,
+				ResetAt:      err.resetAt,
+				CurrentColor: err.currentColor,
+			}
+		}
+	}
+	return results, nil
+}
+
+// batchPixelBytes bounds the request body of /api/pixels/batch per pixel,
+// unless MAX_BATCH_BODY_BYTES is set
+// A pixel with a 64-character userId is about 120 bytes of JSON, so this
+// leaves room for whitespace without letting a huge body be read
+const batchPixelBytes = 256
+
+// handlePixelBatch places several pixels in one request
+// The body is a JSON array of pixels for one user: the userId they all share
+// or, with AUTH_SECRET, the bearer token's user. Every pixel goes through
+// placePixel like a single placement, so each one still costs a cooldown and
+// a batch can't place more than the user could one request at a time.
+func (s *Server) handlePixelBatch(w http.ResponseWriter, r *http.Request) {
+	s.writeCORS(w, r, "POST, OPTIONS")
+
+	// Refuse oversized bodies before decoding them
+	limitBody(w, r, s.maxBatchBodyBytes)
+
+	var pixels []PixelUpdate
+	if err := decodeJSONBody(r.Body, &pixels, s.strictJSON); err != nil {
+		pixelsRejected.WithLabelValues(rejectValidation).Inc()
+		if readError(err, "") == errBodyTooLarge {
+			writeError(w, http.StatusRequestEntityTooLarge, codePayloadTooLarge, fmt.Sprintf("request body too large (at most %d bytes); send at most %d pixels", s.maxBatchBodyBytes, s.maxBatchSize))
+			return
+		}
+		writeError(w, http.StatusBadRequest, codeInvalidBody, "Body must be a JSON array of pixels")
+		return
+	}
+	if len(pixels) == 0 {
+		writeError(w, http.StatusBadRequest, codeValidation, "Batch must contain at least one pixel")
+		return
+	}
+
+	var userID, team string
+	service := false
+	if s.tokens != nil {
+		claims, ok := s.tokenClaims(r)
+		if !ok {
+			writeUnauthorized(w)
+			return
+		}
+		userID, team = claims.Subject, claims.Team
+		service = s.serviceAccounts.Match(claims)
+	} else {
+		// One batch is one user, so its pixels can't spread a burst over many ids
+		userID, team = pixels[0].UserID, pixels[0].Team
+		for _, pixel := range pixels[1:] {
+			if pixel.UserID != userID {
+				writeError(w, http.StatusBadRequest, codeValidation, "Every pixel in a batch must have the same userId")
+				return
+			}
+			if pixel.Team != team {
+				writeError(w, http.StatusBadRequest, codeValidation, "Every pixel in a batch must have the same team")
+				return
+			}
+		}
+	}
+
+	results, err := s.placeBatch(userID, team, service, s.clientIP(r), requestID(r.Context()), pixels)
+	if err != nil {
+		writePlacementError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"results": results}); err != nil {
+		slog.WarnContext(r.Context(), "Failed to encode batch results", "err", err)
+	}
+}
+
+// writePlacementError sends a rejected placement to an HTTP client
+// Rate-limited placements get a Retry-After header (whole seconds, rounded up)
+// and the remaining cooldown in milliseconds and which limit ("user", "ip",
+// "global" or "quota") was hit; a used-up quota also sends when it resets. A conditional placement refused with 409 gets the pixel's
+// current color.
+func writePlacementError(w http.ResponseWriter, err *placementError) {
+	if err.status == http.StatusTooManyRequests {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(err.retryAfter.Seconds()))))
+	}
+	writeAPIError(w, err.status, apiError{
+		Code:         err.code,
+		Message:      err.message,
+		RetryAfterMs: err.retryAfter.Milliseconds(),
+		Reason:       err.reason,
+		ResetAt:      err.resetAt,
+		CurrentColor: err.currentColor,
+	})
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// History pruning
+//
+// pixel_history gets a row for every placement, forever. A retention policy
+// bounds it: HISTORY_RETENTION keeps entries for a while (e.g. 720h for 30
+// days) and HISTORY_MAX_ROWS keeps only the newest entries. Both are off by
+// default, since pruning throws history away for good. With a policy set, a
+// background goroutine prunes every HISTORY_PRUNE_INTERVAL, and
+// POST /api/admin/prune prunes right away.
+//
+// The two limits become one cutoff time. Everything placed before it is
+// deleted, oldest first, HISTORY_PRUNE_BATCH rows per statement (found
+// through idx_history_placed_at). Each batch is its own short write on the
+// writer goroutine (see serialize.go), so placements keep being saved in
+// between instead of waiting for one huge delete.
+//
+// The newest entry is never deleted. The sequence counter starts after the
+// highest seq in the history when the server starts (see sequence.go), so
+// losing it would hand out old sequence numbers again.
+//
+// Deleted rows leave free pages in a SQLite file. When they make up at least
+// pruneVacuumShare of it the database is vacuumed afterwards (see
+// vacuum.go). PostgreSQL is vacuumed after every prune that deleted
+// something, which only makes the dead rows reusable and doesn't lock.
+//
+// Everything that reads the history only sees what is left: the history of a
+// pixel, GET /api/canvas/at and timelapses before the cutoff, placement
+// counts in GET /api/stats and replays. The leaderboard keeps its totals.
+
+// pruneVacuumShare is the share of free space in the SQLite file after a
+// prune that makes it worth a vacuum
+const pruneVacuumShare = 0.25
+
+// RetentionPolicy says which history entries to keep
+// A zero limit means no limit of that kind.
+type RetentionPolicy struct {
+	MaxAge  time.Duration // Keep entries placed within this long
+	MaxRows int           // Keep at most this many of the newest entries
+}
+
+// Unlimited returns true when the policy keeps everything
+func (p RetentionPolicy) Unlimited() bool {
+	return p.MaxAge <= 0 && p.MaxRows <= 0
+}
+
+// Validate checks that the limits aren't negative
+func (p RetentionPolicy) Validate() error {
+	if p.MaxAge < 0 {
+		return fmt.Errorf("history retention must not be negative (got %s)", p.MaxAge)
+	}
+	if p.MaxRows < 0 {
+		return fmt.Errorf("history row limit must not be negative (got %d)", p.MaxRows)
+	}
+	return nil
+}
+
+// PruneResult reports what a prune did
+type PruneResult struct {
+	Cutoff     int64         `json:"cutoff"`           // Entries placed before this (Unix milliseconds) were deleted
+	Deleted    int64         `json:"deleted"`          // History entries deleted
+	Batches    int           `json:"batches"`          // Delete statements it took
+	Vacuum     *VacuumResult `json:"vacuum,omitempty"` // Set when the database was vacuumed afterwards
+	DurationMs int64         `json:"durationMs"`
+}
+
+// historyCutoff returns the time before which the policy drops history
+// entries, or 0 when nothing has to go
+func (d *Database) historyCutoff(policy RetentionPolicy, now time.Time) (int64, error) {
+	var cutoff int64
+	if policy.MaxAge > 0 {
+		cutoff = now.Add(-policy.MaxAge).UnixMilli()
+	}
+
+	if policy.MaxRows > 0 {
+		// The oldest entry that is still among the newest MaxRows; entries
+		// placed in the same millisecond as it are kept too
+		var oldestKept int64
+		err := d.db.QueryRow(d.rebind(`
+		SELECT placed_at FROM pixel_history ORDER BY placed_at DESC LIMIT 1 OFFSET ?
+		`), policy.MaxRows-1).Scan(&oldestKept)
+		if err != nil && err != sql.ErrNoRows {
+			return 0, err
+		}
+		cutoff = max(cutoff, oldestKept)
+	}
+	return cutoff, nil
+}
+
+// PruneHistory deletes the history entries the policy doesn't keep, at most
+// batch rows per statement
+func (d *Database) PruneHistory(policy RetentionPolicy, batch int) (PruneResult, error) {
+	start := time.Now()
+	result := PruneResult{}
+	if policy.Unlimited() {
+		return result, nil
+	}
+
+	cutoff, err := d.historyCutoff(policy, timeNow())
+	if err != nil {
+		return result, err
+	}
+	result.Cutoff = cutoff
+
+	var newestSeq int64
+	if err := d.db.QueryRow(`SELECT COALESCE(MAX(seq), 0) FROM pixel_history`).Scan(&newestSeq); err != nil {
+		return result, err
+	}
+
+	query := d.rebind(`
+	DELETE FROM pixel_history WHERE id IN (
+		SELECT id FROM pixel_history WHERE placed_at < ? AND seq < ? ORDER BY placed_at LIMIT ?
+	)
+	`)
+	for cutoff > 0 {
+		var deleted int64
+		err := d.withRetry(func() error {
+			d.maintenance.RLock()
+			defer d.maintenance.RUnlock()
+
+			res, err := d.db.Exec(query, cutoff, newestSeq, batch)
+			if err != nil {
+				return err
+			}
+			deleted, err = res.RowsAffected()
+			return err
+		})
+		if err != nil {
+			result.DurationMs = time.Since(start).Milliseconds()
+			return result, err
+		}
+
+		result.Batches++
+		result.Deleted += deleted
+		historyPruned.Add(float64(deleted))
+		if deleted < int64(batch) {
+			break
+		}
+	}
+
+	if result.Deleted > 0 {
+		vacuum, err := d.worthVacuum()
+		if err != nil {
+			slog.Warn("Failed to check free space after pruning", "err", err)
+		}
+		if vacuum {
+			vacuumed, err := d.Vacuum()
+			if err != nil {
+				// The rows are gone either way; the next vacuum gets the space
+				slog.Error("Database vacuum after pruning failed", "err", err)
+			} else {
+				result.Vacuum = &vacuumed
+			}
+		}
+	}
+
+	result.DurationMs = time.Since(start).Milliseconds()
+	return result, nil
+}
+
+// worthVacuum returns true when enough of the database is free space for a
+// vacuum to pay off
+func (d *Database) worthVacuum() (bool, error) {
+	if d.dialect == dialectPostgres {
+		return true, nil
+	}
+
+	var free, size int64
+	err := d.db.QueryRow(`
+	SELECT f.freelist_count * s.page_size, c.page_count * s.page_size
+	FROM pragma_freelist_count() f, pragma_page_count() c, pragma_page_size() s
+	`).Scan(&free, &size)
+	if err != nil || size == 0 {
+		return false, err
+	}
+	return float64(free) >= pruneVacuumShare*float64(size), nil
+}
+
+// HistoryPruner applies a retention policy to the history
+// One prune runs at a time, whether scheduled or requested by an admin.
+type HistoryPruner struct {
+	db       *Database
+	policy   RetentionPolicy
+	batch    int           // Rows deleted per statement
+	interval time.Duration // Time between scheduled prunes
+
+	running sync.Mutex // Held while a prune runs
+}
+
+// NewHistoryPruner creates a pruner for policy
+func NewHistoryPruner(db *Database, policy RetentionPolicy, batch int, interval time.Duration) (*HistoryPruner, error) {
+	if err := policy.Validate(); err != nil {
+		return nil, err
+	}
+	if batch < 1 {
+		return nil, fmt.Errorf("history prune batch must be at least 1 (got %d)", batch)
+	}
+	if interval <= 0 {
+		return nil, fmt.Errorf("history prune interval must be positive (got %s)", interval)
+	}
+	return &HistoryPruner{db: db, policy: policy, batch: batch, interval: interval}, nil
+}
+
+// errPruneRunning is returned by Prune while another prune is running
+var errPruneRunning = errors.New("a history prune is already running")
+
+// Prune deletes what policy doesn't keep, unless a prune is already running
+func (p *HistoryPruner) Prune(policy RetentionPolicy) (PruneResult, error) {
+	if !p.running.TryLock() {
+		return PruneResult{}, errPruneRunning
+	}
+	defer p.running.Unlock()
+
+	return p.db.PruneHistory(policy, p.batch)
+}
+
+// Run prunes with the configured policy every interval, forever
+// Failures are logged and retried at the next interval.
+func (p *HistoryPruner) Run() {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		result, err := p.Prune(p.policy)
+		if err != nil {
+			slog.Error("History prune failed", "deleted", result.Deleted, "err", err)
+			continue
+		}
+		if result.Deleted > 0 {
+			logPrune("History pruned", result)
+		}
+	}
+}
+
+// logPrune logs what a prune did
+func logPrune(msg string, result PruneResult) {
+	args := []any{"cutoff", result.Cutoff, "deleted", result.Deleted, "batches", result.Batches, "durationMs", result.DurationMs}
+	if result.Vacuum != nil {
+		args = append(args, "reclaimed", result.Vacuum.SizeBefore-result.Vacuum.SizeAfter)
+	}
+	slog.Info(msg, args...)
+}
+
+// handlePrune prunes the history now
+// Optional query parameters maxAge (a duration such as 720h) and maxRows
+// replace the configured policy for this prune; without them the configured
+// one is used.
+func (s *Server) handlePrune(w http.ResponseWriter, r *http.Request) {
+	policy := s.pruner.policy
+	query := r.URL.Query()
+	if value := query.Get("maxAge"); value != "" {
+		maxAge, err := time.ParseDuration(value)
+		if err != nil || maxAge <= 0 {
+			writeError(w, http.StatusBadRequest, codeValidation, "maxAge must be a positive duration such as 720h")
+			return
+		}
+		policy.MaxAge = maxAge
+	}
+	if value := query.Get("maxRows"); value != "" {
+		maxRows, err := strconv.Atoi(value)
+		if err != nil || maxRows < 1 {
+			writeError(w, http.StatusBadRequest, codeValidation, "maxRows must be a positive integer")
+			return
+		}
+		policy.MaxRows = maxRows
+	}
+	if policy.Unlimited() {
+		writeError(w, http.StatusBadRequest, codeValidation, "No retention policy is configured; pass maxAge or maxRows")
+		return
+	}
+
+	result, err := s.pruner.Prune(policy)
+	if errors.Is(err, errPruneRunning) {
+		writeError(w, http.StatusConflict, codeConflict, "A history prune is already running")
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "History prune failed", "deleted", result.Deleted, "err", err)
+		writeError(w, http.StatusInternalServerError, codeInternal, "Failed to prune the history")
+		return
+	}
+	logPrune("History pruned by admin", result)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(result)
+}
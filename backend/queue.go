@@ -2,32 +2,119 @@ package main
 
 import (
 	"errors"
+	"fmt"
+	"log/slog"
 	"sync"
+	"time"
 )
 
+// OverflowPolicy decides what Enqueue does when the queue is full
+type OverflowPolicy string
+
+const (
+	// OverflowReject refuses the new pixel with errQueueFull
+	OverflowReject OverflowPolicy = "reject"
+
+	// OverflowDropOldest discards the oldest queued pixel to make room
+	// Only its broadcast is lost: the writer already has it for the database
+	OverflowDropOldest OverflowPolicy = "drop-oldest"
+
+	// OverflowBlock waits up to the block timeout for room, then refuses
+	// the pixel like OverflowReject
+	OverflowBlock OverflowPolicy = "block"
+)
+
+// errQueueFull is returned by Enqueue when a pixel doesn't fit
+var errQueueFull = errors.New("queue is full")
+
+// ParseOverflowPolicy checks a QUEUE_OVERFLOW value
+func ParseOverflowPolicy(value string) (OverflowPolicy, error) {
+	switch policy := OverflowPolicy(value); policy {
+	case OverflowReject, OverflowDropOldest, OverflowBlock:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown queue overflow policy %q (expected %q, %q or %q)", value, OverflowReject, OverflowDropOldest, OverflowBlock)
+	}
+}
+
 // PixelQueue is a thread-safe FIFO (First In, First Out) queue for pixel updates
 // It uses a mutex to ensure only one goroutine can modify the queue at a time
+//
+// The items are stored in a ring buffer: a fixed slice of maxSize slots where
+// head is the oldest item and tail is the next free slot, both wrapping around
+// to the start. Dequeuing just moves head forward, so memory use never grows
+// past maxSize items no matter how many pixels pass through the queue.
 type PixelQueue struct {
-	items    []PixelUpdate  // Slice to store pixel updates
-	maxSize  int            // Maximum number of items allowed in the queue
-	mu       sync.Mutex     // Mutex for thread-safe operations
-	notEmpty *sync.Cond     // Condition variable to signal when queue has items
+	items    []PixelUpdate // Ring buffer of pixel updates (len == maxSize)
+	head     int           // Index of the oldest item
+	tail     int           // Index where the next item is written
+	count    int           // Number of items currently in the queue
+	maxSize  int           // Maximum number of items allowed in the queue
+	mu       sync.Mutex    // Mutex for thread-safe operations
+	notEmpty *sync.Cond    // Condition variable to signal when queue has items
+	notFull  *sync.Cond    // Condition variable to signal when queue has room
+	log      *QueueLog     // Write-ahead log of enqueued pixels (nil when disabled)
+
+	// What Enqueue does when the queue is full, how long OverflowBlock
+	// waits, and how many pixels OverflowDropOldest has discarded
+	policy       OverflowPolicy
+	blockTimeout time.Duration
+	dropped      int64
 }
 
 // NewPixelQueue creates a new pixel queue with the specified maximum size
-func NewPixelQueue(maxSize int) *PixelQueue {
+// The ring buffer needs at least one slot, so a maxSize below 1 is an error.
+func NewPixelQueue(maxSize int) (*PixelQueue, error) {
+	if maxSize < 1 {
+		return nil, fmt.Errorf("queue size must be at least 1, got %d", maxSize)
+	}
+
 	q := &PixelQueue{
-		items:   make([]PixelUpdate, 0, maxSize),
+		items:   make([]PixelUpdate, maxSize),
 		maxSize: maxSize,
+		policy:  OverflowReject,
 	}
-	// Initialize the condition variable with the queue's mutex
-	// This allows goroutines to wait for items to be added to the queue
+	// Initialize the condition variables with the queue's mutex
+	// This allows goroutines to wait for items to be added to the queue,
+	// and (with OverflowBlock) for room to free up
 	q.notEmpty = sync.NewCond(&q.mu)
-	return q
+	q.notFull = sync.NewCond(&q.mu)
+	return q, nil
+}
+
+// SetOverflowPolicy sets what Enqueue does when the queue is full
+// blockTimeout is only used by OverflowBlock.
+func (q *PixelQueue) SetOverflowPolicy(policy OverflowPolicy, blockTimeout time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.policy = policy
+	q.blockTimeout = blockTimeout
+}
+
+// NewLoggedPixelQueue creates a pixel queue that appends every enqueued
+// pixel to log (see QueueLog)
+// The pixels recovered from the log are queued first, without being logged
+// again; if there are more than fit, only the newest are kept.
+func NewLoggedPixelQueue(maxSize int, log *QueueLog, recovered []PixelUpdate) (*PixelQueue, error) {
+	q, err := NewPixelQueue(maxSize)
+	if err != nil {
+		return nil, err
+	}
+	if len(recovered) > maxSize {
+		recovered = recovered[len(recovered)-maxSize:]
+	}
+	for _, pixel := range recovered {
+		q.Enqueue(pixel)
+	}
+
+	q.log = log
+	return q, nil
 }
 
 // Enqueue adds a pixel update to the end of the queue
-// Returns an error if the queue is full
+// When the queue is full the overflow policy decides: reject the pixel,
+// drop the oldest one, or wait for room. Returns errQueueFull if the pixel
+// was not added.
 func (q *PixelQueue) Enqueue(pixel PixelUpdate) error {
 	// Lock the mutex to ensure thread-safe access
 	// The mutex will be automatically unlocked when this function returns
@@ -35,12 +122,33 @@ func (q *PixelQueue) Enqueue(pixel PixelUpdate) error {
 	defer q.mu.Unlock()
 
 	// Check if the queue is full
-	if len(q.items) >= q.maxSize {
-		return errors.New("queue is full")
+	if q.count >= q.maxSize {
+		switch q.policy {
+		case OverflowDropOldest:
+			q.dropOldest()
+		case OverflowBlock:
+			if !q.waitForRoom() {
+				return errQueueFull
+			}
+		default:
+			return errQueueFull
+		}
+	}
+
+	// Log the pixel before it can be seen by anyone
+	// A failed write only means it wouldn't survive a crash, so it's not
+	// worth rejecting the placement over
+	if q.log != nil {
+		if err := q.log.Append(pixel); err != nil {
+			slog.Warn("Failed to append pixel to the queue log", "err", err)
+		}
 	}
 
-	// Add the pixel to the end of the queue
-	q.items = append(q.items, pixel)
+	// Write the pixel into the free slot at the tail and advance it,
+	// wrapping around to the start of the buffer
+	q.items[q.tail] = pixel
+	q.tail = (q.tail + 1) % q.maxSize
+	q.count++
 
 	// Signal that the queue is no longer empty
 	// This wakes up any goroutines waiting in DequeueBatch
@@ -49,6 +157,50 @@ func (q *PixelQueue) Enqueue(pixel PixelUpdate) error {
 	return nil
 }
 
+// Record logs a pixel that is saved but not broadcast (see QueueLog), so it
+// survives a crash like the queued ones
+func (q *PixelQueue) Record(pixel PixelUpdate) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.log != nil {
+		if err := q.log.Append(pixel); err != nil {
+			slog.Warn("Failed to append pixel to the queue log", "err", err)
+		}
+	}
+}
+
+// dropOldest discards the item at the head (q.mu must be held)
+func (q *PixelQueue) dropOldest() {
+	q.items[q.head] = PixelUpdate{}
+	q.head = (q.head + 1) % q.maxSize
+	q.count--
+	q.dropped++
+}
+
+// waitForRoom waits until the queue has room or the block timeout passes
+// (q.mu must be held) and returns true if there is room
+// sync.Cond can't wait with a timeout, so a timer wakes the waiters up
+// when it expires; each one then checks its own deadline.
+func (q *PixelQueue) waitForRoom() bool {
+	deadline := time.Now().Add(q.blockTimeout)
+	timer := time.AfterFunc(q.blockTimeout, func() {
+		q.mu.Lock()
+		q.notFull.Broadcast()
+		q.mu.Unlock()
+	})
+	defer timer.Stop()
+
+	for q.count >= q.maxSize {
+		if !time.Now().Before(deadline) {
+			return false
+		}
+		// Wait() releases the mutex while blocked, like in DequeueBatch
+		q.notFull.Wait()
+	}
+	return true
+}
+
 // DequeueBatch removes and returns up to 'batchSize' items from the queue
 // If the queue is empty, it waits until at least one item is available
 func (q *PixelQueue) DequeueBatch(batchSize int) []PixelUpdate {
@@ -59,24 +211,32 @@ func (q *PixelQueue) DequeueBatch(batchSize int) []PixelUpdate {
 	// Wait until the queue has at least one item
 	// The Wait() method releases the mutex and blocks until Signal() is called
 	// When Signal() is called, Wait() reacquires the mutex and continues
-	for len(q.items) == 0 {
+	for q.count == 0 {
 		q.notEmpty.Wait()
 	}
 
 	// Determine how many items to dequeue
 	// Take the minimum of batchSize and the current queue length
 	count := batchSize
-	if count > len(q.items) {
-		count = len(q.items)
+	if count > q.count {
+		count = q.count
 	}
 
-	// Extract the first 'count' items from the queue
+	// Copy the oldest 'count' items out of the ring
+	// The items may wrap around the end of the buffer, so copy in up to two parts
 	batch := make([]PixelUpdate, count)
-	copy(batch, q.items[:count])
+	n := copy(batch, q.items[q.head:min(q.head+count, q.maxSize)])
+	copy(batch[n:], q.items[:count-n])
+
+	// Clear the freed slots so they don't keep strings alive, then advance head
+	for i := 0; i < count; i++ {
+		q.items[(q.head+i)%q.maxSize] = PixelUpdate{}
+	}
+	q.head = (q.head + count) % q.maxSize
+	q.count -= count
 
-	// Remove the dequeued items from the queue
-	// This keeps the remaining items and shifts them to the front
-	q.items = q.items[count:]
+	// Wake up every Enqueue waiting for room (OverflowBlock)
+	q.notFull.Broadcast()
 
 	return batch
 }
@@ -85,12 +245,19 @@ func (q *PixelQueue) DequeueBatch(batchSize int) []PixelUpdate {
 func (q *PixelQueue) Len() int {
 	q.mu.Lock()
 	defer q.mu.Unlock()
-	return len(q.items)
+	return q.count
+}
+
+// Dropped returns how many pixels OverflowDropOldest has discarded
+func (q *PixelQueue) Dropped() int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.dropped
 }
 
 // IsEmpty returns true if the queue has no items
 func (q *PixelQueue) IsEmpty() bool {
 	q.mu.Lock()
 	defer q.mu.Unlock()
-	return len(q.items) == 0
+	return q.count == 0
 }
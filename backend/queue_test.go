@@ -0,0 +1,231 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestQueue creates a pixel queue, failing the test on error
+func newTestQueue(tb testing.TB, maxSize int) *PixelQueue {
+	tb.Helper()
+	q, err := NewPixelQueue(maxSize)
+	if err != nil {
+		tb.Fatalf("creating queue: %v", err)
+	}
+	return q
+}
+
+func TestNewPixelQueueRejectsEmptyBuffer(t *testing.T) {
+	for _, size := range []int{0, -1} {
+		if _, err := NewPixelQueue(size); err == nil {
+			t.Errorf("queue of size %d created", size)
+		}
+	}
+}
+
+func TestPixelQueueWrapsAround(t *testing.T) {
+	q := newTestQueue(t, 3)
+
+	// Fill, drain part, refill: the items wrap around the end of the ring
+	// and still come out in order
+	next := 0
+	for round := 0; round < 5; round++ {
+		for q.Len() < 3 {
+			if err := q.Enqueue(PixelUpdate{X: next}); err != nil {
+				t.Fatalf("enqueue %d: %v", next, err)
+			}
+			next++
+		}
+		batch := q.DequeueBatch(2)
+		want := next - 3
+		for _, pixel := range batch {
+			if pixel.X != want {
+				t.Fatalf("round %d: dequeued %d, want %d", round, pixel.X, want)
+			}
+			want++
+		}
+	}
+	if q.Len() != 1 || q.IsEmpty() {
+		t.Fatalf("length %d, want 1", q.Len())
+	}
+}
+
+// fullQueue returns a queue of size 2 holding pixels 0 and 1
+func fullQueue(t *testing.T, policy OverflowPolicy, blockTimeout time.Duration) *PixelQueue {
+	t.Helper()
+	q := newTestQueue(t, 2)
+	q.SetOverflowPolicy(policy, blockTimeout)
+	q.Enqueue(PixelUpdate{X: 0})
+	q.Enqueue(PixelUpdate{X: 1})
+	return q
+}
+
+// queuedXs dequeues everything in q and returns the X of each pixel
+func queuedXs(q *PixelQueue) []int {
+	var xs []int
+	for !q.IsEmpty() {
+		for _, pixel := range q.DequeueBatch(10) {
+			xs = append(xs, pixel.X)
+		}
+	}
+	return xs
+}
+
+func TestOverflowRejectAtCapacity(t *testing.T) {
+	q := fullQueue(t, OverflowReject, 0)
+
+	if err := q.Enqueue(PixelUpdate{X: 2}); !errors.Is(err, errQueueFull) {
+		t.Fatalf("enqueue into a full queue: %v, want errQueueFull", err)
+	}
+	if got := queuedXs(q); len(got) != 2 || got[0] != 0 || got[1] != 1 {
+		t.Fatalf("queue holds %v, want [0 1]", got)
+	}
+	if q.Dropped() != 0 {
+		t.Fatalf("%d pixels dropped by reject", q.Dropped())
+	}
+}
+
+func TestOverflowDropOldestAtCapacity(t *testing.T) {
+	q := fullQueue(t, OverflowDropOldest, 0)
+
+	for x := 2; x < 5; x++ {
+		if err := q.Enqueue(PixelUpdate{X: x}); err != nil {
+			t.Fatalf("enqueue %d: %v", x, err)
+		}
+	}
+	// The newest pixels are kept, in order
+	if got := queuedXs(q); len(got) != 2 || got[0] != 3 || got[1] != 4 {
+		t.Fatalf("queue holds %v, want [3 4]", got)
+	}
+	if q.Dropped() != 3 {
+		t.Fatalf("%d pixels dropped, want 3", q.Dropped())
+	}
+}
+
+func TestOverflowBlockWaitsForRoom(t *testing.T) {
+	q := fullQueue(t, OverflowBlock, 5*time.Second)
+
+	enqueued := make(chan error)
+	go func() { enqueued <- q.Enqueue(PixelUpdate{X: 2}) }()
+
+	select {
+	case err := <-enqueued:
+		t.Fatalf("enqueue into a full queue returned %v without waiting", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Dequeuing makes room and wakes the blocked Enqueue
+	if batch := q.DequeueBatch(1); batch[0].X != 0 {
+		t.Fatalf("dequeued %d, want 0", batch[0].X)
+	}
+	select {
+	case err := <-enqueued:
+		if err != nil {
+			t.Fatalf("blocked enqueue: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("enqueue still blocked after room freed up")
+	}
+	if got := queuedXs(q); len(got) != 2 || got[0] != 1 || got[1] != 2 {
+		t.Fatalf("queue holds %v, want [1 2]", got)
+	}
+}
+
+func TestOverflowBlockTimesOut(t *testing.T) {
+	q := fullQueue(t, OverflowBlock, 50*time.Millisecond)
+
+	start := time.Now()
+	if err := q.Enqueue(PixelUpdate{X: 2}); !errors.Is(err, errQueueFull) {
+		t.Fatalf("enqueue after the timeout: %v, want errQueueFull", err)
+	}
+	if waited := time.Since(start); waited < 50*time.Millisecond {
+		t.Fatalf("gave up after %s, before the 50ms timeout", waited)
+	}
+	if q.Len() != 2 {
+		t.Fatalf("length %d, want 2", q.Len())
+	}
+}
+
+func TestParseOverflowPolicy(t *testing.T) {
+	for _, value := range []string{"reject", "drop-oldest", "block"} {
+		if policy, err := ParseOverflowPolicy(value); err != nil || string(policy) != value {
+			t.Errorf("%q: %q, %v", value, policy, err)
+		}
+	}
+	for _, value := range []string{"", "drop", "Block"} {
+		if _, err := ParseOverflowPolicy(value); err == nil {
+			t.Errorf("%q accepted", value)
+		}
+	}
+}
+
+// sliceQueue is the queue PixelQueue replaced: dequeuing reslices the
+// front off the slice, and appending reallocates the backing array whenever
+// it runs out of room at the end
+// It is only kept to benchmark against.
+type sliceQueue struct {
+	items   []PixelUpdate
+	maxSize int
+	mu      sync.Mutex
+}
+
+func (q *sliceQueue) Enqueue(pixel PixelUpdate) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.items) >= q.maxSize {
+		return errQueueFull
+	}
+	q.items = append(q.items, pixel)
+	return nil
+}
+
+func (q *sliceQueue) DequeueBatch(batchSize int) []PixelUpdate {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	count := min(batchSize, len(q.items))
+	batch := make([]PixelUpdate, count)
+	copy(batch, q.items[:count])
+	q.items = q.items[count:]
+	return batch
+}
+
+// queueCycles is how many enqueue/dequeue cycles each benchmark iteration runs
+const queueCycles = 1000000
+
+// benchmarkQueue keeps a backlog of pixels in q and runs queueCycles cycles
+// of enqueueing one pixel and dequeueing one
+func benchmarkQueue(b *testing.B, enqueue func(PixelUpdate) error, dequeue func(int) []PixelUpdate) {
+	b.ReportAllocs()
+	pixel := PixelUpdate{X: 1, Y: 2, Color: "#FF0000", UserID: "alice"}
+	for i := 0; i < 100; i++ {
+		enqueue(pixel)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for c := 0; c < queueCycles; c++ {
+			if err := enqueue(pixel); err != nil {
+				b.Fatalf("enqueue: %v", err)
+			}
+			dequeue(1)
+		}
+	}
+}
+
+// BenchmarkPixelQueueRing never allocates beyond the dequeued batches: the
+// ring's backing array is allocated once
+func BenchmarkPixelQueueRing(b *testing.B) {
+	q := newTestQueue(b, 10000)
+	benchmarkQueue(b, q.Enqueue, q.DequeueBatch)
+	b.ReportMetric(float64(len(q.items)), "slots")
+}
+
+// BenchmarkPixelQueueSlice reallocates and copies the backing array every
+// time appending reaches its end
+func BenchmarkPixelQueueSlice(b *testing.B) {
+	q := &sliceQueue{maxSize: 10000}
+	benchmarkQueue(b, q.Enqueue, q.DequeueBatch)
+	b.ReportMetric(float64(cap(q.items)), "slots")
+}
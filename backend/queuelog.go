@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// QueueLog is an optional write-ahead log for the pixel queue
+//
+// Accepted pixels are saved to the database in the background (see
+// PixelWriter), so for a short time the queue and the writer are the only
+// place they exist. With the log enabled, Enqueue also appends every pixel to
+// a file first. After a crash the next start reads the file back, queues the
+// pixels again and hands them to the writer, so nothing accepted is lost.
+//
+// The log is split into segments. A checkpoint closes the active file as a
+// segment and starts a new one, then waits for the writer to save every pixel
+// it has. Because placements hand a pixel to the writer before enqueueing it,
+// every pixel in the closed segment is then in the database, and the segment
+// is deleted. If the writer failed a batch since the last checkpoint the
+// segment is kept instead and replayed on the next start.
+//
+// Each record is one JSON-encoded pixel per line. Records are written to the
+// operating system right away but not fsynced, so the log survives the process
+// crashing but not the whole machine losing power.
+type QueueLog struct {
+	path string // Active file; segments are path.1, path.2, ...
+
+	// mu guards everything below
+	mu      sync.Mutex
+	file    *os.File
+	records int // Records in the active file
+
+	// Closed segments and whether each may be deleted by the next good
+	// checkpoint (false once a failed batch may have lost its pixels)
+	segments    []string
+	deletable   map[string]bool
+	nextSegment int
+
+	// Writer failures already accounted for by a checkpoint, and whether
+	// one of them may have hit pixels in the active file
+	failuresSeen int64
+	activeFailed bool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// OpenQueueLog opens the log at path and returns the pixels left in it by a
+// previous run, oldest first
+// Those pixels are the caller's to queue and save again; their files are
+// removed by the first checkpoint that saves them.
+func OpenQueueLog(path string) (*QueueLog, []PixelUpdate, error) {
+	l := &QueueLog{
+		path:      path,
+		deletable: make(map[string]bool),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+
+	// Earlier segments, in the order they were written, then the active file
+	segments, err := l.existingSegments()
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := os.Stat(path); err == nil {
+		l.nextSegment++
+		segment := fmt.Sprintf("%s.%d", path, l.nextSegment)
+		if err := os.Rename(path, segment); err != nil {
+			return nil, nil, err
+		}
+		segments = append(segments, segment)
+	}
+
+	var recovered []PixelUpdate
+	for _, segment := range segments {
+		pixels, err := readQueueLogFile(segment)
+		if err != nil {
+			return nil, nil, fmt.Errorf("reading %s: %w", segment, err)
+		}
+		recovered = append(recovered, pixels...)
+
+		// The recovered pixels are given to the writer again, so a good
+		// checkpoint may delete their segments
+		l.segments = append(l.segments, segment)
+		l.deletable[segment] = true
+	}
+
+	if l.file, err = os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644); err != nil {
+		return nil, nil, err
+	}
+
+	if len(recovered) > 0 {
+		slog.Warn("Recovered unsaved pixels from the queue log", "pixels", len(recovered), "segments", len(segments))
+	}
+	return l, recovered, nil
+}
+
+// existingSegments lists the segment files next to the active file in the
+// order they were written and sets nextSegment past the last one
+func (l *QueueLog) existingSegments() ([]string, error) {
+	matches, err := filepath.Glob(l.path + ".*")
+	if err != nil {
+		return nil, err
+	}
+
+	numbers := make(map[string]int)
+	var segments []string
+	for _, match := range matches {
+		n, err := strconv.Atoi(strings.TrimPrefix(match, l.path+"."))
+		if err != nil {
+			continue
+		}
+		numbers[match] = n
+		segments = append(segments, match)
+		l.nextSegment = max(l.nextSegment, n)
+	}
+
+	sort.Slice(segments, func(i, j int) bool { return numbers[segments[i]] < numbers[segments[j]] })
+	return segments, nil
+}
+
+// readQueueLogFile reads every pixel in a log file
+// A torn last line (the process died mid-write) is skipped
+func readQueueLogFile(path string) ([]PixelUpdate, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var pixels []PixelUpdate
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var pixel PixelUpdate
+		if err := json.Unmarshal(scanner.Bytes(), &pixel); err != nil {
+			slog.Warn("Skipping unreadable queue log record", "file", path, "err", err)
+			continue
+		}
+		pixels = append(pixels, pixel)
+	}
+
+	return pixels, scanner.Err()
+}
+
+// Append writes a pixel to the log
+func (l *QueueLog) Append(pixel PixelUpdate) error {
+	record, err := json.Marshal(pixel)
+	if err != nil {
+		return err
+	}
+	record = append(record, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, err := l.file.Write(record); err != nil {
+		return err
+	}
+	l.records++
+	return nil
+}
+
+// Checkpoint deletes the log records the writer has saved (see QueueLog)
+func (l *QueueLog) Checkpoint(w *PixelWriter) error {
+	// Close the active file as a segment, unless nothing was logged
+	l.mu.Lock()
+	if l.records > 0 {
+		if err := l.rotate(); err != nil {
+			l.mu.Unlock()
+			return err
+		}
+	}
+	if len(l.segments) == 0 {
+		l.mu.Unlock()
+		return nil
+	}
+	segments := append([]string(nil), l.segments...)
+	l.mu.Unlock()
+
+	// Every pixel in those segments was given to the writer before it was
+	// logged, so once this returns it has been written, or counted as failed
+	w.Flush()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// A failed batch may also have held pixels logged after the rotation
+	failures := w.Failures()
+	failed := failures != l.failuresSeen
+	l.failuresSeen = failures
+	if failed {
+		l.activeFailed = true
+	}
+
+	kept := l.segments[:0]
+	for _, segment := range l.segments {
+		switch {
+		case !slices.Contains(segments, segment):
+			// Closed after this checkpoint started
+			kept = append(kept, segment)
+		case failed || !l.deletable[segment]:
+			// Some of its pixels may never have reached the database
+			if l.deletable[segment] {
+				slog.Warn("Keeping queue log segment after failed database writes; it is replayed on the next start", "file", segment)
+			}
+			l.deletable[segment] = false
+			kept = append(kept, segment)
+		default:
+			if err := os.Remove(segment); err != nil {
+				return err
+			}
+			delete(l.deletable, segment)
+		}
+	}
+	l.segments = kept
+	return nil
+}
+
+// rotate closes the active file as the next segment and starts a new one
+// Must be called with mu held
+func (l *QueueLog) rotate() error {
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+
+	l.nextSegment++
+	segment := fmt.Sprintf("%s.%d", l.path, l.nextSegment)
+	if err := os.Rename(l.path, segment); err != nil {
+		return err
+	}
+	l.segments = append(l.segments, segment)
+	l.deletable[segment] = !l.activeFailed
+	l.activeFailed = false
+
+	file, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	l.file = file
+	l.records = 0
+	return nil
+}
+
+// Run checkpoints every interval until Stop is called
+func (l *QueueLog) Run(w *PixelWriter, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := l.Checkpoint(w); err != nil {
+				slog.Error("Queue log checkpoint failed", "err", err)
+			}
+
+		case <-l.stop:
+			close(l.done)
+			return
+		}
+	}
+}
+
+// Stop ends Run and waits for it to return
+func (l *QueueLog) Stop() {
+	close(l.stop)
+	<-l.done
+}
+
+// Close closes the active file
+func (l *QueueLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"time"
+)
+
+// Placement quota
+//
+// The cooldown spaces a user's pixels out, but a script that places one
+// every cooldown, all day long, still gets through. PLACEMENT_QUOTA caps the
+// pixels each user may place within a rolling PLACEMENT_QUOTA_WINDOW (an
+// hour by default), on top of the cooldown: a placement must pass both.
+//
+// The window is rolling rather than reset on the hour, so there is no
+// moment where a user can place a whole quota just before the reset and
+// another one just after it. Each user's placement times within the window
+// are kept, oldest first; a user who has placed PLACEMENT_QUOTA pixels gets
+// their next one when the oldest of them leaves the window. That time is the
+// "reset" sent with the 429 QUOTA_EXCEEDED answer.
+//
+// The quota uses the rate limiter's user map (see ratelimiter.go), with the
+// same shards, size limit and jittered sweep. A user is forgotten once none
+// of their pixels is in the window anymore; until then they are kept,
+// whatever RATE_LIMIT_TTL says, or the quota would start over.
+
+// PlacementQuota caps the pixels each user may place within a rolling window
+// A nil *PlacementQuota allows everything.
+type PlacementQuota struct {
+	shards []*limiterShard
+	limit  int           // Pixels allowed within the window
+	window time.Duration // How far back placements count
+	config LimiterConfig
+}
+
+// NewPlacementQuota allows limit pixels per user within any window
+// config must be valid (see LimiterConfig.Validate); its TTL is not used.
+func NewPlacementQuota(limit int, window time.Duration, config LimiterConfig) (*PlacementQuota, error) {
+	if limit < 1 || window <= 0 {
+		return nil, fmt.Errorf("placement quota needs at least 1 pixel and a positive window (got %d and %s)", limit, window)
+	}
+
+	q := &PlacementQuota{
+		shards: newLimiterShards(config),
+		limit:  limit,
+		window: window,
+		config: config,
+	}
+	superviseGo("quotaCleanup", q.cleanup)
+	return q, nil
+}
+
+// Status returns how many pixels the user may still place within the
+// window, and when they get the next one back (the zero time if none are in use)
+func (q *PlacementQuota) Status(userID string) (remaining int, resetAt time.Time) {
+	now := timeNow()
+
+	shard := shardFor(q.shards, userID)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+
+	placed := q.inWindow(shard.lookup(userID), now)
+	if len(placed) == 0 {
+		return q.limit, time.Time{}
+	}
+	return max(q.limit-len(placed), 0), placed[0].Add(q.window)
+}
+
+// TimeUntilAllowed returns how long the user must wait before the quota
+// lets them place again (0 if it does right now)
+// A nil quota never makes anyone wait.
+func (q *PlacementQuota) TimeUntilAllowed(userID string) time.Duration {
+	if q == nil {
+		return 0
+	}
+
+	remaining, resetAt := q.Status(userID)
+	if remaining > 0 {
+		return 0
+	}
+	return max(resetAt.Sub(timeNow()), 0)
+}
+
+// Take counts a placement against the user's quota
+// If the quota is used up, nothing is counted and it returns false and the
+// time until the next pixel is allowed.
+func (q *PlacementQuota) Take(userID string) (bool, time.Duration) {
+	if q == nil {
+		return true, 0
+	}
+	now := timeNow()
+
+	shard := shardFor(q.shards, userID)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	entry := shard.store(userID)
+	entry.placed = q.inWindow(entry, now)
+	if len(entry.placed) >= q.limit {
+		return false, max(entry.placed[0].Add(q.window).Sub(now), 0)
+	}
+	entry.placed = append(entry.placed, now)
+	return true, 0
+}
+
+// inWindow returns the placement times of an entry that are still within
+// the window at 'now' (nil for a user who isn't tracked)
+// The caller must hold the shard's lock (read or write)
+func (q *PlacementQuota) inWindow(entry *limiterEntry, now time.Time) []time.Time {
+	if entry == nil {
+		return nil
+	}
+
+	// Times are appended in order, so the expired ones are at the front
+	start := now.Add(-q.window)
+	placed := entry.placed
+	for len(placed) > 0 && !placed[0].After(start) {
+		placed = placed[1:]
+	}
+	return placed
+}
+
+// Len returns the number of users currently tracked
+func (q *PlacementQuota) Len() int {
+	total := 0
+	for _, shard := range q.shards {
+		shard.mu.RLock()
+		total += len(shard.entries)
+		shard.mu.RUnlock()
+	}
+	return total
+}
+
+// Snapshot returns the placement times within the window of every tracked
+// user, oldest first, as Unix timestamps in milliseconds (nil when q is nil)
+func (q *PlacementQuota) Snapshot() map[string][]int64 {
+	if q == nil {
+		return nil
+	}
+	now := timeNow()
+
+	snapshot := make(map[string][]int64)
+	for _, shard := range q.shards {
+		shard.mu.RLock()
+		for key, element := range shard.entries {
+			placed := q.inWindow(element.Value.(*limiterEntry), now)
+			if len(placed) == 0 {
+				continue
+			}
+			times := make([]int64, len(placed))
+			for i, t := range placed {
+				times[i] = t.UnixMilli()
+			}
+			snapshot[key] = times
+		}
+		shard.mu.RUnlock()
+	}
+	return snapshot
+}
+
+// Restore replaces the tracked users with a snapshot taken by Snapshot
+// Times that have left the window since are dropped by the next Take or
+// sweep as usual. A nil quota ignores the snapshot.
+func (q *PlacementQuota) Restore(snapshot map[string][]int64) {
+	if q == nil {
+		return
+	}
+
+	restoreShards(q.shards, func() {
+		for key, times := range snapshot {
+			placed := make([]time.Time, len(times))
+			for i, millis := range times {
+				placed[i] = time.UnixMilli(millis)
+			}
+			shardFor(q.shards, key).store(key).placed = placed
+		}
+	})
+}
+
+// cleanup periodically forgets the users with no pixel left in the window
+// The interval is jittered like the rate limiter's.
+func (q *PlacementQuota) cleanup() {
+	for {
+		jitter := time.Duration((rand.Float64()*0.2 - 0.1) * float64(q.config.CleanupInterval))
+		time.Sleep(q.config.CleanupInterval + jitter)
+		q.sweep(timeNow())
+	}
+}
+
+// sweep forgets the users with no pixel left in the window at 'now'
+// Only one shard is locked at a time.
+func (q *PlacementQuota) sweep(now time.Time) {
+	for _, shard := range q.shards {
+		shard.mu.Lock()
+		for _, element := range shard.entries {
+			entry := element.Value.(*limiterEntry)
+			if entry.placed = q.inWindow(entry, now); len(entry.placed) == 0 {
+				shard.remove(element)
+			}
+		}
+		shard.mu.Unlock()
+	}
+}
+
+// exceeded builds the 429 error for a user whose quota is used up and who
+// gets their next pixel back after wait
+func (q *PlacementQuota) exceeded(wait time.Duration) *placementError {
+	pixelsRejected.WithLabelValues(rejectQuota).Inc()
+	return &placementError{
+		status:     http.StatusTooManyRequests,
+		code:       codeQuotaExceeded,
+		message:    fmt.Sprintf("Placement quota of %d pixels used up. Please wait until it resets.", q.limit),
+		retryAfter: wait,
+		reason:     rateLimitQuota,
+		resetAt:    timeNow().Add(wait).UnixMilli(),
+	}
+}
+
+// quotaStatus is the "quota" part of GET /api/cooldown
+type quotaStatus struct {
+	Limit     int   `json:"limit"`
+	Remaining int   `json:"remaining"`
+	WindowMs  int64 `json:"windowMs"`
+	ResetAt   int64 `json:"resetAt,omitempty"` // When the next pixel is given back (Unix milliseconds)
+}
+
+// status returns the user's quota for GET /api/cooldown (nil when q is nil)
+func (q *PlacementQuota) status(userID string) *quotaStatus {
+	if q == nil {
+		return nil
+	}
+
+	remaining, resetAt := q.Status(userID)
+	status := &quotaStatus{Limit: q.limit, Remaining: remaining, WindowMs: q.window.Milliseconds()}
+	if !resetAt.IsZero() {
+		status.ResetAt = resetAt.UnixMilli()
+	}
+	return status
+}
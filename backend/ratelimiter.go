@@ -1,88 +1,497 @@
 package main
 
 import (
+	"container/list"
+	"fmt"
+	"math/rand/v2"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // RateLimiter tracks when each user last placed a pixel
 // It prevents users from placing pixels too frequently
+//
+// It works in one of two modes:
+//   - strict cooldown (capacity 1): one pixel, then wait the full cooldown
+//   - token bucket (capacity > 1): each user has a bucket of up to capacity
+//     pixels that refills by one every cooldown, so pixels can be banked and
+//     placed in a burst
+//
+// In adaptive mode (see adaptive.go) the cooldown also follows the recent
+// placement rate.
+//
+// Users are spread over shards by a hash of their key, each with its own
+// lock, so placements by different users rarely wait for each other. Each
+// shard holds at most its share of LimiterConfig.MaxEntries users. When a
+// flash crowd fills it up, the user who placed least recently is forgotten
+// to make room (their cooldown is the closest to running out anyway), so
+// memory stays bounded between cleanups.
 type RateLimiter struct {
-	lastUpdate map[string]time.Time // Maps userId to their last pixel timestamp
-	mu         sync.RWMutex         // Read-Write mutex for thread-safe map access
-	cooldown   time.Duration        // Time users must wait between pixels
+	shards   []*limiterShard
+	capacity int // Most pixels a user can bank (1 = strict cooldown)
+	config   LimiterConfig
+
+	// The cooldown is shared by all shards, so it is read without a lock
+	cooldown atomic.Int64 // Time users must wait between pixels (per token in bucket mode)
+
+	// Adaptive mode (nil keeps the cooldown fixed)
+	// rateMu guards rate; a shard's lock may be held while taking it.
+	adaptive atomic.Pointer[AdaptiveCooldown]
+	rateMu   sync.Mutex
+	rate     placementRate // Allowed placements, counted in adaptive mode
+}
+
+// LimiterConfig holds the memory and cleanup settings of a RateLimiter
+type LimiterConfig struct {
+	// Shards is the number of independently locked parts of the user map
+	Shards int
+
+	// MaxEntries caps the users tracked at once (0 = no limit)
+	MaxEntries int
+
+	// TTL is how long after their last pixel a user is forgotten; it should
+	// be longer than the longest cooldown
+	TTL time.Duration
+
+	// CleanupInterval is the average time between cleanups, each one
+	// jittered by up to a tenth either way
+	CleanupInterval time.Duration
+}
+
+// DefaultLimiterConfig returns the settings used unless configured otherwise
+func DefaultLimiterConfig() LimiterConfig {
+	return LimiterConfig{
+		Shards:          16,
+		MaxEntries:      1000000,
+		TTL:             10 * time.Minute,
+		CleanupInterval: 5 * time.Minute,
+	}
+}
+
+// Validate checks the settings
+func (c LimiterConfig) Validate() error {
+	if c.Shards < 1 || c.MaxEntries < 0 {
+		return fmt.Errorf("rate limiter needs at least 1 shard and a non-negative size limit (got %d shards, %d entries)", c.Shards, c.MaxEntries)
+	}
+	if c.TTL <= 0 || c.CleanupInterval <= 0 {
+		return fmt.Errorf("rate limiter TTL and cleanup interval must be positive (got %s and %s)", c.TTL, c.CleanupInterval)
+	}
+	return nil
+}
+
+// limiterShard is one part of the user map
+// entries maps a key to its element in recent, which lists the users from
+// the most to the least recent placement.
+type limiterShard struct {
+	mu         sync.RWMutex
+	entries    map[string]*list.Element
+	recent     *list.List
+	maxEntries int // 0 = no limit
+}
+
+// limiterEntry is the state of one user
+// lastUpdate is used in cooldown mode and bucket in token bucket mode;
+// placed is only used by PlacementQuota (see quota.go).
+type limiterEntry struct {
+	key        string
+	lastUpdate time.Time
+	bucket     tokenBucket
+	placed     []time.Time
+}
+
+// tokenBucket is one user's bucket in token bucket mode
+// tokens is the number of pixels they can place right now as of updated;
+// it is topped up lazily whenever the bucket is looked at
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
 }
 
 // NewRateLimiter creates a new rate limiter with the specified cooldown period
-func NewRateLimiter(cooldown time.Duration) *RateLimiter {
+func NewRateLimiter(cooldown time.Duration, config LimiterConfig) *RateLimiter {
+	return NewTokenBucketLimiter(1, cooldown, config)
+}
+
+// NewTokenBucketLimiter creates a rate limiter that lets users bank up to
+// capacity pixels, refilling one every refill period
+// A capacity of 1 is the same as a strict cooldown of refill. config must be
+// valid (see LimiterConfig.Validate).
+func NewTokenBucketLimiter(capacity int, refill time.Duration, config LimiterConfig) *RateLimiter {
+	if capacity < 1 {
+		capacity = 1
+	}
+
 	rl := &RateLimiter{
-		lastUpdate: make(map[string]time.Time),
-		cooldown:   cooldown,
+		shards:   newLimiterShards(config),
+		capacity: capacity,
+		config:   config,
 	}
+	rl.cooldown.Store(int64(refill))
 
 	// Start a cleanup goroutine to remove old entries from the map
 	// This prevents memory leaks from users who no longer use the service
-	go rl.cleanup()
+	superviseGo("rateLimiterCleanup", rl.cleanup)
 
 	return rl
 }
 
+// shard returns the shard a key belongs to
+func (rl *RateLimiter) shard(key string) *limiterShard {
+	return shardFor(rl.shards, key)
+}
+
+// shardFor returns the shard of shards a key belongs to
+// The hash is FNV-1a, computed inline so looking up a key doesn't allocate.
+func shardFor(shards []*limiterShard, key string) *limiterShard {
+	if len(shards) == 1 {
+		return shards[0]
+	}
+	hash := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint32(key[i])
+		hash *= 16777619
+	}
+	return shards[hash%uint32(len(shards))]
+}
+
+// SetAdaptive turns on adaptive mode, where cooldown is the cooldown at the
+// target placement rate; nil turns it off
+func (rl *RateLimiter) SetAdaptive(adaptive *AdaptiveCooldown) {
+	rl.adaptive.Store(adaptive)
+}
+
 // Allow checks if a user is allowed to place a pixel
 // Returns true if enough time has passed since their last pixel
 func (rl *RateLimiter) Allow(userID string) bool {
+	return rl.AllowN(userID, 1)
+}
+
+// AllowN is Allow for a pixel that costs cost cooldowns (e.g. in a zone
+// with a cooldown multiplier, or in a color listed in colorCooldowns)
+// The user only needs to be allowed one pixel right now; the extra cost makes
+// them wait longer for the next one. In token bucket mode the bucket can go
+// below zero for that.
+func (rl *RateLimiter) AllowN(userID string, cost float64) bool {
 	// Use the current time for consistent checking
 	now := timeNow()
 
-	// Acquire a write lock since we might modify the map
-	rl.mu.Lock()
-	defer rl.mu.Unlock()
+	// Only the user's shard is locked, since we might modify it
+	shard := rl.shard(userID)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
 
-	// Check if the user has placed a pixel before
-	lastTime, exists := rl.lastUpdate[userID]
-
-	if !exists {
-		// First pixel from this user - allow it
-		rl.lastUpdate[userID] = now
+	if rl.capacity > 1 {
+		// Token bucket mode - take a token if there is one
+		bucket := rl.refill(shard, userID, now)
+		if bucket.tokens < 1 {
+			return false
+		}
+		bucket.tokens -= cost
+		shard.store(userID).bucket = bucket
+		rl.countPlacement(now)
 		return true
 	}
 
-	// Calculate how much time has passed since the last pixel
-	timeSinceLastUpdate := now.Sub(lastTime)
-
-	// Check if the cooldown period has passed
-	if timeSinceLastUpdate < rl.cooldown {
+	// Check if the cooldown period has passed (or the user is new)
+	if rl.remaining(shard, userID, now) > 0 {
 		// User is still in cooldown - deny the pixel
 		return false
 	}
 
 	// Cooldown period has passed - allow the pixel and update timestamp
-	rl.lastUpdate[userID] = now
+	// A cost above one moves the timestamp into the future, so the next
+	// pixel is cost cooldowns away
+	shard.store(userID).lastUpdate = now.Add(time.Duration((cost - 1) * float64(rl.currentCooldown(now))))
+	rl.countPlacement(now)
 	return true
 }
 
+// TimeUntilAllowed returns how long the user must wait before Allow would
+// return true (0 if they can place a pixel right now)
+func (rl *RateLimiter) TimeUntilAllowed(userID string) time.Duration {
+	now := timeNow()
+
+	shard := rl.shard(userID)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+
+	return rl.remaining(shard, userID, now)
+}
+
+// remaining is the cooldown left for a user at 'now'
+// The caller must hold shard.mu (read or write)
+func (rl *RateLimiter) remaining(shard *limiterShard, userID string, now time.Time) time.Duration {
+	if rl.capacity > 1 {
+		// Token bucket mode - time until the bucket holds a whole token
+		bucket := rl.refill(shard, userID, now)
+		if bucket.tokens >= 1 {
+			return 0
+		}
+		return time.Duration((1 - bucket.tokens) * float64(rl.currentCooldown(now)))
+	}
+
+	// Check if the user has placed a pixel before
+	entry := shard.lookup(userID)
+	if entry == nil {
+		return 0
+	}
+
+	// Calculate how much of the cooldown is left since the last pixel
+	if left := rl.currentCooldown(now) - now.Sub(entry.lastUpdate); left > 0 {
+		return left
+	}
+	return 0
+}
+
+// refill returns a user's bucket topped up to 'now', without storing it
+// Users without a bucket (new, or cleaned up) have a full one
+// The caller must hold shard.mu (read or write)
+func (rl *RateLimiter) refill(shard *limiterShard, userID string, now time.Time) tokenBucket {
+	full := tokenBucket{tokens: float64(rl.capacity), updated: now}
+
+	cooldown := rl.currentCooldown(now)
+	entry := shard.lookup(userID)
+	if entry == nil || cooldown <= 0 {
+		return full
+	}
+
+	tokens := entry.bucket.tokens + float64(now.Sub(entry.bucket.updated))/float64(cooldown)
+	if tokens >= float64(rl.capacity) {
+		return full
+	}
+	return tokenBucket{tokens: tokens, updated: now}
+}
+
+// newLimiterShards creates the empty shards of a user map
+// The size limit is split evenly; keys hash evenly enough over the shards
+// that the total stays close to MaxEntries.
+func newLimiterShards(config LimiterConfig) []*limiterShard {
+	perShard := 0
+	if config.MaxEntries > 0 {
+		perShard = max(config.MaxEntries/config.Shards, 1)
+	}
+
+	shards := make([]*limiterShard, config.Shards)
+	for i := range shards {
+		shards[i] = &limiterShard{
+			entries:    make(map[string]*list.Element),
+			recent:     list.New(),
+			maxEntries: perShard,
+		}
+	}
+	return shards
+}
+
+// lookup returns a user's entry, or nil if they aren't tracked
+// The caller must hold s.mu (read or write)
+func (s *limiterShard) lookup(key string) *limiterEntry {
+	if element, ok := s.entries[key]; ok {
+		return element.Value.(*limiterEntry)
+	}
+	return nil
+}
+
+// store returns a user's entry for updating and marks it most recent
+// A new user may push out the least recent one when the shard is full.
+// The caller must hold s.mu
+func (s *limiterShard) store(key string) *limiterEntry {
+	if element, ok := s.entries[key]; ok {
+		s.recent.MoveToFront(element)
+		return element.Value.(*limiterEntry)
+	}
+
+	if s.maxEntries > 0 && len(s.entries) >= s.maxEntries {
+		oldest := s.recent.Back()
+		s.remove(oldest)
+		rateLimiterEvictions.Inc()
+	}
+
+	entry := &limiterEntry{key: key}
+	s.entries[key] = s.recent.PushFront(entry)
+	return entry
+}
+
+// remove forgets the user of an element
+// The caller must hold s.mu
+func (s *limiterShard) remove(element *list.Element) {
+	s.recent.Remove(element)
+	delete(s.entries, element.Value.(*limiterEntry).key)
+}
+
+// SetCooldown changes the cooldown period for all subsequent checks
+// In token bucket mode this is the time it takes to refill one token, and in
+// adaptive mode the cooldown at the target rate
+// Used when the config is reloaded at runtime
+func (rl *RateLimiter) SetCooldown(cooldown time.Duration) {
+	rl.cooldown.Store(int64(cooldown))
+}
+
+// Cooldown returns the cooldown that applies right now
+// It is the configured one unless adaptive mode scales it.
+func (rl *RateLimiter) Cooldown() time.Duration {
+	return rl.currentCooldown(timeNow())
+}
+
+// currentCooldown is Cooldown at 'now'
+func (rl *RateLimiter) currentCooldown(now time.Time) time.Duration {
+	cooldown := time.Duration(rl.cooldown.Load())
+	adaptive := rl.adaptive.Load()
+	if adaptive == nil {
+		return cooldown
+	}
+
+	rl.rateMu.Lock()
+	rate := rl.rate.perSecond(now)
+	rl.rateMu.Unlock()
+	return adaptive.scale(cooldown, rate)
+}
+
+// countPlacement records an allowed placement for adaptive mode
+func (rl *RateLimiter) countPlacement(now time.Time) {
+	if rl.adaptive.Load() == nil {
+		return
+	}
+
+	rl.rateMu.Lock()
+	defer rl.rateMu.Unlock()
+	rl.rate.record(now)
+}
+
+// Len returns the number of users currently tracked
+func (rl *RateLimiter) Len() int {
+	total := 0
+	for _, shard := range rl.shards {
+		shard.mu.RLock()
+		total += len(shard.entries)
+		shard.mu.RUnlock()
+	}
+	return total
+}
+
+// LimiterSnapshot is the state of a RateLimiter, as saved by Snapshot
+// Times are Unix timestamps in milliseconds so it can be saved as JSON. Only
+// the section of the limiter's mode is filled in.
+type LimiterSnapshot struct {
+	// Cooldowns maps a key to the time of its last pixel (strict cooldown mode)
+	Cooldowns map[string]int64 `json:"cooldowns,omitempty"`
+
+	// Buckets maps a key to its token bucket (token bucket mode)
+	Buckets map[string]BucketState `json:"buckets,omitempty"`
+}
+
+// BucketState is one saved token bucket: the tokens it held when it was
+// last topped up, and when that was
+type BucketState struct {
+	Tokens  float64 `json:"tokens"`
+	Updated int64   `json:"updated"`
+}
+
+// Snapshot returns the state of every tracked user
+func (rl *RateLimiter) Snapshot() LimiterSnapshot {
+	var snapshot LimiterSnapshot
+	if rl.capacity > 1 {
+		snapshot.Buckets = make(map[string]BucketState)
+	} else {
+		snapshot.Cooldowns = make(map[string]int64)
+	}
+
+	for _, shard := range rl.shards {
+		shard.mu.RLock()
+		for key, element := range shard.entries {
+			entry := element.Value.(*limiterEntry)
+			if rl.capacity > 1 {
+				snapshot.Buckets[key] = BucketState{Tokens: entry.bucket.tokens, Updated: entry.bucket.updated.UnixMilli()}
+			} else {
+				snapshot.Cooldowns[key] = entry.lastUpdate.UnixMilli()
+			}
+		}
+		shard.mu.RUnlock()
+	}
+	return snapshot
+}
+
+// Restore replaces the tracked users with a snapshot taken by Snapshot
+// Buckets keep refilling from the time they were saved, so the time between
+// export and import counts towards the refill like any other wait.
+func (rl *RateLimiter) Restore(snapshot LimiterSnapshot) {
+	restoreShards(rl.shards, func() {
+		for key, millis := range snapshot.Cooldowns {
+			rl.shard(key).store(key).lastUpdate = time.UnixMilli(millis)
+		}
+		for key, bucket := range snapshot.Buckets {
+			rl.shard(key).store(key).bucket = tokenBucket{tokens: bucket.Tokens, updated: time.UnixMilli(bucket.Updated)}
+		}
+	})
+}
+
+// restoreShards empties shards and calls fill to store the restored entries
+// Every shard is locked for the whole swap, so no placement sees some shards
+// restored and others not yet (or still empty). The locks are taken in order;
+// everything else holds one shard lock at a time, so this can't deadlock.
+func restoreShards(shards []*limiterShard, fill func()) {
+	for _, shard := range shards {
+		shard.mu.Lock()
+	}
+	defer func() {
+		for _, shard := range shards {
+			shard.mu.Unlock()
+		}
+	}()
+
+	for _, shard := range shards {
+		shard.entries = make(map[string]*list.Element)
+		shard.recent.Init()
+	}
+	fill()
+}
+
 // cleanup periodically removes old entries from the rate limiter
-// This runs in a separate goroutine to avoid memory buildup
+// This runs in a separate goroutine to avoid memory buildup. The interval is
+// jittered so several servers (or limiters) don't all sweep at the same
+// moment.
 func (rl *RateLimiter) cleanup() {
-	// Create a ticker that fires every 5 minutes
-	ticker := time.NewTicker(5 * time.Minute)
-	defer ticker.Stop()
-
-	for range ticker.C {
-		rl.mu.Lock()
-
-		now := timeNow()
-		// Remove entries older than 10 minutes
-		// These users are no longer active
-		for userID, lastTime := range rl.lastUpdate {
-			if now.Sub(lastTime) > 10*time.Minute {
-				delete(rl.lastUpdate, userID)
+	for {
+		jitter := time.Duration((rand.Float64()*0.2 - 0.1) * float64(rl.config.CleanupInterval))
+		time.Sleep(rl.config.CleanupInterval + jitter)
+		rl.sweep(timeNow())
+	}
+}
+
+// sweep removes the users that are no longer limited at 'now'
+// Only one shard is locked at a time. cleanup calls it on a timer, but it can
+// be called directly (with a fake clock, for instance) to sweep right away.
+func (rl *RateLimiter) sweep(now time.Time) {
+	for _, shard := range rl.shards {
+		rl.cleanShard(shard, now)
+	}
+}
+
+// cleanShard removes the users of a shard that are no longer limited
+func (rl *RateLimiter) cleanShard(shard *limiterShard, now time.Time) {
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	for key, element := range shard.entries {
+		entry := element.Value.(*limiterEntry)
+		if rl.capacity > 1 {
+			// A bucket that has refilled completely is the same as no bucket
+			if rl.refill(shard, key, now).tokens >= float64(rl.capacity) {
+				shard.remove(element)
 			}
+			continue
 		}
 
-		rl.mu.Unlock()
+		// Remove entries older than the TTL; these users are no longer active
+		// A user still cooling down is kept even then (the TTL may be shorter
+		// than an adaptive cooldown)
+		if now.Sub(entry.lastUpdate) > rl.config.TTL && rl.remaining(shard, key, now) == 0 {
+			shard.remove(element)
+		}
 	}
 }
 
 // timeNow returns the current time
-// This is a separate function to make testing easier
+// Everything time-dependent in the limiters reads the clock through it, so
+// it can be replaced with a fake clock to step through cooldowns and sweeps
 var timeNow = time.Now
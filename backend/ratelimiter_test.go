@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTokenBucketRefill(t *testing.T) {
+	clock := useFakeClock(t)
+	rl := NewTokenBucketLimiter(3, 10*time.Second, DefaultLimiterConfig())
+
+	// A new user starts with a full bucket and can spend all of it at once
+	for i := 0; i < 3; i++ {
+		if !rl.Allow("alice") {
+			t.Fatalf("pixel %d denied with tokens left", i+1)
+		}
+	}
+	if rl.Allow("alice") {
+		t.Fatal("allowed with an empty bucket")
+	}
+	if wait := rl.TimeUntilAllowed("alice"); wait != 10*time.Second {
+		t.Fatalf("wait with an empty bucket = %s, want 10s", wait)
+	}
+
+	// Part of a refill period is not a whole token
+	clock.Advance(9 * time.Second)
+	if rl.Allow("alice") {
+		t.Fatal("allowed before a token refilled")
+	}
+	// The bucket is kept in floating point, so allow for rounding
+	if wait := rl.TimeUntilAllowed("alice"); wait < time.Second-time.Millisecond || wait > time.Second {
+		t.Fatalf("wait = %s, want 1s", wait)
+	}
+
+	// One token per refill period
+	clock.Advance(time.Second)
+	if !rl.Allow("alice") {
+		t.Fatal("denied after a token refilled")
+	}
+	if rl.Allow("alice") {
+		t.Fatal("allowed a second pixel on one refilled token")
+	}
+}
+
+func TestTokenBucketCapsAtCapacity(t *testing.T) {
+	clock := useFakeClock(t)
+	rl := NewTokenBucketLimiter(3, 10*time.Second, DefaultLimiterConfig())
+
+	rl.Allow("alice")
+	rl.Allow("alice")
+
+	// A long break refills the bucket, but never past its capacity
+	clock.Advance(time.Hour)
+	for i := 0; i < 3; i++ {
+		if !rl.Allow("alice") {
+			t.Fatalf("pixel %d denied after a long break", i+1)
+		}
+	}
+	if rl.Allow("alice") {
+		t.Fatal("bucket held more than its capacity")
+	}
+}
+
+func TestTokenBucketCostGoesNegative(t *testing.T) {
+	clock := useFakeClock(t)
+	rl := NewTokenBucketLimiter(2, 10*time.Second, DefaultLimiterConfig())
+
+	// One token is enough for a pixel that costs three; the bucket then owes
+	// one token and takes two refill periods to hold a whole token again
+	if !rl.AllowN("alice", 3) {
+		t.Fatal("expensive pixel denied on a full bucket")
+	}
+	if wait := rl.TimeUntilAllowed("alice"); wait != 20*time.Second {
+		t.Fatalf("wait after an expensive pixel = %s, want 20s", wait)
+	}
+	clock.Advance(20 * time.Second)
+	if !rl.Allow("alice") {
+		t.Fatal("denied once the debt was refilled")
+	}
+}
+
+func TestTokenBucketSnapshotRestore(t *testing.T) {
+	clock := useFakeClock(t)
+	rl := NewTokenBucketLimiter(3, 10*time.Second, DefaultLimiterConfig())
+
+	rl.Allow("alice")
+	rl.Allow("alice")
+	rl.Allow("alice")
+	clock.Advance(5 * time.Second)
+	snapshot := rl.Snapshot()
+
+	// The restored bucket is as empty as the saved one, and keeps refilling
+	// from when it was saved
+	restored := NewTokenBucketLimiter(3, 10*time.Second, DefaultLimiterConfig())
+	restored.Restore(snapshot)
+	if wait := restored.TimeUntilAllowed("alice"); wait != 5*time.Second {
+		t.Fatalf("wait after the restore = %s, want 5s", wait)
+	}
+	if wait := restored.TimeUntilAllowed("bob"); wait != 0 {
+		t.Fatalf("untracked user has to wait %s", wait)
+	}
+}
+
+func TestCooldown(t *testing.T) {
+	clock := useFakeClock(t)
+	rl := NewRateLimiter(5*time.Second, DefaultLimiterConfig())
+
+	if !rl.Allow("alice") {
+		t.Fatal("first pixel denied")
+	}
+	clock.Advance(4 * time.Second)
+	if rl.Allow("alice") {
+		t.Fatal("second pixel allowed within the cooldown")
+	}
+	if wait := rl.TimeUntilAllowed("alice"); wait != time.Second {
+		t.Fatalf("wait = %s, want 1s", wait)
+	}
+
+	// A denied pixel doesn't restart the cooldown
+	clock.Advance(time.Second)
+	if !rl.Allow("alice") {
+		t.Fatal("denied after the cooldown")
+	}
+}
+
+func TestCooldownIsPerUser(t *testing.T) {
+	useFakeClock(t)
+	rl := NewRateLimiter(5*time.Second, DefaultLimiterConfig())
+
+	if !rl.Allow("alice") {
+		t.Fatal("alice's first pixel denied")
+	}
+	// alice's cooldown doesn't hold anyone else back
+	if !rl.Allow("bob") {
+		t.Fatal("bob denied because of alice")
+	}
+	if rl.Allow("alice") || rl.Allow("bob") {
+		t.Fatal("a user placed twice within the cooldown")
+	}
+	if wait := rl.TimeUntilAllowed("carol"); wait != 0 {
+		t.Fatalf("new user has to wait %s", wait)
+	}
+}
+
+func TestSweepEvictsStaleEntries(t *testing.T) {
+	clock := useFakeClock(t)
+	config := DefaultLimiterConfig()
+	config.TTL = time.Minute
+	rl := NewRateLimiter(5*time.Second, config)
+
+	rl.Allow("alice")
+	clock.Advance(50 * time.Second)
+	rl.Allow("bob")
+
+	// alice is past the TTL, bob isn't
+	clock.Advance(20 * time.Second)
+	rl.sweep(timeNow())
+	if n := rl.Len(); n != 1 {
+		t.Fatalf("%d users tracked after the sweep, want 1", n)
+	}
+	if snapshot := rl.Snapshot(); len(snapshot.Cooldowns) != 1 || snapshot.Cooldowns["bob"] == 0 {
+		t.Fatalf("tracked %v, want only bob", snapshot.Cooldowns)
+	}
+
+	clock.Advance(time.Minute)
+	rl.sweep(timeNow())
+	if n := rl.Len(); n != 0 {
+		t.Fatalf("%d users tracked after everyone went stale", n)
+	}
+}
+
+func TestSweepKeepsUsersStillCoolingDown(t *testing.T) {
+	clock := useFakeClock(t)
+	config := DefaultLimiterConfig()
+	config.TTL = time.Second
+	rl := NewRateLimiter(time.Minute, config)
+
+	// The TTL is shorter than the cooldown; forgetting alice would let her
+	// place again early
+	rl.Allow("alice")
+	clock.Advance(30 * time.Second)
+	rl.sweep(timeNow())
+	if rl.Allow("alice") {
+		t.Fatal("sweep forgot a user still cooling down")
+	}
+}
+
+func TestSweepEvictsFullBuckets(t *testing.T) {
+	clock := useFakeClock(t)
+	rl := NewTokenBucketLimiter(3, 10*time.Second, DefaultLimiterConfig())
+
+	rl.Allow("alice")
+	rl.Allow("bob")
+	clock.Advance(5 * time.Second)
+	rl.Allow("bob")
+
+	// alice's bucket is full again, bob's isn't
+	clock.Advance(6 * time.Second)
+	rl.sweep(timeNow())
+	if n := rl.Len(); n != 1 {
+		t.Fatalf("%d users tracked, want only bob", n)
+	}
+}
+
+func BenchmarkRateLimiterAllow(b *testing.B) {
+	for _, shards := range []int{1, 16} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			config := DefaultLimiterConfig()
+			config.Shards = shards
+			rl := NewRateLimiter(time.Millisecond, config)
+
+			// Each goroutine places as its own set of users, so the only
+			// contention is on the shard locks
+			var workers atomic.Int64
+			b.RunParallel(func(pb *testing.PB) {
+				worker := workers.Add(1)
+				users := make([]string, 1024)
+				for i := range users {
+					users[i] = fmt.Sprintf("user-%d-%d", worker, i)
+				}
+				for i := 0; pb.Next(); i++ {
+					rl.Allow(users[i%len(users)])
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// backgroundColor is the default color of coordinates where no pixel has been placed
+var backgroundColor = color.RGBA{R: 255, G: 255, B: 255, A: 255}
+
+// parseHexColor converts a "#RRGGBB" or "#RRGGBBAA" string into a
+// color.RGBA, whose alpha is premultiplied as image.RGBA stores it
+// "#RRGGBB" colors are opaque.
+func parseHexColor(hex string) (color.RGBA, error) {
+	c, err := parseHexNRGBA(hex)
+	if err != nil {
+		return color.RGBA{}, err
+	}
+	return color.RGBAModel.Convert(c).(color.RGBA), nil
+}
+
+// RenderCanvas draws the visible canvas into an image, one image pixel per canvas pixel
+// Coordinates without a pixel are filled with the background color, and pixels
+// outside the canvas (left over from a larger canvas) are skipped
+func (d *Database) RenderCanvas(canvas CanvasConfig) (*image.RGBA, error) {
+	pixels, err := d.GetAllPixels()
+	if err != nil {
+		return nil, err
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, canvas.Width, canvas.Height))
+
+	// Start from a blank canvas in the configured background color
+	background, err := parseHexColor(canvas.Background)
+	if err != nil {
+		background = backgroundColor
+	}
+	for i := 0; i < len(img.Pix); i += 4 {
+		img.Pix[i] = background.R
+		img.Pix[i+1] = background.G
+		img.Pix[i+2] = background.B
+		img.Pix[i+3] = background.A
+	}
+
+	// Plot every stored pixel, blending translucent ones over the background
+	for _, pixel := range pixels {
+		if !canvas.Contains(pixel.X, pixel.Y) {
+			continue
+		}
+		c, err := parseHexColor(pixel.Color)
+		if err != nil {
+			// Skip anything that isn't a valid color rather than failing the whole render
+			continue
+		}
+		img.SetRGBA(pixel.X, pixel.Y, blendOver(background, c))
+	}
+
+	return img, nil
+}
+
+// canvasPNGCache keeps the most recent full-canvas PNG for a short time
+type canvasPNGCache struct {
+	mu         sync.Mutex
+	renderedAt time.Time // When png was rendered
+	png        []byte    // Encoded PNG (nil until the first render)
+}
+
+// handleCanvasPNG returns the whole canvas as a PNG image, one image pixel
+// per canvas pixel
+func (s *Server) handleCanvasPNG(w http.ResponseWriter, r *http.Request) {
+	s.writeCORS(w, r, "GET, OPTIONS")
+
+	data, err := s.canvasPNG()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to render canvas PNG", "err", err)
+		writeError(w, http.StatusInternalServerError, codeInternal, "Failed to render canvas")
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// canvasPNG returns the encoded canvas, re-rendering it only when the cached
+// copy is older than pngCacheTTL
+func (s *Server) canvasPNG() ([]byte, error) {
+	cache := &s.canvasPNGs
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	if cache.png != nil && timeNow().Sub(cache.renderedAt) < s.pngCacheTTL {
+		return cache.png, nil
+	}
+
+	img, err := s.db.RenderCanvas(s.canvas)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+
+	cache.renderedAt = timeNow()
+	cache.png = buf.Bytes()
+	return cache.png, nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import "testing"
+
+// checksum returns the canvas checksum of db, failing the test on error
+func checksum(t *testing.T, db *Database) string {
+	t.Helper()
+	sum, err := db.Checksum()
+	if err != nil {
+		t.Fatalf("checksum: %v", err)
+	}
+	return sum
+}
+
+// replayInto replays the history of src into a fresh database and returns it
+func replayInto(t *testing.T, src *Database) *Database {
+	t.Helper()
+	dst := newTestDatabase(t)
+	if err := ReplayHistory(src, dst, defaultTimestampPolicy); err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	return dst
+}
+
+func TestReplayMatchesLiveCanvas(t *testing.T) {
+	src := newTestDatabase(t)
+
+	// Overwrites, batches and an overlay pixel hiding a base pixel
+	src.SavePixel(PixelUpdate{X: 1, Y: 1, Color: "#FF0000", UserID: "alice"})
+	src.SavePixel(PixelUpdate{X: 1, Y: 1, Color: "#00FF00", UserID: "bob"})
+	src.SavePixelBatch([]PixelUpdate{
+		{X: 2, Y: 2, Color: "#0000FF", UserID: "alice"},
+		{X: 3, Y: 3, Color: "#000000", UserID: "carol"},
+		{X: 2, Y: 2, Color: "#FFFF00", UserID: "carol"},
+	})
+	src.SavePixelToLayer(PixelUpdate{X: 3, Y: 3, Color: "#FFFFFF", UserID: adminUserID}, LayerOverlay)
+
+	dst := replayInto(t, src)
+	if got, want := checksum(t, dst), checksum(t, src); got != want {
+		t.Fatalf("replayed checksum %s, live checksum %s", got, want)
+	}
+	pixel, ok, err := dst.GetPixel(2, 2)
+	if err != nil || !ok || pixel.Color != "#FFFF00" {
+		t.Fatalf("replayed (2,2) = %+v, %v, %v; want carol's #FFFF00", pixel, ok, err)
+	}
+}
+
+func TestReplayClearTombstones(t *testing.T) {
+	src := newTestDatabase(t)
+	src.SavePixel(PixelUpdate{X: 1, Y: 1, Color: "#FF0000", UserID: "alice"})
+	src.SavePixel(PixelUpdate{X: 2, Y: 2, Color: "#00FF00", UserID: "bob"})
+	if err := src.ClearCanvas(); err != nil {
+		t.Fatalf("clear: %v", err)
+	}
+
+	// Only what was placed after the clear survives the replay
+	src.SavePixel(PixelUpdate{X: 2, Y: 2, Color: "#0000FF", UserID: "carol"})
+
+	dst := replayInto(t, src)
+	if got, want := checksum(t, dst), checksum(t, src); got != want {
+		t.Fatalf("replayed checksum %s, live checksum %s", got, want)
+	}
+	if _, ok, _ := dst.GetPixel(1, 1); ok {
+		t.Fatal("pixel cleared before the replay point came back")
+	}
+	if pixel, ok, _ := dst.GetPixel(2, 2); !ok || pixel.Color != "#0000FF" {
+		t.Fatalf("replayed (2,2) = %+v, %v; want carol's pixel from after the clear", pixel, ok)
+	}
+}
+
+func TestReplayLatePlacementDoesNotWin(t *testing.T) {
+	src := newTestDatabase(t)
+	now := currentTimeMillis()
+
+	// The newer placement is saved first; the older one arrives late and
+	// must not overwrite it, live or replayed
+	src.SavePixelBatch([]PixelUpdate{{X: 5, Y: 5, Color: "#FF0000", UserID: "alice", Timestamp: now, Seq: 20}})
+	src.SavePixelBatch([]PixelUpdate{{X: 5, Y: 5, Color: "#00FF00", UserID: "bob", Timestamp: now - 1000, Seq: 10}})
+
+	if pixel, _, _ := src.GetPixel(5, 5); pixel == nil || pixel.Color != "#FF0000" {
+		t.Fatalf("live (5,5) = %+v, want alice's newer pixel", pixel)
+	}
+
+	dst := replayInto(t, src)
+	if got, want := checksum(t, dst), checksum(t, src); got != want {
+		t.Fatalf("replayed checksum %s, live checksum %s", got, want)
+	}
+}
+
+func TestReplayRefusesNonEmptyDestination(t *testing.T) {
+	src := newTestDatabase(t)
+	dst := newTestDatabase(t)
+	dst.SavePixel(PixelUpdate{X: 1, Y: 1, Color: "#FF0000", UserID: "alice"})
+
+	if err := ReplayHistory(src, dst, defaultTimestampPolicy); err == nil {
+		t.Fatal("replay into a store with history succeeded")
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"regexp"
+)
+
+// Request IDs
+//
+// Every HTTP request gets an ID, so the log lines it causes can be found
+// together, across instances too. withRequestID wraps the whole server:
+//
+//   - a valid X-Request-ID header (from a load balancer, or a client that
+//     wants to follow its own request) is kept; otherwise a random ID is made
+//   - the ID is echoed in the X-Request-ID response header
+//   - the ID is stored in the request's context. Handlers log with the
+//     slog *Context functions, and contextLogHandler adds "requestId" to
+//     those lines.
+//
+// A pixel outlives its request: it is saved by the background writer and
+// broadcast by the hub later. So placements also copy the ID into the pixel
+// (PixelUpdate.RequestID), and the writer and the hub log the IDs of the
+// pixels they handle (at debug level when all went well). One pixel can be
+// followed from "Pixel accepted" to "Pixels saved" and "Batch broadcast"
+// by searching for its ID. WebSocket placements use the ID of the request
+// that opened the connection.
+
+// requestIDHeader carries the request ID in both directions
+const requestIDHeader = "X-Request-ID"
+
+// requestIDRegex bounds the IDs taken from clients: common ID characters
+// only (UUIDs, hex, base64), so a client can't put markup or line breaks in
+// the logs
+var requestIDRegex = regexp.MustCompile(`^[A-Za-z0-9._:+/=-]{1,128}$`)
+
+// requestIDKey is the context key of the request ID
+type requestIDKey struct{}
+
+// newRequestID returns a random 16-character hex ID
+func newRequestID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// withRequestID gives every request an ID (see above) before passing it on
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !requestIDRegex.MatchString(id) {
+			id = newRequestID()
+		}
+
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// requestID returns the ID of the request ctx belongs to ("" outside a request)
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// requestIDs returns the distinct request IDs of the pixels, in order
+func requestIDs(pixels []PixelUpdate) []string {
+	var ids []string
+	seen := make(map[string]bool)
+	for _, pixel := range pixels {
+		if pixel.RequestID != "" && !seen[pixel.RequestID] {
+			seen[pixel.RequestID] = true
+			ids = append(ids, pixel.RequestID)
+		}
+	}
+	return ids
+}
+
+// contextLogHandler adds the request ID of the context to every record
+// logged with one (slog.InfoContext and friends)
+type contextLogHandler struct {
+	slog.Handler
+}
+
+// Handle adds "requestId" when the context has one
+func (h contextLogHandler) Handle(ctx context.Context, record slog.Record) error {
+	if id := requestID(ctx); id != "" {
+		record.AddAttrs(slog.String("requestId", id))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+// WithAttrs keeps the wrapper around the derived handler
+func (h contextLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextLogHandler{h.Handler.WithAttrs(attrs)}
+}
+
+// WithGroup keeps the wrapper around the derived handler
+func (h contextLogHandler) WithGroup(name string) slog.Handler {
+	return contextLogHandler{h.Handler.WithGroup(name)}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"database/sql"
+	"log/slog"
+	"math"
+)
+
+// Resuming a WebSocket connection
+//
+// A client that loses its connection for a moment would otherwise load the
+// whole canvas again when it reconnects. Instead it can pick up where it
+// left off with a cursor, a placement sequence number (see sequence.go):
+//
+//  1. On connect the server sends the current cursor, in the snapshot
+//     ({"type":"snapshot","cursor":N,...}) or, for clients connecting with
+//     ?snapshot=false, in a message of its own ({"type":"cursor","cursor":N}).
+//     Every broadcast pixel carries its seq; the client keeps the highest
+//     one it has applied as its cursor.
+//  2. After reconnecting (with ?snapshot=false) the client sends
+//     {"type":"resume","cursor":N}.
+//  3. The server answers {"type":"resume","cursor":M,"pixels":[...]} with the
+//     current pixel of every coordinate changed after N. A coordinate that is
+//     empty now is sent in the canvas background color, like the broadcast
+//     after an overlay pixel is removed. M is the cursor to resume from the
+//     next time. The live stream goes on from there.
+//
+// When the changes after N can't be listed, the server sends a full
+// snapshot ({"type":"snapshot",...}) instead and the client replaces its
+// canvas, as on a first connect. That happens when:
+//
+//   - history after N was deleted by the retention policy (see prune.go)
+//   - N is ahead of the server, e.g. the database was replaced
+//   - more than maxDiffPixels coordinates changed, which makes the snapshot
+//     the cheaper message
+//
+// The changes come from canvas_state and the history's tombstones by
+// sequence number, plus the pixels the writer hasn't saved yet, like
+// GET /api/canvas/diff does by timestamp. Sequence numbers are handed out
+// just before a pixel is queued, so two placements accepted at the same
+// moment can be broadcast in the opposite order: a client could see seq 6,
+// disconnect and only then miss seq 5. Changes made up to snapshotOverlap
+// before seq N are therefore sent again too; applying one twice does no
+// harm.
+//
+// The reply is built on the hub goroutine, like a snapshot, so no batch is
+// broadcast in between. Pixels the client already had live before its
+// resume message are older than the reply, and pixels of the reply that are
+// still queued for broadcast are skipped when they arrive (see
+// skipSnapshotted).
+
+// ChangedAfterSeq returns the coordinates changed after seq, or at or after
+// since (Unix milliseconds), with their visible pixel, at most limit of them
+// Coordinates that are empty now have an empty Color.
+func (d *Database) ChangedAfterSeq(seq, since int64, limit int) ([]PixelUpdate, error) {
+	query := `
+	WITH changed AS (
+		SELECT x, y FROM canvas_state WHERE seq > ?
+		UNION ALL
+		SELECT x, y FROM canvas_state WHERE updated_at >= ?
+		UNION ALL
+		SELECT x, y FROM pixel_history WHERE seq > ? AND color = ''
+		UNION ALL
+		SELECT x, y FROM pixel_history WHERE placed_at >= ? AND color = ''
+	), coordinates AS (
+		SELECT DISTINCT x, y FROM changed
+	)
+	SELECT l.x, l.y, c.color, c.user_id, c.updated_at, c.seq
+	FROM coordinates l
+	LEFT JOIN canvas_state c ON c.x = l.x AND c.y = l.y AND ` + visibleLayerFilter + `
+	LIMIT ?
+	`
+
+	rows, err := d.db.Query(d.rebind(query), seq, since, seq, since, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var pixels []PixelUpdate
+	for rows.Next() {
+		var pixel PixelUpdate
+		var color, userID sql.NullString
+		var timestamp, pixelSeq sql.NullInt64
+		if err := rows.Scan(&pixel.X, &pixel.Y, &color, &userID, &timestamp, &pixelSeq); err != nil {
+			return nil, err
+		}
+		pixel.Color, pixel.UserID = color.String, userID.String
+		pixel.Timestamp, pixel.Seq = timestamp.Int64, pixelSeq.Int64
+		pixels = append(pixels, pixel)
+	}
+	return pixels, rows.Err()
+}
+
+// OldestHistorySeq returns the smallest sequence number still in the
+// history (0 when it is empty)
+func (d *Database) OldestHistorySeq() (int64, error) {
+	var oldest int64
+	err := d.db.QueryRow(`SELECT COALESCE(MIN(seq), 0) FROM pixel_history`).Scan(&oldest)
+	return oldest, err
+}
+
+// historyTimeAt returns when the newest history entry numbered seq or lower
+// was placed (0 when there is none)
+func (d *Database) historyTimeAt(seq int64) (int64, error) {
+	var placedAt int64
+	err := d.db.QueryRow(d.rebind(`
+	SELECT placed_at FROM pixel_history WHERE seq <= ? ORDER BY seq DESC LIMIT 1
+	`), seq).Scan(&placedAt)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return placedAt, err
+}
+
+// resumeChanges returns the hub's Resume function for the canvas stored in
+// db: the current pixel of every coordinate changed after a cursor, or false
+// when the client needs a full snapshot instead
+// Empty coordinates are sent in the background color. cache may be nil.
+func resumeChanges(db *Database, writer *PixelWriter, cache *CanvasCache, background string) func(cursor int64) ([]PixelUpdate, bool, error) {
+	return func(cursor int64) ([]PixelUpdate, bool, error) {
+		if cursor < 0 || cursor > db.LastSeq() {
+			return nil, false, nil
+		}
+
+		// Entries after the cursor must still be in the history, or removals
+		// would be missed
+		oldest, err := db.OldestHistorySeq()
+		if err != nil {
+			return nil, false, err
+		}
+		if oldest > cursor+1 {
+			return nil, false, nil
+		}
+
+		// Changes shortly before the cursor's placement may have been broadcast
+		// after it (see above)
+		since := int64(math.MaxInt64)
+		if placedAt, err := db.historyTimeAt(cursor); err != nil {
+			return nil, false, err
+		} else if placedAt > 0 {
+			since = placedAt - snapshotOverlap.Milliseconds()
+		}
+
+		// Unsaved pixels are read before the database, like withUnsaved does,
+		// so a pixel saved in between is seen twice rather than not at all
+		unsaved := writer.Unsaved()
+		stored, err := db.ChangedAfterSeq(cursor, since, maxDiffPixels+1)
+		if err != nil {
+			return nil, false, err
+		}
+
+		// The latest state of every changed coordinate; unsaved pixels are newer
+		// than anything stored
+		changed := make(map[coord]PixelUpdate, len(stored))
+		var order []coord
+		for _, pixel := range stored {
+			key := coord{pixel.X, pixel.Y}
+			order = append(order, key)
+			changed[key] = pixel
+		}
+		for _, pixel := range unsaved {
+			if pixel.Seq <= cursor && pixel.Timestamp < since {
+				continue
+			}
+			key := coord{pixel.X, pixel.Y}
+			if _, seen := changed[key]; !seen {
+				order = append(order, key)
+			}
+			changed[key] = pixel
+		}
+		if len(changed) > maxDiffPixels {
+			return nil, false, nil
+		}
+
+		pixels := make([]PixelUpdate, 0, len(order))
+		for _, key := range order {
+			// The cache knows the visible pixel including overlays and unsaved
+			// erasers; without it the newest change decides
+			pixel, visible := changed[key], changed[key].Color != "" && !isTransparent(changed[key].Color)
+			if cache != nil {
+				pixel, visible = cache.Pixel(key[0], key[1])
+			}
+			if !visible {
+				pixel = PixelUpdate{X: key[0], Y: key[1], Color: background, Timestamp: currentTimeMillis()}
+			}
+			pixels = append(pixels, pixel)
+		}
+		return pixels, true, nil
+	}
+}
+
+// clientResume is a resume request received from a client's readPump
+type clientResume struct {
+	client *Client
+	cursor int64
+}
+
+// handleResume hands a resume request to the hub, which answers it
+func (c *Client) handleResume(msg inboundMessage) {
+	select {
+	case c.hub.resumes <- clientResume{client: c, cursor: msg.Cursor}:
+	case <-c.hub.stop:
+	}
+}
+
+// sendResume sends a resuming client what changed after its cursor, or a
+// full snapshot when that can't be listed (must be called from Run)
+// Pixels held for the client are older than either, so they are dropped.
+func (h *Hub) sendResume(client *Client, cursor int64) {
+	client.held = nil
+	client.stalls = 0
+
+	if h.resume == nil {
+		wsResumes.WithLabelValues(resumeSnapshot).Inc()
+		h.sendSnapshot(client)
+		return
+	}
+
+	// The cursor is read first: placements numbered after it may be in the
+	// reply already, which only means the next resume sends them again
+	next := h.cursor()
+	pixels, ok, err := h.resume(cursor)
+	if err != nil {
+		slog.Error("Failed to read changes for a resuming client", "cursor", cursor, "err", err)
+	}
+	if !ok {
+		slog.Debug("Client can't resume, sending a snapshot", "cursor", cursor)
+		wsResumes.WithLabelValues(resumeSnapshot).Inc()
+		h.sendSnapshot(client)
+		return
+	}
+	wsResumes.WithLabelValues(resumeResumed).Inc()
+
+	h.rememberPending(client, pixels)
+	select {
+	case client.send <- outboundMessage{Type: messageResume, Pixels: pixels, Cursor: &next}:
+	default:
+		h.drop(client, "resume could not be queued")
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+)
+
+// Retrying transient database errors
+//
+// Some write errors only mean "not right now": SQLite answers SQLITE_BUSY
+// or SQLITE_LOCKED when another connection holds the lock for longer than
+// its busy timeout, and PostgreSQL aborts transactions that deadlock or
+// can't be serialized. Trying the same write again a moment later usually
+// succeeds, so SavePixelBatch and ApplyHistoryEntry retry such errors with
+// exponential backoff (10ms, 20ms, 40ms, ...) before giving up.
+//
+// Every other error (a constraint violation, a full disk, a syntax error)
+// would fail again the same way, so it is returned at once. The number of
+// retries and the total time spent retrying are both capped, so a write
+// never hangs the background writer for long; what still fails is reported
+// to the circuit breaker as before.
+
+// RetryPolicy says how a database write is retried after a transient error
+type RetryPolicy struct {
+	// Attempts is the most retries after the first try (0 = never retry)
+	Attempts int
+
+	// BaseDelay is the wait before the first retry; it doubles for each one
+	BaseDelay time.Duration
+
+	// MaxElapsed caps the time from the first try to the start of the last retry
+	MaxElapsed time.Duration
+}
+
+// defaultRetryPolicy is used unless DB_RETRY_ATTEMPTS, DB_RETRY_BASE_DELAY
+// or DB_RETRY_MAX_ELAPSED say otherwise
+var defaultRetryPolicy = RetryPolicy{
+	Attempts:   4,
+	BaseDelay:  10 * time.Millisecond,
+	MaxElapsed: time.Second,
+}
+
+// Validate checks that the policy makes sense
+func (p RetryPolicy) Validate() error {
+	if p.Attempts < 0 {
+		return fmt.Errorf("retry attempts must not be negative, got %d", p.Attempts)
+	}
+	if p.Attempts > 0 && (p.BaseDelay <= 0 || p.MaxElapsed <= 0) {
+		return fmt.Errorf("retry delays must be positive, got base %s and max %s", p.BaseDelay, p.MaxElapsed)
+	}
+	return nil
+}
+
+// SetRetryPolicy replaces the retry policy
+// Call it before the database is written to.
+func (d *Database) SetRetryPolicy(policy RetryPolicy) {
+	d.retries = policy
+}
+
+// withRetry runs write, and runs it again after a backoff while it fails
+// with a retryable error and the policy allows more attempts
+// write must be a whole transaction, so a failed attempt changed nothing.
+// Each attempt runs on the writer goroutine (see serialize.go); the backoff
+// doesn't, so other writes go ahead meanwhile.
+func (d *Database) withRetry(write func() error) error {
+	start := time.Now()
+	delay := d.retries.BaseDelay
+
+	for attempt := 0; ; attempt++ {
+		err := d.serialize(write)
+		if err == nil || !isRetryable(err) || attempt >= d.retries.Attempts {
+			return err
+		}
+		if time.Since(start)+delay > d.retries.MaxElapsed {
+			return err
+		}
+
+		dbWriteRetries.Inc()
+		slog.Warn("Database busy, retrying write", "attempt", attempt+1, "delay", delay, "err", err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// isRetryable returns true for errors that only mean the database was busy
+func isRetryable(err error) bool {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code {
+		case "40001", // serialization_failure
+			"40P01", // deadlock_detected
+			"55P03": // lock_not_available
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// lockedDatabase opens a database that gives up on a lock after 1ms, and a
+// second connection to the same file holding its write lock
+// unlock releases the lock; it is also released when the test ends.
+func lockedDatabase(t *testing.T) (db *Database, unlock func()) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "canvas.db")
+	db, err := NewDatabase(path + "?_busy_timeout=1")
+	if err != nil {
+		t.Fatalf("opening database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	other, err := sql.Open("sqlite3", path+"?_busy_timeout=1")
+	if err != nil {
+		t.Fatalf("opening second connection: %v", err)
+	}
+	t.Cleanup(func() { other.Close() })
+	conn, err := other.Conn(context.Background())
+	if err != nil {
+		t.Fatalf("opening second connection: %v", err)
+	}
+	// BEGIN IMMEDIATE takes the write lock right away and keeps it
+	if _, err := conn.ExecContext(context.Background(), "BEGIN IMMEDIATE"); err != nil {
+		t.Fatalf("locking the database: %v", err)
+	}
+
+	unlocked := false
+	unlock = func() {
+		if !unlocked {
+			unlocked = true
+			conn.ExecContext(context.Background(), "ROLLBACK")
+			conn.Close()
+		}
+	}
+	t.Cleanup(unlock)
+	return db, unlock
+}
+
+func TestWriteRetriesWhileDatabaseIsLocked(t *testing.T) {
+	logs := captureLogs(t)
+	db, unlock := lockedDatabase(t)
+	db.SetRetryPolicy(RetryPolicy{Attempts: 10, BaseDelay: 10 * time.Millisecond, MaxElapsed: 5 * time.Second})
+
+	// The lock is held for a while, then released mid-retry
+	released := make(chan struct{})
+	go func() {
+		defer close(released)
+		time.Sleep(60 * time.Millisecond)
+		unlock()
+	}()
+
+	if err := db.SavePixelBatch([]PixelUpdate{{X: 1, Y: 1, Color: "#FF0000", UserID: "alice", Timestamp: 1000}}); err != nil {
+		t.Fatalf("write failed although the lock was released: %v", err)
+	}
+	<-released
+
+	if !strings.Contains(logs.String(), "Database busy, retrying write") {
+		t.Fatal("the write succeeded without hitting the busy path")
+	}
+	if pixel, ok, err := db.GetPixel(1, 1); err != nil || !ok || pixel.UserID != "alice" {
+		t.Fatalf("pixel after the retried write = %+v, %v, %v", pixel, ok, err)
+	}
+}
+
+func TestWriteGivesUpWhileDatabaseStaysLocked(t *testing.T) {
+	captureLogs(t)
+	db, _ := lockedDatabase(t)
+	db.SetRetryPolicy(RetryPolicy{Attempts: 3, BaseDelay: 5 * time.Millisecond, MaxElapsed: time.Second})
+
+	start := time.Now()
+	err := db.SavePixelBatch([]PixelUpdate{{X: 1, Y: 1, Color: "#FF0000", UserID: "alice", Timestamp: 1000}})
+	if err == nil {
+		t.Fatal("write succeeded on a locked database")
+	}
+	if !isRetryable(err) {
+		t.Fatalf("error %v is not the busy error", err)
+	}
+	// Three backoffs of 5, 10 and 20ms, far below the one-second cap
+	if elapsed := time.Since(start); elapsed < 35*time.Millisecond || elapsed > 500*time.Millisecond {
+		t.Fatalf("gave up after %s, want about 35ms of backoff", elapsed)
+	}
+}
+
+func TestPermanentErrorIsNotRetried(t *testing.T) {
+	logs := captureLogs(t)
+	db := newTestDatabase(t)
+	db.SetRetryPolicy(RetryPolicy{Attempts: 5, BaseDelay: 10 * time.Millisecond, MaxElapsed: time.Second})
+
+	calls := 0
+	err := db.withRetry(func() error {
+		calls++
+		_, err := db.db.Exec("INSERT INTO no_such_table VALUES (1)")
+		return err
+	})
+	if err == nil || calls != 1 {
+		t.Fatalf("error %v after %d calls, want a failure after 1", err, calls)
+	}
+	if strings.Contains(logs.String(), "retrying") {
+		t.Fatal("a permanent error was retried")
+	}
+}
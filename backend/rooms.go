@@ -0,0 +1,552 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Canvases
+//
+// One server can host several independent canvases, for example one per
+// event. The main canvas is served on the usual paths (/api/pixel,
+// /ws/queue, ...); each canvas listed in CANVASES is served on the same paths
+// with its name after /api/ or /ws/ (/api/event1/pixel, /ws/event1/queue,
+// /api/event1/admin/clear, ...).
+//
+// A canvas is a room: a Server with its own database, queue, hub, rate
+// limiters, background writer and canvas cache, built by newRoom from the
+// same settings as the main canvas. Nothing but the process is shared, so a
+// flood of placements in one room fills that room's queue and keeps its hub
+// busy without slowing the others down, and a user's cooldown in one room
+// doesn't apply in another.
+//
+// Rooms are created on demand: the first request for a listed canvas opens
+// its database and starts its goroutines. Each room has its own SQLite file
+// next to the main one (canvas.db -> canvas-event1.db) unless
+// CANVAS_<NAME>_DATABASE_URL names another database; on PostgreSQL that
+// variable is required, since every room needs its own tables. A room can be
+// a different size than the main canvas with CANVAS_<NAME>_WIDTH and
+// CANVAS_<NAME>_HEIGHT.
+//
+// Some things stay with the main canvas only: the health checks and
+// /metrics (the counters add up all rooms, the queue and hub gauges are the
+// main canvas's), the queue log, backups, scheduled vacuums and webhooks.
+
+// Room is one canvas with everything that serves it
+// The server serves the room's routes, without the /api/<name> prefix.
+type Room struct {
+	name   string
+	server *Server
+}
+
+// roomOptions holds what newRoom takes from main instead of building itself
+type roomOptions struct {
+	liveConfig *LiveConfig
+	tokens     *TokenVerifier
+	drain      *Drain
+
+	// queue is used instead of a new queue when set (the main canvas's
+	// queue may be backed by QUEUE_LOG), and recovered are the pixels the
+	// queue log still had; they are handed to the writer
+	queue     *PixelQueue
+	recovered []PixelUpdate
+
+	// Only the main canvas has these; they are nil for other rooms
+	webhooks *WebhookNotifier
+	backups  *BackupScheduler
+}
+
+// newRoom builds the server for one canvas stored in db and starts its
+// goroutines
+// Settings come from the same environment variables for every room.
+func newRoom(name string, db *Database, canvas CanvasConfig, options roomOptions) (*Room, error) {
+	cfg := options.liveConfig.Get()
+
+	// Initialize the pixel queue with a maximum capacity of 10,000 items
+	queue := options.queue
+	if queue == nil {
+		var err error
+		if queue, err = NewPixelQueue(10000); err != nil {
+			return nil, err
+		}
+	}
+
+	// Delete history older than HISTORY_RETENTION or beyond the newest
+	// HISTORY_MAX_ROWS entries (both off by default; see prune.go)
+	retention := RetentionPolicy{
+		MaxAge:  envDuration("HISTORY_RETENTION", 0),
+		MaxRows: envInt("HISTORY_MAX_ROWS", 0),
+	}
+	pruner, err := NewHistoryPruner(db, retention,
+		envInt("HISTORY_PRUNE_BATCH", 5000),
+		envDuration("HISTORY_PRUNE_INTERVAL", time.Hour),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("invalid history retention: %w", err)
+	}
+	if !retention.Unlimited() {
+		superviseGo("historyPruner", pruner.Run)
+	}
+
+	// What happens to a placement when the queue is full (QUEUE_OVERFLOW):
+	// reject it with 503 (default), drop the oldest queued pixel, or block
+	// for up to QUEUE_BLOCK_TIMEOUT waiting for room
+	overflow, err := ParseOverflowPolicy(envString("QUEUE_OVERFLOW", string(OverflowReject)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid queue settings: %w", err)
+	}
+	queue.SetOverflowPolicy(overflow, envDuration("QUEUE_BLOCK_TIMEOUT", 100*time.Millisecond))
+
+	// Initialize the rate limiter (1 pixel per user per cooldown, PIXEL_COOLDOWN or 5 seconds by default)
+	// With RATE_LIMIT_BURST above 1, users bank up to that many pixels
+	// instead, earning one back every cooldown (token bucket)
+	// Users are forgotten RATE_LIMIT_TTL after their last pixel, by a sweep
+	// every RATE_LIMIT_CLEANUP_INTERVAL, and at most RATE_LIMIT_MAX_ENTRIES are
+	// tracked at once, spread over RATE_LIMIT_SHARDS locks
+	defaults := DefaultLimiterConfig()
+	limiterConfig := LimiterConfig{
+		Shards:          envInt("RATE_LIMIT_SHARDS", defaults.Shards),
+		MaxEntries:      envInt("RATE_LIMIT_MAX_ENTRIES", defaults.MaxEntries),
+		TTL:             envDuration("RATE_LIMIT_TTL", defaults.TTL),
+		CleanupInterval: envDuration("RATE_LIMIT_CLEANUP_INTERVAL", defaults.CleanupInterval),
+	}
+	if err := limiterConfig.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid rate limiter settings: %w", err)
+	}
+	rateLimiter := NewTokenBucketLimiter(envInt("RATE_LIMIT_BURST", 1), time.Duration(cfg.Cooldown), limiterConfig)
+
+	// With ADAPTIVE_COOLDOWN_TARGET set, the cooldown follows the placement
+	// rate, between ADAPTIVE_COOLDOWN_MIN and ADAPTIVE_COOLDOWN_MAX
+	adaptive, err := adaptiveFromEnv(time.Duration(cfg.Cooldown))
+	if err != nil {
+		return nil, fmt.Errorf("invalid adaptive cooldown settings: %w", err)
+	}
+	if adaptive != nil {
+		rateLimiter.SetAdaptive(adaptive)
+		slog.Info("Adaptive cooldown enabled", "target", adaptive.Target, "min", adaptive.Min, "max", adaptive.Max)
+	}
+
+	// Optionally limit placements per client IP address as well, so rotating
+	// userIds doesn't get around the cooldown (IP_COOLDOWN, off by default)
+	var ipLimiter *RateLimiter
+	if ipCooldown := envDuration("IP_COOLDOWN", 0); ipCooldown > 0 {
+		ipLimiter = NewRateLimiter(ipCooldown, limiterConfig)
+	}
+
+	// Optionally cap the placements per second of all users together
+	// (GLOBAL_RATE_LIMIT, off by default), in bursts of up to
+	// GLOBAL_RATE_BURST (one second's worth)
+	var globalLimit *GlobalLimiter
+	if rate := envFloat("GLOBAL_RATE_LIMIT", 0); rate > 0 {
+		if globalLimit, err = NewGlobalLimiter(rate, envInt("GLOBAL_RATE_BURST", int(math.Ceil(rate)))); err != nil {
+			return nil, fmt.Errorf("invalid global rate limit: %w", err)
+		}
+	}
+
+	// Optionally cap the pixels each user places within a rolling
+	// PLACEMENT_QUOTA_WINDOW (PLACEMENT_QUOTA, off by default; see quota.go)
+	var quota *PlacementQuota
+	if limit := envInt("PLACEMENT_QUOTA", 0); limit > 0 {
+		if quota, err = NewPlacementQuota(limit, envDuration("PLACEMENT_QUOTA_WINDOW", time.Hour), limiterConfig); err != nil {
+			return nil, fmt.Errorf("invalid placement quota: %w", err)
+		}
+	}
+
+	// Trusted bots may skip the public cooldowns: tokens with the service
+	// role or users listed in SERVICE_ACCOUNTS wait SERVICE_ACCOUNT_COOLDOWN
+	// instead (0 = not at all; see serviceaccount.go)
+	serviceAccounts := NewServiceAccounts(options.tokens, envList("SERVICE_ACCOUNTS"),
+		envDuration("SERVICE_ACCOUNT_COOLDOWN", 0), limiterConfig)
+
+	// Initialize the database circuit breaker
+	// After DB_BREAKER_THRESHOLD consecutive write failures, writes are skipped
+	// for DB_BREAKER_COOLDOWN before a single probe write is attempted
+	dbBreaker := NewCircuitBreaker(
+		envInt("DB_BREAKER_THRESHOLD", 5),
+		envDuration("DB_BREAKER_COOLDOWN", 30*time.Second),
+	)
+
+	// COALESCE_UPDATES keeps only the latest update per coordinate within a
+	// batch, for both broadcasts and database writes. Overwritten pixels are
+	// then missing from the history, so it is off by default.
+	coalesce := envBool("COALESCE_UPDATES", false)
+
+	// Start the background database writer
+	// Accepted pixels are saved in one transaction per DB_BATCH_SIZE pixels,
+	// or every DB_FLUSH_INTERVAL, whichever comes first (see BatchConfig)
+	writer := NewPixelWriter(db, dbBreaker,
+		cfg.Batch.DBSize,
+		time.Duration(cfg.Batch.DBFlushInterval),
+		coalesce,
+	)
+	writer.Start()
+
+	// PERSISTENCE_MODE=write-through saves each placement before answering
+	// it instead of handing it to the writer (see PersistenceMode)
+	persistence, err := ParsePersistenceMode(envString("PERSISTENCE_MODE", string(WriteBehind)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid persistence settings: %w", err)
+	}
+
+	// THUMBNAIL_MODE is the downscaling /api/canvas/thumbnail uses when the
+	// request doesn't pick one
+	thumbnailMode, err := ParseThumbnailMode(envString("THUMBNAIL_MODE", string(thumbnailArea)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid thumbnail settings: %w", err)
+	}
+
+	// Keep the canvas in memory for /api/canvas unless CANVAS_CACHE=false
+	// It is loaded before the recovered pixels below are added to it
+	var canvasCache *CanvasCache
+	if envBool("CANVAS_CACHE", true) {
+		if canvasCache, err = NewCanvasCache(db); err != nil {
+			return nil, fmt.Errorf("loading the canvas cache: %w", err)
+		}
+	}
+
+	// Load the shadow-banned users (see shadowban.go)
+	shadowBans, err := NewShadowBans(db)
+	if err != nil {
+		return nil, fmt.Errorf("loading the shadow bans: %w", err)
+	}
+
+	// Save the pixels recovered from the queue log
+	for _, pixel := range options.recovered {
+		writer.Write(pixel)
+		canvasCache.Place(pixel)
+	}
+
+	// Initialize the WebSocket hub that manages all consumer connections
+	// Clients that opt in to acknowledgements may have at most WS_ACK_WINDOW
+	// unacknowledged batches in flight before further batches are held.
+	// BROADCAST_POLICY decides what happens when the broadcast channel is full.
+	// WS_REAP_AFTER closes clients that stop answering pings for that long.
+	// WS_MAX_CLIENTS caps connected WebSocket clients (0 = no limit).
+	// Broadcast batching: BATCH_SIZE and BATCH_INTERVAL (see BatchConfig)
+	batchSize := cfg.Batch.Size
+	batchInterval := time.Duration(cfg.Batch.Interval)
+
+	// Request bodies are cut off after MAX_BODY_BYTES (one pixel) or
+	// MAX_BATCH_BODY_BYTES (/api/pixels/batch, by default enough for
+	// MAX_BATCH_SIZE pixels), so a client can't stream a huge body into memory
+	maxBatchSize := envInt("MAX_BATCH_SIZE", 100)
+	maxBodyBytes := envInt("MAX_BODY_BYTES", defaultMaxBodyBytes)
+	maxBatchBodyBytes := envInt("MAX_BATCH_BODY_BYTES", maxBatchSize*batchPixelBytes)
+	if maxBodyBytes < 1 || maxBatchBodyBytes < 1 {
+		return nil, fmt.Errorf("invalid body size limits (MAX_BODY_BYTES %d, MAX_BATCH_BODY_BYTES %d)", maxBodyBytes, maxBatchBodyBytes)
+	}
+
+	// WebSocket timeouts: a client is pinged every WS_PING_PERIOD and closed
+	// after WS_PONG_WAIT without an answer; each write may take WS_WRITE_WAIT
+	// Messages from clients may be at most WS_MAX_MESSAGE_BYTES, by default
+	// enough for the largest placeBatch or subscribe message
+	pongWait := envDuration("WS_PONG_WAIT", defaultPongWait)
+	clientConfig := ClientConfig{
+		WriteWait:      envDuration("WS_WRITE_WAIT", defaultWriteWait),
+		PongWait:       pongWait,
+		PingPeriod:     envDuration("WS_PING_PERIOD", defaultPingPeriod(pongWait)),
+		MaxMessageSize: int64(envInt("WS_MAX_MESSAGE_BYTES", int(defaultMaxMessageSize(canvas, maxBatchBodyBytes)))),
+	}
+	if err := clientConfig.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid WebSocket settings: %w", err)
+	}
+
+	// BROADCAST_POLICY decides what happens when the broadcast channel is full
+	broadcastPolicy, err := ParseBroadcastPolicy(envString("BROADCAST_POLICY", string(broadcastBlock)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid broadcast settings: %w", err)
+	}
+
+	// New clients get their snapshot from the canvas cache, the same
+	// composited canvas /api/canvas serves, so connecting never scans the
+	// database on the hub goroutine. Without the cache it has to be read
+	// from the database, with the writer's unsaved pixels on top.
+	snapshot := withUnsaved(writer, db.GetAllPixels, func() ([]PixelUpdate, error) {
+		return db.GetLayerPixels(LayerOverlay)
+	})
+	if canvasCache != nil {
+		snapshot = func() ([]PixelUpdate, error) { return canvasCache.Pixels(), nil }
+	}
+
+	hub := NewHub(queue, HubConfig{
+		AckWindow:       envInt("WS_ACK_WINDOW", 16),
+		BroadcastBuffer: envInt("BROADCAST_BUFFER", 256),
+		BroadcastPolicy: broadcastPolicy,
+		ReapAfter:       envDuration("WS_REAP_AFTER", 0),
+		Snapshot:        snapshot,
+		Cursor:          db.LastSeq,
+		Resume:          resumeChanges(db, writer, canvasCache, canvas.Background),
+		Coalesce:        coalesce,
+		MaxClients:      envInt("WS_MAX_CLIENTS", 0),
+		ChunkSize:       canvas.ChunkSize,
+		SendBuffer:      envInt("WS_SEND_BUFFER", defaultSendBuffer),
+		SlowGrace:       envDuration("WS_SLOW_GRACE", 2*time.Second),
+		SlowStrikes:     envInt("WS_SLOW_STRIKES", 3),
+		BatchSize:       batchSize,
+		BatchInterval:   batchInterval,
+		Client:          clientConfig,
+	})
+
+	// Start the hub in separate goroutines (concurrent execution)
+	// This allows the hub to handle broadcasting while the server handles requests
+	hub.Start()
+
+	// Create HTTP server with our handlers
+	// Live stats are pushed to /ws/stats clients every STATS_STREAM_INTERVAL,
+	// to at most WS_STATS_MAX_CLIENTS of them (0 = no limit)
+	server, err := NewServer(queue, rateLimiter, hub, db, options.liveConfig, serverOptions{
+		ipLimiter:          ipLimiter,
+		globalLimit:        globalLimit,
+		quota:              quota,
+		adminToken:         os.Getenv("ADMIN_TOKEN"),
+		tokens:             options.tokens,
+		canvas:             canvas,
+		bodyFormats:        parseBodyFormats(envString("PIXEL_BODY_FORMATS", "json,form")),
+		maxBodyBytes:       int64(maxBodyBytes),
+		maxBatchBodyBytes:  int64(maxBatchBodyBytes),
+		strictJSON:         envBool("STRICT_JSON", false),
+		thumbnailMode:      thumbnailMode,
+		pngCacheTTL:        envDuration("CANVAS_PNG_TTL", 5*time.Second),
+		statsCacheTTL:      envDuration("STATS_CACHE_TTL", 5*time.Second),
+		backups:            options.backups,
+		areaGuard:          NewAreaGuard(db, canvas, envInt("MAX_CONTIGUOUS_AREA", 0), envInt("CONTIGUOUS_SEARCH_RADIUS", 32)),
+		wsPlacement:        envBool("WS_PLACEMENT", false),
+		batchPlacement:     envBool("BATCH_PLACEMENT", false),
+		maxBatchSize:       maxBatchSize,
+		trustProxy:         envBool("TRUST_PROXY", false),
+		wsCompression:      envBool("WS_COMPRESSION", true),
+		timelapseMaxFrames: envInt("TIMELAPSE_MAX_FRAMES", defaultTimelapseMaxFrames),
+		dbBreaker:          dbBreaker,
+		writer:             writer,
+		pruner:             pruner,
+		persistence:        persistence,
+		shedWhenDegraded:   envBool("DB_BREAKER_SHED", false),
+		undos:              NewUndoTracker(envDuration("UNDO_WINDOW", 0)),
+		statsInterval:      envDuration("STATS_STREAM_INTERVAL", time.Second),
+		statsMaxClients:    envInt("WS_STATS_MAX_CLIENTS", 100),
+		webhooks:           options.webhooks,
+		shadowBans:         shadowBans,
+		canvasCache:        canvasCache,
+		serviceAccounts:    serviceAccounts,
+		drain:              options.drain,
+	})
+	if err != nil {
+		return nil, err
+	}
+	options.drain.track(server)
+	superviseGo("statsStream", server.statsStream.Run)
+
+	return &Room{name: name, server: server}, nil
+}
+
+// Stop shuts the room down like main does for the main canvas: its
+// WebSocket clients get the pixels still queued, and the writer saves what
+// it has before the database is closed
+func (room *Room) Stop(ctx context.Context) {
+	server := room.server
+	if err := server.hub.Stop(ctx); err != nil {
+		slog.Warn("WebSocket hub shutdown", "canvas", room.name, "err", err)
+	}
+	server.statsStream.Stop()
+	if err := server.writer.Stop(ctx); err != nil {
+		slog.Warn("Pixel writer shutdown", "canvas", room.name, "err", err)
+	}
+	if err := server.db.Close(); err != nil {
+		slog.Warn("Database close", "canvas", room.name, "err", err)
+	}
+}
+
+// canvasNamePattern is what a canvas name may look like
+// Names end up in URLs, environment variable names and file names.
+var canvasNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,31}$`)
+
+// roomSlot holds a listed canvas and, once it was requested, its room
+type roomSlot struct {
+	databaseURL string
+	canvas      CanvasConfig
+
+	mu   sync.Mutex // Held while the room is created
+	room atomic.Pointer[Room]
+}
+
+// CanvasManager serves the rooms next to the main canvas
+// It is the server's top handler: requests for /api/<name>/... and
+// /ws/<name>/... of a listed canvas go to that room, everything else to the
+// main canvas's routes.
+type CanvasManager struct {
+	main    http.Handler
+	slots   map[string]*roomSlot // One per listed canvas; never changes after NewCanvasManager
+	options roomOptions
+	retries RetryPolicy
+}
+
+// NewCanvasManager checks the listed canvas names and works out where their
+// databases are and how large they are
+// mainDatabase is the main canvas's DATABASE_URL or path. reserved holds the
+// first path segments of the main canvas's routes ("pixel" for
+// /api/pixel/history), which would be ambiguous as canvas names.
+func NewCanvasManager(names []string, mainDatabase string, canvas CanvasConfig, retries RetryPolicy, options roomOptions, main http.Handler, reserved map[string]bool) (*CanvasManager, error) {
+	m := &CanvasManager{
+		main:    main,
+		slots:   make(map[string]*roomSlot, len(names)),
+		options: options,
+		retries: retries,
+	}
+
+	for _, name := range names {
+		if !canvasNamePattern.MatchString(name) {
+			return nil, fmt.Errorf("invalid canvas name %q (use up to 32 lowercase letters, digits, - and _)", name)
+		}
+		if reserved[name] {
+			return nil, fmt.Errorf("canvas name %q is already used by an endpoint", name)
+		}
+		if m.slots[name] != nil {
+			return nil, fmt.Errorf("canvas %q is listed twice", name)
+		}
+
+		prefix := "CANVAS_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+		databaseURL, err := roomDatabase(mainDatabase, name, envString(prefix+"DATABASE_URL", ""))
+		if err != nil {
+			return nil, err
+		}
+
+		roomCanvas := canvas
+		roomCanvas.Width = envInt(prefix+"WIDTH", canvas.Width)
+		roomCanvas.Height = envInt(prefix+"HEIGHT", canvas.Height)
+		if err := roomCanvas.Validate(); err != nil {
+			return nil, fmt.Errorf("canvas %q: %w", name, err)
+		}
+
+		m.slots[name] = &roomSlot{databaseURL: databaseURL, canvas: roomCanvas}
+	}
+	return m, nil
+}
+
+// roomDatabase returns where the room called name keeps its canvas
+// Without a database of its own, a room on SQLite gets a file next to the
+// main one; PostgreSQL rooms must be given one.
+func roomDatabase(mainDatabase, name, own string) (string, error) {
+	if own != "" {
+		return own, nil
+	}
+
+	scheme, path, found := strings.Cut(mainDatabase, "://")
+	if !found {
+		scheme, path = "", mainDatabase
+	}
+	if scheme != "" && scheme != "sqlite" && scheme != "sqlite3" {
+		return "", fmt.Errorf("canvas %q needs CANVAS_%s_DATABASE_URL when the main canvas isn't on SQLite",
+			name, strings.ToUpper(strings.ReplaceAll(name, "-", "_")))
+	}
+
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "-" + name + ext, nil
+}
+
+// Names returns the listed canvases
+func (m *CanvasManager) Names() []string {
+	names := make([]string, 0, len(m.slots))
+	for name := range m.slots {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ServeHTTP sends a request to the room it names, or to the main canvas
+func (m *CanvasManager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	for _, prefix := range []string{"/api/", "/ws/"} {
+		rest, ok := strings.CutPrefix(r.URL.Path, prefix)
+		if !ok {
+			continue
+		}
+		name, path, _ := strings.Cut(rest, "/")
+		slot := m.slots[name]
+		if slot == nil {
+			break
+		}
+
+		room, err := m.room(name, slot)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Failed to open canvas", "canvas", name, "err", err)
+			writeError(w, http.StatusServiceUnavailable, codeUnavailable, "The canvas is not available right now")
+			return
+		}
+
+		// The room's routes are the main canvas's, so /api/event1/pixel
+		// becomes /api/pixel for it
+		inner := new(http.Request)
+		*inner = *r
+		inner.URL = new(url.URL)
+		*inner.URL = *r.URL
+		inner.URL.Path = prefix + path
+		inner.URL.RawPath = ""
+		room.server.ServeHTTP(w, inner)
+		return
+	}
+
+	m.main.ServeHTTP(w, r)
+}
+
+// room returns the room of a listed canvas, creating it on first use
+// A room that fails to open is tried again by the next request.
+func (m *CanvasManager) room(name string, slot *roomSlot) (*Room, error) {
+	if room := slot.room.Load(); room != nil {
+		return room, nil
+	}
+
+	// Only requests for this canvas wait while it opens
+	slot.mu.Lock()
+	defer slot.mu.Unlock()
+	if room := slot.room.Load(); room != nil {
+		return room, nil
+	}
+
+	db, err := OpenDatabase(slot.databaseURL)
+	if err != nil {
+		return nil, err
+	}
+	db.SetRetryPolicy(m.retries)
+
+	room, err := newRoom(name, db, slot.canvas, m.options)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	slot.room.Store(room)
+
+	slog.Info("Canvas opened", "canvas", name, "width", slot.canvas.Width, "height", slot.canvas.Height)
+	return room, nil
+}
+
+// SetCooldown changes the cooldown of every room that was opened (rooms
+// opened later read it from the config)
+func (m *CanvasManager) SetCooldown(cooldown time.Duration) {
+	for _, slot := range m.slots {
+		if room := slot.room.Load(); room != nil {
+			room.server.rateLimiter.SetCooldown(cooldown)
+		}
+	}
+}
+
+// Stop shuts down every room that was opened
+// Call it after the HTTP server has stopped, so no room is opened meanwhile.
+func (m *CanvasManager) Stop(ctx context.Context) {
+	for _, slot := range m.slots {
+		if room := slot.room.Load(); room != nil {
+			room.Stop(ctx)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import "net/http"
+
+// routes registers the canvas endpoints of s on a new mux
+// It also returns the endpoints (method, path, description) for the startup
+// log. NewServer calls it, so every room gets the same routes (see
+// rooms.go); main adds the health checks and /metrics to the main canvas's
+// mux. Either way the mux is served through withPreflight, which answers
+// CORS preflights (see cors.go).
+func (s *Server) routes() (*http.ServeMux, [][3]string) {
+	// Register HTTP endpoints
+	// Each pattern declares its method, so the router answers requests with
+	// the wrong method with 405 (and an Allow header) and unknown paths with 404
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/pixel", s.handlePixelUpdate)
+	mux.HandleFunc("GET /api/pixel", s.handleGetPixel)
+	mux.HandleFunc("GET /api/pixel/history", s.handlePixelHistory)
+	mux.HandleFunc("GET /api/cooldown", s.handleCooldown)
+	mux.HandleFunc("GET /api/canvas", withCompression(s.handleGetCanvas))
+	mux.HandleFunc("GET /api/canvas/at", withCompression(s.handleGetCanvasAt))
+	mux.HandleFunc("GET /api/canvas/diff", withCompression(s.handleCanvasDiff))
+	mux.HandleFunc("GET /api/canvas/checksum", s.handleCanvasChecksum)
+	mux.HandleFunc("GET /api/canvas.png", s.handleCanvasPNG)
+	mux.HandleFunc("GET /api/canvas/region", withCompression(s.handleGetCanvasRegion))
+	mux.HandleFunc("GET /api/canvas/thumbnail", s.handleThumbnail)
+	mux.HandleFunc("GET /api/chunk/{cx}/{cy}", withCompression(s.handleGetChunk))
+	mux.HandleFunc("GET /api/timelapse", s.handleTimelapse)
+	mux.HandleFunc("GET /api/stats", withCompression(s.handleStats))
+	mux.HandleFunc("GET /api/stats/colors", withCompression(s.handleColorStats))
+	mux.HandleFunc("GET /api/region/owners", withCompression(s.handleRegionOwners))
+	mux.HandleFunc("GET /api/leaderboard", s.handleLeaderboard)
+	mux.HandleFunc("GET /api/config", s.handleConfig)
+	mux.HandleFunc("GET /api/palette", s.handlePalette)
+	mux.HandleFunc("GET /api/teams", s.handleTeams)
+	mux.HandleFunc("GET /ws/queue", s.handleWebSocket)
+	mux.HandleFunc("GET /ws/stats", s.handleStatsWebSocket)
+
+	// CORS preflight requests are answered for every route by withPreflight
+	// (see cors.go); this one adds the body types /api/pixel accepts
+	mux.HandleFunc("OPTIONS /api/pixel", s.handlePixelPreflight)
+
+	// Optional endpoints are only registered when enabled
+	if s.batchPlacement {
+		mux.HandleFunc("POST /api/pixels/batch", s.handlePixelBatch)
+	}
+	if s.undos != nil {
+		mux.HandleFunc("POST /api/pixel/undo", s.handleUndo)
+	}
+
+	// Admin endpoints are only exposed when an admin token is configured
+	if s.adminToken != "" {
+		mux.HandleFunc("POST /api/admin/clear", s.requireAdmin(s.handleClearCanvas))
+		mux.HandleFunc("POST /api/admin/overlay", s.requireAdmin(s.handleOverlayPlace))
+		mux.HandleFunc("DELETE /api/admin/overlay/{x}/{y}", s.requireAdmin(s.handleOverlayRemove))
+		mux.HandleFunc("GET /api/admin/export-state", s.requireAdmin(s.handleExportState))
+		mux.HandleFunc("POST /api/admin/import-state", s.requireAdmin(s.handleImportState))
+		mux.HandleFunc("POST /api/admin/vacuum", s.requireAdmin(s.handleVacuum))
+		mux.HandleFunc("POST /api/admin/prune", s.requireAdmin(s.handlePrune))
+		mux.HandleFunc("GET /api/admin/clients", s.requireAdmin(s.handleAdminClients))
+		mux.HandleFunc("GET /api/admin/shadowbans", s.requireAdmin(s.handleShadowBanList))
+		mux.HandleFunc("POST /api/admin/shadowbans", s.requireAdmin(s.handleShadowBanAdd))
+		mux.HandleFunc("DELETE /api/admin/shadowbans/{userId}", s.requireAdmin(s.handleShadowBanRemove))
+	}
+
+	// The endpoints for the startup log (method, path, description)
+	endpoints := [][3]string{
+		{"POST", "/api/pixel", "Submit pixel updates"},
+		{"GET", "/api/pixel", "Current pixel at one coordinate"},
+		{"GET", "/api/pixel/history", "Placements at one coordinate"},
+		{"GET", "/api/cooldown", "Time until a user may place again"},
+		{"GET", "/api/canvas", "Get full canvas state"},
+		{"GET", "/api/canvas/at", "Canvas as it was at a timestamp"},
+		{"GET", "/api/canvas/diff", "Pixels changed since a timestamp"},
+		{"GET", "/api/canvas/checksum", "Hash of the visible canvas, to detect missed updates"},
+		{"GET", "/api/canvas.png", "Full canvas as a PNG image"},
+		{"GET", "/api/canvas/region", "Pixels inside a rectangle"},
+		{"GET", "/api/canvas/thumbnail", "Downscaled PNG preview"},
+		{"GET", "/api/chunk/{cx}/{cy}", "Pixels of one chunk"},
+		{"GET", "/api/timelapse", "ZIP of PNG frames replaying the history"},
+		{"GET", "/api/stats", "Canvas analytics (totals, users, top color, last hour)"},
+		{"GET", "/api/stats/colors", "Pixel count per color"},
+		{"GET", "/api/region/owners", "Pixel count per user in a region"},
+		{"GET", "/api/leaderboard", "Top users by pixels placed"},
+		{"GET", "/api/config", "Canvas size"},
+		{"GET", "/api/palette", "Allowed colors"},
+		{"GET", "/api/teams", "Teams and their pixel counts"},
+		{"WS", "/ws/queue", "WebSocket for consumers"},
+		{"WS", "/ws/stats", "Live stats, pushed every second"},
+	}
+	if s.batchPlacement {
+		endpoints = append(endpoints, [3]string{"POST", "/api/pixels/batch", "Place several pixels for one user"})
+	}
+	if s.undos != nil {
+		endpoints = append(endpoints, [3]string{"POST", "/api/pixel/undo", "Undo the user's most recent placement"})
+	}
+	if s.adminToken != "" {
+		endpoints = append(endpoints, [][3]string{
+			{"POST", "/api/admin/clear", "Clear the canvas (admin)"},
+			{"POST", "/api/admin/overlay", "Place an overlay pixel (admin)"},
+			{"DELETE", "/api/admin/overlay/{x}/{y}", "Remove an overlay pixel (admin)"},
+			{"GET", "/api/admin/export-state", "Export runtime state (admin)"},
+			{"POST", "/api/admin/import-state", "Import runtime state (admin)"},
+			{"POST", "/api/admin/vacuum", "Reclaim free space in the database (admin)"},
+			{"POST", "/api/admin/prune", "Delete history outside the retention policy (admin)"},
+			{"GET", "/api/admin/clients", "List connected WebSocket clients (admin)"},
+			{"GET", "/api/admin/shadowbans", "List shadow-banned users (admin)"},
+			{"POST", "/api/admin/shadowbans", "Shadow-ban a user (admin)"},
+			{"DELETE", "/api/admin/shadowbans/{userId}", "Lift a shadow ban (admin)"},
+		}...)
+	}
+
+	return mux, endpoints
+}
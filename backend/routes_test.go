@@ -0,0 +1,162 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// request sends a request with an empty body and returns the response
+func request(t *testing.T, method, url string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatalf("building request: %v", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, url, err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestWrongMethodIs405(t *testing.T) {
+	ts := startTestServer(t, newTestRoom(t, nil))
+
+	tests := []struct {
+		method, path string
+		allow        []string // Methods the Allow header must list
+	}{
+		{http.MethodDelete, "/api/pixel", []string{"GET", "POST"}},
+		{http.MethodPut, "/api/canvas", []string{"GET"}},
+		{http.MethodPost, "/api/stats", []string{"GET"}},
+		{http.MethodPost, "/api/chunk/0/0", []string{"GET"}},
+	}
+	for _, test := range tests {
+		resp := request(t, test.method, ts.URL+test.path)
+		if resp.StatusCode != http.StatusMethodNotAllowed {
+			t.Errorf("%s %s: status %d, want 405", test.method, test.path, resp.StatusCode)
+			continue
+		}
+		allow := resp.Header.Get("Allow")
+		for _, method := range test.allow {
+			if !strings.Contains(allow, method) {
+				t.Errorf("%s %s: Allow %q is missing %s", test.method, test.path, allow, method)
+			}
+		}
+	}
+}
+
+func TestUnknownPathIs404(t *testing.T) {
+	ts := startTestServer(t, newTestRoom(t, nil))
+
+	// Admin routes don't exist without ADMIN_TOKEN, nor batch placement
+	// without BATCH_PLACEMENT
+	for _, path := range []string{"/api/nope", "/api/pixel/1/2/3", "/api/chunk/0", "/api/admin/clear", "/api/pixels/batch"} {
+		for _, method := range []string{http.MethodGet, http.MethodPost} {
+			if resp := request(t, method, ts.URL+path); resp.StatusCode != http.StatusNotFound {
+				t.Errorf("%s %s: status %d, want 404", method, path, resp.StatusCode)
+			}
+		}
+	}
+}
+
+func TestPathValues(t *testing.T) {
+	ts := startTestServer(t, newTestRoom(t, nil))
+
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{"/api/chunk/0/0", http.StatusOK},
+		{"/api/chunk/x/0", http.StatusBadRequest},
+		{"/api/chunk/9999/0", http.StatusNotFound},
+	}
+	for _, test := range tests {
+		if resp := request(t, http.MethodGet, ts.URL+test.path); resp.StatusCode != test.status {
+			t.Errorf("GET %s: status %d, want %d", test.path, resp.StatusCode, test.status)
+		}
+	}
+}
+
+func TestOptionsPreflight(t *testing.T) {
+	ts := startTestServer(t, newTestRoom(t, nil))
+
+	tests := []struct {
+		path       string
+		allow      []string // Methods the Allow header must list
+		disallowed []string // and must not
+	}{
+		{"/api/pixel", []string{"GET", "POST", "OPTIONS"}, []string{"DELETE", "PUT"}},
+		{"/api/canvas", []string{"GET", "OPTIONS"}, []string{"POST", "DELETE", "PUT"}},
+	}
+	for _, test := range tests {
+		// What a browser sends before a cross-origin request
+		req, _ := http.NewRequest(http.MethodOptions, ts.URL+test.path, nil)
+		req.Header.Set("Origin", "https://example.com")
+		req.Header.Set("Access-Control-Request-Method", "GET")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("OPTIONS %s: %v", test.path, err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+			t.Errorf("OPTIONS %s: status %d, want 200 or 204", test.path, resp.StatusCode)
+			continue
+		}
+		allow := resp.Header.Get("Allow")
+		for _, method := range test.allow {
+			if !strings.Contains(allow, method) {
+				t.Errorf("OPTIONS %s: Allow %q is missing %s", test.path, allow, method)
+			}
+		}
+		for _, method := range test.disallowed {
+			if strings.Contains(allow, method) {
+				t.Errorf("OPTIONS %s: Allow %q lists %s", test.path, allow, method)
+			}
+		}
+		if got := resp.Header.Get("Access-Control-Allow-Methods"); got != allow {
+			t.Errorf("OPTIONS %s: Access-Control-Allow-Methods %q, want %q", test.path, got, allow)
+		}
+		if resp.Header.Get("Access-Control-Allow-Origin") == "" {
+			t.Errorf("OPTIONS %s: no Access-Control-Allow-Origin", test.path)
+		}
+	}
+
+	// /api/pixel's own preflight handler adds the accepted body types
+	if resp := request(t, http.MethodOptions, ts.URL+"/api/pixel"); !strings.Contains(resp.Header.Get("Accept-Post"), "application/json") {
+		t.Errorf("OPTIONS /api/pixel: Accept-Post %q, want JSON listed", resp.Header.Get("Accept-Post"))
+	}
+	// A path without routes has nothing to preflight
+	if resp := request(t, http.MethodOptions, ts.URL+"/api/nope"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("OPTIONS /api/nope: status %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestPixelHistoryLimit(t *testing.T) {
+	ts := startTestServer(t, newTestRoom(t, nil))
+
+	// A limit outside 1..500 is refused rather than quietly capped
+	tests := []struct {
+		limit string
+		want  int
+	}{
+		{"", http.StatusOK},
+		{"1", http.StatusOK},
+		{"500", http.StatusOK},
+		{"0", http.StatusBadRequest},
+		{"501", http.StatusBadRequest},
+		{"lots", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		url := ts.URL + "/api/pixel/history?x=1&y=1"
+		if tt.limit != "" {
+			url += "&limit=" + tt.limit
+		}
+		if resp := request(t, http.MethodGet, url); resp.StatusCode != tt.want {
+			t.Errorf("limit %q: %d, want %d", tt.limit, resp.StatusCode, tt.want)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"log/slog"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+)
+
+// goroutinePanics counts panics recovered by safeGo and superviseGo
+var goroutinePanics atomic.Int64
+
+// restartDelay is how long superviseGo waits before restarting a crashed goroutine
+// This stops a goroutine that panics immediately from spinning the CPU
+const restartDelay = time.Second
+
+// safeGo runs fn in a new goroutine and recovers if it panics
+// The panic is logged with the goroutine name and a stack trace instead of
+// crashing the whole server
+func safeGo(name string, fn func()) {
+	go func() {
+		runRecovered(name, fn)
+	}()
+}
+
+// superviseGo runs fn in a new goroutine and restarts it whenever it panics
+// Use it for loops the server can't work without (hub, queue processing, ...)
+func superviseGo(name string, fn func()) {
+	go func() {
+		for {
+			if !runRecovered(name, fn) {
+				// fn returned normally - it's done
+				return
+			}
+			slog.Warn("Restarting goroutine", "name", name, "delay", restartDelay)
+			time.Sleep(restartDelay)
+		}
+	}()
+}
+
+// runRecovered calls fn and reports whether it panicked
+func runRecovered(name string, fn func()) (panicked bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			panicked = true
+			goroutinePanics.Add(1)
+			slog.Error("Recovered panic in goroutine", "name", name, "panic", r, "stack", string(debug.Stack()))
+		}
+	}()
+
+	fn()
+	return false
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lockedBuffer is a bytes.Buffer that can be written from several goroutines
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// captureLogs sends the default logger to a buffer until the test ends
+func captureLogs(t *testing.T) *lockedBuffer {
+	t.Helper()
+	logs := &lockedBuffer{}
+	previous := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(logs, nil)))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+	return logs
+}
+
+func TestSafeGoRecoversPanic(t *testing.T) {
+	logs := captureLogs(t)
+	before := goroutinePanics.Load()
+
+	done := make(chan struct{})
+	safeGo("test-handler", func() {
+		defer close(done)
+		var m map[string]int
+		m["boom"]++ // nil map write
+	})
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the goroutine never finished")
+	}
+	waitFor(t, time.Second, "the panic to be counted", func() bool { return goroutinePanics.Load() == before+1 })
+
+	out := logs.String()
+	if !strings.Contains(out, "name=test-handler") || !strings.Contains(out, "assignment to entry in nil map") {
+		t.Fatalf("panic not logged with its goroutine name and cause:\n%s", out)
+	}
+	if !strings.Contains(out, "safego_test.go") {
+		t.Fatalf("panic logged without a stack trace:\n%s", out)
+	}
+}
+
+func TestSuperviseGoRestartsAfterPanic(t *testing.T) {
+	captureLogs(t)
+	before := goroutinePanics.Load()
+
+	var mu sync.Mutex
+	runs := 0
+	finished := make(chan struct{})
+	superviseGo("test-loop", func() {
+		mu.Lock()
+		runs++
+		first := runs == 1
+		mu.Unlock()
+		if first {
+			panic("first run fails")
+		}
+		close(finished)
+	})
+
+	// The second run starts after restartDelay and returns normally
+	select {
+	case <-finished:
+	case <-time.After(restartDelay + 2*time.Second):
+		t.Fatal("the goroutine was not restarted")
+	}
+	if got := goroutinePanics.Load() - before; got != 1 {
+		t.Fatalf("%d panics counted, want 1", got)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"log/slog"
+	"os"
+)
+
+// Canvas seed
+//
+// For an event the canvas can start out with a picture on it, such as a faint
+// template to paint over. SEED_IMAGE names a PNG that is drawn onto the
+// canvas at startup, but only when the canvas is empty, so a restart never
+// paints over what people placed.
+//
+// Every pixel of the image that isn't fully transparent becomes a #RRGGBB
+// pixel owned by SEED_USER_ID. A translucent pixel is blended over the canvas
+// background first, which makes a half-transparent image come out as a faint
+// version of itself. Fully transparent pixels are left empty.
+//
+// SEED_IMAGE_FIT decides what happens when the image isn't the size of the
+// canvas:
+//
+//   - clip (default): the image is drawn at 0,0 one pixel per pixel and what
+//     sticks out is cut off
+//   - scale: the image is resized (nearest neighbour, keeping its aspect
+//     ratio) to the largest size that fits the canvas
+//
+// Seeded pixels go into canvas_state and the history like placements, but
+// don't count towards the leaderboard.
+
+// Ways to fit the seed image to the canvas
+const (
+	seedFitClip  = "clip"
+	seedFitScale = "scale"
+)
+
+// seedBatchSize is how many seeded pixels are written per transaction
+const seedBatchSize = 5000
+
+// seedPixels turns the image into pixels for the canvas, fitted with fit
+func seedPixels(img image.Image, canvas CanvasConfig, fit, userID string) []PixelUpdate {
+	background, err := parseHexColor(canvas.Background)
+	if err != nil {
+		background = backgroundColor
+	}
+
+	bounds := img.Bounds()
+	width, height := min(bounds.Dx(), canvas.Width), min(bounds.Dy(), canvas.Height)
+	if fit == seedFitScale {
+		// The largest size with the image's aspect ratio that fits; both
+		// sides are rounded down, so it never sticks out
+		if bounds.Dx()*canvas.Height > bounds.Dy()*canvas.Width {
+			width, height = canvas.Width, bounds.Dy()*canvas.Width/bounds.Dx()
+		} else {
+			width, height = bounds.Dx()*canvas.Height/bounds.Dy(), canvas.Height
+		}
+	}
+
+	timestamp := currentTimeMillis()
+	var pixels []PixelUpdate
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			// Nearest neighbour: the source pixel this canvas pixel falls in
+			sx, sy := x, y
+			if fit == seedFitScale {
+				sx, sy = x*bounds.Dx()/width, y*bounds.Dy()/height
+			}
+
+			c := color.RGBAModel.Convert(img.At(bounds.Min.X+sx, bounds.Min.Y+sy)).(color.RGBA)
+			if c.A == 0 {
+				continue
+			}
+			c = blendOver(background, c)
+			pixels = append(pixels, PixelUpdate{
+				X:         x,
+				Y:         y,
+				Color:     fmt.Sprintf("#%02X%02X%02X", c.R, c.G, c.B),
+				UserID:    userID,
+				Timestamp: timestamp,
+			})
+		}
+	}
+	return pixels
+}
+
+// seedCanvas draws the PNG at path onto the canvas if it is empty
+func seedCanvas(db *Database, canvas CanvasConfig, path, fit, userID string) error {
+	if fit != seedFitClip && fit != seedFitScale {
+		return fmt.Errorf("unknown seed image fit %q (use %s or %s)", fit, seedFitClip, seedFitScale)
+	}
+
+	count, err := db.GetPixelCount()
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		slog.Info("Canvas already has pixels, not seeding it", "pixels", count, "path", path)
+		return nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	img, err := png.Decode(file)
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", path, err)
+	}
+
+	pixels := seedPixels(img, canvas, fit, userID)
+	if err := db.SeedPixels(pixels); err != nil {
+		return err
+	}
+
+	bounds := img.Bounds()
+	slog.Info("Canvas seeded from image",
+		"pixels", len(pixels),
+		"path", path,
+		"imageWidth", bounds.Dx(),
+		"imageHeight", bounds.Dy(),
+		"fit", fit,
+	)
+	return nil
+}
+
+// SeedPixels writes base-layer pixels to canvas_state and the history,
+// seedBatchSize per transaction
+// Unlike SavePixelBatch it leaves the leaderboard alone, so the seed user
+// doesn't top it with the whole picture.
+func (d *Database) SeedPixels(pixels []PixelUpdate) error {
+	for start := 0; start < len(pixels); start += seedBatchSize {
+		batch := pixels[start:min(start+seedBatchSize, len(pixels))]
+
+		// Numbers are assigned once, so a retried batch keeps them
+		seqs := make([]int64, len(batch))
+		for i, pixel := range batch {
+			seqs[i] = d.assignSeq(pixel.Seq)
+		}
+
+		if err := d.withRetry(func() error { return d.seedPixels(batch, seqs) }); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// seedPixels is one attempt at writing a batch of SeedPixels
+func (d *Database) seedPixels(pixels []PixelUpdate, seqs []int64) error {
+	d.maintenance.RLock()
+	defer d.maintenance.RUnlock()
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	insertHistory, err := tx.Prepare(d.rebind(insertHistorySQL))
+	if err != nil {
+		return err
+	}
+	defer insertHistory.Close()
+
+	upsertPixel, err := tx.Prepare(d.rebind(upsertPixelSQL))
+	if err != nil {
+		return err
+	}
+	defer upsertPixel.Close()
+
+	for i, pixel := range pixels {
+		if _, err := insertHistory.Exec(pixel.X, pixel.Y, LayerBase, pixel.Color, pixel.UserID, pixel.Timestamp, seqs[i]); err != nil {
+			return err
+		}
+		if _, err := upsertPixel.Exec(pixel.X, pixel.Y, LayerBase, pixel.Color, pixel.UserID, pixel.Timestamp, seqs[i]); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	d.version.Add(1)
+	return nil
+}
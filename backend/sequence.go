@@ -0,0 +1,144 @@
+package main
+
+import (
+	"log/slog"
+)
+
+// Placement sequence numbers
+//
+// Timestamps come from the wall clock, which can jump backwards (an NTP
+// correction, a VM migration), so "the newest updated_at wins" could let an
+// older placement overwrite a newer one. Every write is therefore also given
+// a sequence number from a counter that only ever goes up. The number is
+// stored with the pixel (canvas_state.seq) and its history entry
+// (pixel_history.seq), and decides which placement wins, the order of the
+// canvas and the order history is replayed in. Timestamps are still stored,
+// but only as information.
+//
+// Placements get their number when they are accepted, before they are queued,
+// so the order they are broadcast in and the order they are stored in agree.
+// The counter starts from the highest stored number, so it keeps going up
+// across restarts.
+
+// NextSeq returns a new sequence number, higher than every one handed out
+// or stored before
+func (d *Database) NextSeq() int64 {
+	return d.seq.Add(1)
+}
+
+// LastSeq returns the newest sequence number handed out or stored
+func (d *Database) LastSeq() int64 {
+	return d.seq.Load()
+}
+
+// observeSeq raises the counter to at least seq, so entries written with a
+// number of their own (a history replay) are never overtaken by older ones
+func (d *Database) observeSeq(seq int64) {
+	for {
+		current := d.seq.Load()
+		if seq <= current || d.seq.CompareAndSwap(current, seq) {
+			return
+		}
+	}
+}
+
+// assignSeq returns seq, or a new sequence number when it is 0 (unassigned)
+func (d *Database) assignSeq(seq int64) int64 {
+	if seq == 0 {
+		return d.NextSeq()
+	}
+	d.observeSeq(seq)
+	return seq
+}
+
+// initSequence adds the seq columns to databases from before sequence
+// numbers, creates their indexes and seeds the counter
+func (d *Database) initSequence() error {
+	if err := d.migrateSequence(); err != nil {
+		return err
+	}
+
+	_, err := d.db.Exec(`
+	CREATE INDEX IF NOT EXISTS idx_canvas_state_seq ON canvas_state(seq);
+	CREATE INDEX IF NOT EXISTS idx_history_seq ON pixel_history(seq);
+	`)
+	if err != nil {
+		return err
+	}
+
+	var highest int64
+	if err := d.db.QueryRow(`SELECT COALESCE(MAX(seq), 0) FROM pixel_history`).Scan(&highest); err != nil {
+		return err
+	}
+	d.seq.Store(highest)
+	return nil
+}
+
+// migrateSequence adds the seq columns if they are missing
+// Existing history is numbered in its old (placed_at, id) order, and each
+// stored pixel takes the number of the last history entry at its coordinate
+// and layer, so nothing changes order or owner.
+func (d *Database) migrateSequence() error {
+	historyMissing, err := d.columnMissing("pixel_history", "seq")
+	if err != nil {
+		return err
+	}
+	canvasMissing, err := d.columnMissing("canvas_state", "seq")
+	if err != nil {
+		return err
+	}
+	if !historyMissing && !canvasMissing {
+		return nil
+	}
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var migration []string
+	if historyMissing {
+		migration = append(migration,
+			`ALTER TABLE pixel_history ADD COLUMN seq BIGINT NOT NULL DEFAULT 0`,
+			`UPDATE pixel_history SET seq = ranked.n
+			FROM (SELECT id, ROW_NUMBER() OVER (ORDER BY placed_at, id) AS n FROM pixel_history) AS ranked
+			WHERE pixel_history.id = ranked.id`,
+		)
+	}
+	if canvasMissing {
+		migration = append(migration,
+			`ALTER TABLE canvas_state ADD COLUMN seq BIGINT NOT NULL DEFAULT 0`,
+			`UPDATE canvas_state SET seq = COALESCE((
+				SELECT MAX(h.seq) FROM pixel_history h
+				WHERE h.x = canvas_state.x AND h.y = canvas_state.y AND h.layer = canvas_state.layer
+			), 0)`,
+		)
+	}
+	for _, statement := range migration {
+		if _, err := tx.Exec(statement); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	slog.Info("Added placement sequence numbers to the database")
+	return nil
+}
+
+// columnMissing returns true if table has no column with the given name
+func (d *Database) columnMissing(table, column string) (bool, error) {
+	query := `SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?`
+	if d.dialect == dialectPostgres {
+		query = `SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = ? AND column_name = ?`
+	}
+
+	var count int
+	if err := d.db.QueryRow(d.rebind(query), table, column).Scan(&count); err != nil {
+		return false, err
+	}
+	return count == 0, nil
+}
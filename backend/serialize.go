@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+	"sync"
+)
+
+// One SQLite writer
+//
+// SQLite allows a single writer at a time. When several goroutines write at
+// once (the background PixelWriter, conditional placements, undo, overlay
+// changes, a clear) they queue up on the database lock inside SQLite, each
+// waiting out its busy timeout, and under load some give up with "database
+// is locked".
+//
+// To avoid that, every write goes through one goroutine. A write hands its
+// transaction to the goroutine over a channel, with a channel for the result,
+// and waits for it to finish. SQLite therefore only ever sees one writer, and
+// writes take their turn in the order they arrive instead of racing for the
+// lock. Reads don't go through the goroutine and keep running concurrently
+// (WAL mode lets them read while a write is in progress).
+//
+// Each attempt runs on the goroutine whole, including its hold of
+// Database.maintenance, so a vacuum (which also runs there) never waits for a
+// write that is waiting for it. Retries of busy errors (see retry.go) sleep on
+// the caller's goroutine, not the writer's.
+//
+// PostgreSQL handles concurrent writers with row locks, so there writes run
+// on the caller's goroutine as before. The schema setup in NewDatabase runs
+// before the goroutine starts, when nothing else uses the database yet.
+
+// errDatabaseClosed is returned for writes made after Close
+var errDatabaseClosed = errors.New("database is closed")
+
+// writeRequest is one write waiting for the writer goroutine
+// The result is sent on done, which has room for it.
+type writeRequest struct {
+	write func() error
+	done  chan error
+}
+
+// writeQueue feeds the writer goroutine of a SQLite database
+type writeQueue struct {
+	requests  chan writeRequest
+	closing   chan struct{}
+	closeOnce sync.Once
+}
+
+// startWriter starts the goroutine that runs every write
+func (d *Database) startWriter() {
+	d.writes = &writeQueue{
+		requests: make(chan writeRequest),
+		closing:  make(chan struct{}),
+	}
+	go d.runWrites()
+}
+
+// runWrites runs the queued writes one at a time until the database is closed
+func (d *Database) runWrites() {
+	for {
+		select {
+		case req := <-d.writes.requests:
+			req.done <- runWrite(req.write)
+		case <-d.writes.closing:
+			return
+		}
+	}
+}
+
+// runWrite runs one write and turns a panic into an error
+// The writer goroutine must survive a bad write, and the caller waiting for
+// the result must get one.
+func runWrite(write func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			goroutinePanics.Add(1)
+			slog.Error("Recovered panic in database write", "panic", r, "stack", string(debug.Stack()))
+			err = fmt.Errorf("database write panicked: %v", r)
+		}
+	}()
+	return write()
+}
+
+// serialize runs write on the writer goroutine and waits for its result
+// write must be a whole transaction. Without a writer goroutine (PostgreSQL)
+// it runs on the calling goroutine.
+func (d *Database) serialize(write func() error) error {
+	if d.writes == nil {
+		return write()
+	}
+
+	req := writeRequest{write: write, done: make(chan error, 1)}
+	select {
+	case d.writes.requests <- req:
+		return <-req.done
+	case <-d.writes.closing:
+		return errDatabaseClosed
+	}
+}
+
+// stopWriter ends the writer goroutine; writes made afterwards fail
+func (d *Database) stopWriter() {
+	if d.writes != nil {
+		d.writes.closeOnce.Do(func() { close(d.writes.closing) })
+	}
+}
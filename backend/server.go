@@ -2,183 +2,821 @@ package main
 
 import (
 	"encoding/json"
-	"log"
+	"fmt"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/netip"
 	"regexp"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // Server holds all the dependencies needed to handle HTTP requests
+// Build it with NewServer, which checks that none of the required ones is
+// missing; a nil dependency would otherwise only show up as a panic on the
+// first request that uses it.
 type Server struct {
 	queue       *PixelQueue
 	rateLimiter *RateLimiter
 	hub         *Hub
 	db          *Database
+
+	// config holds the hot-reloadable settings (palette, allowed origins, ...)
+	config *LiveConfig
+
+	// The other dependencies and the settings, as given to NewServer
+	serverOptions
+
+	// mux has the canvas routes (see routes.go) and endpoints describes them
+	// for the startup log; handler serves mux with CORS preflights (see cors.go)
+	mux       *http.ServeMux
+	endpoints [][3]string
+	handler   http.Handler
+
+	// thumbnails caches the most recently rendered thumbnail
+	thumbnails thumbnailCache
+
+	// canvasPNGs caches the full-canvas PNG for pngCacheTTL
+	canvasPNGs canvasPNGCache
+
+	// stats caches the /api/stats result for statsCacheTTL
+	stats statsCache
+
+	// timelapseSlot lets only one /api/timelapse export render at a time
+	timelapseSlot chan struct{}
+
+	// activity counts recent placements for the live stats, which
+	// statsStream pushes to /ws/stats clients (see livestats.go)
+	activity    *PlacementActivity
+	statsStream *StatsStream
+}
+
+// serverOptions holds what NewServer takes besides the core dependencies
+// dbBreaker, writer, pruner and shadowBans are required; for the other
+// dependencies nil turns the feature off.
+type serverOptions struct {
+	ipLimiter   *RateLimiter    // Per-IP cooldown (nil disables it)
+	globalLimit *GlobalLimiter  // Placements per second of the whole server (nil disables it)
+	quota       *PlacementQuota // Pixels per user per window (nil disables it)
+	adminToken  string          // Bearer token for /api/admin endpoints (empty disables them)
+
+	// tokens verifies signed user tokens (nil when AUTH_SECRET is not set and
+	// the userId in the request is trusted)
+	tokens *TokenVerifier
+
+	// canvas is the size of the canvas (fixed at startup)
+	canvas CanvasConfig
+
+	// dbBreaker stops writing to the database while it keeps failing
+	dbBreaker *CircuitBreaker
+
+	// writer saves accepted pixels to the database in batches
+	writer *PixelWriter
+
+	// pruner deletes old history entries (POST /api/admin/prune); its
+	// policy is empty unless HISTORY_RETENTION or HISTORY_MAX_ROWS is set
+	pruner *HistoryPruner
+
+	// persistence is WriteBehind (pixels go to writer) or WriteThrough
+	// (each pixel is saved before the placement is answered)
+	persistence PersistenceMode
+
+	// shedWhenDegraded rejects placements with 503 while the breaker is open
+	// When false, placements are still broadcast but not persisted
+	shedWhenDegraded bool
+
+	// bodyFormats is the set of accepted request body formats for /api/pixel
+	// ("json", "form", "protobuf")
+	bodyFormats map[string]bool
+
+	// maxBodyBytes limits the request body of a single pixel (MAX_BODY_BYTES)
+	// and maxBatchBodyBytes the body of /api/pixels/batch; longer bodies get 413
+	maxBodyBytes      int64
+	maxBatchBodyBytes int64
+
+	// strictJSON rejects JSON bodies with fields the server doesn't know
+	strictJSON bool
+
+	// thumbnailMode is the default downscaling mode ("area" or "nearest")
+	thumbnailMode ThumbnailMode
+
+	// pngCacheTTL is how long the full-canvas PNG is reused and statsCacheTTL
+	// how long the /api/stats result is
+	pngCacheTTL   time.Duration
+	statsCacheTTL time.Duration
+
+	// backups uploads periodic canvas snapshots (nil when disabled)
+	backups *BackupScheduler
+
+	// areaGuard limits how large a contiguous block one user may own
+	// (nil allows any size)
+	areaGuard *AreaGuard
+
+	// wsPlacement lets WebSocket clients place pixels with placeBatch messages
+	wsPlacement bool
+
+	// batchPlacement enables POST /api/pixels/batch
+	batchPlacement bool
+
+	// maxBatchSize is the largest number of pixels accepted in one batch
+	maxBatchSize int
+
+	// wsCompression offers permessage-deflate to WebSocket clients
+	wsCompression bool
+
+	// timelapseMaxFrames caps the frames of one /api/timelapse export
+	timelapseMaxFrames int
+
+	// trustProxy takes the client address from X-Forwarded-For
+	trustProxy bool
+
+	// undos remembers each user's most recent placement for POST
+	// /api/pixel/undo (nil when UNDO_WINDOW is not set)
+	undos *UndoTracker
+
+	// statsInterval is how often live stats are pushed to /ws/stats clients,
+	// and statsMaxClients how many of them may connect (0 = no limit)
+	statsInterval   time.Duration
+	statsMaxClients int
+
+	// webhooks POSTs notable events to WEBHOOK_URL (nil when not set)
+	webhooks *WebhookNotifier
+
+	// drain refuses new connections once POST /api/admin/drain was called
+	// (shared by every room; see drain.go)
+	drain *Drain
+
+	// shadowBans are the users whose placements are quarantined instead of
+	// placed (see shadowban.go)
+	shadowBans *ShadowBans
+
+	// canvasCache keeps the canvas in memory for /api/canvas (nil when
+	// CANVAS_CACHE=false; see canvascache.go)
+	canvasCache *CanvasCache
+
+	// serviceAccounts are the users who skip the public cooldowns (nil when
+	// there are none; see serviceaccount.go)
+	serviceAccounts *ServiceAccounts
+}
+
+// NewServer builds the server of one canvas and registers its routes on a
+// mux of its own
+// It returns an error naming every required dependency that is nil. The
+// live stats stream is created but not started (see StatsStream.Run).
+func NewServer(queue *PixelQueue, rateLimiter *RateLimiter, hub *Hub, db *Database, config *LiveConfig, options serverOptions) (*Server, error) {
+	var missing []string
+	for _, dependency := range []struct {
+		name string
+		nil  bool
+	}{
+		{"queue", queue == nil},
+		{"rate limiter", rateLimiter == nil},
+		{"hub", hub == nil},
+		{"database", db == nil},
+		{"config", config == nil},
+		{"circuit breaker", options.dbBreaker == nil},
+		{"writer", options.writer == nil},
+		{"history pruner", options.pruner == nil},
+		{"shadow bans", options.shadowBans == nil},
+	} {
+		if dependency.nil {
+			missing = append(missing, dependency.name)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("server is missing its %s", strings.Join(missing, ", "))
+	}
+	if options.statsInterval <= 0 {
+		return nil, fmt.Errorf("live stats interval must be positive (got %s)", options.statsInterval)
+	}
+
+	s := &Server{
+		queue:         queue,
+		rateLimiter:   rateLimiter,
+		hub:           hub,
+		db:            db,
+		config:        config,
+		serverOptions: options,
+		timelapseSlot: make(chan struct{}, 1),
+		activity:      NewPlacementActivity(),
+	}
+	s.statsStream = NewStatsStream(s.liveStats, options.statsInterval, options.statsMaxClients)
+
+	s.mux, s.endpoints = s.routes()
+	s.handler = s.withPreflight(s.mux)
+	return s, nil
+}
+
+// ServeHTTP serves the canvas routes, and anything main added to s.mux
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.handler.ServeHTTP(w, r)
 }
 
 // PixelUpdate represents a single pixel change on the canvas
 type PixelUpdate struct {
-	X         int    `json:"x"`         // X coordinate (0-999)
-	Y         int    `json:"y"`         // Y coordinate (0-999)
-	Color     string `json:"color"`     // Hex color (#RRGGBB)
+	X         int    `json:"x"`         // X coordinate (0 to width-1)
+	Y         int    `json:"y"`         // Y coordinate (0 to height-1)
+	Color     string `json:"color"`     // Hex color (#RRGGBB, or #RRGGBBAA with ALPHA_COLORS)
 	UserID    string `json:"userId"`    // User identifier
-	Timestamp int64  `json:"timestamp"` // Unix timestamp in milliseconds
+	Timestamp int64  `json:"timestamp"` // Unix timestamp in milliseconds, set by the server (see timestamps.go)
+
+	// ExpectedColor makes the placement conditional: it is only applied if
+	// the pixel currently has this color (see conditional.go). It is cleared
+	// before the pixel is broadcast.
+	ExpectedColor string `json:"expectedColor,omitempty"`
+
+	// Team is the placing user's team when teams are configured (see
+	// teams.go). It is cleared before the pixel is broadcast.
+	Team string `json:"team,omitempty"`
+
+	// Seq is the server-assigned sequence number that orders placements
+	// (see sequence.go); anything a client sends is overwritten
+	Seq int64 `json:"seq,omitempty"`
+
+	// Chunk is set by the hub on broadcast pixels so clients can route them
+	// to the right tile; it is never read from clients or stored
+	Chunk *ChunkCoord `json:"chunk,omitempty"`
+
+	// RequestID is the ID of the request that placed the pixel, for the
+	// logs of the writer and the hub (see requestid.go); it is never read
+	// from clients, sent or stored
+	RequestID string `json:"-"`
+
+	// ServiceAccount is set when the placing user's token makes them a
+	// service account (see serviceaccount.go); it is never read from clients,
+	// sent or stored
+	ServiceAccount bool `json:"-"`
 }
 
 // Regular expression to validate hex color format (#RRGGBB)
 var hexColorRegex = regexp.MustCompile(`^#[0-9A-Fa-f]{6}$`)
 
+// Regular expression to validate user IDs: letters, digits, dashes and underscores
+// This keeps control characters and markup out of the database, the logs and
+// the rate limiter's keys
+var userIDRegex = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
 // handlePixelUpdate processes incoming pixel update requests
 func (s *Server) handlePixelUpdate(w http.ResponseWriter, r *http.Request) {
-	// Only accept POST requests
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-
 	// Enable CORS (Cross-Origin Resource Sharing) for frontend access
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	s.writeCORS(w, r, "GET, POST, OPTIONS")
 
-	// Handle preflight OPTIONS request
-	if r.Method == http.MethodOptions {
-		w.WriteHeader(http.StatusOK)
-		return
+	// Parse the request body (JSON, form or protobuf) into a PixelUpdate struct
+	// Bodies longer than MAX_BODY_BYTES are refused without reading the rest
+	limitBody(w, r, s.maxBodyBytes)
+	pixel, err := s.decodePixel(r)
+	if err != nil {
+		pixelsRejected.WithLabelValues(rejectValidation).Inc()
 	}
-
-	// Parse the JSON request body into a PixelUpdate struct
-	var pixel PixelUpdate
-	if err := json.NewDecoder(r.Body).Decode(&pixel); err != nil {
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+	if err == errUnsupportedFormat {
+		writeError(w, http.StatusUnsupportedMediaType, codeUnsupportedMediaType, "Unsupported Content-Type")
 		return
 	}
-
-	// Validate the pixel data
-	if err := validatePixel(&pixel); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	if err == errBodyTooLarge {
+		writeError(w, http.StatusRequestEntityTooLarge, codePayloadTooLarge, fmt.Sprintf("Request body too large (at most %d bytes)", s.maxBodyBytes))
 		return
 	}
-
-	// Check if the user is rate limited
-	// Returns true if the user is allowed to place a pixel
-	if !s.rateLimiter.Allow(pixel.UserID) {
-		http.Error(w, "Rate limit exceeded. Please wait before placing another pixel.", http.StatusTooManyRequests)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidBody, err.Error())
 		return
 	}
 
-	// Add timestamp to the pixel update (in milliseconds)
-	pixel.Timestamp = currentTimeMillis()
-
-	// Save pixel to database for persistence
-	if err := s.db.SavePixel(pixel); err != nil {
-		log.Printf("Warning: Failed to save pixel to database: %v", err)
-		// Continue anyway - database failure shouldn't block real-time updates
+	// With authentication enabled the user and team come from the token,
+	// never the body
+	if s.tokens != nil {
+		claims, ok := s.tokenClaims(r)
+		if !ok {
+			writeUnauthorized(w)
+			return
+		}
+		pixel.UserID, pixel.Team = claims.Subject, claims.Team
+		pixel.ServiceAccount = s.serviceAccounts.Match(claims)
 	}
 
-	// Try to add the pixel to the queue
-	if err := s.queue.Enqueue(pixel); err != nil {
-		log.Printf("Failed to enqueue pixel: %v", err)
-		http.Error(w, "Queue is full. Please try again.", http.StatusServiceUnavailable)
+	// Validate, rate limit, save and enqueue the pixel
+	pixel.RequestID = requestID(r.Context())
+	if err := s.placePixel(&pixel, s.clientIP(r)); err != nil {
+		writePlacementError(w, err)
 		return
 	}
 
-	// Success! Return 200 OK
+	// Success! Return 200 OK with the pixel as it was accepted, including
+	// the server timestamp, so clients can reconcile optimistic updates
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("Pixel update accepted"))
+	if err := json.NewEncoder(w).Encode(pixel); err != nil {
+		slog.WarnContext(r.Context(), "Failed to encode accepted pixel", "err", err)
+	}
+}
 
-	log.Printf("Pixel accepted: user=%s x=%d y=%d color=%s",
-		pixel.UserID, pixel.X, pixel.Y, pixel.Color)
+// handlePixelPreflight finishes CORS preflight requests for /api/pixel
+// withPreflight has set the CORS headers; this lists the accepted body types
+// in Accept-Post (JSON first). The response to a successful POST is always JSON.
+func (s *Server) handlePixelPreflight(w http.ResponseWriter, r *http.Request) {
+	var types []string
+	for _, format := range []string{formatJSON, formatForm, formatProtobuf} {
+		if s.bodyFormats[format] {
+			types = append(types, formatContentType[format])
+		}
+	}
+	w.Header().Set("Accept-Post", strings.Join(types, ", "))
+	w.WriteHeader(http.StatusNoContent)
 }
 
 // handleWebSocket upgrades HTTP connection to WebSocket for consumers
 func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	// Enable CORS for WebSocket
-	w.Header().Set("Access-Control-Allow-Origin", "*")
+	s.writeCORS(w, r, "GET")
+
+	// A draining server takes no new connections
+	if s.refuseWhileDraining(w) {
+		return
+	}
+
+	// Take a client slot before upgrading so a full hub answers with a plain
+	// HTTP 503 instead of accepting a connection it would have to drop
+	if !s.hub.reserveClient() {
+		slog.WarnContext(r.Context(), "WebSocket client limit reached", "addr", s.clientIP(r), "maxClients", s.hub.MaxClients())
+		writeError(w, http.StatusServiceUnavailable, codeUnavailable, "Too many WebSocket clients")
+		return
+	}
 
 	// Upgrade the HTTP connection to a WebSocket connection
-	conn, err := upgrader.Upgrade(w, r, nil)
+	// With compression enabled, permessage-deflate is offered to clients that
+	// ask for it; clients that don't keep receiving uncompressed messages
+	wsUpgrader := upgrader
+	wsUpgrader.EnableCompression = s.wsCompression
+	wsUpgrader.CheckOrigin = s.checkOrigin
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Printf("WebSocket upgrade failed: %v", err)
+		s.hub.releaseClient()
+		slog.WarnContext(r.Context(), "WebSocket upgrade failed", "err", err)
 		return
 	}
 
 	// Create a new client connection and register it with the hub
+	// Clients connecting with ?ack=true are paced by their acknowledgements
 	client := &Client{
-		hub:  s.hub,
-		conn: conn,
-		send: make(chan []PixelUpdate, 256),
+		hub:     s.hub,
+		conn:    conn,
+		send:    make(chan outboundMessage, s.hub.sendBuffer),
+		control: make(chan []byte, 16),
+		paced:   s.hub.ackWindow > 0 && r.URL.Query().Get("ack") == "true",
+
+		// Every client gets the current canvas first unless it opts out
+		wantsSnapshot: r.URL.Query().Get("snapshot") != "false",
+
+		// Batches are JSON unless the client asks for the binary format
+		binary: r.URL.Query().Get("format") == "binary",
+
+		addr:        s.clientIP(r),
+		connectedAt: timeNow(),
+	}
+
+	// Clients connecting with ?userId= may place pixels as that user when
+	// WebSocket placement is enabled
+	// With authentication the user comes from ?token= instead (browsers can't
+	// set headers on a WebSocket handshake); without one the client can watch
+	// but not place
+	// The address is taken from the upgrade request for the per-IP limit
+	if s.wsPlacement {
+		ip := s.clientIP(r)
+		service := false
+		client.userID, client.team = r.URL.Query().Get("userId"), r.URL.Query().Get("team")
+		if s.tokens != nil {
+			client.userID, client.team = "", ""
+			if token := r.URL.Query().Get("token"); token != "" {
+				if claims, err := s.tokens.Verify(token); err == nil {
+					client.userID, client.team = claims.Subject, claims.Team
+					service = s.serviceAccounts.Match(claims)
+				}
+			}
+		}
+		client.placeBatch = func(userID, team string, pixels []PixelUpdate) ([]placementResult, *placementError) {
+			return s.placeBatch(userID, team, service, ip, requestID(r.Context()), pixels)
+		}
+	}
+
+	// Count the client's writePump before registering it: once the hub has
+	// the client, Stop may start waiting for the pumps at any moment, and a
+	// pump added after that wait began would not be waited for
+	// A hub that is shutting down doesn't accept new clients
+	if !s.hub.addPump() {
+		s.hub.releaseClient()
+		conn.Close()
+		return
 	}
 
 	// Register the client with the hub
-	s.hub.register <- client
+	select {
+	case s.hub.register <- client:
+	case <-s.hub.stop:
+		s.hub.pumps.Done()
+		s.hub.releaseClient()
+		conn.Close()
+		return
+	}
 
 	// Start goroutines to handle reading and writing
 	// These run concurrently to handle bidirectional communication
-	go client.writePump()
-	go client.readPump()
+	// A panic in either pump only affects this connection
+	safeGo("writePump", client.writePump)
+	safeGo("readPump", client.readPump)
 
-	log.Printf("New WebSocket consumer connected from %s", r.RemoteAddr)
+	slog.InfoContext(r.Context(), "New WebSocket consumer connected", "addr", s.clientIP(r))
 }
 
 // handleGetCanvas returns the full canvas state from the database
 func (s *Server) handleGetCanvas(w http.ResponseWriter, r *http.Request) {
-	// Only accept GET requests
-	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	// Enable CORS for frontend access
+	s.writeCORS(w, r, "GET, OPTIONS")
+	w.Header().Set("Content-Type", "application/json")
+
+	// Get all pixels from memory, or from the database without the cache
+	var pixels []PixelUpdate
+	if s.canvasCache != nil {
+		pixels = s.canvasCache.Pixels()
+	} else {
+		var err error
+		pixels, err = s.db.GetAllPixels()
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Failed to retrieve canvas state", "err", err)
+			writeError(w, http.StatusInternalServerError, codeInternal, "Failed to retrieve canvas state")
+			return
+		}
+	}
+
+	slog.DebugContext(r.Context(), "Canvas state requested", "pixels", len(pixels))
+
+	// Return pixels as JSON
+	// If no pixels exist, return empty array
+	if pixels == nil {
+		pixels = []PixelUpdate{}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(pixels); err != nil {
+		slog.WarnContext(r.Context(), "Failed to encode canvas state", "err", err)
+	}
+}
+
+// handleGetCanvasAt returns the canvas as it was at a moment in the past
+// Query parameter: ts, in Unix milliseconds. The pixels are rebuilt from the
+// history and have the same format as /api/canvas, so the response is never
+// larger than the canvas.
+func (s *Server) handleGetCanvasAt(w http.ResponseWriter, r *http.Request) {
+	s.writeCORS(w, r, "GET, OPTIONS")
+
+	ts, err := strconv.ParseInt(r.URL.Query().Get("ts"), 10, 64)
+	if err != nil || ts < 0 {
+		writeError(w, http.StatusBadRequest, codeValidation, "ts must be a Unix timestamp in milliseconds")
 		return
 	}
 
-	// Enable CORS for frontend access
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	pixels, err := s.db.GetPixelsAt(ts)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to rebuild canvas", "ts", ts, "err", err)
+		writeError(w, http.StatusInternalServerError, codeInternal, "Failed to rebuild canvas")
+		return
+	}
+	if pixels == nil {
+		pixels = []PixelUpdate{}
+	}
+
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(pixels); err != nil {
+		slog.WarnContext(r.Context(), "Failed to encode canvas", "err", err)
+	}
+}
 
-	// Handle preflight OPTIONS request
-	if r.Method == http.MethodOptions {
-		w.WriteHeader(http.StatusOK)
+// maxRegionSide caps the width and height of a /api/canvas/region request
+const maxRegionSide = 500
+
+// handleGetCanvasRegion returns only the pixels inside a rectangle of the canvas
+// Query parameters: x, y (top-left corner) and w, h (size, at most maxRegionSide)
+func (s *Server) handleGetCanvasRegion(w http.ResponseWriter, r *http.Request) {
+	s.writeCORS(w, r, "GET, OPTIONS")
+
+	// Parse the four required integer parameters
+	names := []string{"x", "y", "w", "h"}
+	values := make([]int, len(names))
+	for i, name := range names {
+		v, err := strconv.Atoi(r.URL.Query().Get(name))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, codeValidation, "x, y, w and h must be integers")
+			return
+		}
+		values[i] = v
+	}
+	x, y, width, height := values[0], values[1], values[2], values[3]
+
+	if width < 1 || height < 1 || width > maxRegionSide || height > maxRegionSide {
+		writeError(w, http.StatusBadRequest, codeValidation, fmt.Sprintf("w and h must be between 1 and %d", maxRegionSide))
+		return
+	}
+	if !s.canvas.Contains(x, y) || !s.canvas.Contains(x+width-1, y+height-1) {
+		writeError(w, http.StatusBadRequest, codeValidation, fmt.Sprintf("region must be inside the %dx%d canvas", s.canvas.Width, s.canvas.Height))
 		return
 	}
 
-	// Get all pixels from the database
-	pixels, err := s.db.GetAllPixels()
+	pixels, err := s.db.GetPixelsInRegion(x, y, width, height)
 	if err != nil {
-		log.Printf("Failed to retrieve canvas state: %v", err)
-		http.Error(w, "Failed to retrieve canvas state", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Failed to retrieve canvas region", "err", err)
+		writeError(w, http.StatusInternalServerError, codeInternal, "Failed to retrieve canvas region")
 		return
 	}
 
-	// Get pixel count for logging
-	count, _ := s.db.GetPixelCount()
-	log.Printf("Canvas state requested - returning %d pixels", count)
-
-	// Return pixels as JSON
-	// If no pixels exist, return empty array
+	// If no pixels exist in the region, return an empty array
 	if pixels == nil {
 		pixels = []PixelUpdate{}
 	}
 
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	if err := json.NewEncoder(w).Encode(pixels); err != nil {
-		log.Printf("Failed to encode canvas state: %v", err)
+		slog.WarnContext(r.Context(), "Failed to encode canvas region", "err", err)
+	}
+}
+
+// handleGetPixel returns the visible pixel at one coordinate
+// Query parameters: x and y. A coordinate nobody has painted gets 404, so
+// inspection tools can tell it apart from a pixel in the background color.
+func (s *Server) handleGetPixel(w http.ResponseWriter, r *http.Request) {
+	s.writeCORS(w, r, "GET, POST, OPTIONS")
+
+	x, errX := strconv.Atoi(r.URL.Query().Get("x"))
+	y, errY := strconv.Atoi(r.URL.Query().Get("y"))
+	if errX != nil || errY != nil {
+		writeError(w, http.StatusBadRequest, codeValidation, "x and y must be integers")
+		return
+	}
+	if !s.canvas.Contains(x, y) {
+		writeError(w, http.StatusBadRequest, codeValidation, fmt.Sprintf("coordinate must be inside the %dx%d canvas", s.canvas.Width, s.canvas.Height))
+		return
+	}
+
+	// Read it from memory like /api/canvas, or from the database (a primary
+	// key lookup) without the cache
+	var pixel PixelUpdate
+	var ok bool
+	if s.canvasCache != nil {
+		pixel, ok = s.canvasCache.Pixel(x, y)
+	} else {
+		stored, found, err := s.db.GetPixel(x, y)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Failed to retrieve pixel", "x", x, "y", y, "err", err)
+			writeError(w, http.StatusInternalServerError, codeInternal, "Failed to retrieve pixel")
+			return
+		}
+		if found {
+			pixel, ok = *stored, true
+		}
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, codeNotFound, "Pixel not set")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(pixel); err != nil {
+		slog.WarnContext(r.Context(), "Failed to encode pixel", "err", err)
+	}
+}
+
+// Limits for /api/pixel/history
+const (
+	defaultHistoryLimit = 50
+	maxHistoryLimit     = 500
+)
+
+// pixelHistoryItem is one placement returned by /api/pixel/history
+// Color is empty when the pixel was cleared rather than placed
+type pixelHistoryItem struct {
+	Color    string `json:"color"`
+	UserID   string `json:"userId"`
+	PlacedAt int64  `json:"placedAt"`
+}
+
+// handlePixelHistory returns who placed which color at one coordinate, oldest first
+// Query parameters: x, y and optionally limit (the most recent placements to return)
+func (s *Server) handlePixelHistory(w http.ResponseWriter, r *http.Request) {
+	s.writeCORS(w, r, "GET, OPTIONS")
+
+	x, errX := strconv.Atoi(r.URL.Query().Get("x"))
+	y, errY := strconv.Atoi(r.URL.Query().Get("y"))
+	if errX != nil || errY != nil {
+		writeError(w, http.StatusBadRequest, codeValidation, "x and y must be integers")
+		return
+	}
+	if !s.canvas.Contains(x, y) {
+		writeError(w, http.StatusBadRequest, codeValidation, fmt.Sprintf("coordinate must be inside the %dx%d canvas", s.canvas.Width, s.canvas.Height))
+		return
+	}
+
+	limit := defaultHistoryLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > maxHistoryLimit {
+			writeError(w, http.StatusBadRequest, codeValidation, fmt.Sprintf("limit must be between 1 and %d", maxHistoryLimit))
+			return
+		}
+		limit = parsed
+	}
+
+	entries, err := s.db.GetPixelHistory(x, y, limit)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to retrieve pixel history", "err", err)
+		writeError(w, http.StatusInternalServerError, codeInternal, "Failed to retrieve pixel history")
+		return
+	}
+
+	items := make([]pixelHistoryItem, len(entries))
+	for i, entry := range entries {
+		items[i] = pixelHistoryItem{Color: entry.Color, UserID: entry.UserID, PlacedAt: entry.PlacedAt}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(items); err != nil {
+		slog.WarnContext(r.Context(), "Failed to encode pixel history", "err", err)
+	}
+}
+
+// handleConfig returns the public settings clients need to draw the canvas
+func (s *Server) handleConfig(w http.ResponseWriter, r *http.Request) {
+	s.writeCORS(w, r, "GET, OPTIONS")
+
+	// Zones are included so the frontend can outline protected areas
+	zones := s.config.Get().Zones
+	if zones == nil {
+		zones = []Zone{}
+	}
+
+	config := map[string]interface{}{
+		"width":       s.canvas.Width,
+		"height":      s.canvas.Height,
+		"background":  s.canvas.Background,
+		"chunkSize":   s.canvas.ChunkSize,
+		"alphaColors": s.canvas.AlphaColors,
+		"zones":       zones,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(config)
+}
+
+// handlePalette returns the colors pixels may be placed in, in #RRGGBB upper case
+// An empty list means every #RRGGBB color is allowed
+func (s *Server) handlePalette(w http.ResponseWriter, r *http.Request) {
+	s.writeCORS(w, r, "GET, OPTIONS")
+
+	palette := s.config.Get().Palette
+	if palette == nil {
+		palette = []string{}
+	}
+
+	// The cooldown multiplier of each color that costs more than one
+	cooldowns := make(map[string]float64)
+	for color, multiplier := range s.config.Get().colorCosts {
+		cooldowns[color] = multiplier
 	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{"palette": palette, "colorCooldowns": cooldowns})
+}
+
+// persist runs a database write through the circuit breaker
+// While the breaker is open the write is skipped and errCircuitOpen is returned
+func (s *Server) persist(write func() error) error {
+	return s.dbBreaker.Call(write)
+}
+
+// writeCORS sets the CORS headers for a response
+// With no allowed origins configured every origin is allowed ("*").
+// Otherwise the request's Origin is echoed back only if it is in the allowlist.
+func (s *Server) writeCORS(w http.ResponseWriter, r *http.Request, methods string) {
+	cfg := s.config.Get()
+
+	if len(cfg.AllowedOrigins) == 0 {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+	} else {
+		// The response depends on the Origin header, so caches must key on it
+		w.Header().Add("Vary", "Origin")
+		origin := r.Header.Get("Origin")
+		if origin != "" && cfg.AllowsOrigin(origin) {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+	}
+
+	w.Header().Set("Access-Control-Allow-Methods", methods)
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+}
+
+// checkOrigin decides whether a WebSocket upgrade is allowed
+// Browsers always send Origin with a WebSocket handshake and don't apply CORS
+// to it, so this is where the allowlist protects the socket. Requests without
+// an Origin come from non-browser clients (the consumer, scripts), which could
+// set any header they like anyway, and are allowed.
+func (s *Server) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || s.config.Get().AllowsOrigin(origin) {
+		return true
+	}
+
+	slog.WarnContext(r.Context(), "WebSocket origin not allowed", "origin", origin, "addr", s.clientIP(r))
+	return false
+}
+
+// clientIP returns the address of the client that sent a request, without
+// the port and in normalized form (see normalizeIP)
+// Behind a reverse proxy every request comes from the proxy, so with
+// trustProxy the last X-Forwarded-For entry (the one the proxy appended) is
+// used instead, or X-Real-IP for proxies that set that. Earlier
+// X-Forwarded-For entries are set by the client and can't be trusted, and
+// without trustProxy neither header is looked at, since any client can send
+// them.
+func (s *Server) clientIP(r *http.Request) string {
+	if s.trustProxy {
+		if forwarded := r.Header.Values("X-Forwarded-For"); len(forwarded) > 0 {
+			// A proxy may add a second header instead of appending to the first
+			entries := strings.Split(forwarded[len(forwarded)-1], ",")
+			if ip, ok := normalizeIP(entries[len(entries)-1]); ok {
+				return ip
+			}
+		}
+		if ip, ok := normalizeIP(r.Header.Get("X-Real-IP")); ok {
+			return ip
+		}
+	}
+
+	if ip, ok := normalizeIP(r.RemoteAddr); ok {
+		return ip
+	}
+	return r.RemoteAddr
+}
+
+// normalizeIP parses an address with or without a port ("1.2.3.4",
+// "1.2.3.4:5678", "::1", "[::1]:5678") and returns it in one canonical form,
+// so the same client always gets the same rate-limit key: IPv6 in lowercase
+// with zeros compressed and no zone, and IPv4-mapped IPv6 (::ffff:1.2.3.4)
+// as plain IPv4
+func normalizeIP(value string) (string, bool) {
+	value = strings.TrimSpace(value)
+	if host, _, err := net.SplitHostPort(value); err == nil {
+		value = host
+	}
+	value = strings.TrimSuffix(strings.TrimPrefix(value, "["), "]")
+
+	addr, err := netip.ParseAddr(value)
+	if err != nil {
+		return "", false
+	}
+	return addr.Unmap().WithZone("").String(), true
 }
 
 // validatePixel checks if a pixel update is valid
-func validatePixel(pixel *PixelUpdate) error {
-	// Check X coordinate is within bounds (0-999)
-	if pixel.X < 0 || pixel.X > 999 {
-		return &ValidationError{"x coordinate must be between 0 and 999"}
+// The coordinates must be on the canvas, and the palette from the active
+// config is applied on top of the format checks
+func validatePixel(pixel *PixelUpdate, cfg *Config, canvas CanvasConfig) error {
+	// Check X coordinate is within bounds (0 to width-1)
+	if pixel.X < 0 || pixel.X >= canvas.Width {
+		return &ValidationError{fmt.Sprintf("x coordinate must be between 0 and %d", canvas.Width-1)}
+	}
+
+	// Check Y coordinate is within bounds (0 to height-1)
+	if pixel.Y < 0 || pixel.Y >= canvas.Height {
+		return &ValidationError{fmt.Sprintf("y coordinate must be between 0 and %d", canvas.Height-1)}
+	}
+
+	// Check color format is valid hex (#RRGGBB, or #RRGGBBAA with ALPHA_COLORS)
+	if !validColor(pixel.Color, canvas.AlphaColors) {
+		return &ValidationError{"color must be in " + colorFormat(canvas) + " format"}
 	}
+	pixel.Color = normalizeColor(pixel.Color)
 
-	// Check Y coordinate is within bounds (0-999)
-	if pixel.Y < 0 || pixel.Y > 999 {
-		return &ValidationError{"y coordinate must be between 0 and 999"}
+	// Check color is part of the palette (if one is configured)
+	// Only the #RRGGBB part is checked, and erasers are always allowed
+	if !isTransparent(pixel.Color) && !cfg.AllowsColor(opaquePart(pixel.Color)) {
+		return &ValidationError{"color is not in the palette"}
 	}
 
-	// Check color format is valid hex (#RRGGBB)
-	if !hexColorRegex.MatchString(pixel.Color) {
-		return &ValidationError{"color must be in #RRGGBB format"}
+	// The expected color of a conditional placement needs the same format,
+	// but may be any color (the pixel may predate the palette)
+	// Expecting a transparent pixel means expecting an empty coordinate
+	if pixel.ExpectedColor != "" {
+		if !validColor(pixel.ExpectedColor, canvas.AlphaColors) {
+			return &ValidationError{"expectedColor must be in " + colorFormat(canvas) + " format"}
+		}
+		pixel.ExpectedColor = normalizeColor(pixel.ExpectedColor)
+		if isTransparent(pixel.ExpectedColor) {
+			pixel.ExpectedColor = canvas.Background
+		}
 	}
 
 	// Check userId is not empty
@@ -186,9 +824,26 @@ func validatePixel(pixel *PixelUpdate) error {
 		return &ValidationError{"userId is required"}
 	}
 
+	// Check userId is short enough and uses only safe characters
+	// The length is checked first so a huge id isn't run through the regex
+	if len(pixel.UserID) > cfg.MaxUserIDLength {
+		return &ValidationError{fmt.Sprintf("userId must be at most %d characters", cfg.MaxUserIDLength)}
+	}
+	if !userIDRegex.MatchString(pixel.UserID) {
+		return &ValidationError{"userId may only contain letters, digits, dashes and underscores"}
+	}
+
 	return nil
 }
 
+// colorFormat describes the accepted color format in validation errors
+func colorFormat(canvas CanvasConfig) string {
+	if canvas.AlphaColors {
+		return "#RRGGBB or #RRGGBBAA"
+	}
+	return "#RRGGBB"
+}
+
 // ValidationError is a custom error type for validation failures
 type ValidationError struct {
 	message string
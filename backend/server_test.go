@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestValidatePixelUserID(t *testing.T) {
+	cfg := DefaultConfig()
+	tests := []struct {
+		name   string
+		userID string
+		valid  bool
+	}{
+		{"simple", "alice", true},
+		{"dashes and underscores", "team-red_42", true},
+		{"at the limit", strings.Repeat("a", 64), true},
+		{"empty", "", false},
+		{"overlong", strings.Repeat("a", 65), false},
+		{"megabyte", strings.Repeat("a", 1<<20), false},
+		{"unicode letters", "álice", false},
+		{"emoji", "alice🎨", false},
+		{"space", "alice smith", false},
+		{"control character", "alice\x00", false},
+		{"newline", "alice\nadmin", false},
+		{"sql injection", "alice'; DROP TABLE canvas_state;--", false},
+		{"html", "<script>alert(1)</script>", false},
+		{"path", "../../etc/passwd", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pixel := PixelUpdate{X: 1, Y: 1, Color: "#FF0000", UserID: tt.userID}
+			err := validatePixel(&pixel, cfg, cfg.Canvas)
+			if tt.valid {
+				if err != nil {
+					t.Fatalf("rejected: %v", err)
+				}
+				return
+			}
+			var validationErr *ValidationError
+			if !errors.As(err, &validationErr) {
+				t.Fatalf("error %v, want a ValidationError", err)
+			}
+		})
+	}
+}
+
+func TestUserIDMaxLengthIsConfigurable(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.MaxUserIDLength = 5
+
+	pixel := PixelUpdate{X: 1, Y: 1, Color: "#FF0000", UserID: "alice"}
+	if err := validatePixel(&pixel, cfg, cfg.Canvas); err != nil {
+		t.Fatalf("5 characters rejected: %v", err)
+	}
+	pixel.UserID = "alice2"
+	if err := validatePixel(&pixel, cfg, cfg.Canvas); err == nil || !strings.Contains(err.Error(), "at most 5") {
+		t.Fatalf("6 characters: %v, want the length error", err)
+	}
+}
+
+func TestBadUserIDIsRejectedBeforeTheRateLimiter(t *testing.T) {
+	room := newTestRoom(t, nil)
+	ts := startTestServer(t, room)
+
+	for _, userID := range []string{"", strings.Repeat("x", 65), "bob'--", "ünicode"} {
+		body, _ := json.Marshal(map[string]interface{}{"x": 1, "y": 1, "color": "#FF0000", "userId": userID})
+		status, resp := postPixel(t, ts, string(body))
+		if status != http.StatusBadRequest || errorCode(resp) != codeValidation {
+			t.Errorf("userId %q: status %d, code %q; want 400 %s", userID, status, errorCode(resp), codeValidation)
+		}
+	}
+
+	// None of them got a rate limiter entry
+	if n := room.server.rateLimiter.Len(); n != 0 {
+		t.Fatalf("rate limiter tracks %d users, want 0", n)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name       string
+		trustProxy bool
+		remoteAddr string
+		headers    map[string][]string
+		want       string
+	}{
+		{"ipv4 with port", false, "203.0.113.7:51234", nil, "203.0.113.7"},
+		{"ipv4 without port", false, "203.0.113.7", nil, "203.0.113.7"},
+		{"ipv6 with port", false, "[2001:DB8:0:0::1]:51234", nil, "2001:db8::1"},
+		{"ipv6 with zone", false, "[fe80::1%eth0]:51234", nil, "fe80::1"},
+		{"ipv4-mapped ipv6", false, "[::ffff:203.0.113.7]:51234", nil, "203.0.113.7"},
+		{"unparsable address", false, "somewhere", nil, "somewhere"},
+
+		// Without TRUST_PROXY the headers are the client's word and are ignored
+		{"untrusted forwarded-for", false, "10.0.0.1:80", map[string][]string{"X-Forwarded-For": {"198.51.100.9"}}, "10.0.0.1"},
+		{"untrusted real-ip", false, "10.0.0.1:80", map[string][]string{"X-Real-IP": {"198.51.100.9"}}, "10.0.0.1"},
+
+		// Behind a trusted proxy the entry it appended is used: the last one,
+		// since anything before it came from the client
+		{"one hop", true, "10.0.0.1:80", map[string][]string{"X-Forwarded-For": {"198.51.100.9"}}, "198.51.100.9"},
+		{"several hops", true, "10.0.0.1:80", map[string][]string{"X-Forwarded-For": {"1.1.1.1, 192.0.2.44,  198.51.100.9"}}, "198.51.100.9"},
+		{"several headers", true, "10.0.0.1:80", map[string][]string{"X-Forwarded-For": {"1.1.1.1", "198.51.100.9"}}, "198.51.100.9"},
+		{"ipv6 hop", true, "10.0.0.1:80", map[string][]string{"X-Forwarded-For": {"1.1.1.1, [2001:db8::0:9]:443"}}, "2001:db8::9"},
+		{"real-ip", true, "10.0.0.1:80", map[string][]string{"X-Real-IP": {"198.51.100.9"}}, "198.51.100.9"},
+		{"garbage falls back", true, "10.0.0.1:80", map[string][]string{"X-Forwarded-For": {"not-an-ip"}}, "10.0.0.1"},
+		{"no headers", true, "10.0.0.1:80", nil, "10.0.0.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{serverOptions: serverOptions{trustProxy: tt.trustProxy}}
+			r := httptest.NewRequest(http.MethodGet, "/api/canvas", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for name, values := range tt.headers {
+				for _, value := range values {
+					r.Header.Add(name, value)
+				}
+			}
+			if got := s.clientIP(r); got != tt.want {
+				t.Fatalf("clientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
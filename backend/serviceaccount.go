@@ -0,0 +1,114 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+)
+
+// Service accounts
+//
+// Trusted bots, such as the one drawing an approved template, need to place
+// faster than the public cooldown allows. A service account skips the
+// per-user cooldown, the per-IP cooldown (bots often share one address) and
+// the placement quota (see quota.go). Instead it waits
+// SERVICE_ACCOUNT_COOLDOWN between pixels, or not at all when that is 0 (the
+// default). Everything else still applies to it: validation, zones, the
+// contiguous area limit and shadow bans. So does GLOBAL_RATE_LIMIT, which
+// keeps a runaway bot from flooding the canvas for everyone.
+//
+// A user is a service account when their identity was verified and either:
+//
+//   - their token has the claim "role": "service" (`-issue-token bot
+//     -token-role service` prints one), or
+//   - their userId is listed in SERVICE_ACCOUNTS, for tokens issued by a login
+//     service that doesn't set roles
+//
+// Both need AUTH_SECRET. Without it any client can claim any userId, so
+// SERVICE_ACCOUNTS is ignored (with a warning) rather than handing the bypass
+// to whoever sends the right name.
+//
+// Every placement accepted from a service account is logged as "Service
+// account placement" with the user, the pixel and the request ID, and counted
+// in wplace_service_account_pixels_total, so what bots did can be audited
+// afterwards.
+
+// roleService is the token role of a service account
+const roleService = "service"
+
+// ServiceAccounts decides which users are service accounts and limits them
+// A nil *ServiceAccounts has none.
+type ServiceAccounts struct {
+	allowlist map[string]bool
+	cooldown  time.Duration
+	limiter   *RateLimiter // Nil when service accounts have no cooldown
+}
+
+// NewServiceAccounts creates the service accounts for a room
+// userIDs is the SERVICE_ACCOUNTS allowlist. Without tokens (no AUTH_SECRET)
+// it returns nil, since no identity can be trusted.
+func NewServiceAccounts(tokens *TokenVerifier, userIDs []string, cooldown time.Duration, config LimiterConfig) *ServiceAccounts {
+	if tokens == nil {
+		if len(userIDs) > 0 {
+			slog.Warn("SERVICE_ACCOUNTS is ignored without AUTH_SECRET, since userIds can't be verified", "accounts", userIDs)
+		}
+		return nil
+	}
+
+	accounts := &ServiceAccounts{allowlist: make(map[string]bool, len(userIDs)), cooldown: max(cooldown, 0)}
+	for _, userID := range userIDs {
+		accounts.allowlist[userID] = true
+	}
+	if cooldown > 0 {
+		accounts.limiter = NewRateLimiter(cooldown, config)
+	}
+	slog.Info("Service accounts enabled", "allowlist", userIDs, "cooldown", accounts.cooldown)
+	return accounts
+}
+
+// Match returns true if the verified claims belong to a service account
+func (a *ServiceAccounts) Match(claims tokenClaims) bool {
+	if a == nil {
+		return false
+	}
+	return claims.Role == roleService || a.allowlist[claims.Subject]
+}
+
+// TimeUntilAllowed returns how long a service account must wait before its
+// next pixel (0 if it can place right now)
+func (a *ServiceAccounts) TimeUntilAllowed(userID string) time.Duration {
+	if a == nil || a.limiter == nil {
+		return 0
+	}
+	return a.limiter.TimeUntilAllowed(userID)
+}
+
+// Cooldown returns the cooldown of service accounts (0 when there is none)
+func (a *ServiceAccounts) Cooldown() time.Duration {
+	if a == nil {
+		return 0
+	}
+	return a.cooldown
+}
+
+// checkServiceCooldown peeks at a service account's cooldown
+func (s *Server) checkServiceCooldown(pixel *PixelUpdate) *placementError {
+	if s.serviceAccounts.TimeUntilAllowed(pixel.UserID) > 0 {
+		return s.rateLimited(s.serviceAccounts.limiter, pixel.UserID, rateLimitUser)
+	}
+	return nil
+}
+
+// takeServiceCooldown uses up a service account's cooldown
+func (s *Server) takeServiceCooldown(pixel *PixelUpdate) *placementError {
+	limiter := s.serviceAccounts.limiter
+	if limiter != nil && !limiter.Allow(pixel.UserID) {
+		return s.rateLimited(limiter, pixel.UserID, rateLimitUser)
+	}
+	return nil
+}
+
+// auditServicePlacement records an accepted placement of a service account
+func auditServicePlacement(pixel *PixelUpdate) {
+	serviceAccountPixels.Inc()
+	slog.Info("Service account placement", "requestId", pixel.RequestID, "user", pixel.UserID, "x", pixel.X, "y", pixel.Y, "color", pixel.Color, "seq", pixel.Seq)
+}
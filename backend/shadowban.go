@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// Shadow bans
+//
+// A griefer who is banned outright just comes back under another userId.
+// A shadow-banned user notices nothing: their placements go through the
+// same checks as everyone's (cooldowns included) and are answered 200 OK,
+// but instead of reaching the canvas they are saved to the
+// quarantined_pixels table. They aren't broadcast, drawn, counted on the
+// leaderboard or added to the history, and can't be undone.
+//
+// The bans are stored in the shadow_bans table and kept in memory by
+// ShadowBans, a map loaded at startup, so the check on every placement is
+// one map lookup. Admins manage them with:
+//
+//   - GET /api/admin/shadowbans lists the bans
+//   - POST /api/admin/shadowbans with {"userId": "...", "reason": "..."}
+//     adds one (or updates its reason)
+//   - DELETE /api/admin/shadowbans/{userId} lifts one
+//
+// Lifting a ban keeps the user's quarantined pixels; they stay in the table
+// for moderators to look at and are never applied to the canvas. Every
+// canvas (see rooms.go) has its own bans, stored in its own database.
+
+// shadowBanSchema creates the bans and quarantine tables
+const shadowBanSchema = `
+CREATE TABLE IF NOT EXISTS shadow_bans (
+	user_id TEXT PRIMARY KEY,
+	reason TEXT NOT NULL DEFAULT '',
+	banned_at BIGINT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS quarantined_pixels (
+	x INTEGER NOT NULL,
+	y INTEGER NOT NULL,
+	color TEXT NOT NULL,
+	user_id TEXT NOT NULL,
+	placed_at BIGINT NOT NULL,
+	seq BIGINT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_quarantined_user ON quarantined_pixels(user_id, placed_at);
+`
+
+// ShadowBan is one shadow-banned user
+type ShadowBan struct {
+	UserID   string `json:"userId"`
+	Reason   string `json:"reason,omitempty"`
+	BannedAt int64  `json:"bannedAt"` // Unix milliseconds
+}
+
+// ShadowBans is the in-memory set of shadow-banned users
+// Safe for concurrent use; a nil *ShadowBans bans nobody.
+type ShadowBans struct {
+	mu   sync.RWMutex
+	bans map[string]ShadowBan
+}
+
+// NewShadowBans loads the bans stored in db
+func NewShadowBans(db *Database) (*ShadowBans, error) {
+	bans, err := db.GetShadowBans()
+	if err != nil {
+		return nil, err
+	}
+
+	set := &ShadowBans{bans: make(map[string]ShadowBan, len(bans))}
+	for _, ban := range bans {
+		set.bans[ban.UserID] = ban
+	}
+	return set, nil
+}
+
+// Banned returns true if the user is shadow-banned
+func (b *ShadowBans) Banned(userID string) bool {
+	_, banned := b.Get(userID)
+	return banned
+}
+
+// Get returns the user's ban, if they are shadow-banned
+func (b *ShadowBans) Get(userID string) (ShadowBan, bool) {
+	if b == nil {
+		return ShadowBan{}, false
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	ban, banned := b.bans[userID]
+	return ban, banned
+}
+
+// Add remembers a ban (called once it is saved)
+func (b *ShadowBans) Add(ban ShadowBan) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.bans[ban.UserID] = ban
+}
+
+// Remove forgets a ban and returns false if there was none
+func (b *ShadowBans) Remove(userID string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, banned := b.bans[userID]
+	delete(b.bans, userID)
+	return banned
+}
+
+// List returns the bans, most recent first
+func (b *ShadowBans) List() []ShadowBan {
+	b.mu.RLock()
+	list := make([]ShadowBan, 0, len(b.bans))
+	for _, ban := range b.bans {
+		list = append(list, ban)
+	}
+	b.mu.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].BannedAt != list[j].BannedAt {
+			return list[i].BannedAt > list[j].BannedAt
+		}
+		return list[i].UserID < list[j].UserID
+	})
+	return list
+}
+
+// initShadowBans creates the bans and quarantine tables
+func (d *Database) initShadowBans() error {
+	_, err := d.db.Exec(shadowBanSchema)
+	return err
+}
+
+// GetShadowBans returns every stored ban
+func (d *Database) GetShadowBans() ([]ShadowBan, error) {
+	rows, err := d.db.Query(`SELECT user_id, reason, banned_at FROM shadow_bans`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var bans []ShadowBan
+	for rows.Next() {
+		var ban ShadowBan
+		if err := rows.Scan(&ban.UserID, &ban.Reason, &ban.BannedAt); err != nil {
+			return nil, err
+		}
+		bans = append(bans, ban)
+	}
+	return bans, rows.Err()
+}
+
+// SaveShadowBan stores a ban, replacing the reason of an existing one
+// A user banned again keeps the time of the first ban.
+func (d *Database) SaveShadowBan(ban ShadowBan) error {
+	return d.withRetry(func() error {
+		d.maintenance.RLock()
+		defer d.maintenance.RUnlock()
+
+		_, err := d.db.Exec(d.rebind(`
+		INSERT INTO shadow_bans (user_id, reason, banned_at) VALUES (?, ?, ?)
+		ON CONFLICT (user_id) DO UPDATE SET reason = excluded.reason
+		`), ban.UserID, ban.Reason, ban.BannedAt)
+		return err
+	})
+}
+
+// DeleteShadowBan removes a stored ban
+func (d *Database) DeleteShadowBan(userID string) error {
+	return d.withRetry(func() error {
+		d.maintenance.RLock()
+		defer d.maintenance.RUnlock()
+
+		_, err := d.db.Exec(d.rebind(`DELETE FROM shadow_bans WHERE user_id = ?`), userID)
+		return err
+	})
+}
+
+// QuarantinePixel saves a shadow-banned user's placement away from the canvas
+func (d *Database) QuarantinePixel(pixel PixelUpdate) error {
+	return d.withRetry(func() error {
+		d.maintenance.RLock()
+		defer d.maintenance.RUnlock()
+
+		_, err := d.db.Exec(d.rebind(`
+		INSERT INTO quarantined_pixels (x, y, color, user_id, placed_at, seq) VALUES (?, ?, ?, ?, ?, ?)
+		`), pixel.X, pixel.Y, pixel.Color, pixel.UserID, pixel.Timestamp, pixel.Seq)
+		return err
+	})
+}
+
+// quarantine saves an accepted placement of a shadow-banned user
+// A failure is only logged: the user must get the same answer either way.
+func (s *Server) quarantine(pixel *PixelUpdate) {
+	if err := s.persist(func() error { return s.db.QuarantinePixel(*pixel) }); err != nil {
+		slog.Error("Failed to quarantine pixel", "requestId", pixel.RequestID, "user", pixel.UserID, "err", err)
+	}
+	pixelsQuarantined.Inc()
+	slog.Info("Pixel quarantined", "requestId", pixel.RequestID, "user", pixel.UserID, "x", pixel.X, "y", pixel.Y, "color", pixel.Color, "seq", pixel.Seq)
+}
+
+// shadowBanRequest is the body of POST /api/admin/shadowbans
+type shadowBanRequest struct {
+	UserID string `json:"userId"`
+	Reason string `json:"reason"`
+}
+
+// maxShadowBanReason is the longest reason accepted, in bytes
+const maxShadowBanReason = 500
+
+// handleShadowBanList lists the shadow-banned users
+func (s *Server) handleShadowBanList(w http.ResponseWriter, r *http.Request) {
+	bans := s.shadowBans.List()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{"count": len(bans), "bans": bans})
+}
+
+// handleShadowBanAdd shadow-bans a user
+func (s *Server) handleShadowBanAdd(w http.ResponseWriter, r *http.Request) {
+	var req shadowBanRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidBody, "Invalid JSON")
+		return
+	}
+	if req.UserID == "" || len(req.UserID) > s.config.Get().MaxUserIDLength || !userIDRegex.MatchString(req.UserID) {
+		writeError(w, http.StatusBadRequest, codeValidation, "userId must be a valid user ID")
+		return
+	}
+	if len(req.Reason) > maxShadowBanReason {
+		writeError(w, http.StatusBadRequest, codeValidation, "reason is too long")
+		return
+	}
+
+	// Banning a user again only changes the reason
+	ban := ShadowBan{UserID: req.UserID, Reason: req.Reason, BannedAt: currentTimeMillis()}
+	if existing, banned := s.shadowBans.Get(ban.UserID); banned {
+		ban.BannedAt = existing.BannedAt
+	}
+	if err := s.persist(func() error { return s.db.SaveShadowBan(ban) }); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to save shadow ban", "user", ban.UserID, "err", err)
+		writeError(w, http.StatusInternalServerError, codeInternal, "Failed to save the ban")
+		return
+	}
+	s.shadowBans.Add(ban)
+
+	slog.InfoContext(r.Context(), "User shadow-banned", "user", ban.UserID, "reason", ban.Reason)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(ban)
+}
+
+// handleShadowBanRemove lifts the shadow ban of /api/admin/shadowbans/{userId}
+func (s *Server) handleShadowBanRemove(w http.ResponseWriter, r *http.Request) {
+	userID := r.PathValue("userId")
+	if !s.shadowBans.Banned(userID) {
+		writeError(w, http.StatusNotFound, codeNotFound, "User is not shadow-banned")
+		return
+	}
+
+	if err := s.persist(func() error { return s.db.DeleteShadowBan(userID) }); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to delete shadow ban", "user", userID, "err", err)
+		writeError(w, http.StatusInternalServerError, codeInternal, "Failed to lift the ban")
+		return
+	}
+	s.shadowBans.Remove(userID)
+
+	slog.InfoContext(r.Context(), "Shadow ban lifted", "user", userID)
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Shadow ban lifted"))
+}
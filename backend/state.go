@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+)
+
+// stateVersion is the format version of exported runtime state
+// Bump it whenever a section is added or changes shape
+const stateVersion = 4
+
+// RuntimeState is a snapshot of the mutable in-memory state of the server
+// Each subsystem that keeps state outside the database contributes a section,
+// so the whole snapshot can be moved to a fresh instance in one request
+type RuntimeState struct {
+	Version    int   `json:"version"`    // Format version (must equal stateVersion)
+	ExportedAt int64 `json:"exportedAt"` // Unix timestamp in milliseconds
+
+	// RateLimiter holds each user's cooldown or token bucket
+	RateLimiter LimiterSnapshot `json:"rateLimiter"`
+
+	// IPLimiter holds each client IP address's cooldown; nil without IP_COOLDOWN
+	IPLimiter *LimiterSnapshot `json:"ipLimiter,omitempty"`
+
+	// Quota maps userId to the times of their pixels within the quota window,
+	// oldest first (Unix milliseconds); empty without PLACEMENT_QUOTA
+	Quota map[string][]int64 `json:"quota,omitempty"`
+}
+
+// exportState collects the state of every subsystem into one snapshot
+func (s *Server) exportState() RuntimeState {
+	state := RuntimeState{
+		Version:     stateVersion,
+		ExportedAt:  currentTimeMillis(),
+		RateLimiter: s.rateLimiter.Snapshot(),
+		Quota:       s.quota.Snapshot(),
+	}
+	if s.ipLimiter != nil {
+		ipLimiter := s.ipLimiter.Snapshot()
+		state.IPLimiter = &ipLimiter
+	}
+	return state
+}
+
+// importState validates a snapshot and then applies every section
+// Nothing is applied unless the whole snapshot is valid
+func (s *Server) importState(state RuntimeState) error {
+	if state.Version != stateVersion {
+		return fmt.Errorf("unsupported state version %d (expected %d)", state.Version, stateVersion)
+	}
+
+	if err := validateLimiterSnapshot("rate limiter", state.RateLimiter); err != nil {
+		return err
+	}
+	if state.IPLimiter != nil {
+		if err := validateLimiterSnapshot("IP limiter", *state.IPLimiter); err != nil {
+			return err
+		}
+	}
+	for userID, times := range state.Quota {
+		if userID == "" || len(times) == 0 {
+			return fmt.Errorf("invalid quota entry for %q", userID)
+		}
+		for i, millis := range times {
+			if millis <= 0 || (i > 0 && millis < times[i-1]) {
+				return fmt.Errorf("invalid quota entry for %q: times must be positive and in order", userID)
+			}
+		}
+	}
+
+	// Everything checked - apply all sections
+	// A missing section empties the limiter, like a section with no entries;
+	// an instance without IP_COOLDOWN ignores the IP limiter section
+	s.rateLimiter.Restore(state.RateLimiter)
+	if s.ipLimiter != nil {
+		var ipLimiter LimiterSnapshot
+		if state.IPLimiter != nil {
+			ipLimiter = *state.IPLimiter
+		}
+		s.ipLimiter.Restore(ipLimiter)
+	}
+	s.quota.Restore(state.Quota)
+	return nil
+}
+
+// validateLimiterSnapshot checks every entry of a limiter's section
+// name is the section's name in the error
+func validateLimiterSnapshot(name string, snapshot LimiterSnapshot) error {
+	for key, lastUpdate := range snapshot.Cooldowns {
+		if key == "" || lastUpdate <= 0 {
+			return fmt.Errorf("invalid %s entry for %q", name, key)
+		}
+	}
+	for key, bucket := range snapshot.Buckets {
+		if key == "" || bucket.Updated <= 0 {
+			return fmt.Errorf("invalid %s bucket for %q", name, key)
+		}
+	}
+	return nil
+}
+
+// entries returns the number of keys in a limiter snapshot
+func (s LimiterSnapshot) entries() int {
+	return len(s.Cooldowns) + len(s.Buckets)
+}
+
+// handleExportState returns the runtime state as JSON (admin only)
+func (s *Server) handleExportState(w http.ResponseWriter, r *http.Request) {
+	state := s.exportState()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(state); err != nil {
+		slog.WarnContext(r.Context(), "Failed to encode runtime state", "err", err)
+	}
+
+	slog.InfoContext(r.Context(), "Runtime state exported", "rateLimiterEntries", state.RateLimiter.entries(), "quotaEntries", len(state.Quota))
+}
+
+// handleImportState replaces the runtime state with a previously exported snapshot (admin only)
+func (s *Server) handleImportState(w http.ResponseWriter, r *http.Request) {
+	var state RuntimeState
+	if err := json.NewDecoder(r.Body).Decode(&state); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidBody, "Invalid JSON")
+		return
+	}
+
+	if err := s.importState(state); err != nil {
+		writeError(w, http.StatusBadRequest, codeValidation, err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Runtime state imported"))
+
+	slog.InfoContext(r.Context(), "Runtime state imported", "rateLimiterEntries", state.RateLimiter.entries(), "quotaEntries", len(state.Quota))
+}
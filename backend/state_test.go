@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// adminRequest sends an admin-authenticated request and returns the status and body
+func adminRequest(t *testing.T, ts *httptest.Server, method, path, body string) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("building request: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer test-admin")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(data)
+}
+
+func TestExportImportStateRoundTrip(t *testing.T) {
+	env := map[string]string{"ADMIN_TOKEN": "test-admin", "PIXEL_COOLDOWN": "1h"}
+	src := startTestServer(t, newTestRoom(t, env))
+	dst := startTestServer(t, newTestRoom(t, env))
+
+	if status, body := postPixel(t, src, `{"x":1,"y":1,"color":"#FF0000","userId":"alice"}`); status != http.StatusOK {
+		t.Fatalf("first placement: %d %v", status, body)
+	}
+
+	status, state := adminRequest(t, src, http.MethodGet, "/api/admin/export-state", "")
+	if status != http.StatusOK {
+		t.Fatalf("export: %d %s", status, state)
+	}
+	if status, body := adminRequest(t, dst, http.MethodPost, "/api/admin/import-state", state); status != http.StatusOK {
+		t.Fatalf("import: %d %s", status, body)
+	}
+
+	// alice is still cooling down on the fresh instance; bob was never limited
+	status, body := postPixel(t, dst, `{"x":2,"y":2,"color":"#FF0000","userId":"alice"}`)
+	if status != http.StatusTooManyRequests {
+		t.Fatalf("alice after the import: %d %v, want 429", status, body)
+	}
+	if status, body := postPixel(t, dst, `{"x":3,"y":3,"color":"#FF0000","userId":"bob"}`); status != http.StatusOK {
+		t.Fatalf("bob after the import: %d %v, want 200", status, body)
+	}
+}
+
+func TestExportImportStateKeepsTokenBuckets(t *testing.T) {
+	env := map[string]string{"ADMIN_TOKEN": "test-admin", "PIXEL_COOLDOWN": "1h", "RATE_LIMIT_BURST": "2"}
+	src := startTestServer(t, newTestRoom(t, env))
+	dst := startTestServer(t, newTestRoom(t, env))
+
+	// alice spends her whole bucket
+	for i := 0; i < 2; i++ {
+		if status, body := postPixel(t, src, fmt.Sprintf(`{"x":%d,"y":1,"color":"#FF0000","userId":"alice"}`, i)); status != http.StatusOK {
+			t.Fatalf("placement %d: %d %v", i+1, status, body)
+		}
+	}
+
+	status, state := adminRequest(t, src, http.MethodGet, "/api/admin/export-state", "")
+	if status != http.StatusOK {
+		t.Fatalf("export: %d %s", status, state)
+	}
+	if status, body := adminRequest(t, dst, http.MethodPost, "/api/admin/import-state", state); status != http.StatusOK {
+		t.Fatalf("import: %d %s", status, body)
+	}
+
+	// Her bucket is still empty on the fresh instance, instead of full again
+	if status, body := postPixel(t, dst, `{"x":2,"y":2,"color":"#FF0000","userId":"alice"}`); status != http.StatusTooManyRequests {
+		t.Fatalf("alice after the import: %d %v, want 429", status, body)
+	}
+}
+
+func TestExportImportStateKeepsQuota(t *testing.T) {
+	env := map[string]string{"ADMIN_TOKEN": "test-admin", "PIXEL_COOLDOWN": "1h", "RATE_LIMIT_BURST": "10", "PLACEMENT_QUOTA": "2"}
+	src := startTestServer(t, newTestRoom(t, env))
+	dst := startTestServer(t, newTestRoom(t, env))
+
+	// alice uses up her quota; the bucket would allow more
+	for i := 0; i < 2; i++ {
+		if status, body := postPixel(t, src, fmt.Sprintf(`{"x":%d,"y":1,"color":"#FF0000","userId":"alice"}`, i)); status != http.StatusOK {
+			t.Fatalf("placement %d: %d %v", i+1, status, body)
+		}
+	}
+
+	status, state := adminRequest(t, src, http.MethodGet, "/api/admin/export-state", "")
+	if status != http.StatusOK {
+		t.Fatalf("export: %d %s", status, state)
+	}
+	if status, body := adminRequest(t, dst, http.MethodPost, "/api/admin/import-state", state); status != http.StatusOK {
+		t.Fatalf("import: %d %s", status, body)
+	}
+
+	status, body := postPixel(t, dst, `{"x":2,"y":2,"color":"#FF0000","userId":"alice"}`)
+	if status != http.StatusTooManyRequests || errorCode(body) != codeQuotaExceeded {
+		t.Fatalf("alice after the import: %d %v, want 429 %s", status, body, codeQuotaExceeded)
+	}
+}
+
+func TestExportImportStateKeepsIPCooldowns(t *testing.T) {
+	env := map[string]string{"ADMIN_TOKEN": "test-admin", "IP_COOLDOWN": "1h"}
+	src := startTestServer(t, newTestRoom(t, env))
+	dst := startTestServer(t, newTestRoom(t, env))
+
+	if status, body := postPixel(t, src, `{"x":1,"y":1,"color":"#FF0000","userId":"alice"}`); status != http.StatusOK {
+		t.Fatalf("first placement: %d %v", status, body)
+	}
+
+	status, state := adminRequest(t, src, http.MethodGet, "/api/admin/export-state", "")
+	if status != http.StatusOK {
+		t.Fatalf("export: %d %s", status, state)
+	}
+	if status, body := adminRequest(t, dst, http.MethodPost, "/api/admin/import-state", state); status != http.StatusOK {
+		t.Fatalf("import: %d %s", status, body)
+	}
+
+	// bob was never limited, but he places from alice's address
+	status, body := postPixel(t, dst, `{"x":2,"y":2,"color":"#FF0000","userId":"bob"}`)
+	if envelope, _ := body["error"].(map[string]interface{}); status != http.StatusTooManyRequests || envelope["reason"] != rateLimitIP {
+		t.Fatalf("bob after the import: %d %v, want 429 for the IP", status, body)
+	}
+}
+
+func TestImportStateIsAllOrNothing(t *testing.T) {
+	ts := startTestServer(t, newTestRoom(t, map[string]string{"ADMIN_TOKEN": "test-admin", "PIXEL_COOLDOWN": "1h"}))
+	postPixel(t, ts, `{"x":1,"y":1,"color":"#FF0000","userId":"alice"}`)
+
+	rejected := []string{
+		`{"version": 99, "rateLimiter": {}}`,
+		`{"version": 1, "rateLimiter": {"cooldowns": {"bob": 1700000000000}}}`,
+		fmt.Sprintf(`{"version": %d, "rateLimiter": {"cooldowns": {"bob": 1700000000000, "": 1700000000000}}}`, stateVersion),
+		fmt.Sprintf(`{"version": %d, "rateLimiter": {"cooldowns": {"bob": -5}}}`, stateVersion),
+		fmt.Sprintf(`{"version": %d, "rateLimiter": {"buckets": {"bob": {"tokens": 1, "updated": 0}}}}`, stateVersion),
+		fmt.Sprintf(`{"version": %d, "rateLimiter": {}, "quota": {"bob": [1700000000000, 1600000000000]}}`, stateVersion),
+		fmt.Sprintf(`{"version": %d, "rateLimiter": {}, "quota": {"bob": []}}`, stateVersion),
+		fmt.Sprintf(`{"version": %d, "rateLimiter": {}, "ipLimiter": {"cooldowns": {"127.0.0.1": 0}}}`, stateVersion),
+		`not json`,
+	}
+	for _, state := range rejected {
+		if status, body := adminRequest(t, ts, http.MethodPost, "/api/admin/import-state", state); status != http.StatusBadRequest {
+			t.Errorf("import %s: %d %s, want 400", state, status, body)
+		}
+	}
+
+	// None of the rejected snapshots replaced the limiter: alice is still limited
+	if status, _ := postPixel(t, ts, `{"x":2,"y":2,"color":"#FF0000","userId":"alice"}`); status != http.StatusTooManyRequests {
+		t.Fatalf("alice after rejected imports: %d, want 429", status)
+	}
+}
+
+func TestStateEndpointsRequireAdmin(t *testing.T) {
+	ts := startTestServer(t, newTestRoom(t, map[string]string{"ADMIN_TOKEN": "test-admin"}))
+
+	resp, err := http.Get(ts.URL + "/api/admin/export-state")
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("export without a token: %d, want 401", resp.StatusCode)
+	}
+}
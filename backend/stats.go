@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Region is an inclusive rectangle of canvas coordinates
+type Region struct {
+	X0, Y0 int // Top-left corner
+	X1, Y1 int // Bottom-right corner
+}
+
+// maxOwnerRegionArea caps the region size for /api/region/owners (a 500x500 square)
+const maxOwnerRegionArea = 500 * 500
+
+// Area returns the number of pixels in the region
+func (rg Region) Area() int {
+	return (rg.X1 - rg.X0 + 1) * (rg.Y1 - rg.Y0 + 1)
+}
+
+// Contains returns true if (x, y) is inside the region
+func (rg Region) Contains(x, y int) bool {
+	return x >= rg.X0 && x <= rg.X1 && y >= rg.Y0 && y <= rg.Y1
+}
+
+// parseRegionQuery reads an optional x0, y0, x1, y1 region from the query string
+// Without any of the parameters the whole canvas is returned. If any is given,
+// all four are required and the region must lie inside the canvas.
+func parseRegionQuery(r *http.Request, canvas CanvasConfig) (Region, error) {
+	query := r.URL.Query()
+	names := []string{"x0", "y0", "x1", "y1"}
+
+	present := 0
+	for _, name := range names {
+		if query.Has(name) {
+			present++
+		}
+	}
+	if present == 0 {
+		return canvas.Region(), nil
+	}
+	if present != len(names) {
+		return Region{}, fmt.Errorf("x0, y0, x1 and y1 must all be given")
+	}
+
+	values := make([]int, len(names))
+	for i, name := range names {
+		v, err := strconv.Atoi(query.Get(name))
+		if err != nil {
+			return Region{}, fmt.Errorf("%s must be an integer", name)
+		}
+		values[i] = v
+	}
+
+	region := Region{X0: values[0], Y0: values[1], X1: values[2], Y1: values[3]}
+	if !canvas.Contains(region.X0, region.Y0) || !canvas.Contains(region.X1, region.Y1) {
+		return Region{}, fmt.Errorf("region must be inside the %dx%d canvas", canvas.Width, canvas.Height)
+	}
+	if region.X0 > region.X1 || region.Y0 > region.Y1 {
+		return Region{}, fmt.Errorf("x0/y0 must not be greater than x1/y1")
+	}
+
+	return region, nil
+}
+
+// handleColorStats returns how many visible pixels each color has
+// An optional x0, y0, x1, y1 region restricts the count to part of the canvas
+func (s *Server) handleColorStats(w http.ResponseWriter, r *http.Request) {
+	s.writeCORS(w, r, "GET, OPTIONS")
+
+	region, err := parseRegionQuery(r, s.canvas)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeValidation, err.Error())
+		return
+	}
+
+	counts, err := s.db.ColorCounts(region.X0, region.Y0, region.X1, region.Y1)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to count colors", "err", err)
+		writeError(w, http.StatusInternalServerError, codeInternal, "Failed to compute color statistics")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(counts); err != nil {
+		slog.WarnContext(r.Context(), "Failed to encode color statistics", "err", err)
+	}
+}
+
+// handleRegionOwners returns how many visible pixels each user owns in a region,
+// biggest owner first - effectively "who controls this area"
+// The x0, y0, x1, y1 query parameters are required and the area is capped
+func (s *Server) handleRegionOwners(w http.ResponseWriter, r *http.Request) {
+	s.writeCORS(w, r, "GET, OPTIONS")
+
+	if !r.URL.Query().Has("x0") {
+		writeError(w, http.StatusBadRequest, codeValidation, "x0, y0, x1 and y1 are required")
+		return
+	}
+
+	region, err := parseRegionQuery(r, s.canvas)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeValidation, err.Error())
+		return
+	}
+
+	if region.Area() > maxOwnerRegionArea {
+		writeError(w, http.StatusBadRequest, codeValidation, fmt.Sprintf("region must not cover more than %d pixels", maxOwnerRegionArea))
+		return
+	}
+
+	owners, err := s.db.RegionOwners(region.X0, region.Y0, region.X1, region.Y1)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to compute region owners", "err", err)
+		writeError(w, http.StatusInternalServerError, codeInternal, "Failed to compute region owners")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(owners); err != nil {
+		slog.WarnContext(r.Context(), "Failed to encode region owners", "err", err)
+	}
+}
+
+// statsCache keeps the most recent /api/stats result for statsCacheTTL
+type statsCache struct {
+	mu         sync.Mutex
+	computedAt time.Time
+	stats      *CanvasStats // nil until the first computation
+}
+
+// handleStats returns canvas-wide analytics for the stats dashboard
+// The aggregates scan the history, so the result is cached for statsCacheTTL
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	s.writeCORS(w, r, "GET, OPTIONS")
+
+	stats, err := s.canvasStats()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to compute canvas statistics", "err", err)
+		writeError(w, http.StatusInternalServerError, codeInternal, "Failed to compute statistics")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(stats); err != nil {
+		slog.WarnContext(r.Context(), "Failed to encode canvas statistics", "err", err)
+	}
+}
+
+// canvasStats returns the cached statistics, recomputing them only when the
+// cached copy is older than statsCacheTTL
+func (s *Server) canvasStats() (*CanvasStats, error) {
+	cache := &s.stats
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	if cache.stats != nil && timeNow().Sub(cache.computedAt) < s.statsCacheTTL {
+		return cache.stats, nil
+	}
+
+	stats, err := s.db.GetStats(timeNow())
+	if err != nil {
+		return nil, err
+	}
+
+	cache.computedAt = timeNow()
+	cache.stats = &stats
+	return cache.stats, nil
+}
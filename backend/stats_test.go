@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// getColorStats fetches /api/stats/colors with the given query string
+func getColorStats(t *testing.T, url, query string) (int, []ColorCount) {
+	t.Helper()
+	resp, err := http.Get(url + "/api/stats/colors" + query)
+	if err != nil {
+		t.Fatalf("GET /api/stats/colors: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var counts []ColorCount
+	if resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(&counts); err != nil {
+			t.Fatalf("decoding response: %v", err)
+		}
+	}
+	return resp.StatusCode, counts
+}
+
+func TestColorCountsEmptyCanvas(t *testing.T) {
+	db := newTestDatabase(t)
+
+	counts, err := db.ColorCounts(0, 0, 999, 999)
+	if err != nil {
+		t.Fatalf("color counts: %v", err)
+	}
+	// An empty list, not nil, so the endpoint encodes [] rather than null
+	if counts == nil || len(counts) != 0 {
+		t.Fatalf("counts %#v, want an empty list", counts)
+	}
+}
+
+func TestColorCountsOrderAndRegion(t *testing.T) {
+	db := newTestDatabase(t)
+	db.SavePixelBatch([]PixelUpdate{
+		{X: 1, Y: 1, Color: "#FF0000", UserID: "alice"},
+		{X: 2, Y: 1, Color: "#FF0000", UserID: "alice"},
+		{X: 3, Y: 1, Color: "#00FF00", UserID: "bob"},
+		{X: 50, Y: 50, Color: "#0000FF", UserID: "carol"},
+		{X: 51, Y: 50, Color: "#0000FF", UserID: "carol"},
+		{X: 52, Y: 50, Color: "#0000FF", UserID: "carol"},
+	})
+	// The overlay pixel hides the green one below it
+	db.SavePixelToLayer(PixelUpdate{X: 3, Y: 1, Color: "#FF0000", UserID: adminUserID}, LayerOverlay)
+
+	counts, err := db.ColorCounts(0, 0, 999, 999)
+	if err != nil {
+		t.Fatalf("color counts: %v", err)
+	}
+	want := []ColorCount{{"#0000FF", 3}, {"#FF0000", 3}}
+	if !reflect.DeepEqual(counts, want) {
+		t.Fatalf("whole canvas %v, want %v", counts, want)
+	}
+
+	counts, err = db.ColorCounts(0, 0, 10, 10)
+	if err != nil {
+		t.Fatalf("color counts: %v", err)
+	}
+	want = []ColorCount{{"#FF0000", 3}}
+	if !reflect.DeepEqual(counts, want) {
+		t.Fatalf("region %v, want %v", counts, want)
+	}
+}
+
+func TestColorStatsEndpoint(t *testing.T) {
+	// A palette-restricted canvas only ever reports palette colors;
+	// write-through so the placements are in the database before the query
+	room := newTestRoom(t, map[string]string{"PALETTE": "#FF0000,#00FF00", "PERSISTENCE_MODE": "write-through"})
+	ts := startTestServer(t, room)
+
+	if status, counts := getColorStats(t, ts.URL, ""); status != http.StatusOK || len(counts) != 0 {
+		t.Fatalf("empty canvas: %d %v, want 200 []", status, counts)
+	}
+
+	postPixel(t, ts, `{"x":1,"y":1,"color":"#FF0000","userId":"alice"}`)
+	postPixel(t, ts, `{"x":2,"y":2,"color":"#00FF00","userId":"bob"}`)
+	postPixel(t, ts, `{"x":3,"y":3,"color":"#00FF00","userId":"carol"}`)
+	postPixel(t, ts, `{"x":4,"y":4,"color":"#0000FF","userId":"dave"}`)
+
+	status, counts := getColorStats(t, ts.URL, "")
+	want := []ColorCount{{"#00FF00", 2}, {"#FF0000", 1}}
+	if status != http.StatusOK || !reflect.DeepEqual(counts, want) {
+		t.Fatalf("whole canvas: %d %v, want 200 %v", status, counts, want)
+	}
+
+	status, counts = getColorStats(t, ts.URL, "?x0=0&y0=0&x1=1&y1=1")
+	want = []ColorCount{{"#FF0000", 1}}
+	if status != http.StatusOK || !reflect.DeepEqual(counts, want) {
+		t.Fatalf("region: %d %v, want 200 %v", status, counts, want)
+	}
+
+	for _, query := range []string{"?x0=0&y0=0", "?x0=a&y0=0&x1=1&y1=1", "?x0=5&y0=0&x1=1&y1=1", "?x0=0&y0=0&x1=5000&y1=1"} {
+		if status, _ := getColorStats(t, ts.URL, query); status != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", query, status)
+		}
+	}
+}
+
+func TestRegionOwners(t *testing.T) {
+	db := newTestDatabase(t)
+	// A 4x2 region: alice owns the left three columns, bob the last one,
+	// and carol has a pixel outside it
+	var pixels []PixelUpdate
+	for y := 0; y < 2; y++ {
+		for x := 0; x < 4; x++ {
+			owner := "alice"
+			if x == 3 {
+				owner = "bob"
+			}
+			pixels = append(pixels, PixelUpdate{X: x, Y: y, Color: "#FF0000", UserID: owner})
+		}
+	}
+	pixels = append(pixels, PixelUpdate{X: 20, Y: 20, Color: "#FF0000", UserID: "carol"})
+	db.SavePixelBatch(pixels)
+
+	owners, err := db.RegionOwners(0, 0, 3, 1)
+	if err != nil {
+		t.Fatalf("region owners: %v", err)
+	}
+	want := []UserStat{{"alice", 6}, {"bob", 2}}
+	if !reflect.DeepEqual(owners, want) {
+		t.Fatalf("owners %v, want %v", owners, want)
+	}
+
+	// An empty region is an empty list, not nil
+	owners, err = db.RegionOwners(100, 100, 110, 110)
+	if err != nil {
+		t.Fatalf("region owners: %v", err)
+	}
+	if owners == nil || len(owners) != 0 {
+		t.Fatalf("empty region %#v, want an empty list", owners)
+	}
+}
+
+func TestRegionOwnersEndpoint(t *testing.T) {
+	ts := startTestServer(t, newTestRoom(t, map[string]string{"PERSISTENCE_MODE": "write-through"}))
+	postPixel(t, ts, `{"x":1,"y":1,"color":"#FF0000","userId":"alice"}`)
+
+	get := func(query string) (int, string) {
+		t.Helper()
+		resp, err := http.Get(ts.URL + "/api/region/owners" + query)
+		if err != nil {
+			t.Fatalf("GET: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, strings.TrimSpace(string(body))
+	}
+
+	if status, body := get("?x0=0&y0=0&x1=5&y1=5"); status != http.StatusOK || body != `[{"userId":"alice","count":1}]` {
+		t.Fatalf("region: %d %s", status, body)
+	}
+	if status, body := get("?x0=10&y0=10&x1=20&y1=20"); status != http.StatusOK || body != `[]` {
+		t.Fatalf("empty region: %d %s, want 200 []", status, body)
+	}
+
+	// The region is required, must be inside the canvas and is capped
+	for _, query := range []string{"", "?x0=0&y0=0&x1=5", "?x0=0&y0=0&x1=1000&y1=5", "?x0=0&y0=0&x1=999&y1=999"} {
+		if status, _ := get(query); status != http.StatusBadRequest {
+			t.Errorf("%q: status %d, want 400", query, status)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Store is the persistence interface of the canvas
+// *Database implements it for both SQLite and PostgreSQL; which one is used
+// is decided when the database is opened (see OpenDatabase).
+type Store interface {
+	// SavePixel saves or updates a pixel on the base layer
+	SavePixel(pixel PixelUpdate) error
+
+	// SavePixelBatch saves many base-layer pixels in one transaction
+	SavePixelBatch(pixels []PixelUpdate) error
+
+	// GetAllPixels returns the visible canvas
+	GetAllPixels() ([]PixelUpdate, error)
+
+	// GetPixelsInRegion returns the visible pixels inside a w x h rectangle
+	GetPixelsInRegion(x, y, w, h int) ([]PixelUpdate, error)
+
+	// GetPixelCount returns the number of visible pixels
+	GetPixelCount() (int, error)
+
+	// ClearCanvas removes every pixel
+	ClearCanvas() error
+
+	// Close releases the connection
+	Close() error
+
+	// ForEachHistoryEntry calls fn for every history entry in placement order
+	ForEachHistoryEntry(fn func(HistoryEntry) error) error
+
+	// ApplyHistoryEntry records an entry and applies it to the canvas
+	ApplyHistoryEntry(entry HistoryEntry) error
+
+	// GetHistoryCount returns the number of history entries
+	GetHistoryCount() (int, error)
+
+	// Checksum returns a hash of the visible canvas
+	Checksum() (string, error)
+}
+
+// Database dialects
+const (
+	dialectSQLite   = "sqlite"
+	dialectPostgres = "postgres"
+)
+
+// OpenDatabase opens the database named by target
+//
+//   - postgres://... or postgresql://... connects to PostgreSQL
+//   - sqlite://path opens the SQLite file at path
+//   - anything else is taken as a SQLite file path
+//
+// A plain path keeps local runs zero-config: without DATABASE_URL the
+// server opens ./canvas.db as before.
+func OpenDatabase(target string) (*Database, error) {
+	scheme, rest, found := strings.Cut(target, "://")
+	if !found {
+		return NewDatabase(target)
+	}
+
+	switch scheme {
+	case "postgres", "postgresql":
+		return NewPostgresDatabase(target)
+	case "sqlite", "sqlite3":
+		return NewDatabase(rest)
+	default:
+		return nil, fmt.Errorf("unsupported database URL scheme %q (use postgres:// or sqlite://)", scheme)
+	}
+}
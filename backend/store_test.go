@@ -0,0 +1,118 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// testStores returns the Store implementations to run a test against
+// SQLite always runs; PostgreSQL only when TEST_DATABASE_URL points at a
+// server, whose canvas is cleared first (so use a throwaway database).
+func testStores(t *testing.T) map[string]Store {
+	t.Helper()
+	stores := map[string]Store{dialectSQLite: newTestDatabase(t)}
+
+	if url := os.Getenv("TEST_DATABASE_URL"); url != "" {
+		db, err := OpenDatabase(url)
+		if err != nil {
+			t.Fatalf("opening %s: %v", postgresHost(url), err)
+		}
+		t.Cleanup(func() { db.Close() })
+		if err := db.ClearCanvas(); err != nil {
+			t.Fatalf("clearing the PostgreSQL canvas: %v", err)
+		}
+		stores[dialectPostgres] = db
+	}
+	return stores
+}
+
+// sortPixels orders pixels by row, then column
+func sortPixels(pixels []PixelUpdate) {
+	sort.Slice(pixels, func(i, j int) bool {
+		if pixels[i].Y != pixels[j].Y {
+			return pixels[i].Y < pixels[j].Y
+		}
+		return pixels[i].X < pixels[j].X
+	})
+}
+
+func TestStore(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			if err := store.SavePixelBatch([]PixelUpdate{
+				{X: 0, Y: 0, Color: "#FF0000", UserID: "alice", Timestamp: 1000},
+				{X: 5, Y: 5, Color: "#00FF00", UserID: "bob", Timestamp: 2000},
+				{X: 9, Y: 9, Color: "#0000FF", UserID: "alice", Timestamp: 3000},
+			}); err != nil {
+				t.Fatalf("SavePixelBatch: %v", err)
+			}
+
+			// Saving a taken coordinate replaces the pixel (ON CONFLICT on PostgreSQL)
+			if err := store.SavePixel(PixelUpdate{X: 5, Y: 5, Color: "#FFFFFF", UserID: "carol", Timestamp: 4000}); err != nil {
+				t.Fatalf("SavePixel: %v", err)
+			}
+
+			if count, err := store.GetPixelCount(); err != nil || count != 3 {
+				t.Fatalf("GetPixelCount = %d, %v; want 3", count, err)
+			}
+
+			all, err := store.GetAllPixels()
+			if err != nil {
+				t.Fatalf("GetAllPixels: %v", err)
+			}
+			sortPixels(all)
+			want := []PixelUpdate{
+				{X: 0, Y: 0, Color: "#FF0000", UserID: "alice"},
+				{X: 5, Y: 5, Color: "#FFFFFF", UserID: "carol"},
+				{X: 9, Y: 9, Color: "#0000FF", UserID: "alice"},
+			}
+			if len(all) != len(want) {
+				t.Fatalf("GetAllPixels = %+v, want %+v", all, want)
+			}
+			for i := range want {
+				if all[i].X != want[i].X || all[i].Y != want[i].Y || all[i].Color != want[i].Color || all[i].UserID != want[i].UserID {
+					t.Fatalf("GetAllPixels = %+v, want %+v", all, want)
+				}
+			}
+
+			// The region is x, y, width, height: (5,5) is inside and (9,9) is
+			// just past its far corner
+			region, err := store.GetPixelsInRegion(1, 1, 8, 8)
+			if err != nil {
+				t.Fatalf("GetPixelsInRegion: %v", err)
+			}
+			if len(region) != 1 || region[0].X != 5 || region[0].Color != "#FFFFFF" {
+				t.Fatalf("GetPixelsInRegion = %+v, want carol's pixel at (5,5)", region)
+			}
+
+			if err := store.ClearCanvas(); err != nil {
+				t.Fatalf("ClearCanvas: %v", err)
+			}
+			if count, err := store.GetPixelCount(); err != nil || count != 0 {
+				t.Fatalf("GetPixelCount after clearing = %d, %v; want 0", count, err)
+			}
+		})
+	}
+}
+
+func TestOpenDatabase(t *testing.T) {
+	dir := t.TempDir()
+
+	// A plain path and a sqlite:// URL both open a SQLite file
+	for _, target := range []string{filepath.Join(dir, "plain.db"), "sqlite://" + filepath.Join(dir, "url.db")} {
+		db, err := OpenDatabase(target)
+		if err != nil {
+			t.Fatalf("%s: %v", target, err)
+		}
+		if db.dialect != dialectSQLite {
+			t.Errorf("%s: dialect %q, want %q", target, db.dialect, dialectSQLite)
+		}
+		db.Close()
+	}
+
+	if _, err := OpenDatabase("mysql://localhost/canvas"); err == nil {
+		t.Fatal("unsupported scheme accepted")
+	}
+}
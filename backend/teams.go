@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// Teams
+//
+// For faction events the config file can split users into teams, each with
+// a single color:
+//
+//	"teams": [{"name": "red", "color": "#E50000"}, {"name": "blue", "color": "#0000EA"}]
+//
+// With teams configured, every placement needs a team and may only use that
+// team's color; anything else is refused with 400. The team comes from the
+// same place as the user:
+//
+//   - with AUTH_SECRET, the token's "team" claim, so users can't choose it
+//     (`wplace-backend -issue-token alice -token-team red`)
+//   - otherwise the pixel's "team" field (?team= on the WebSocket), which is
+//     trusted as sent, just like the userId
+//
+// The team is only used for the check and isn't stored or broadcast. Like
+// zones, teams are reloaded on SIGHUP. GET /api/teams lists them with the
+// number of visible pixels in each team's color.
+
+// Team is a faction and the one color its members may place
+type Team struct {
+	Name  string `json:"name"`
+	Color string `json:"color"`
+}
+
+// TeamStat is one entry of GET /api/teams
+type TeamStat struct {
+	Name   string `json:"name"`
+	Color  string `json:"color"`
+	Pixels int    `json:"pixels"` // Visible pixels in the team's color
+}
+
+// validateTeams checks the teams and that their names and colors are unique
+// Team colors must be in the palette when there is one.
+func validateTeams(teams []Team, palette []string) error {
+	names := make(map[string]bool, len(teams))
+	colors := make(map[string]bool, len(teams))
+	for _, team := range teams {
+		if !userIDRegex.MatchString(team.Name) {
+			return fmt.Errorf("team name %q may only contain letters, digits, dashes and underscores", team.Name)
+		}
+		if !hexColorRegex.MatchString(team.Color) {
+			return fmt.Errorf("team %q color %q is not in #RRGGBB format", team.Name, team.Color)
+		}
+
+		color := strings.ToUpper(team.Color)
+		if names[team.Name] {
+			return fmt.Errorf("team %q is listed twice", team.Name)
+		}
+		if colors[color] {
+			return fmt.Errorf("team %q has the same color as another team", team.Name)
+		}
+		if len(palette) > 0 && !containsFold(palette, color) {
+			return fmt.Errorf("team %q color %s is not in the palette", team.Name, team.Color)
+		}
+		names[team.Name], colors[color] = true, true
+	}
+	return nil
+}
+
+// containsFold returns true if list has value, ignoring case
+func containsFold(list []string, value string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkTeam refuses a placement that doesn't use its team's color
+// Without teams in the config every placement passes. The team is cleared
+// afterwards so it isn't broadcast.
+func checkTeam(cfg *Config, pixel *PixelUpdate) *placementError {
+	name := pixel.Team
+	pixel.Team = ""
+	if len(cfg.Teams) == 0 {
+		return nil
+	}
+
+	var message string
+	team, ok := cfg.teams[name]
+	switch {
+	case name == "":
+		message = "team is required for placing pixels"
+	case !ok:
+		message = fmt.Sprintf("unknown team %q", name)
+	case !strings.EqualFold(pixel.Color, team.Color):
+		message = fmt.Sprintf("team %q may only place %s", team.Name, team.Color)
+	default:
+		return nil
+	}
+
+	pixelsRejected.WithLabelValues(rejectValidation).Inc()
+	return &placementError{status: http.StatusBadRequest, code: codeValidation, message: message}
+}
+
+// handleTeams lists the teams and how many visible pixels have their color
+// The counts come from the same color aggregation as /api/stats/colors.
+// Without teams in the config the list is empty.
+func (s *Server) handleTeams(w http.ResponseWriter, r *http.Request) {
+	s.writeCORS(w, r, "GET, OPTIONS")
+
+	teams := s.config.Get().Teams
+	stats := make([]TeamStat, len(teams))
+	if len(teams) > 0 {
+		region := s.canvas.Region()
+		counts, err := s.db.ColorCounts(region.X0, region.Y0, region.X1, region.Y1)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Failed to count colors", "err", err)
+			writeError(w, http.StatusInternalServerError, codeInternal, "Failed to compute team statistics")
+			return
+		}
+
+		// Pixels keep the case they were placed in, so counts are matched
+		// ignoring it
+		byColor := make(map[string]int, len(counts))
+		for _, count := range counts {
+			byColor[strings.ToUpper(count.Color)] += count.Count
+		}
+		for i, team := range teams {
+			stats[i] = TeamStat{Name: team.Name, Color: team.Color, Pixels: byColor[strings.ToUpper(team.Color)]}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(stats); err != nil {
+		slog.WarnContext(r.Context(), "Failed to encode team statistics", "err", err)
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// ThumbnailMode is how a thumbnail is downscaled from the full canvas
+type ThumbnailMode string
+
+const (
+	// thumbnailNearest picks the source pixel at the center of each thumbnail pixel
+	thumbnailNearest ThumbnailMode = "nearest"
+
+	// thumbnailArea averages every source pixel covered by a thumbnail pixel,
+	// weighted by how much of it is covered
+	thumbnailArea ThumbnailMode = "area"
+)
+
+// ParseThumbnailMode checks a THUMBNAIL_MODE (or ?mode=) value
+func ParseThumbnailMode(value string) (ThumbnailMode, error) {
+	switch mode := ThumbnailMode(value); mode {
+	case thumbnailNearest, thumbnailArea:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown thumbnail mode %q (expected %q or %q)", value, thumbnailArea, thumbnailNearest)
+	}
+}
+
+// maxThumbnailSize caps the requested thumbnail width and height
+const maxThumbnailSize = 512
+
+// thumbnailCache keeps the most recently rendered thumbnail
+// It is valid as long as the canvas version and the requested size/mode match
+type thumbnailCache struct {
+	mu      sync.Mutex
+	version int64  // Canvas version the thumbnail was rendered from
+	key     string // Width, height and mode of the cached thumbnail
+	png     []byte // Encoded PNG
+}
+
+// RenderThumbnail renders the canvas scaled down to w x h pixels
+// mode is thumbnailNearest or thumbnailArea
+func (d *Database) RenderThumbnail(canvas CanvasConfig, w, h int, mode ThumbnailMode) (*image.RGBA, error) {
+	full, err := d.RenderCanvas(canvas)
+	if err != nil {
+		return nil, err
+	}
+
+	return downscale(full, w, h, mode)
+}
+
+// downscale resizes src to w x h pixels
+// Scale factors don't have to be integers: with area averaging, source pixels
+// that straddle a thumbnail pixel boundary contribute proportionally to both
+func downscale(src *image.RGBA, w, h int, mode ThumbnailMode) (*image.RGBA, error) {
+	if w <= 0 || h <= 0 {
+		return nil, fmt.Errorf("thumbnail size must be positive")
+	}
+
+	bounds := src.Bounds()
+	scaleX := float64(bounds.Dx()) / float64(w)
+	scaleY := float64(bounds.Dy()) / float64(h)
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+
+	for ty := 0; ty < h; ty++ {
+		for tx := 0; tx < w; tx++ {
+			switch mode {
+			case thumbnailNearest:
+				sx := bounds.Min.X + int((float64(tx)+0.5)*scaleX)
+				sy := bounds.Min.Y + int((float64(ty)+0.5)*scaleY)
+				dst.SetRGBA(tx, ty, src.RGBAAt(sx, sy))
+
+			case thumbnailArea:
+				dst.SetRGBA(tx, ty, areaAverage(src,
+					float64(tx)*scaleX, float64(ty)*scaleY,
+					float64(tx+1)*scaleX, float64(ty+1)*scaleY))
+
+			default:
+				return nil, fmt.Errorf("unknown thumbnail mode %q", mode)
+			}
+		}
+	}
+
+	return dst, nil
+}
+
+// areaAverage returns the average color of src over the rectangle (x0, y0)-(x1, y1)
+// The rectangle is in source pixel units and may start or end partway through a pixel
+func areaAverage(src *image.RGBA, x0, y0, x1, y1 float64) color.RGBA {
+	bounds := src.Bounds()
+	var r, g, b, a, total float64
+
+	for sy := int(y0); float64(sy) < y1 && sy < bounds.Dy(); sy++ {
+		// How much of this source row lies inside the rectangle
+		wy := overlap(float64(sy), y0, y1)
+
+		for sx := int(x0); float64(sx) < x1 && sx < bounds.Dx(); sx++ {
+			weight := wy * overlap(float64(sx), x0, x1)
+			c := src.RGBAAt(bounds.Min.X+sx, bounds.Min.Y+sy)
+
+			r += float64(c.R) * weight
+			g += float64(c.G) * weight
+			b += float64(c.B) * weight
+			a += float64(c.A) * weight
+			total += weight
+		}
+	}
+
+	if total == 0 {
+		return backgroundColor
+	}
+
+	return color.RGBA{
+		R: uint8(r/total + 0.5),
+		G: uint8(g/total + 0.5),
+		B: uint8(b/total + 0.5),
+		A: uint8(a/total + 0.5),
+	}
+}
+
+// overlap returns how much of the unit interval [p, p+1) lies inside [lo, hi)
+func overlap(p, lo, hi float64) float64 {
+	start := p
+	if lo > start {
+		start = lo
+	}
+	end := p + 1
+	if hi < end {
+		end = hi
+	}
+	if end <= start {
+		return 0
+	}
+	return end - start
+}
+
+// handleThumbnail returns a downscaled PNG of the canvas
+// Query parameters: w and h (default 100, larger values are clamped to
+// maxThumbnailSize) and an optional mode ("area" or "nearest") overriding the server default
+func (s *Server) handleThumbnail(w http.ResponseWriter, r *http.Request) {
+	s.writeCORS(w, r, "GET, OPTIONS")
+
+	width, errW := thumbnailDimension(r.URL.Query().Get("w"))
+	height, errH := thumbnailDimension(r.URL.Query().Get("h"))
+	if errW != nil || errH != nil {
+		writeError(w, http.StatusBadRequest, codeValidation, "w and h must be positive integers")
+		return
+	}
+
+	mode := s.thumbnailMode
+	if value := r.URL.Query().Get("mode"); value != "" {
+		var err error
+		if mode, err = ParseThumbnailMode(value); err != nil {
+			writeError(w, http.StatusBadRequest, codeValidation, "mode must be \"area\" or \"nearest\"")
+			return
+		}
+	}
+
+	data, err := s.thumbnail(width, height, mode)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to render thumbnail", "err", err)
+		writeError(w, http.StatusInternalServerError, codeInternal, "Failed to render thumbnail")
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// thumbnail returns the encoded PNG thumbnail, re-rendering only when the
+// canvas changed or a different size/mode was requested since the last call
+func (s *Server) thumbnail(width, height int, mode ThumbnailMode) ([]byte, error) {
+	cache := &s.thumbnails
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	key := fmt.Sprintf("%dx%d/%s", width, height, mode)
+	version := s.db.Version()
+	if cache.png != nil && cache.version == version && cache.key == key {
+		return cache.png, nil
+	}
+
+	img, err := s.db.RenderThumbnail(s.canvas, width, height, mode)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+
+	cache.version = version
+	cache.key = key
+	cache.png = buf.Bytes()
+	return cache.png, nil
+}
+
+// thumbnailDimension parses a thumbnail width or height (default 100)
+// Values above maxThumbnailSize are clamped to it rather than rejected.
+func thumbnailDimension(value string) (int, error) {
+	if value == "" {
+		return 100, nil
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("invalid thumbnail dimension %q", value)
+	}
+	if n > maxThumbnailSize {
+		n = maxThumbnailSize
+	}
+	return n, nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"testing"
+)
+
+var (
+	red   = color.RGBA{R: 255, A: 255}
+	blue  = color.RGBA{B: 255, A: 255}
+	white = color.RGBA{R: 255, G: 255, B: 255, A: 255}
+)
+
+// quadrants returns a 4x4 image with red, blue, white and blue 2x2 quadrants
+// (top-left, top-right, bottom-left, bottom-right)
+func quadrants() *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 4; x++ {
+			c := blue
+			if x < 2 && y < 2 {
+				c = red
+			} else if x < 2 {
+				c = white
+			}
+			img.SetRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+func TestDownscaleIntegerFactor(t *testing.T) {
+	want := [][]color.RGBA{{red, blue}, {white, blue}}
+
+	for _, mode := range []ThumbnailMode{thumbnailArea, thumbnailNearest} {
+		thumb, err := downscale(quadrants(), 2, 2, mode)
+		if err != nil {
+			t.Fatalf("%s: %v", mode, err)
+		}
+		for y, row := range want {
+			for x, c := range row {
+				if got := thumb.RGBAAt(x, y); got != c {
+					t.Errorf("%s (%d,%d) = %v, want %v", mode, x, y, got, c)
+				}
+			}
+		}
+	}
+}
+
+func TestDownscaleNonIntegerFactor(t *testing.T) {
+	// 4 -> 3 columns over the full height, so each thumbnail pixel covers
+	// 1 1/3 source columns and straddles a column boundary
+	thumb, err := downscale(quadrants(), 3, 1, thumbnailArea)
+	if err != nil {
+		t.Fatalf("downscale: %v", err)
+	}
+
+	// Left: columns 0 and a third of 1, half red and half white
+	if got, want := thumb.RGBAAt(0, 0), (color.RGBA{R: 255, G: 128, B: 128, A: 255}); got != want {
+		t.Errorf("left = %v, want %v", got, want)
+	}
+	// Middle: two thirds of columns 1 and 2 - a quarter red, a quarter
+	// white and half blue
+	if got, want := thumb.RGBAAt(1, 0), (color.RGBA{R: 128, G: 64, B: 191, A: 255}); got != want {
+		t.Errorf("middle = %v, want %v", got, want)
+	}
+	if got := thumb.RGBAAt(2, 0); got != blue {
+		t.Errorf("right = %v, want %v", got, blue)
+	}
+}
+
+func TestDownscaleRejectsBadInput(t *testing.T) {
+	if _, err := downscale(quadrants(), 0, 2, thumbnailArea); err == nil {
+		t.Error("zero width accepted")
+	}
+	if _, err := downscale(quadrants(), 2, 2, "bicubic"); err == nil {
+		t.Error("unknown mode accepted")
+	}
+}
+
+func TestParseThumbnailMode(t *testing.T) {
+	for _, value := range []string{"area", "nearest"} {
+		if mode, err := ParseThumbnailMode(value); err != nil || string(mode) != value {
+			t.Errorf("%q: %q, %v", value, mode, err)
+		}
+	}
+	for _, value := range []string{"", "Area", "bilinear"} {
+		if _, err := ParseThumbnailMode(value); err == nil {
+			t.Errorf("%q accepted", value)
+		}
+	}
+}
+
+func TestUnknownThumbnailModeStopsStartup(t *testing.T) {
+	t.Setenv("THUMBNAIL_MODE", "bilinear")
+	liveConfig, err := NewLiveConfig("")
+	if err != nil {
+		t.Fatalf("loading config: %v", err)
+	}
+	db := newTestDatabase(t)
+
+	if _, err := newRoom("", db, liveConfig.Get().Canvas, roomOptions{liveConfig: liveConfig, drain: NewDrain(0)}); err == nil {
+		t.Fatal("room built with an unknown thumbnail mode")
+	}
+}
+
+func TestThumbnailEndpoint(t *testing.T) {
+	room := newTestRoom(t, map[string]string{"CANVAS_WIDTH": "4", "CANVAS_HEIGHT": "4", "PERSISTENCE_MODE": "write-through"})
+	ts := startTestServer(t, room)
+
+	// The same quadrants as quadrants(), on a white canvas
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 4; x++ {
+			switch {
+			case x < 2 && y < 2:
+				room.server.db.SavePixel(PixelUpdate{X: x, Y: y, Color: "#FF0000", UserID: "alice"})
+			case x >= 2:
+				room.server.db.SavePixel(PixelUpdate{X: x, Y: y, Color: "#0000FF", UserID: "bob"})
+			}
+		}
+	}
+
+	get := func(query string) (int, image.Image) {
+		t.Helper()
+		resp, err := http.Get(ts.URL + "/api/canvas/thumbnail" + query)
+		if err != nil {
+			t.Fatalf("GET: %v", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return resp.StatusCode, nil
+		}
+		img, err := png.Decode(resp.Body)
+		if err != nil {
+			t.Fatalf("decoding PNG: %v", err)
+		}
+		return resp.StatusCode, img
+	}
+
+	status, img := get("?w=2&h=2&mode=nearest")
+	if status != http.StatusOK {
+		t.Fatalf("status %d, want 200", status)
+	}
+	want := [][]color.RGBA{{red, blue}, {white, blue}}
+	for y, row := range want {
+		for x, c := range row {
+			if got := color.RGBAModel.Convert(img.At(x, y)); got != c {
+				t.Errorf("(%d,%d) = %v, want %v", x, y, got, c)
+			}
+		}
+	}
+
+	// Oversized dimensions are clamped, not rejected
+	status, img = get("?w=5000&h=600")
+	if status != http.StatusOK {
+		t.Fatalf("oversized: status %d, want 200", status)
+	}
+	if size := img.Bounds().Size(); size.X != maxThumbnailSize || size.Y != maxThumbnailSize {
+		t.Fatalf("oversized: %v, want %dx%d", size, maxThumbnailSize, maxThumbnailSize)
+	}
+
+	for _, query := range []string{"?w=0", "?h=-3", "?w=abc", "?mode=bicubic"} {
+		if status, _ := get(query); status != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", query, status)
+		}
+	}
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Timelapse export
+//
+// GET /api/timelapse replays the pixel history and streams the canvas as a
+// sequence of PNG frames inside a ZIP archive. Frames are rendered and written
+// one at a time, so memory stays at a few canvas-sized images no matter how
+// many frames are requested, and the history is read in short pages.
+
+// Limits for /api/timelapse
+const (
+	// defaultTimelapseMaxFrames is the frame limit when TIMELAPSE_MAX_FRAMES is not set
+	defaultTimelapseMaxFrames = 500
+
+	// timelapsePageSize is how many history entries are read per query
+	timelapsePageSize = 5000
+)
+
+// timelapseFrame describes one frame in the frames.json manifest
+type timelapseFrame struct {
+	File       string `json:"file"`
+	Time       int64  `json:"time"`       // Placements up to this Unix time (ms) are shown
+	Placements int    `json:"placements"` // History entries applied since from
+}
+
+// timelapseCanvas is the canvas being rebuilt from the history
+// Each layer is kept separately (a zero alpha means no pixel) so removing an
+// overlay pixel reveals the base pixel underneath, like in canvas_state
+type timelapseCanvas struct {
+	canvas     CanvasConfig
+	background color.RGBA
+	layers     [2]*image.RGBA // LayerBase and LayerOverlay
+	frame      *image.RGBA    // Composited image, reused for every frame
+}
+
+// newTimelapseCanvas creates an empty canvas
+func newTimelapseCanvas(canvas CanvasConfig) *timelapseCanvas {
+	background, err := parseHexColor(canvas.Background)
+	if err != nil {
+		background = backgroundColor
+	}
+
+	bounds := image.Rect(0, 0, canvas.Width, canvas.Height)
+	return &timelapseCanvas{
+		canvas:     canvas,
+		background: background,
+		layers:     [2]*image.RGBA{image.NewRGBA(bounds), image.NewRGBA(bounds)},
+		frame:      image.NewRGBA(bounds),
+	}
+}
+
+// apply paints or removes the pixel of one history entry
+// Entries outside the canvas, on unknown layers or with invalid colors are skipped
+func (t *timelapseCanvas) apply(entry HistoryEntry) {
+	if !t.canvas.Contains(entry.X, entry.Y) || entry.Layer < 0 || entry.Layer >= len(t.layers) {
+		return
+	}
+
+	layer := t.layers[entry.Layer]
+	if entry.IsTombstone() {
+		layer.SetRGBA(entry.X, entry.Y, color.RGBA{})
+		return
+	}
+
+	c, err := parseHexColor(entry.Color)
+	if err != nil {
+		return
+	}
+	layer.SetRGBA(entry.X, entry.Y, c)
+}
+
+// render composites the layers over the background into t.frame
+// Translucent pixels (ALPHA_COLORS) are blended over what is below them.
+func (t *timelapseCanvas) render() *image.RGBA {
+	base, overlay := t.layers[LayerBase].Pix, t.layers[LayerOverlay].Pix
+	pix := t.frame.Pix
+	for i := 0; i < len(pix); i += 4 {
+		switch {
+		case overlay[i+3] == 255:
+			copy(pix[i:i+4], overlay[i:i+4])
+		case overlay[i+3] == 0 && base[i+3] == 255:
+			copy(pix[i:i+4], base[i:i+4])
+		default:
+			c := t.background
+			if base[i+3] != 0 {
+				c = blendOver(c, color.RGBA{R: base[i], G: base[i+1], B: base[i+2], A: base[i+3]})
+			}
+			if overlay[i+3] != 0 {
+				c = blendOver(c, color.RGBA{R: overlay[i], G: overlay[i+1], B: overlay[i+2], A: overlay[i+3]})
+			}
+			pix[i], pix[i+1], pix[i+2], pix[i+3] = c.R, c.G, c.B, c.A
+		}
+	}
+	return t.frame
+}
+
+// timelapseParams are the parsed query parameters of /api/timelapse
+// Exactly one of step and every is set
+type timelapseParams struct {
+	from, to  int64         // Unix milliseconds
+	step      time.Duration // A frame every step of placement time
+	every     int           // A frame every this many history entries
+	maxFrames int
+}
+
+// parseTimelapseParams reads and checks the query parameters
+func parseTimelapseParams(r *http.Request, limit int) (timelapseParams, error) {
+	query := r.URL.Query()
+	p := timelapseParams{from: 0, to: timeNow().UnixMilli(), maxFrames: limit}
+
+	var err error
+	if v := query.Get("from"); v != "" {
+		if p.from, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return p, fmt.Errorf("from must be a Unix timestamp in milliseconds")
+		}
+	}
+	if v := query.Get("to"); v != "" {
+		if p.to, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return p, fmt.Errorf("to must be a Unix timestamp in milliseconds")
+		}
+	}
+	if p.from > p.to {
+		return p, fmt.Errorf("from must not be after to")
+	}
+
+	if v := query.Get("maxFrames"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > limit {
+			return p, fmt.Errorf("maxFrames must be between 1 and %d", limit)
+		}
+		p.maxFrames = n
+	}
+
+	stepValue, everyValue := query.Get("step"), query.Get("every")
+	switch {
+	case stepValue != "" && everyValue != "":
+		return p, fmt.Errorf("give either step or every, not both")
+	case stepValue != "":
+		if p.step, err = time.ParseDuration(stepValue); err != nil || p.step < time.Millisecond {
+			return p, fmt.Errorf("step must be a duration of at least 1ms, e.g. 10m")
+		}
+	case everyValue != "":
+		if p.every, err = strconv.Atoi(everyValue); err != nil || p.every < 1 {
+			return p, fmt.Errorf("every must be a positive number of placements")
+		}
+	default:
+		return p, fmt.Errorf("step (e.g. 10m) or every (a number of placements) is required")
+	}
+
+	return p, nil
+}
+
+// handleTimelapse streams a ZIP archive of PNG frames showing the canvas
+// evolving between from and to
+// Query parameters: from, to (Unix ms; default the beginning and now), step
+// (a frame every step of placement time) or every (a frame every N
+// placements), and maxFrames (at most TIMELAPSE_MAX_FRAMES)
+func (s *Server) handleTimelapse(w http.ResponseWriter, r *http.Request) {
+	s.writeCORS(w, r, "GET, OPTIONS")
+
+	params, err := parseTimelapseParams(r, s.timelapseMaxFrames)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeValidation, err.Error())
+		return
+	}
+
+	// Work out the number of frames before rendering anything
+	var frames int64
+	if params.step > 0 {
+		frames = (params.to-params.from)/params.step.Milliseconds() + 1
+	} else {
+		placements, err := s.db.CountHistoryBetween(params.from, params.to)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Failed to count history for timelapse", "err", err)
+			writeError(w, http.StatusInternalServerError, codeInternal, "Failed to read pixel history")
+			return
+		}
+		frames = int64((placements+params.every-1)/params.every) + 1
+	}
+	if frames > int64(params.maxFrames) {
+		writeError(w, http.StatusBadRequest, codeValidation, fmt.Sprintf("timelapse would have %d frames, more than the limit of %d; use a larger step or every", frames, params.maxFrames))
+		return
+	}
+
+	// Rendering is expensive, so only one timelapse is rendered at a time
+	select {
+	case s.timelapseSlot <- struct{}{}:
+		defer func() { <-s.timelapseSlot }()
+	default:
+		writeError(w, http.StatusServiceUnavailable, codeUnavailable, "A timelapse is already being rendered. Please try again later.")
+		return
+	}
+
+	t := newTimelapseCanvas(s.canvas)
+	history := &historyReader{db: s.db, until: params.to, afterPlacedAt: -1}
+
+	// Rebuild the canvas as it was at from; nothing is sent until this worked,
+	// so a failing database still gets a proper error status
+	entry, ok, err := history.next()
+	for ; err == nil && ok && entry.PlacedAt <= params.from; entry, ok, err = history.next() {
+		t.apply(entry)
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to read history for timelapse", "err", err)
+		writeError(w, http.StatusInternalServerError, codeInternal, "Failed to read pixel history")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="timelapse.zip"`)
+	w.WriteHeader(http.StatusOK)
+
+	archive := zip.NewWriter(w)
+	var manifest []timelapseFrame
+	placements := 0
+
+	// writeFrame adds the current canvas as the next frame
+	writeFrame := func(at int64) error {
+		name := fmt.Sprintf("frame-%05d.png", len(manifest)+1)
+		file, err := archive.CreateHeader(&zip.FileHeader{
+			Name:     name,
+			Method:   zip.Store, // PNG data is already compressed
+			Modified: time.UnixMilli(at),
+		})
+		if err != nil {
+			return err
+		}
+		if err := (&png.Encoder{CompressionLevel: png.BestSpeed}).Encode(file, t.render()); err != nil {
+			return err
+		}
+		manifest = append(manifest, timelapseFrame{File: name, Time: at, Placements: placements})
+		return nil
+	}
+
+	err = writeFrame(params.from)
+	next := params.from + params.step.Milliseconds()
+
+	// Apply the placements after from, writing a frame whenever the next
+	// frame time is passed (step) or enough placements were applied (every)
+	for ; err == nil && ok; entry, ok, err = history.next() {
+		for params.step > 0 && entry.PlacedAt > next && err == nil {
+			err = writeFrame(next)
+			next += params.step.Milliseconds()
+		}
+		if err != nil {
+			break
+		}
+
+		t.apply(entry)
+		placements++
+
+		if params.every > 0 && placements%params.every == 0 {
+			err = writeFrame(entry.PlacedAt)
+		}
+	}
+
+	// Frames after the last placement, or the leftover placements
+	switch {
+	case err != nil:
+	case params.step > 0:
+		for ; next <= params.to && err == nil; next += params.step.Milliseconds() {
+			err = writeFrame(next)
+		}
+	case placements%params.every != 0:
+		err = writeFrame(params.to)
+	}
+
+	if err == nil {
+		var file io.Writer
+		if file, err = archive.Create("frames.json"); err == nil {
+			err = json.NewEncoder(file).Encode(manifest)
+		}
+	}
+	if err == nil {
+		err = archive.Close()
+	}
+	if err != nil {
+		// The status has been sent already; the truncated archive tells the client
+		slog.WarnContext(r.Context(), "Timelapse export stopped", "frames", len(manifest), "err", err)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Timelapse exported", "frames", len(manifest), "placements", placements)
+}
+
+// historyReader walks the pixel history in placement order, one page at a time
+type historyReader struct {
+	db    *Database
+	until int64
+
+	page []HistoryEntry
+
+	// Position of the last entry read
+	afterPlacedAt int64
+	afterID       int64
+	done          bool
+}
+
+// next returns the next entry; ok is false once every entry up to until was read
+func (h *historyReader) next() (entry HistoryEntry, ok bool, err error) {
+	if len(h.page) == 0 {
+		if h.done {
+			return HistoryEntry{}, false, nil
+		}
+
+		h.page, err = h.db.GetHistoryPage(h.afterPlacedAt, h.afterID, h.until, timelapsePageSize)
+		if err != nil {
+			return HistoryEntry{}, false, err
+		}
+		if len(h.page) < timelapsePageSize {
+			h.done = true
+		}
+		if len(h.page) == 0 {
+			return HistoryEntry{}, false, nil
+		}
+	}
+
+	entry, h.page = h.page[0], h.page[1:]
+	h.afterPlacedAt, h.afterID = entry.PlacedAt, entry.ID
+	return entry, true, nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// Placement timestamps
+//
+// A PixelUpdate mixes fields a client chooses with fields only the server
+// may set:
+//
+//   - client-controlled: x, y, color, expectedColor, userId and team (with
+//     AUTH_SECRET the last two come from the user's token instead)
+//   - server-assigned: timestamp, seq and chunk
+//
+// The public ways of placing pixels (POST /api/pixel, POST /api/pixels/batch
+// and the WebSocket) all go through placePixel, which drops the
+// server-assigned fields first and stamps the pixel with the server's clock
+// and a fresh sequence number once it is accepted (see placement.go). A
+// client sending "timestamp" can't date its pixel in the past or the future.
+//
+// Some paths do keep a pixel's timestamp, because they bring back
+// placements the server made before:
+//
+//   - -restore-backup, from a backup file
+//   - QUEUE_LOG recovery, from the log of a previous run
+//   - -replay-from, from another database's history
+//
+// Those files can still be edited, corrupted or written with seconds instead
+// of milliseconds, so their timestamps are checked against a TimestampPolicy:
+// a timestamp more than TIMESTAMP_MAX_FUTURE ahead of the clock, or older
+// than TIMESTAMP_MAX_AGE (or before 2000 when no age is set), is refused.
+// A restore or replay stops at the first bad timestamp; recovered queue log
+// pixels with one are dropped. A zero timestamp means "not set" and is
+// replaced with the current time when the pixel is saved.
+//
+// The order of placements never depends on timestamps anyway: it comes from
+// sequence numbers (see sequence.go).
+
+// timestampFloor is the earliest timestamp accepted when no maximum age is
+// configured (2000-01-01 UTC). It also catches timestamps in seconds, which
+// read as January 1970 in milliseconds.
+var timestampFloor = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC).UnixMilli()
+
+// TimestampPolicy bounds the timestamps accepted from trusted import paths
+type TimestampPolicy struct {
+	MaxFuture time.Duration // How far ahead of the clock a timestamp may be
+	MaxAge    time.Duration // How old a timestamp may be (0 = back to timestampFloor)
+}
+
+// defaultTimestampPolicy allows for an hour of clock difference between
+// servers and any age after timestampFloor
+var defaultTimestampPolicy = TimestampPolicy{MaxFuture: time.Hour}
+
+// Validate checks that the limits aren't negative
+func (p TimestampPolicy) Validate() error {
+	if p.MaxFuture < 0 {
+		return fmt.Errorf("maximum timestamp skew must not be negative (got %s)", p.MaxFuture)
+	}
+	if p.MaxAge < 0 {
+		return fmt.Errorf("maximum timestamp age must not be negative (got %s)", p.MaxAge)
+	}
+	return nil
+}
+
+// Check returns an error when timestamp (Unix milliseconds) is outside the
+// accepted range around now; 0 (not set) is always accepted
+func (p TimestampPolicy) Check(timestamp int64, now time.Time) error {
+	if timestamp == 0 {
+		return nil
+	}
+
+	earliest := timestampFloor
+	if p.MaxAge > 0 {
+		earliest = now.Add(-p.MaxAge).UnixMilli()
+	}
+	if timestamp < earliest {
+		return fmt.Errorf("timestamp %d is before %d", timestamp, earliest)
+	}
+	if latest := now.Add(p.MaxFuture).UnixMilli(); timestamp > latest {
+		return fmt.Errorf("timestamp %d is after %d", timestamp, latest)
+	}
+	return nil
+}
+
+// CheckPixels checks the timestamp of every pixel and reports the first bad one
+func (p TimestampPolicy) CheckPixels(pixels []PixelUpdate, now time.Time) error {
+	for i, pixel := range pixels {
+		if err := p.Check(pixel.Timestamp, now); err != nil {
+			return fmt.Errorf("pixel %d at %d,%d: %w", i, pixel.X, pixel.Y, err)
+		}
+	}
+	return nil
+}
+
+// FilterPixels returns the pixels whose timestamps are accepted, logging the
+// ones dropped
+func (p TimestampPolicy) FilterPixels(pixels []PixelUpdate, now time.Time) []PixelUpdate {
+	kept := pixels[:0:0]
+	for _, pixel := range pixels {
+		if err := p.Check(pixel.Timestamp, now); err != nil {
+			slog.Warn("Dropping pixel with a bad timestamp", "x", pixel.X, "y", pixel.Y, "user", pixel.UserID, "err", err)
+			continue
+		}
+		kept = append(kept, pixel)
+	}
+	return kept
+}
+
+// timestampPolicyFromEnv reads TIMESTAMP_MAX_FUTURE and TIMESTAMP_MAX_AGE
+func timestampPolicyFromEnv() (TimestampPolicy, error) {
+	policy := TimestampPolicy{
+		MaxFuture: envDuration("TIMESTAMP_MAX_FUTURE", defaultTimestampPolicy.MaxFuture),
+		MaxAge:    envDuration("TIMESTAMP_MAX_AGE", defaultTimestampPolicy.MaxAge),
+	}
+	return policy, policy.Validate()
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Undo
+//
+// POST /api/pixel/undo lets a user take back their most recent placement,
+// for a short time after placing it (UNDO_WINDOW). The pixel goes back to
+// the color it had before, read from the pixel history, or is removed if it
+// was empty. The undo itself is appended to the history like any change.
+//
+// A placement can only be undone while it is still the visible pixel: once
+// someone else has painted over it, undoing would erase their pixel, so the
+// undo is refused. Each placement can be undone once.
+//
+// Which placement is a user's most recent is remembered in memory only, so
+// a restart (or another server process) forgets it; the window is meant to
+// be seconds anyway.
+
+// errUndoConflict is returned when the pixel changed after the placement
+var errUndoConflict = errors.New("the pixel was changed by someone else after your placement, so it can't be undone")
+
+// undoablePlacement is a user's most recent placement
+type undoablePlacement struct {
+	x, y     int
+	seq      int64
+	placedAt time.Time
+}
+
+// UndoTracker remembers each user's most recent placement for the undo window
+type UndoTracker struct {
+	mu        sync.Mutex
+	window    time.Duration
+	last      map[string]undoablePlacement
+	lastPrune time.Time
+}
+
+// NewUndoTracker creates a tracker for the given window
+// A window of 0 returns nil, which disables undo
+func NewUndoTracker(window time.Duration) *UndoTracker {
+	if window <= 0 {
+		return nil
+	}
+	return &UndoTracker{window: window, last: make(map[string]undoablePlacement), lastPrune: timeNow()}
+}
+
+// Record remembers an accepted placement as its user's most recent one
+func (t *UndoTracker) Record(pixel PixelUpdate) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := timeNow()
+	t.last[pixel.UserID] = undoablePlacement{x: pixel.X, y: pixel.Y, seq: pixel.Seq, placedAt: now}
+
+	// Forget placements past the window, at most once per window, so the
+	// map only holds users who placed recently
+	if now.Sub(t.lastPrune) >= t.window {
+		for userID, placement := range t.last {
+			if now.Sub(placement.placedAt) > t.window {
+				delete(t.last, userID)
+			}
+		}
+		t.lastPrune = now
+	}
+}
+
+// Take returns the user's most recent placement if it is at (x, y) and
+// still inside the window, and forgets it so it can't be undone twice
+func (t *UndoTracker) Take(userID string, x, y int) (undoablePlacement, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	placement, ok := t.last[userID]
+	if !ok || placement.x != x || placement.y != y || timeNow().Sub(placement.placedAt) > t.window {
+		return undoablePlacement{}, false
+	}
+	delete(t.last, userID)
+	return placement, true
+}
+
+// decrementUserCountSQL takes one placement off a user's leaderboard total
+const decrementUserCountSQL = `
+UPDATE user_pixel_counts SET count = count - 1 WHERE user_id = ? AND count > 0
+`
+
+// RevertPlacement puts a base-layer pixel back to the previous history entry
+// at its coordinate (a tombstone removes it) in one transaction
+// Nothing is changed, and reverted is false, unless the stored pixel is
+// still the placement with sequence number seq. The undo is recorded in the
+// history with a new sequence number, and the placement no longer counts
+// for the leaderboard. The recorded entry is returned as revert.
+func (d *Database) RevertPlacement(seq int64, userID string, previous HistoryEntry) (revert HistoryEntry, reverted bool, err error) {
+	err = d.serialize(func() (err error) {
+		revert, reverted, err = d.revertPlacement(seq, userID, previous)
+		return err
+	})
+	return revert, reverted, err
+}
+
+// revertPlacement is RevertPlacement on the writer goroutine
+func (d *Database) revertPlacement(seq int64, userID string, previous HistoryEntry) (revert HistoryEntry, reverted bool, err error) {
+	d.maintenance.RLock()
+	defer d.maintenance.RUnlock()
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return revert, false, err
+	}
+	defer tx.Rollback()
+
+	revert = HistoryEntry{
+		X:        previous.X,
+		Y:        previous.Y,
+		Layer:    LayerBase,
+		Color:    previous.Color,
+		UserID:   previous.UserID,
+		PlacedAt: currentTimeMillis(),
+		Seq:      d.NextSeq(),
+	}
+	if revert.IsTombstone() {
+		revert.UserID = userID
+	}
+
+	// Only change the pixel if it is still the placement being undone
+	var result sql.Result
+	if revert.IsTombstone() {
+		result, err = tx.Exec(d.rebind(`
+		DELETE FROM canvas_state
+		WHERE x = ? AND y = ? AND layer = ? AND seq = ?
+		`), revert.X, revert.Y, LayerBase, seq)
+	} else {
+		result, err = tx.Exec(d.rebind(`
+		UPDATE canvas_state SET color = ?, user_id = ?, updated_at = ?, seq = ?
+		WHERE x = ? AND y = ? AND layer = ? AND seq = ?
+		`), revert.Color, revert.UserID, revert.PlacedAt, revert.Seq, revert.X, revert.Y, LayerBase, seq)
+	}
+	if err != nil {
+		return revert, false, err
+	}
+	if changed, err := result.RowsAffected(); err != nil || changed == 0 {
+		return revert, false, err
+	}
+
+	_, err = tx.Exec(d.rebind(insertHistorySQL), revert.X, revert.Y, revert.Layer, revert.Color, revert.UserID, revert.PlacedAt, revert.Seq)
+	if err != nil {
+		return revert, false, err
+	}
+	if _, err := tx.Exec(d.rebind(decrementUserCountSQL), userID); err != nil {
+		return revert, false, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return revert, false, err
+	}
+
+	d.version.Add(1)
+	return revert, true, nil
+}
+
+// undoRequest is the body of POST /api/pixel/undo
+type undoRequest struct {
+	X      int    `json:"x"`
+	Y      int    `json:"y"`
+	UserID string `json:"userId"`
+}
+
+// handleUndo reverts the user's most recent placement at a coordinate
+// Body: {"x": 10, "y": 20, "userId": "user123"} (with AUTH_SECRET the user
+// comes from the bearer token instead)
+func (s *Server) handleUndo(w http.ResponseWriter, r *http.Request) {
+	s.writeCORS(w, r, "POST, OPTIONS")
+
+	limitBody(w, r, s.maxBodyBytes)
+	var req undoRequest
+	if err := decodeJSONBody(r.Body, &req, s.strictJSON); err != nil {
+		if readError(err, "") == errBodyTooLarge {
+			writeError(w, http.StatusRequestEntityTooLarge, codePayloadTooLarge, "Request body too large")
+			return
+		}
+		writeError(w, http.StatusBadRequest, codeInvalidBody, "Invalid JSON")
+		return
+	}
+	if s.tokens != nil {
+		userID, ok := s.tokenUser(r)
+		if !ok {
+			writeUnauthorized(w)
+			return
+		}
+		req.UserID = userID
+	}
+	if req.UserID == "" {
+		writeError(w, http.StatusBadRequest, codeValidation, "userId is required")
+		return
+	}
+
+	placement, ok := s.undos.Take(req.UserID, req.X, req.Y)
+	if !ok {
+		writeError(w, http.StatusConflict, codeConflict, fmt.Sprintf("Nothing to undo: only your most recent placement can be undone, within %s of placing it", s.undos.window))
+		return
+	}
+
+	if err := s.undo(req.UserID, placement); err != nil {
+		if err == errUndoConflict {
+			writeError(w, http.StatusConflict, codeConflict, "Can't undo: "+err.Error())
+			return
+		}
+		slog.ErrorContext(r.Context(), "Failed to undo placement", "user", req.UserID, "x", req.X, "y", req.Y, "err", err)
+		writeError(w, http.StatusInternalServerError, codeInternal, "Failed to undo placement")
+		return
+	}
+
+	// Consumers get the pixel as it looks now, like after an overlay change
+	s.broadcastVisiblePixel(req.X, req.Y)
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Placement undone"))
+
+	slog.InfoContext(r.Context(), "Placement undone", "user", req.UserID, "x", req.X, "y", req.Y)
+}
+
+// undo reverts a placement to the history entry before it
+func (s *Server) undo(userID string, placement undoablePlacement) error {
+	// The placement may still be waiting for its batch; save it first so the
+	// history has it. A newer pixel still waiting to be saved at the same
+	// coordinate means someone painted over it.
+	s.writer.Flush()
+	for _, pixel := range s.writer.Unsaved() {
+		if pixel.X == placement.x && pixel.Y == placement.y && pixel.Seq > placement.seq {
+			return errUndoConflict
+		}
+	}
+
+	entries, err := s.db.GetPixelHistory(placement.x, placement.y, 2)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 || entries[len(entries)-1].Seq != placement.seq {
+		// Not the latest entry: overwritten (or, with COALESCE_UPDATES,
+		// never saved because a newer pixel in its batch replaced it)
+		return errUndoConflict
+	}
+
+	// Without an earlier entry the pixel was empty before
+	previous := HistoryEntry{X: placement.x, Y: placement.y, Layer: LayerBase}
+	if len(entries) == 2 {
+		previous = entries[0]
+	}
+
+	// A conflict isn't a database failure, so it is reported outside persist
+	var revert HistoryEntry
+	var reverted bool
+	err = s.persist(func() (err error) {
+		revert, reverted, err = s.db.RevertPlacement(placement.seq, userID, previous)
+		return err
+	})
+	if err == nil && !reverted {
+		err = errUndoConflict
+	}
+	if err == nil {
+		s.canvasCache.Apply(revert)
+	}
+	return err
+}
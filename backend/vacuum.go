@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// Vacuum
+//
+// Every placement that overwrites a pixel rewrites its row, and with enough
+// churn the database file fills up with free pages it never gives back.
+// VACUUM rebuilds the database without them. It is run every
+// VACUUM_INTERVAL (off by default) and on demand with
+// POST /api/admin/vacuum.
+//
+// A vacuum can't run inside a transaction and needs the database to itself
+// for a moment, so it waits for the current write transaction to finish and
+// holds off new ones (Database.maintenance; on SQLite it also simply takes
+// its turn on the writer goroutine, see serialize.go). Placements keep
+// being accepted and broadcast meanwhile; the background writer just saves
+// them a little later.
+
+// VacuumResult reports what a vacuum achieved
+type VacuumResult struct {
+	SizeBefore int64 `json:"sizeBefore"` // Database size in bytes before
+	SizeAfter  int64 `json:"sizeAfter"`  // Database size in bytes after
+	DurationMs int64 `json:"durationMs"`
+}
+
+// Vacuum reclaims the free space in the database
+// On SQLite the whole file is rebuilt and, in WAL mode, the log is truncated
+// afterwards. On PostgreSQL the canvas tables are vacuumed, which makes their
+// dead rows reusable but rarely shrinks the files.
+func (d *Database) Vacuum() (result VacuumResult, err error) {
+	err = d.serialize(func() (err error) {
+		result, err = d.vacuum()
+		return err
+	})
+	return result, err
+}
+
+// vacuum is Vacuum on the writer goroutine
+func (d *Database) vacuum() (VacuumResult, error) {
+	d.maintenance.Lock()
+	defer d.maintenance.Unlock()
+
+	start := time.Now()
+	before, err := d.size()
+	if err != nil {
+		return VacuumResult{}, err
+	}
+
+	statements := []string{`VACUUM`, `PRAGMA wal_checkpoint(TRUNCATE)`}
+	if d.dialect == dialectPostgres {
+		statements = []string{`VACUUM ANALYZE canvas_state, pixel_history, user_pixel_counts`}
+	}
+	for _, statement := range statements {
+		if _, err := d.db.Exec(statement); err != nil {
+			return VacuumResult{}, err
+		}
+	}
+
+	after, err := d.size()
+	if err != nil {
+		return VacuumResult{}, err
+	}
+
+	return VacuumResult{SizeBefore: before, SizeAfter: after, DurationMs: time.Since(start).Milliseconds()}, nil
+}
+
+// size returns the size of the database in bytes
+// For SQLite that is the main file (pages times page size), not counting
+// the WAL file.
+func (d *Database) size() (int64, error) {
+	query := `SELECT page_count * page_size FROM pragma_page_count(), pragma_page_size()`
+	if d.dialect == dialectPostgres {
+		query = `SELECT pg_database_size(current_database())`
+	}
+
+	var size int64
+	err := d.db.QueryRow(query).Scan(&size)
+	return size, err
+}
+
+// runVacuums vacuums the database every interval, forever
+// Failures are logged and retried at the next interval.
+func runVacuums(db *Database, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		result, err := db.Vacuum()
+		if err != nil {
+			slog.Error("Database vacuum failed", "err", err)
+			continue
+		}
+		logVacuum("Database vacuumed", result)
+	}
+}
+
+// logVacuum logs the sizes before and after a vacuum
+func logVacuum(msg string, result VacuumResult) {
+	slog.Info(msg,
+		"sizeBefore", result.SizeBefore,
+		"sizeAfter", result.SizeAfter,
+		"reclaimed", result.SizeBefore-result.SizeAfter,
+		"durationMs", result.DurationMs,
+	)
+}
+
+// handleVacuum vacuums the database now and reports the sizes
+func (s *Server) handleVacuum(w http.ResponseWriter, r *http.Request) {
+	result, err := s.db.Vacuum()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Database vacuum failed", "err", err)
+		writeError(w, http.StatusInternalServerError, codeInternal, "Failed to vacuum the database")
+		return
+	}
+	logVacuum("Database vacuumed by admin", result)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Webhooks
+//
+// With WEBHOOK_URL set, the server POSTs a small JSON message to that URL
+// when something notable happens:
+//
+//	pixel      every WEBHOOK_EVERY_N-th accepted placement (since the start)
+//	clear      an admin cleared the canvas
+//	milestone  a user's total placements reached one of WEBHOOK_MILESTONES
+//
+// WEBHOOK_EVENTS picks which of them are sent (all by default).
+//
+// Placements must never wait for a slow or unreachable receiver, so events
+// are only put in a buffered channel on the request path. A single worker
+// POSTs them one at a time and retries failed deliveries with a growing
+// delay. When the buffer is full, new events are dropped and counted
+// (wplace_webhook_dropped_total) instead.
+
+// Webhook event names
+const (
+	webhookPixel     = "pixel"
+	webhookClear     = "clear"
+	webhookMilestone = "milestone"
+)
+
+// webhookEvents is every event name WEBHOOK_EVENTS may list
+var webhookEvents = []string{webhookPixel, webhookClear, webhookMilestone}
+
+// WebhookEvent is the body POSTed to the webhook URL
+type WebhookEvent struct {
+	Event     string       `json:"event"`
+	Timestamp int64        `json:"timestamp"`        // When it happened, in Unix milliseconds
+	Count     int64        `json:"count,omitempty"`  // pixel: placements since the start; milestone: the user's total
+	UserID    string       `json:"userId,omitempty"` // milestone: the user
+	Pixel     *PixelUpdate `json:"pixel,omitempty"`  // pixel and milestone: the placement that triggered it
+}
+
+// WebhookConfig configures a WebhookNotifier
+type WebhookConfig struct {
+	URL        string
+	Events     []string      // Events to send (see webhookEvents)
+	EveryN     int64         // Send a pixel event every EveryN placements
+	Milestones []int64       // User totals that trigger a milestone event
+	Buffer     int           // Events waiting for delivery before new ones are dropped
+	Retries    int           // Retries of a failed delivery
+	RetryDelay time.Duration // Wait before the first retry; doubles for each one
+	Timeout    time.Duration // Time allowed for one POST
+}
+
+// WebhookNotifier delivers webhook events in the background
+// A nil notifier (webhooks disabled) ignores every call.
+type WebhookNotifier struct {
+	config     WebhookConfig
+	events     map[string]bool
+	milestones map[int64]bool
+	client     *http.Client
+
+	// userCount returns a user's saved total, to start counting from
+	userCount func(userID string) (int64, error)
+
+	// mu guards the counts below
+	mu         sync.Mutex
+	placements int64            // Placements since the start
+	users      map[string]int64 // Totals of users seen since the start
+
+	queue chan WebhookEvent
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// NewWebhookNotifier creates a notifier for config
+// userCount is only called for users whose total isn't known yet.
+func NewWebhookNotifier(config WebhookConfig, userCount func(string) (int64, error)) (*WebhookNotifier, error) {
+	target, err := url.Parse(config.URL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return nil, fmt.Errorf("webhook URL must be an http(s) URL, got %q", config.URL)
+	}
+	if config.EveryN < 1 {
+		return nil, fmt.Errorf("webhook pixel interval must be at least 1, got %d", config.EveryN)
+	}
+	if config.Buffer < 1 || config.Retries < 0 || config.RetryDelay <= 0 || config.Timeout <= 0 {
+		return nil, fmt.Errorf("invalid webhook delivery settings (buffer %d, retries %d, retry delay %s, timeout %s)",
+			config.Buffer, config.Retries, config.RetryDelay, config.Timeout)
+	}
+
+	n := &WebhookNotifier{
+		config:     config,
+		events:     make(map[string]bool),
+		milestones: make(map[int64]bool),
+		client:     &http.Client{Timeout: config.Timeout},
+		userCount:  userCount,
+		users:      make(map[string]int64),
+		queue:      make(chan WebhookEvent, config.Buffer),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	for _, event := range config.Events {
+		if !containsString(webhookEvents, event) {
+			return nil, fmt.Errorf("unknown webhook event %q (expected one of %v)", event, webhookEvents)
+		}
+		n.events[event] = true
+	}
+	for _, milestone := range config.Milestones {
+		if milestone < 1 {
+			return nil, fmt.Errorf("webhook milestones must be positive, got %d", milestone)
+		}
+		n.milestones[milestone] = true
+	}
+	return n, nil
+}
+
+// PixelPlaced counts an accepted placement and queues the events it triggers
+// saved tells whether the placement is already in the database (conditional
+// placements are saved right away), so a user's saved total isn't counted
+// twice the first time they are seen.
+func (n *WebhookNotifier) PixelPlaced(pixel PixelUpdate, saved bool) {
+	if n == nil {
+		return
+	}
+
+	n.mu.Lock()
+	n.placements++
+	placements := n.placements
+	n.mu.Unlock()
+
+	// Erasers don't add to the leaderboard, so they don't count here either
+	var total int64
+	var reached bool
+	if !isTransparent(pixel.Color) {
+		total, reached = n.countUser(pixel.UserID, saved)
+	}
+
+	if n.events[webhookPixel] && placements%n.config.EveryN == 0 {
+		n.notify(WebhookEvent{Event: webhookPixel, Timestamp: pixel.Timestamp, Count: placements, Pixel: &pixel})
+	}
+	if reached {
+		n.notify(WebhookEvent{Event: webhookMilestone, Timestamp: pixel.Timestamp, Count: total, UserID: pixel.UserID, Pixel: &pixel})
+	}
+}
+
+// countUser adds one placement to a user's total and reports whether it
+// just reached a milestone
+// The first placement of a user since the start reads their saved total, a
+// single indexed lookup done without holding n.mu.
+func (n *WebhookNotifier) countUser(userID string, saved bool) (int64, bool) {
+	if !n.events[webhookMilestone] || len(n.milestones) == 0 || userID == "" {
+		return 0, false
+	}
+
+	n.mu.Lock()
+	_, known := n.users[userID]
+	n.mu.Unlock()
+
+	var stored int64
+	if !known {
+		var err error
+		if stored, err = n.userCount(userID); err != nil {
+			// Without the saved total a milestone could be announced twice,
+			// so this placement isn't counted and the next one tries again
+			slog.Warn("Failed to read user total for webhook milestones", "user", userID, "err", err)
+			return 0, false
+		}
+		if saved {
+			stored--
+		}
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	total, ok := n.users[userID]
+	if !ok {
+		// Another placement by the same user may have got here first
+		total = stored
+	}
+	total++
+	n.users[userID] = total
+	return total, n.milestones[total]
+}
+
+// CanvasCleared queues a clear event
+func (n *WebhookNotifier) CanvasCleared() {
+	if n == nil || !n.events[webhookClear] {
+		return
+	}
+	n.notify(WebhookEvent{Event: webhookClear, Timestamp: currentTimeMillis()})
+}
+
+// notify queues an event for delivery without waiting
+// When the buffer is full the event is dropped and counted.
+func (n *WebhookNotifier) notify(event WebhookEvent) {
+	select {
+	case n.queue <- event:
+	default:
+		webhooksDropped.Inc()
+		slog.Warn("Webhook buffer full, event dropped", "event", event.Event)
+	}
+}
+
+// Run delivers queued events until Stop is called
+// Events still queued then are tried once each, without retries.
+func (n *WebhookNotifier) Run() {
+	for {
+		select {
+		case event := <-n.queue:
+			n.deliver(event, n.config.Retries)
+		case <-n.stop:
+			for {
+				select {
+				case event := <-n.queue:
+					n.deliver(event, 0)
+				default:
+					close(n.done)
+					return
+				}
+			}
+		}
+	}
+}
+
+// Stop ends Run after the queued events have been tried, or when ctx is done
+func (n *WebhookNotifier) Stop(ctx context.Context) error {
+	if n == nil {
+		return nil
+	}
+	close(n.stop)
+
+	select {
+	case <-n.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// deliver POSTs one event, retrying up to retries times with backoff
+// Failures are logged and counted; the event is then given up.
+func (n *WebhookNotifier) deliver(event WebhookEvent, retries int) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		slog.Error("Failed to encode webhook event", "event", event.Event, "err", err)
+		return
+	}
+
+	delay := n.config.RetryDelay
+	for attempt := 0; ; attempt++ {
+		retry, err := n.post(body)
+		if err == nil {
+			webhookDeliveries.WithLabelValues("ok").Inc()
+			return
+		}
+		if !retry || attempt >= retries {
+			webhookDeliveries.WithLabelValues("failed").Inc()
+			slog.Warn("Webhook delivery failed", "event", event.Event, "attempts", attempt+1, "err", err)
+			return
+		}
+
+		// Stop waiting when the server shuts down and make this attempt the last
+		select {
+		case <-time.After(delay):
+		case <-n.stop:
+			retries = attempt + 1
+		}
+		delay *= 2
+	}
+}
+
+// post sends the body once and reports whether a failure is worth retrying
+// Network errors, 429 and 5xx responses are; other 4xx responses would fail
+// the same way again.
+func (n *WebhookNotifier) post(body []byte) (bool, error) {
+	resp, err := n.client.Post(n.config.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	retry := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return retry, fmt.Errorf("webhook answered %s", resp.Status)
+}
+
+// newWebhookNotifierFromEnv builds the notifier from environment variables
+// Returns nil when WEBHOOK_URL is not set.
+func newWebhookNotifierFromEnv(db *Database) (*WebhookNotifier, error) {
+	target := envString("WEBHOOK_URL", "")
+	if target == "" {
+		return nil, nil
+	}
+
+	events := envList("WEBHOOK_EVENTS")
+	if events == nil {
+		events = webhookEvents
+	}
+
+	milestones := []int64{100, 1000, 10000}
+	if list := envList("WEBHOOK_MILESTONES"); list != nil {
+		milestones = nil
+		for _, item := range list {
+			milestone, err := strconv.ParseInt(item, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid WEBHOOK_MILESTONES entry %q", item)
+			}
+			milestones = append(milestones, milestone)
+		}
+	}
+
+	return NewWebhookNotifier(WebhookConfig{
+		URL:        target,
+		Events:     events,
+		EveryN:     int64(envInt("WEBHOOK_EVERY_N", 1000)),
+		Milestones: milestones,
+		Buffer:     envInt("WEBHOOK_BUFFER", 100),
+		Retries:    envInt("WEBHOOK_RETRIES", 3),
+		RetryDelay: envDuration("WEBHOOK_RETRY_DELAY", time.Second),
+		Timeout:    envDuration("WEBHOOK_TIMEOUT", 5*time.Second),
+	}, db.GetUserPixelCount)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Binary batch format
+//
+// The JSON batches sent to consumers repeat every key and a full timestamp
+// for every pixel, even though all pixels in a batch are placed within about
+// 100ms of each other. Clients that connect with ?format=binary get batches
+// as binary WebSocket messages in this format instead (snapshots and clears
+// stay JSON text messages). It stores one base timestamp and sequence number
+// in the header and small deltas per pixel. All integers are big-endian
+// (network order), which is also what JavaScript's DataView reads by default.
+//
+//	header:  version uint8 | count uint16 | base timestamp int64 (ms) |
+//	         base seq int64
+//	pixel:   x uint16 | y uint16 | r, g, b, a uint8 |
+//	         delta uint16 [| timestamp int64 when delta == wireFullTimestamp] |
+//	         seq delta uvarint | userId length uvarint | userId bytes
+//
+// The bases are the smallest timestamp and sequence number in the batch, so
+// deltas are never negative. A pixel whose timestamp delta doesn't fit in 16
+// bits carries its full timestamp instead, marked by the reserved delta value
+// wireFullTimestamp. a is the opacity: 255 for #RRGGBB colors, 0 for an
+// eraser (see alpha.go). uvarints are the protobuf/Go varint encoding: 7 bits per
+// byte, least significant group first, high bit set on all but the last byte.
+const (
+	wireVersion = 3
+
+	// wireFullTimestamp marks a pixel that carries a full int64 timestamp
+	wireFullTimestamp = 0xFFFF
+
+	wireHeaderSize = 1 + 2 + 8 + 8
+)
+
+// maxWireBatch is the largest number of pixels one binary batch can hold
+const maxWireBatch = 0xFFFF
+
+// encodeBatchBinary encodes a batch of pixels in the binary format
+// Colors must already be valid #RRGGBB or #RRGGBBAA strings (see validatePixel)
+func encodeBatchBinary(batch []PixelUpdate) ([]byte, error) {
+	if len(batch) > maxWireBatch {
+		return nil, fmt.Errorf("batch of %d pixels is too large for the binary format", len(batch))
+	}
+
+	// The smallest timestamp and sequence number become the bases for all deltas
+	var base, baseSeq int64
+	for i, pixel := range batch {
+		if i == 0 || pixel.Timestamp < base {
+			base = pixel.Timestamp
+		}
+		if i == 0 || pixel.Seq < baseSeq {
+			baseSeq = pixel.Seq
+		}
+	}
+
+	buf := make([]byte, 0, wireHeaderSize+len(batch)*19)
+	buf = append(buf, wireVersion)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(batch)))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(base))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(baseSeq))
+
+	for _, pixel := range batch {
+		rgba, err := parseHexNRGBA(pixel.Color)
+		if err != nil {
+			return nil, err
+		}
+
+		buf = binary.BigEndian.AppendUint16(buf, uint16(pixel.X))
+		buf = binary.BigEndian.AppendUint16(buf, uint16(pixel.Y))
+		buf = append(buf, rgba.R, rgba.G, rgba.B, rgba.A)
+
+		// Small deltas fit in 16 bits; anything else falls back to the full timestamp
+		delta := pixel.Timestamp - base
+		if delta < wireFullTimestamp {
+			buf = binary.BigEndian.AppendUint16(buf, uint16(delta))
+		} else {
+			buf = binary.BigEndian.AppendUint16(buf, wireFullTimestamp)
+			buf = binary.BigEndian.AppendUint64(buf, uint64(pixel.Timestamp))
+		}
+
+		buf = binary.AppendUvarint(buf, uint64(pixel.Seq-baseSeq))
+		buf = binary.AppendUvarint(buf, uint64(len(pixel.UserID)))
+		buf = append(buf, pixel.UserID...)
+	}
+
+	return buf, nil
+}
+
+// errShortBatch is returned when a binary batch ends in the middle of a field
+var errShortBatch = errors.New("binary batch is truncated")
+
+// decodeBatchBinary decodes a batch produced by encodeBatchBinary
+// Colors are returned as uppercase #RRGGBB strings, or #RRGGBBAA when not opaque
+func decodeBatchBinary(data []byte) ([]PixelUpdate, error) {
+	if len(data) < wireHeaderSize {
+		return nil, errShortBatch
+	}
+	if data[0] != wireVersion {
+		return nil, fmt.Errorf("unsupported binary batch version %d", data[0])
+	}
+
+	count := int(binary.BigEndian.Uint16(data[1:3]))
+	base := int64(binary.BigEndian.Uint64(data[3:11]))
+	baseSeq := int64(binary.BigEndian.Uint64(data[11:19]))
+	data = data[wireHeaderSize:]
+
+	batch := make([]PixelUpdate, 0, count)
+	for i := 0; i < count; i++ {
+		// x, y, rgba and the delta are always present
+		if len(data) < 10 {
+			return nil, errShortBatch
+		}
+		pixel := PixelUpdate{
+			X:     int(binary.BigEndian.Uint16(data[0:2])),
+			Y:     int(binary.BigEndian.Uint16(data[2:4])),
+			Color: fmt.Sprintf("#%02X%02X%02X", data[4], data[5], data[6]),
+		}
+		if data[7] != 255 {
+			pixel.Color += fmt.Sprintf("%02X", data[7])
+		}
+		delta := binary.BigEndian.Uint16(data[8:10])
+		data = data[10:]
+
+		if delta == wireFullTimestamp {
+			if len(data) < 8 {
+				return nil, errShortBatch
+			}
+			pixel.Timestamp = int64(binary.BigEndian.Uint64(data[0:8]))
+			data = data[8:]
+		} else {
+			pixel.Timestamp = base + int64(delta)
+		}
+
+		seqDelta, n := binary.Uvarint(data)
+		if n <= 0 {
+			return nil, errShortBatch
+		}
+		pixel.Seq = baseSeq + int64(seqDelta)
+		data = data[n:]
+
+		length, n := binary.Uvarint(data)
+		if n <= 0 || uint64(len(data)-n) < length {
+			return nil, errShortBatch
+		}
+		pixel.UserID = string(data[n : n+int(length)])
+		data = data[n+int(length):]
+
+		batch = append(batch, pixel)
+	}
+
+	if len(data) != 0 {
+		return nil, fmt.Errorf("binary batch has %d unexpected trailing bytes", len(data))
+	}
+	return batch, nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBinaryBatchRoundTrip(t *testing.T) {
+	now := currentTimeMillis()
+	batch := []PixelUpdate{
+		{X: 0, Y: 0, Color: "#FF0000", UserID: "alice", Timestamp: now + 40, Seq: 102},
+		{X: 999, Y: 999, Color: "#00FF0080", UserID: "bob", Timestamp: now, Seq: 100},
+		{X: 5, Y: 7, Color: "#00000000", UserID: "", Timestamp: now + 99, Seq: 101},
+		{X: 65535, Y: 1, Color: "#ABCDEF", UserID: "ünïcode", Timestamp: now + 1, Seq: 5000},
+	}
+
+	data, err := encodeBatchBinary(batch)
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	// Every timestamp fits a 16-bit delta, so none is sent in full: the batch
+	// is as small as one whose pixels all share a timestamp
+	same := append([]PixelUpdate(nil), batch...)
+	for i := range same {
+		same[i].Timestamp = now
+	}
+	if compact, _ := encodeBatchBinary(same); len(data) != len(compact) {
+		t.Errorf("encoded %d bytes, want %d", len(data), len(compact))
+	}
+
+	decoded, err := decodeBatchBinary(data)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if !reflect.DeepEqual(decoded, batch) {
+		t.Fatalf("decoded %+v, want %+v", decoded, batch)
+	}
+}
+
+func TestBinaryBatchFullTimestampFallback(t *testing.T) {
+	now := currentTimeMillis()
+	// The batch spans more than a 16-bit delta: the later pixels carry
+	// their full timestamp, including one exactly at the reserved value
+	batch := []PixelUpdate{
+		{X: 1, Y: 1, Color: "#FF0000", UserID: "alice", Timestamp: now, Seq: 1},
+		{X: 2, Y: 2, Color: "#FF0000", UserID: "alice", Timestamp: now + wireFullTimestamp - 1, Seq: 2},
+		{X: 3, Y: 3, Color: "#FF0000", UserID: "alice", Timestamp: now + wireFullTimestamp, Seq: 3},
+		{X: 4, Y: 4, Color: "#FF0000", UserID: "alice", Timestamp: now + 3600*1000, Seq: 4},
+	}
+
+	data, err := encodeBatchBinary(batch)
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	compact, _ := encodeBatchBinary(batch[:2])
+	if extra := len(data) - len(compact); extra != 2*(10+8+1+1+len("alice")) {
+		t.Errorf("the two out-of-range pixels took %d bytes, want full timestamps", extra)
+	}
+
+	decoded, err := decodeBatchBinary(data)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if !reflect.DeepEqual(decoded, batch) {
+		t.Fatalf("decoded %+v, want %+v", decoded, batch)
+	}
+}
+
+func TestBinaryBatchRejectsBadInput(t *testing.T) {
+	data, err := encodeBatchBinary([]PixelUpdate{{X: 1, Y: 1, Color: "#FF0000", UserID: "alice", Timestamp: currentTimeMillis(), Seq: 1}})
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+
+	for cut := 1; cut < len(data); cut++ {
+		if _, err := decodeBatchBinary(data[:cut]); err == nil {
+			t.Errorf("batch truncated to %d bytes decoded", cut)
+		}
+	}
+	if _, err := decodeBatchBinary(append(data, 0)); err == nil {
+		t.Error("batch with a trailing byte decoded")
+	}
+	wrongVersion := append([]byte{wireVersion + 1}, data[1:]...)
+	if _, err := decodeBatchBinary(wrongVersion); err == nil {
+		t.Error("batch with an unknown version decoded")
+	}
+
+	if _, err := encodeBatchBinary(make([]PixelUpdate, maxWireBatch+1)); err == nil {
+		t.Error("batch larger than the count field encoded")
+	}
+}
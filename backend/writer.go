@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// PersistenceMode decides when an accepted pixel is saved (PERSISTENCE_MODE)
+type PersistenceMode string
+
+const (
+	// WriteBehind hands pixels to the PixelWriter, which saves them in
+	// batches after the placement has been answered. Placements never wait
+	// for the database, but the pixels of the last DB_FLUSH_INTERVAL are
+	// lost if the process crashes (see QUEUE_LOG). A batch that fails to save
+	// is kept and retried with the next one (see PixelWriter.flush).
+	WriteBehind PersistenceMode = "write-behind"
+
+	// WriteThrough saves each pixel in its own transaction before the
+	// placement is answered, and refuses the placement with 503 if that
+	// fails. A 200 then means the pixel is in the database, at the cost of a
+	// database round trip per placement.
+	WriteThrough PersistenceMode = "write-through"
+)
+
+// ParsePersistenceMode checks a PERSISTENCE_MODE value
+func ParsePersistenceMode(value string) (PersistenceMode, error) {
+	switch mode := PersistenceMode(value); mode {
+	case WriteBehind, WriteThrough:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown persistence mode %q (expected %q or %q)", value, WriteBehind, WriteThrough)
+	}
+}
+
+// maxUnsavedPixels caps how many pixels the writer keeps for retrying while
+// the database is down
+// At roughly 100 bytes a pixel that is about 10 MB; past it the oldest
+// pixels are given up on so an outage can't use up the server's memory.
+const maxUnsavedPixels = 100000
+
+// PixelWriter saves accepted pixels to the database in the background
+// Placements hand their pixel to the writer and return right away. A single
+// goroutine collects them and writes them with Database.SavePixelBatch, one
+// transaction per batch, instead of one transaction per pixel.
+//
+// Because only one goroutine writes and it keeps the pixels in the order they
+// were accepted, a later placement on a coordinate always wins over an
+// earlier one.
+type PixelWriter struct {
+	db      Store
+	breaker *CircuitBreaker
+
+	// A batch is written once it has batchSize pixels or is interval old
+	batchSize int
+	interval  time.Duration
+
+	// coalesce saves only the latest update per coordinate in each batch,
+	// so overwritten pixels never reach canvas_state or the history
+	coalesce bool
+
+	// mu guards pending and saving
+	// pending are pixels waiting for the next batch; saving is the batch
+	// being written right now. Both are reported by Unsaved.
+	mu      sync.Mutex
+	pending []PixelUpdate
+	saving  []PixelUpdate
+
+	// full wakes Run as soon as pending reaches batchSize
+	full chan struct{}
+
+	// flushes carries Flush requests; Run closes the channel once written
+	flushes chan chan struct{}
+
+	// failures counts batches that could not be saved, and lost the pixels
+	// given up on because too many were waiting (see maxUnsavedPixels)
+	failures atomic.Int64
+	lost     atomic.Int64
+
+	// failing is set while the last batch failed; Run then only retries on
+	// its ticker instead of every time a batch fills up (only touched by Run)
+	failing bool
+
+	// stop asks Run to write what's left and return; done is closed when it has
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewPixelWriter creates a writer that saves through the given circuit breaker
+func NewPixelWriter(db Store, breaker *CircuitBreaker, batchSize int, interval time.Duration, coalesce bool) *PixelWriter {
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	if interval <= 0 {
+		interval = 100 * time.Millisecond
+	}
+
+	return &PixelWriter{
+		db:        db,
+		breaker:   breaker,
+		batchSize: batchSize,
+		interval:  interval,
+		coalesce:  coalesce,
+		full:      make(chan struct{}, 1),
+		flushes:   make(chan chan struct{}),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+}
+
+// Write adds a pixel to the next batch
+// Safe to call from any goroutine; it never waits for the database
+func (w *PixelWriter) Write(pixel PixelUpdate) {
+	w.mu.Lock()
+	w.pending = append(w.pending, pixel)
+	full := len(w.pending) >= w.batchSize
+	w.mu.Unlock()
+
+	if full {
+		// Wake Run without blocking (one wake-up is enough)
+		select {
+		case w.full <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Unsaved returns the accepted pixels that are not in the database yet,
+// oldest first
+// Readers of the database (like the WebSocket snapshot) add these on top of
+// what they read so a pixel isn't missed while it waits for its batch.
+// Call it before reading the database: a pixel saved in between then shows
+// up twice, which is harmless, instead of not at all.
+func (w *PixelWriter) Unsaved() []PixelUpdate {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	unsaved := make([]PixelUpdate, 0, len(w.saving)+len(w.pending))
+	unsaved = append(unsaved, w.saving...)
+	return append(unsaved, w.pending...)
+}
+
+// Pending returns how many accepted pixels are not in the database yet
+// It is Unsaved without the copy, for the metrics.
+func (w *PixelWriter) Pending() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.saving) + len(w.pending)
+}
+
+// Start launches the writer goroutine
+func (w *PixelWriter) Start() {
+	superviseGo("pixelWriter", w.Run)
+}
+
+// Run writes batches until Stop is called
+func (w *PixelWriter) Run() {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.full:
+			if !w.failing {
+				w.flush()
+			}
+
+		case <-ticker.C:
+			w.flush()
+
+		case flushed := <-w.flushes:
+			w.flush()
+			close(flushed)
+
+		case <-w.stop:
+			// Write everything still waiting before returning
+			w.flush()
+			if n := w.Pending(); n > 0 {
+				slog.Error("Unsaved pixels lost at shutdown", "pixels", n)
+			}
+			close(w.done)
+			return
+		}
+	}
+}
+
+// flush writes the pending pixels as one batch
+// A batch that fails with an error worth retrying (the database was busy
+// through all of SavePixelBatch's retries, see isRetryable, or the circuit
+// breaker is open) goes back in front of the pending pixels and is tried
+// again with the next batch, every interval until the database is back. The
+// pixels have already been broadcast and are in the canvas cache, so
+// dropping them would leave the database behind what everyone saw. Only past
+// maxUnsavedPixels are the oldest ones given up on.
+//
+// Any other error (a constraint or a broken statement, say) would fail the
+// same way every time, and keep failing the pixels batched with it; that
+// batch is logged, counted as lost and dropped.
+func (w *PixelWriter) flush() {
+	w.mu.Lock()
+	batch := w.pending
+	w.pending = nil
+	w.saving = batch
+	w.mu.Unlock()
+
+	if len(batch) == 0 {
+		return
+	}
+
+	// Unsaved still reports the whole batch, so nothing is hidden meanwhile
+	save := batch
+	if w.coalesce {
+		save = coalescePixels(batch)
+	}
+
+	err := w.breaker.Call(func() error { return w.db.SavePixelBatch(save) })
+	retry := err != nil && (isRetryable(err) || errors.Is(err, errCircuitOpen))
+	w.failing = retry
+	switch {
+	case retry:
+		w.failures.Add(1)
+		slog.Warn("Failed to save pixels to database, will retry", "pixels", len(batch), "requestIds", requestIDs(batch), "err", err)
+	case err != nil:
+		w.failures.Add(1)
+		w.lost.Add(int64(len(batch)))
+		slog.Error("Failed to save pixels to database, dropping them", "pixels", len(batch), "requestIds", requestIDs(batch), "err", err)
+	case slog.Default().Enabled(context.Background(), slog.LevelDebug):
+		slog.Debug("Pixels saved", "pixels", len(batch), "requestIds", requestIDs(batch))
+	}
+
+	w.mu.Lock()
+	w.saving = nil
+	if retry {
+		w.retain(batch)
+	}
+	w.mu.Unlock()
+}
+
+// retain puts a failed batch back in front of the pending pixels, so they
+// are saved in the order they were accepted (w.mu must be held)
+// If more than maxUnsavedPixels are then waiting, the oldest are dropped.
+func (w *PixelWriter) retain(batch []PixelUpdate) {
+	w.pending = append(batch, w.pending...)
+
+	if excess := len(w.pending) - maxUnsavedPixels; excess > 0 {
+		w.lost.Add(int64(excess))
+		slog.Error("Too many unsaved pixels, dropping the oldest", "pixels", excess, "requestIds", requestIDs(w.pending[:excess]))
+		w.pending = append([]PixelUpdate(nil), w.pending[excess:]...)
+	}
+}
+
+// Flush writes the pending pixels now and waits until they are saved
+// Use it before operations that must see every accepted pixel in the database
+func (w *PixelWriter) Flush() {
+	flushed := make(chan struct{})
+	select {
+	case w.flushes <- flushed:
+		<-flushed
+	case <-w.stop:
+		// Stopping writes everything anyway
+	}
+}
+
+// Failures returns how many batches could not be saved so far
+// Most failed batches are retried, so this counts attempts, not lost pixels.
+func (w *PixelWriter) Failures() int64 {
+	return w.failures.Load()
+}
+
+// Lost returns how many pixels were given up on without being saved
+func (w *PixelWriter) Lost() int64 {
+	return w.lost.Load()
+}
+
+// Stop writes the pixels still waiting and stops the writer
+// It returns early with the context's error if that takes too long
+func (w *PixelWriter) Stop(ctx context.Context) error {
+	close(w.stop)
+
+	select {
+	case <-w.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// withUnsaved wraps a database read of the canvas so the pixels still
+// waiting in the writer are appended to the result (see Unsaved)
+// The writer only saves to the base layer, so an unsaved pixel under an
+// overlay pixel (read with overlay) is left out; it isn't visible yet.
+func withUnsaved(w *PixelWriter, read, overlay func() ([]PixelUpdate, error)) func() ([]PixelUpdate, error) {
+	return func() ([]PixelUpdate, error) {
+		unsaved := w.Unsaved()
+		pixels, err := read()
+		if err != nil {
+			return nil, err
+		}
+		if len(unsaved) == 0 {
+			return pixels, nil
+		}
+
+		covering, err := overlay()
+		if err != nil {
+			return nil, err
+		}
+		covered := make(map[coord]bool, len(covering))
+		for _, pixel := range covering {
+			covered[coord{pixel.X, pixel.Y}] = true
+		}
+		for _, pixel := range unsaved {
+			if !covered[coord{pixel.X, pixel.Y}] {
+				pixels = append(pixels, pixel)
+			}
+		}
+		return pixels, nil
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// errDatabaseBusy is the error SQLite returns while another connection
+// holds the lock; the writer retries it
+var errDatabaseBusy = sqlite3.Error{Code: sqlite3.ErrBusy}
+
+// flakyStore is a Store whose batch writes fail with err while it is set
+type flakyStore struct {
+	Store
+	mu  sync.Mutex
+	err error
+}
+
+func (f *flakyStore) setErr(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.err = err
+}
+
+func (f *flakyStore) SavePixelBatch(pixels []PixelUpdate) error {
+	f.mu.Lock()
+	err := f.err
+	f.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return f.Store.SavePixelBatch(pixels)
+}
+
+func TestWriterRetriesFailedBatches(t *testing.T) {
+	captureLogs(t)
+	db := newTestDatabase(t)
+	store := &flakyStore{Store: db, err: errDatabaseBusy}
+	w := NewPixelWriter(store, NewCircuitBreaker(1000, time.Second), 2, 10*time.Millisecond, false)
+	w.Start()
+	t.Cleanup(func() { w.Stop(context.Background()) })
+
+	w.Write(PixelUpdate{X: 0, Y: 0, Color: "#FF0000", UserID: "alice", Timestamp: 1000})
+	w.Write(PixelUpdate{X: 1, Y: 0, Color: "#FF0000", UserID: "alice", Timestamp: 1001})
+	waitFor(t, time.Second, "a batch to fail", func() bool { return w.Failures() > 0 })
+
+	// The failed pixels are kept, in front of the ones accepted since
+	w.Write(PixelUpdate{X: 0, Y: 0, Color: "#0000FF", UserID: "bob", Timestamp: 1002})
+	waitFor(t, time.Second, "another failed retry", func() bool { return w.Failures() > 2 })
+	unsaved := w.Unsaved()
+	if len(unsaved) != 3 || unsaved[0].Color != "#FF0000" || unsaved[2].Color != "#0000FF" {
+		t.Fatalf("unsaved %+v, want the two failed pixels and bob's", unsaved)
+	}
+
+	// Once the database is back everything is saved, and bob's later pixel wins
+	store.setErr(nil)
+	waitFor(t, time.Second, "the pixels to be saved", func() bool { return w.Pending() == 0 })
+	if count, _ := db.GetPixelCount(); count != 2 {
+		t.Fatalf("%d pixels saved, want 2", count)
+	}
+	if pixel, ok, _ := db.GetPixel(0, 0); !ok || pixel.UserID != "bob" {
+		t.Fatalf("(0,0) = %+v, want bob's pixel", pixel)
+	}
+	if w.Lost() != 0 {
+		t.Fatalf("%d pixels lost", w.Lost())
+	}
+}
+
+func TestWriterDropsBatchesThatCannotSucceed(t *testing.T) {
+	logs := captureLogs(t)
+	db := newTestDatabase(t)
+	store := &flakyStore{Store: db, err: errors.New("NOT NULL constraint failed: canvas_state.color")}
+	w := NewPixelWriter(store, NewCircuitBreaker(1000, time.Second), 2, 10*time.Millisecond, false)
+	w.Start()
+	t.Cleanup(func() { w.Stop(context.Background()) })
+
+	w.Write(PixelUpdate{X: 0, Y: 0, Color: "#FF0000", UserID: "alice", Timestamp: 1000})
+	w.Write(PixelUpdate{X: 1, Y: 0, Color: "#FF0000", UserID: "alice", Timestamp: 1001})
+	waitFor(t, time.Second, "the batch to be dropped", func() bool { return w.Lost() == 2 })
+	if w.Pending() != 0 {
+		t.Fatalf("%d pixels kept for a retry that can't succeed", w.Pending())
+	}
+	if !strings.Contains(logs.String(), "dropping them") {
+		t.Fatal("the dropped batch wasn't logged")
+	}
+
+	// Later pixels aren't held back by it
+	store.setErr(nil)
+	w.Write(PixelUpdate{X: 2, Y: 0, Color: "#0000FF", UserID: "bob", Timestamp: 1002})
+	w.Flush()
+	if count, _ := db.GetPixelCount(); count != 1 {
+		t.Fatalf("%d pixels saved, want bob's", count)
+	}
+}
+
+func TestWriterCapsRetainedPixels(t *testing.T) {
+	captureLogs(t)
+	w := NewPixelWriter(newTestDatabase(t), NewCircuitBreaker(1, time.Second), 10, time.Second, false)
+
+	batch := make([]PixelUpdate, maxUnsavedPixels+5)
+	for i := range batch {
+		batch[i] = PixelUpdate{X: i}
+	}
+	w.mu.Lock()
+	w.retain(batch)
+	w.mu.Unlock()
+
+	if w.Lost() != 5 || w.Pending() != maxUnsavedPixels {
+		t.Fatalf("lost %d and kept %d, want 5 and %d", w.Lost(), w.Pending(), maxUnsavedPixels)
+	}
+	// The oldest are the ones given up on
+	if first := w.Unsaved()[0]; first.X != 5 {
+		t.Fatalf("oldest kept pixel is %d, want 5", first.X)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Protected zones
+//
+// A zone is a rectangle of the canvas with its own placement rule, loaded
+// from the config file's "zones" list (and reloaded on SIGHUP):
+//
+//   - locked: users can't place pixels there at all (the admin overlay
+//     endpoints still work), e.g. to protect a sponsor logo
+//   - cooldownMultiplier: a pixel there costs that many cooldowns, so with
+//     3 a user waits three times as long before their next pixel
+//
+// When zones overlap, the first one in the list applies.
+
+// zoneCellSize is the side of the grid cells zones are indexed by
+const zoneCellSize = 256
+
+// Zone is a rectangle from (X0, Y0) to (X1, Y1), inclusive, with its rule
+type Zone struct {
+	Name string `json:"name"`
+	X0   int    `json:"x0"`
+	Y0   int    `json:"y0"`
+	X1   int    `json:"x1"`
+	Y1   int    `json:"y1"`
+
+	// Locked refuses every user placement inside the zone
+	Locked bool `json:"locked"`
+
+	// CooldownMultiplier scales the cooldown a placement inside the zone
+	// costs (0 or unset means 1)
+	CooldownMultiplier float64 `json:"cooldownMultiplier"`
+}
+
+// Contains returns true if (x, y) is inside the zone
+func (z *Zone) Contains(x, y int) bool {
+	return x >= z.X0 && x <= z.X1 && y >= z.Y0 && y <= z.Y1
+}
+
+// Cost is the number of cooldowns a placement inside the zone uses up
+func (z *Zone) Cost() float64 {
+	if z.CooldownMultiplier == 0 {
+		return 1
+	}
+	return z.CooldownMultiplier
+}
+
+// validate checks the zone's rectangle and rule
+func (z *Zone) validate() error {
+	if z.X0 < 0 || z.Y0 < 0 || z.X1 < z.X0 || z.Y1 < z.Y0 || z.X1 > maxCanvasSize || z.Y1 > maxCanvasSize {
+		return fmt.Errorf("zone %q must have 0 <= x0 <= x1 <= %d and 0 <= y0 <= y1 <= %d", z.Name, maxCanvasSize, maxCanvasSize)
+	}
+	if z.CooldownMultiplier < 0 {
+		return fmt.Errorf("zone %q cooldownMultiplier must not be negative", z.Name)
+	}
+	return nil
+}
+
+// Zones finds the zone of a coordinate
+// The zones are indexed by a grid of zoneCellSize cells, each listing the
+// zones that overlap it, so a lookup only tests the few zones near the point
+// instead of every zone.
+type Zones struct {
+	zones []Zone
+	cells map[ChunkCoord][]int // Indexes into zones, in list order
+}
+
+// NewZones indexes the zones (which must be valid)
+func NewZones(zones []Zone) *Zones {
+	z := &Zones{zones: zones, cells: make(map[ChunkCoord][]int)}
+	for i, zone := range zones {
+		from, to := chunkOf(zone.X0, zone.Y0, zoneCellSize), chunkOf(zone.X1, zone.Y1, zoneCellSize)
+		for cy := from[1]; cy <= to[1]; cy++ {
+			for cx := from[0]; cx <= to[0]; cx++ {
+				cell := ChunkCoord{cx, cy}
+				z.cells[cell] = append(z.cells[cell], i)
+			}
+		}
+	}
+	return z
+}
+
+// At returns the zone containing (x, y), or nil outside every zone
+func (z *Zones) At(x, y int) *Zone {
+	if z == nil {
+		return nil
+	}
+	for _, i := range z.cells[chunkOf(x, y, zoneCellSize)] {
+		if z.zones[i].Contains(x, y) {
+			return &z.zones[i]
+		}
+	}
+	return nil
+}
+
+// ZoneError is returned when a placement falls in a locked zone
+type ZoneError struct {
+	Zone string
+}
+
+func (e *ZoneError) Error() string {
+	return fmt.Sprintf("this area (zone %q) is protected and can't be drawn on", e.Zone)
+}
+
+// checkZone applies the zone rule at the pixel's coordinate
+// It returns the zone's cooldown cost, or a 403 for a locked zone
+func checkZone(zones *Zones, pixel *PixelUpdate) (float64, *placementError) {
+	zone := zones.At(pixel.X, pixel.Y)
+	if zone == nil {
+		return 1, nil
+	}
+	if zone.Locked {
+		pixelsRejected.WithLabelValues(rejectZone).Inc()
+		return 0, &placementError{status: http.StatusForbidden, code: codeZoneLocked, message: (&ZoneError{Zone: zone.Name}).Error()}
+	}
+	return zone.Cost(), nil
+}
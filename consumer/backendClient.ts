@@ -16,6 +16,7 @@ export class BackendClient {
   private reconnectDelay: number;
   private shouldReconnect: boolean = true;
   private onMessageCallback: ((pixel: PixelUpdate) => void) | null = null;
+  private onClearCallback: (() => void) | null = null;
 
   /**
    * Creates a new backend client
@@ -58,30 +59,39 @@ export class BackendClient {
           // Parse the JSON message
           const data = JSON.parse(event.data);
           console.log(`[BackendClient] Parsed data:`, data);
-          console.log(`[BackendClient] Data type:`, Array.isArray(data) ? 'Array' : typeof data);
-
-          // Backend sends batches (arrays) of pixels, not individual pixels
-          if (Array.isArray(data)) {
-            console.log(`[BackendClient] Received batch of ${data.length} pixels`);
-
-            // Process each pixel in the batch
-            data.forEach((pixel: PixelUpdate) => {
-              console.log(`[BackendClient] Processing pixel: (${pixel.x}, ${pixel.y}) ${pixel.color}`);
-
-              // Call the message handler if one is registered
-              if (this.onMessageCallback) {
-                this.onMessageCallback(pixel);
-              }
-            });
-          } else {
-            // Handle single pixel (fallback, though backend sends arrays)
-            const pixel: PixelUpdate = data;
-            console.log(`[BackendClient] Received single pixel: (${pixel.x}, ${pixel.y}) ${pixel.color}`);
+          console.log(`[BackendClient] Message type:`, data.type);
+
+          // Backend wraps pixels in an envelope: {"type": "batch" | "snapshot" | "clear", "pixels": [...]}
+          // Snapshots are skipped - frontends load the canvas from /api/canvas
+          // (the consumer connects with ?snapshot=false, so none should arrive)
+          if (data.type === "snapshot") {
+            console.log(`[BackendClient] Ignoring snapshot of ${data.pixels.length} pixels`);
+            return;
+          }
+          // An admin cleared the canvas - frontends must reset theirs
+          if (data.type === "clear") {
+            console.log(`[BackendClient] Canvas cleared`);
+            if (this.onClearCallback) {
+              this.onClearCallback();
+            }
+            return;
+          }
+          if (data.type !== "batch" || !Array.isArray(data.pixels)) {
+            console.log(`[BackendClient] Ignoring ${data.type ?? "unknown"} message`);
+            return;
+          }
+
+          console.log(`[BackendClient] Received batch of ${data.pixels.length} pixels`);
+
+          // Process each pixel in the batch
+          data.pixels.forEach((pixel: PixelUpdate) => {
+            console.log(`[BackendClient] Processing pixel: (${pixel.x}, ${pixel.y}) ${pixel.color}`);
 
+            // Call the message handler if one is registered
             if (this.onMessageCallback) {
               this.onMessageCallback(pixel);
             }
-          }
+          });
         } catch (error) {
           console.error("[BackendClient] Failed to parse message:", error);
           console.error("[BackendClient] Raw message was:", event.data);
@@ -123,6 +133,15 @@ export class BackendClient {
     this.onMessageCallback = callback;
   }
 
+  /**
+   * Sets the callback function to handle the canvas being cleared
+   *
+   * @param callback - Function to call when a clear message is received
+   */
+  onClear(callback: () => void): void {
+    this.onClearCallback = callback;
+  }
+
   /**
    * Disconnects from the backend and prevents automatic reconnection
    */
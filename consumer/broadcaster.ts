@@ -97,6 +97,26 @@ export class Broadcaster {
     }
   }
 
+  /**
+   * Tells all frontend clients that the canvas was cleared
+   *
+   * Sends {"type": "clear"} so clients reset their canvas to the background
+   */
+  broadcastClear(): void {
+    const message = JSON.stringify({ type: "clear" });
+
+    for (const client of this.clients) {
+      try {
+        client.send(message);
+      } catch (error) {
+        console.error(`[Broadcaster] Failed to send to client:`, error);
+        this.removeClient(client);
+      }
+    }
+
+    console.log(`[Broadcaster] Sent canvas clear to ${this.clients.size} clients`);
+  }
+
   /**
    * Returns the current number of connected clients
    *
@@ -24,7 +24,7 @@ import { validatePixelUpdate } from "./validator";
  * for different deployment environments.
  */
 const config: ConsumerConfig = {
-  backendWsUrl: "ws://localhost:8080/ws/queue",  // Backend WebSocket URL
+  backendWsUrl: "ws://localhost:8080/ws/queue?snapshot=false",  // Backend WebSocket URL (no initial snapshot)
   backendHttpUrl: "http://localhost:8080",       // Backend HTTP URL
   frontendWsPort: 3001,                          // Port for frontend connections
   canvasWidth: 1000,                             // Canvas dimensions
@@ -169,10 +169,12 @@ function startFrontendWebSocketServer(): void {
           const responseText = await response.text();
           console.log(`[Consumer] Backend responded with ${response.status}`);
 
+          // Keep the backend's Content-Type: accepted pixels and errors
+          // ({"error": {"code", "message"}}) are JSON
           return new Response(responseText, {
             status: response.status,
             headers: {
-              "Content-Type": "text/plain",
+              "Content-Type": response.headers.get("Content-Type") ?? "text/plain",
               "Access-Control-Allow-Origin": "*",
             },
           });
@@ -263,6 +265,9 @@ function main(): void {
   // Set up the message handler for backend pixel updates
   backendClient.onMessage(processPixelUpdate);
 
+  // Forward canvas clears to the frontend clients
+  backendClient.onClear(() => broadcaster.broadcastClear());
+
   // Connect to backend queue
   backendClient.connect();
 
@@ -47,7 +47,7 @@ export function validatePixelUpdate(
     };
   }
 
-  // Validate color format (must be hex color like #RRGGBB)
+  // Validate color format (must be hex color like #RRGGBB or #RRGGBBAA)
   if (typeof pixel.color !== "string" || !isValidHexColor(pixel.color)) {
     return {
       isValid: false,
@@ -73,13 +73,15 @@ export function validatePixelUpdate(
  * Valid formats:
  * - #RGB (short form, e.g., #F00)
  * - #RRGGBB (long form, e.g., #FF0000)
+ * - #RRGGBBAA (with transparency, e.g., #FF000080; sent when the backend
+ *   has ALPHA_COLORS enabled)
  *
  * @param color - The color string to validate
  * @returns true if valid hex color, false otherwise
  */
 function isValidHexColor(color: string): boolean {
   // Regular expression for hex color validation
-  // Matches #RGB or #RRGGBB format
-  const hexColorRegex = /^#([0-9A-Fa-f]{3}|[0-9A-Fa-f]{6})$/;
+  // Matches #RGB, #RRGGBB or #RRGGBBAA format
+  const hexColorRegex = /^#([0-9A-Fa-f]{3}|[0-9A-Fa-f]{6}|[0-9A-Fa-f]{8})$/;
   return hexColorRegex.test(color);
 }
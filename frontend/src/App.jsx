@@ -120,9 +120,16 @@ function App() {
         // Pixel placed successfully
         setStatusMessage(`Pixel placed at (${x}, ${y})`)
       } else {
-        // Some other error occurred
-        const error = await response.text()
-        setStatusMessage(`Error: ${error}`)
+        // Some other error occurred; the backend explains it in
+        // {"error": {"code": ..., "message": ...}}
+        const text = await response.text()
+        let message = text
+        try {
+          message = JSON.parse(text).error?.message ?? text
+        } catch {
+          // Not JSON (e.g. from a proxy); show it as is
+        }
+        setStatusMessage(`Error: ${message}`)
       }
     } catch (error) {
       console.error('Failed to place pixel:', error)
@@ -113,10 +113,23 @@ function Canvas({ onPixelClick, websocket }) {
     /**
      * Handle incoming WebSocket messages
      * Expected format: { x: number, y: number, color: string, timestamp: number }
+     * or { type: "clear" } when an admin cleared the canvas
      */
     const handleMessage = (event) => {
       try {
         const pixelData = JSON.parse(event.data)
+
+        // The canvas was cleared - reset it to the white background
+        if (pixelData.type === 'clear') {
+          const ctx = ctxRef.current
+          if (ctx) {
+            ctx.fillStyle = '#FFFFFF'
+            ctx.fillRect(0, 0, CANVAS_SIZE, CANVAS_SIZE)
+          }
+          setUpdateCount(0)
+          return
+        }
+
         const { x, y, color } = pixelData
 
         // Validate pixel coordinates
@@ -149,12 +162,19 @@ function Canvas({ onPixelClick, websocket }) {
    *
    * @param {number} x - X coordinate (0-999)
    * @param {number} y - Y coordinate (0-999)
-   * @param {string} color - Hex color code (e.g., "#FF0000")
+   * @param {string} color - Hex color code (e.g., "#FF0000", or "#FF000080"
+   *   with transparency; "#00000000" erases the pixel)
    */
   const drawPixel = (x, y, color) => {
     const ctx = ctxRef.current
     if (!ctx) return
 
+    // A transparent color is drawn over the background, not the old pixel
+    if (color.length === 9) {
+      ctx.fillStyle = '#FFFFFF'
+      ctx.fillRect(x, y, 1, 1)
+    }
+
     // Set the fill color
     ctx.fillStyle = color
 